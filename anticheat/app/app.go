@@ -29,9 +29,10 @@ func Run(ctx context.Context, configFile string) error {
 	}
 
 	// 注册到节点服务器
-	rsp, err := discoveryClient.RegisterServer(context.TODO(), &api.RegisterServerReq{
+	registerReq := &api.RegisterServerReq{
 		ServerType: api.ANTICHEAT,
-	})
+	}
+	rsp, err := discoveryClient.RegisterServer(context.TODO(), registerReq)
 	if err != nil {
 		return err
 	}
@@ -43,9 +44,16 @@ func Run(ctx context.Context, configFile string) error {
 			_, err := discoveryClient.KeepaliveServer(context.TODO(), &api.KeepaliveServerReq{
 				ServerType: api.ANTICHEAT,
 				AppId:      APPID,
+				Capacity:   uint32(config.GetConfig().Hk4e.Capacity),
 			})
 			if err != nil {
 				logger.Error("keepalive error: %v", err)
+				// 节点服务器重启或主备切换后可能丢失了注册信息 沿用原来的appid重新注册
+				registerReq.AppId = APPID
+				_, err = discoveryClient.RegisterServer(context.TODO(), registerReq)
+				if err != nil {
+					logger.Error("re-register error: %v", err)
+				}
 			}
 		}
 	}()
@@ -175,12 +175,15 @@ func (h *Handle) run() {
 				continue
 			}
 			gameMsg := netMsg.GameMsg
+			h.messageQueue.AddTraceHop(gameMsg.Trace, mq.TraceStageServerRecv)
 			switch gameMsg.CmdId {
 			case cmd.CombatInvocationsNotify:
 				h.CombatInvocationsNotify(gameMsg.UserId, netMsg.OriginServerAppId, gameMsg.PayloadMessage)
 			case cmd.ToTheMoonEnterSceneReq:
 				h.ToTheMoonEnterSceneReq(gameMsg.UserId, netMsg.OriginServerAppId, gameMsg.PayloadMessage)
 			}
+			// 反作弊服务器不返回响应 处理完毕即链路终点
+			h.messageQueue.AddTraceHop(gameMsg.Trace, mq.TraceStageServerHandle)
 		case mq.MsgTypeServer:
 			serverMsg := netMsg.ServerMsg
 			switch netMsg.EventId {
@@ -27,6 +27,7 @@ func main() {
 		PathfindingCmd(),
 		GSCmd(),
 		GMCmd(),
+		ReplayCmd(),
 	)
 
 	if err := rootCmd.Execute(); err != nil {
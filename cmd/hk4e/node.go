@@ -2,7 +2,16 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	commonconfig "hk4e/common/config"
+	"hk4e/common/rpc"
+	"hk4e/node/api"
 	"hk4e/node/app"
 
 	"github.com/spf13/cobra"
@@ -18,5 +27,84 @@ func NodeCmd() *cobra.Command {
 		},
 	}
 	c.Flags().StringVar(&cfg, "config", "application.toml", "config file")
+	c.AddCommand(NodeStatusCmd())
 	return c
 }
+
+func NodeStatusCmd() *cobra.Command {
+	var cfg string
+	var showOnline bool
+	c := &cobra.Command{
+		Use:   "status",
+		Short: "node cluster status",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			commonconfig.InitConfig(cfg)
+			discoveryClient, err := rpc.NewDiscoveryClient()
+			if err != nil {
+				return err
+			}
+			return printNodeStatus(discoveryClient, showOnline)
+		},
+	}
+	c.Flags().StringVar(&cfg, "config", "application.toml", "config file")
+	c.Flags().BoolVar(&showOnline, "online", false, "show which gs each online uid is on")
+	return c
+}
+
+func printNodeStatus(discoveryClient *rpc.DiscoveryClient, showOnline bool) error {
+	instListRsp, err := discoveryClient.GetAllServerInstanceList(context.TODO(), &api.NullMsg{})
+	if err != nil {
+		return err
+	}
+	onlineMapRsp, err := discoveryClient.GetGlobalGsOnlineMap(context.TODO(), &api.NullMsg{})
+	if err != nil {
+		return err
+	}
+	gsOnlineCountMap := make(map[string]int)
+	for _, gsAppId := range onlineMapRsp.GlobalGsOnlineMap {
+		gsOnlineCountMap[gsAppId]++
+	}
+	nowTime := time.Now().Unix()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "TYPE\tAPPID\tGSID\tKCP ADDR\tMQ ADDR\tVERSION\tLOAD\tCAPACITY\tUTIL\tONLINE\tLAST ALIVE\tSTATE")
+	for _, inst := range instListRsp.ServerInstanceList {
+		kcpAddr, mqAddr := "-", "-"
+		if inst.ServerType == api.GATE && inst.GateServerAddr != nil {
+			kcpAddr = fmt.Sprintf("%v:%v", inst.GateServerAddr.KcpAddr, inst.GateServerAddr.KcpPort)
+			mqAddr = fmt.Sprintf("%v:%v", inst.GateServerAddr.MqAddr, inst.GateServerAddr.MqPort)
+		}
+		online := "-"
+		if inst.ServerType == api.GS {
+			online = fmt.Sprintf("%v", gsOnlineCountMap[inst.AppId])
+		}
+		state := make([]string, 0)
+		if inst.IsMainGs {
+			state = append(state, "main")
+		}
+		if inst.IsDraining {
+			state = append(state, "draining")
+		}
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v%%\t%v\t%vs ago\t%v\n",
+			inst.ServerType, inst.AppId, inst.GsId, kcpAddr, mqAddr, strings.Join(inst.Version, ","),
+			inst.LoadCount, inst.Capacity, inst.MainLoopUtil, online, nowTime-inst.LastAliveTime, strings.Join(state, ","))
+	}
+	_ = w.Flush()
+	fmt.Printf("total online user: %v\n", len(onlineMapRsp.GlobalGsOnlineMap))
+	if !showOnline {
+		return nil
+	}
+	uidList := make([]uint32, 0, len(onlineMapRsp.GlobalGsOnlineMap))
+	for uid := range onlineMapRsp.GlobalGsOnlineMap {
+		uidList = append(uidList, uid)
+	}
+	sort.Slice(uidList, func(i, j int) bool {
+		return uidList[i] < uidList[j]
+	})
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "UID\tGS APPID")
+	for _, uid := range uidList {
+		_, _ = fmt.Fprintf(w, "%v\t%v\n", uid, onlineMapRsp.GlobalGsOnlineMap[uid])
+	}
+	_ = w.Flush()
+	return nil
+}
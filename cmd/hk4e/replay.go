@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+
+	"hk4e/gate/replay"
+
+	"github.com/spf13/cobra"
+)
+
+func ReplayCmd() *cobra.Command {
+	var cfg string
+	option := new(replay.Option)
+	c := &cobra.Command{
+		Use:   "replay [record file...]",
+		Short: "replay gate packet record to gs",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			option.FileList = args
+			return replay.Run(context.Background(), cfg, option)
+		},
+	}
+	c.Flags().StringVar(&cfg, "config", "application.toml", "config file")
+	c.Flags().Uint32Var(&option.UserId, "uid", 0, "replay player uid")
+	c.Flags().StringVar(&option.GsAppId, "gs", "", "target gs appid, allocate by node server if empty")
+	c.Flags().Float64Var(&option.Speed, "speed", 1.0, "replay speed, 0 for no wait")
+	_ = c.MarkFlagRequired("uid")
+	return c
+}
@@ -10,13 +10,18 @@ var CONF *Config = nil
 
 // Config 配置
 type Config struct {
-	HttpPort  int32     `toml:"http_port"`
-	Logger    Logger    `toml:"logger"`
-	Database  Database  `toml:"database"`
-	Redis     Redis     `toml:"redis"`
-	Hk4e      Hk4e      `toml:"hk4e"`
-	Hk4eRobot Hk4eRobot `toml:"hk4e_robot"`
-	MQ        MQ        `toml:"mq"`
+	HttpPort       int32     `toml:"http_port"`
+	TrustedProxies []string  `toml:"trusted_proxies"` // http服务前的可信反向代理 ip或cidr 只有来自可信代理的请求才采用X-Forwarded-For中的客户端ip 带转发头的非可信代理请求无法访问管理接口
+	Logger         Logger    `toml:"logger"`
+	Database       Database  `toml:"database"`
+	Redis          Redis     `toml:"redis"`
+	Hk4e           Hk4e      `toml:"hk4e"`
+	Hk4eRobot      Hk4eRobot `toml:"hk4e_robot"`
+	MQ             MQ        `toml:"mq"`
+	Node           Node      `toml:"node"`
+	Gate           Gate      `toml:"gate"`
+	Email          Email     `toml:"email"`
+	Dispatch       Dispatch  `toml:"dispatch"`
 }
 
 // Logger 日志
@@ -37,6 +42,53 @@ type Redis struct {
 	Password string `toml:"password"`
 }
 
+// Dispatch 登录服务器
+type Dispatch struct {
+	LoginProtect LoginProtect `toml:"login_protect"`
+	Token        Token        `toml:"token"`
+	Region       []*Region    `toml:"region"` // 对外提供的区服列表 为空时只有一个使用hk4e.dispatch_url的默认区服
+}
+
+// Region 区服
+type Region struct {
+	Name        string `toml:"name"`         // 区服名 二级dispatch地址以/query_cur_region/区服名区分区服
+	Title       string `toml:"title"`        // 客户端显示的区服标题
+	Type        string `toml:"type"`         // 区服类型 如DEV_PUBLIC
+	DispatchUrl string `toml:"dispatch_url"` // 二级dispatch地址 形如https://hk4e.flswld.com/query_cur_region/区服名
+	Env         string `toml:"env"`          // 区服环境 如live test 只用于运维区分
+	NatsUrl     string `toml:"nats_url"`     // 区服所在节点服务器集群的nats地址 区服密钥和网关地址从该集群获取 为空时使用mq.nats_url
+}
+
+// Token 账号登录态
+type Token struct {
+	TokenTtl      int32 `toml:"token_ttl"`       // 账号token有效期 秒 0为使用默认值
+	ComboTokenTtl int32 `toml:"combo_token_ttl"` // combo token有效期 秒 0为使用默认值
+	MaxDevice     int32 `toml:"max_device"`      // 单个账号同时保持登录的设备数 超出时最早登录的设备失效 0为使用默认值
+}
+
+// LoginProtect 登录防爆破
+type LoginProtect struct {
+	Enable               bool  `toml:"enable"`
+	FailWindow           int32 `toml:"fail_window"`             // 登录失败次数和请求次数的统计窗口 秒
+	AccountLockFailCount int32 `toml:"account_lock_fail_count"` // 账号在统计窗口内失败多少次后锁定 0为不锁定
+	AccountLockTime      int32 `toml:"account_lock_time"`       // 账号锁定秒数
+	IpLockFailCount      int32 `toml:"ip_lock_fail_count"`      // 单个ip在统计窗口内失败多少次后锁定 0为不锁定
+	IpLockTime           int32 `toml:"ip_lock_time"`            // ip锁定秒数
+	IpAttemptLimit       int32 `toml:"ip_attempt_limit"`        // 单个ip在统计窗口内的登录请求上限 0为不限制
+	FailDelay            int32 `toml:"fail_delay"`              // 登录失败的响应延迟 毫秒 随账号连续失败次数翻倍 0为不延迟
+	FailDelayMax         int32 `toml:"fail_delay_max"`          // 登录失败的最大响应延迟 毫秒
+	GeetestFailCount     int32 `toml:"geetest_fail_count"`      // 账号或ip在统计窗口内失败多少次后需要完成geetest验证 0为不需要
+}
+
+// Email 邮件发送 用于账号找回密码等验证码邮件
+type Email struct {
+	SmtpAddr string `toml:"smtp_addr"` // smtp服务器地址 形如smtp.example.com:587 为空时不发送邮件
+	Username string `toml:"username"`  // smtp认证用户名 为空时不认证
+	Password string `toml:"password"`
+	From     string `toml:"from"`      // 发件人 形如hk4e <noreply@example.com>
+	PoolSize int32  `toml:"pool_size"` // smtp连接池大小 0为使用默认值
+}
+
 // Hk4e 原神服务器
 type Hk4e struct {
 	KcpAddr                string `toml:"kcp_addr"` // 该地址只用来注册到节点服务器 填网关的外网地址 网关本地监听为0.0.0.0
@@ -50,6 +102,7 @@ type Hk4e struct {
 	LoginSdkUrl            string `toml:"login_sdk_url"`         // 网关登录验证token的sdk服务器地址 目前填dispatch的内网地址
 	LoadSceneLuaConfig     bool   `toml:"load_scene_lua_config"` // 是否加载场景详情LUA配置数据
 	DispatchUrl            string `toml:"dispatch_url"`          // 二级dispatch地址 将域名改为dispatch的外网地址
+	Capacity               int32  `toml:"capacity"`              // 服务器最大承载量 上报到节点服务器用于负载均衡 0为使用默认值
 }
 
 // Hk4eRobot 原神机器人
@@ -71,11 +124,128 @@ type Hk4eRobot struct {
 	ClientMoveEnable   bool   `toml:"client_move_enable"`    // 是否开启客户端模拟移动
 	ClientMoveSpeed    int32  `toml:"client_move_speed"`     // 客户端模拟移动速度
 	ClientMoveRangeExt int32  `toml:"client_move_range_ext"` // 客户端模拟移动区域半径
+	GateTransport      string `toml:"gate_transport"`        // 连接网关的传输协议 kcp tcp ws 默认kcp
+	GateStreamAddr     string `toml:"gate_stream_addr"`      // tcp或ws连接的网关地址 tcp形如127.0.0.1:22223 ws形如ws://127.0.0.1:22224/gate
 }
 
 // MQ 消息队列
 type MQ struct {
-	NatsUrl string `toml:"nats_url"`
+	NatsUrl          string             `toml:"nats_url"`
+	TraceUidList     []uint32           `toml:"trace_uid_list"`      // 打印完整消息链路日志的玩家uid列表 运行时可通过网关/debug/trace/user修改
+	NatsRecvChanSize int32              `toml:"nats_recv_chan_size"` // nats接收缓冲区大小 0为使用默认值
+	Lane             map[string]*MQLane `toml:"lane"`                // 各优先级通道配置 key:conn_ctrl server game
+}
+
+// MQLane 消息队列优先级通道
+type MQLane struct {
+	Size         int32    `toml:"size"`           // 通道容量 0为使用默认值
+	Policy       string   `toml:"policy"`         // 通道满时的策略 block drop coalesce
+	LossyCmdList []string `toml:"lossy_cmd_list"` // coalesce策略下可合并或丢弃的有损协议名
+}
+
+// Node 节点服务器
+type Node struct {
+	LoadBalance        map[string]string `toml:"load_balance"`         // 各服务器类型的负载均衡策略 key:服务器类型 value:least_load weighted sticky random
+	Ec2bRotateInterval int32             `toml:"ec2b_rotate_interval"` // 区服密钥轮换间隔 秒 0为不轮换
+	Ec2bOverlapTime    int32             `toml:"ec2b_overlap_time"`    // 区服密钥轮换后旧密钥的有效时间 秒
+}
+
+// Gate 网关服务器
+type Gate struct {
+	MaxClientConnNum int32        `toml:"max_client_conn_num"` // 最大客户端连接数 0为使用默认值
+	ResumeTimeout    int32        `toml:"resume_timeout"`      // 连接异常断开后会话保留等待恢复的秒数 0为关闭会话恢复
+	RateLimit        RateLimit    `toml:"rate_limit"`
+	PacketRecord     PacketRecord `toml:"packet_record"`
+	IpFilter         IpFilter     `toml:"ip_filter"`
+	Kcp              Kcp          `toml:"kcp"`
+	CmdFilter        CmdFilter    `toml:"cmd_filter"`
+	Transport        Transport    `toml:"transport"`
+	RespCache        RespCache    `toml:"resp_cache"`
+}
+
+// Transport 网关KCP以外的客户端传输协议 数据包格式与KCP相同
+type Transport struct {
+	TcpPort int32  `toml:"tcp_port"` // TCP监听端口 0为关闭
+	WsPort  int32  `toml:"ws_port"`  // WebSocket监听端口 0为关闭
+	WsPath  string `toml:"ws_path"`  // WebSocket路径 默认/gate
+}
+
+// CmdFilter 网关上行协议过滤 按连接状态只允许客户端可以发送的协议
+type CmdFilter struct {
+	Action       string   `toml:"action"`         // 违规动作 log只记录日志 drop丢弃 kick断开连接 默认drop
+	KickReason   uint32   `toml:"kick_reason"`    // kick动作的enet原因 0为使用默认值
+	AllowCmdList []string `toml:"allow_cmd_list"` // 已激活状态下额外允许的协议名 用于协议定义中缺少客户端标记的Req和网关未内置的客户端上行Notify
+}
+
+// Kcp 网关KCP传输参数
+type Kcp struct {
+	FecEnable           bool                   `toml:"fec_enable"`            // 是否允许客户端握手时请求开启前向纠错
+	FecMaxDataShards    int32                  `toml:"fec_max_data_shards"`   // 允许的最大数据分片数
+	FecMaxParityShards  int32                  `toml:"fec_max_parity_shards"` // 允许的最大校验分片数
+	DefaultProfile      string                 `toml:"default_profile"`       // 新连接使用的配置名 默认normal
+	AutoProfile         bool                   `toml:"auto_profile"`          // 是否按测得的丢包率和延迟自动切换配置
+	AutoProfileInterval int32                  `toml:"auto_profile_interval"` // 自动切换配置的检测间隔 秒
+	FastLossRate        float64                `toml:"fast_loss_rate"`        // 丢包率达到该值时切换为fast 必须写成小数形式
+	LowBandwidthRtt     int32                  `toml:"low_bandwidth_rtt"`     // 平滑延迟达到该值时切换为low_bandwidth 毫秒
+	Profile             map[string]*KcpProfile `toml:"profile"`               // 覆盖或新增的KCP配置 key:配置名
+}
+
+// KcpProfile KCP配置 参数含义见kcp包的SetNoDelay和SetWindowSize
+type KcpProfile struct {
+	NoDelay  int32 `toml:"nodelay"`  // 是否开启nodelay模式 0关闭 1开启
+	Interval int32 `toml:"interval"` // 内部刷新间隔 毫秒
+	Resend   int32 `toml:"resend"`   // 快速重传的跳过ack次数 0为关闭快速重传
+	Nc       int32 `toml:"nc"`       // 是否关闭拥塞控制 0不关闭 1关闭
+	SndWnd   int32 `toml:"snd_wnd"`  // 发送窗口
+	RcvWnd   int32 `toml:"rcv_wnd"`  // 接收窗口 需要容纳最大应用层包的全部分片
+}
+
+// IpFilter 网关ip过滤 运行时可通过网关运维管理接口临时封禁和解封ip
+type IpFilter struct {
+	AllowList     []string `toml:"allow_list"`      // 允许连接的ip或CIDR 为空时不限制
+	DenyList      []string `toml:"deny_list"`       // 禁止连接的ip或CIDR 优先于允许列表
+	AutoBanHit    int32    `toml:"auto_ban_hit"`    // 时间窗口内单个ip握手包限流触发次数达到该值时自动临时封禁 0为不自动封禁
+	AutoBanWindow int32    `toml:"auto_ban_window"` // 统计握手包限流触发次数的时间窗口 秒
+	AutoBanTime   int32    `toml:"auto_ban_time"`   // 自动临时封禁时长 秒
+}
+
+// PacketRecord 网关抓包记录 运行时可通过网关/debug/packet/record修改记录的玩家和连接
+type PacketRecord struct {
+	Path        string   `toml:"path"`          // 记录文件路径 不含扩展名 默认./packet_record
+	MaxFileSize int32    `toml:"max_file_size"` // 单个记录文件最大字节数 超过后轮换
+	MaxFileNum  int32    `toml:"max_file_num"`  // 保留的轮换文件数量
+	UidList     []uint32 `toml:"uid_list"`      // 启动时开启记录的玩家uid列表
+}
+
+// RateLimit 网关限流策略 未配置的规则使用默认值
+type RateLimit struct {
+	ConnSyn     *RateLimitRule            `toml:"conn_syn"`     // 全局连接建立握手包
+	IpConnSyn   *RateLimitRule            `toml:"ip_conn_syn"`  // 单个ip的连接建立握手包
+	SessionRecv *RateLimitRule            `toml:"session_recv"` // 单个会话的上行包
+	SessionSend *RateLimitRule            `toml:"session_send"` // 单个会话的下行包
+	IpRecv      *RateLimitRule            `toml:"ip_recv"`      // 单个ip全部会话的上行包
+	Cmd         map[string]*RateLimitRule `toml:"cmd"`          // 单个会话的协议预算 key:协议名
+}
+
+// RateLimitRule 令牌桶限流规则
+type RateLimitRule struct {
+	Rate       float64 `toml:"rate"`        // 每秒产生的令牌数 必须写成小数形式如10.0 0为不限制
+	Burst      int32   `toml:"burst"`       // 令牌桶容量 0为与rate相同
+	Action     string  `toml:"action"`      // 超限动作 drop丢弃 delay延迟等待令牌 kick断开连接
+	MaxDelay   int32   `toml:"max_delay"`   // delay动作的最大等待时间 毫秒 超过则丢弃
+	KickReason uint32  `toml:"kick_reason"` // kick动作断开连接的enet原因 0为使用默认的EnetPacketFreqTooHigh
+}
+
+// RespCache 网关只读查询响应缓存 相同请求合并转发 缓存期内直接返回缓存的响应
+type RespCache struct {
+	InflightTimeout int32                     `toml:"inflight_timeout"` // 进行中请求等待GS响应的超时时间 毫秒 超时后重新转发 0为使用默认值
+	Cmd             map[string]*RespCacheRule `toml:"cmd"`              // 缓存响应的只读查询 key:请求协议名
+}
+
+// RespCacheRule 单个只读查询的响应缓存规则
+type RespCacheRule struct {
+	Ttl    int32  `toml:"ttl"`     // 响应的缓存时间 毫秒 0为只合并进行中的相同请求
+	RspCmd string `toml:"rsp_cmd"` // 响应协议名 为空时将请求协议名的Req替换为Rsp
 }
 
 func InitConfig(filePath string) {
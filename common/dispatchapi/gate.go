@@ -0,0 +1,17 @@
+package dispatchapi
+
+// 网关调用dispatch接口的请求和响应
+
+// TokenVerifyReq 网关校验账号token /gate/token/verify
+type TokenVerifyReq struct {
+	AccountId    string `json:"accountId"`
+	AccountToken string `json:"accountToken"`
+}
+
+type TokenVerifyRsp struct {
+	Valid         bool   `json:"valid"`
+	Forbid        bool   `json:"forbid"`
+	ForbidEndTime uint32 `json:"forbidEndTime"`
+	PlayerID      uint32 `json:"playerID"`
+	ClientVersion string `json:"clientVersion"` // 签发combo token时客户端上报的版本 三位数字 未上报时为空
+}
@@ -0,0 +1,129 @@
+package httpauth
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"hk4e/common/config"
+	"hk4e/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 管理接口鉴权
+// 管理接口只允许本机和内网访问 客户端ip默认取连接的对端地址
+// 请求来自配置的可信反向代理时 才从X-Forwarded-For中从右往左取第一个非可信代理的地址
+// 请求带有转发头但不是来自可信反向代理时拒绝访问 避免本机反向代理转发的外网请求被当成本机请求放行
+
+// GetAddrIp 获取ip:port格式地址中的ip 格式错误时原样返回
+func GetAddrIp(addr string) string {
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(addr))
+	if err != nil {
+		return addr
+	}
+	return ip
+}
+
+// 是否为可信反向代理的地址
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range config.GetConfig().TrustedProxies {
+		if strings.Contains(proxy, "/") {
+			_, ipNet, err := net.ParseCIDR(proxy)
+			if err == nil && ipNet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if ip.Equal(net.ParseIP(proxy)) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetClientIp 获取http请求的客户端ip
+func GetClientIp(request *http.Request) string {
+	remoteIp := GetAddrIp(request.RemoteAddr)
+	if !isTrustedProxy(net.ParseIP(remoteIp)) {
+		return remoteIp
+	}
+	forwardedIpList := strings.Split(request.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwardedIpList) - 1; i >= 0; i-- {
+		forwardedIp := strings.TrimSpace(forwardedIpList[i])
+		ip := net.ParseIP(forwardedIp)
+		if ip == nil {
+			break
+		}
+		if !isTrustedProxy(ip) {
+			return forwardedIp
+		}
+	}
+	realIp := strings.TrimSpace(request.Header.Get("X-Real-Ip"))
+	if net.ParseIP(realIp) != nil {
+		return realIp
+	}
+	return remoteIp
+}
+
+// IsIntranetIp 是否为本机或内网地址 支持ipv4和ipv6
+func IsIntranetIp(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+var untrustedProxyWarnOnce sync.Once
+
+// 是否允许访问管理接口
+func isAdminRequestAllowed(request *http.Request) bool {
+	remoteIp := GetAddrIp(request.RemoteAddr)
+	if !isTrustedProxy(net.ParseIP(remoteIp)) &&
+		(request.Header.Get("X-Forwarded-For") != "" || request.Header.Get("X-Real-Ip") != "") {
+		untrustedProxyWarnOnce.Do(func() {
+			logger.Warn("admin request with forwarded header from untrusted proxy rejected, remote ip: %v, configure trusted_proxies if behind a reverse proxy", remoteIp)
+		})
+		return false
+	}
+	return IsIntranetIp(GetClientIp(request))
+}
+
+// WarnIfNoTrustedProxy 开启管理接口时检查可信反向代理配置 未配置时打印警告
+func WarnIfNoTrustedProxy() {
+	if len(config.GetConfig().TrustedProxies) != 0 {
+		return
+	}
+	logger.Warn("admin api enabled without trusted_proxies, requests forwarded by a reverse proxy will be rejected")
+}
+
+// Authorize 管理接口鉴权中间件 只允许本机和内网访问
+func Authorize() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if isAdminRequestAllowed(context.Request) {
+			context.Next()
+			return
+		}
+		context.Abort()
+		context.JSON(http.StatusOK, gin.H{
+			"code": "10001",
+			"msg":  "没有访问权限",
+		})
+	}
+}
+
+// AuthorizeHandler 不使用gin的管理接口鉴权 只允许本机和内网访问
+func AuthorizeHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdminRequestAllowed(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,323 @@
+package mq
+
+import (
+	"container/list"
+	"sync"
+
+	"hk4e/common/config"
+	"hk4e/pkg/logger"
+)
+
+// 消息队列的优先级通道
+// 发送和接收方向各有三条通道 按优先级从高到低为连接控制 服务器控制 游戏数据
+// 高优先级通道的消息总是先于低优先级通道被取出 避免大量游戏数据转发阻塞登录踢人等控制消息
+// 同一通道内的消息保持先进先出 同一目标同一玩家的消息跨通道也保持先进先出
+// 高优先级通道的消息取出前 先取出同一目标同一玩家更早写入低优先级通道的消息 避免踢人等控制消息越过之前的游戏数据
+
+const (
+	LaneConnCtrl = iota // 连接控制消息
+	LaneServer          // 服务器控制消息
+	LaneGame            // 游戏数据消息
+	LaneNum
+)
+
+var laneNameList = []string{"conn_ctrl", "server", "game"}
+
+// 通道满时的策略
+const (
+	LanePolicyBlock    = "block"    // 阻塞等待 不丢弃消息
+	LanePolicyDrop     = "drop"     // 丢弃新消息
+	LanePolicyCoalesce = "coalesce" // 有损协议覆盖通道内同一目标同一玩家同一协议的旧消息 通道满时丢弃有损协议 其他消息阻塞等待
+)
+
+const DefaultLaneSize = 1000
+
+func getNetMsgLane(netMsg *NetMsg) int {
+	switch netMsg.MsgType {
+	case MsgTypeConnCtrl:
+		return LaneConnCtrl
+	case MsgTypeServer:
+		return LaneServer
+	default:
+		return LaneGame
+	}
+}
+
+// 消息所属的玩家 不属于玩家的消息为0
+func getNetMsgUserId(netMsg *NetMsg) uint32 {
+	switch netMsg.MsgType {
+	case MsgTypeGame:
+		if netMsg.GameMsg != nil {
+			return netMsg.GameMsg.UserId
+		}
+	case MsgTypeConnCtrl:
+		if netMsg.ConnCtrlMsg != nil {
+			if netMsg.ConnCtrlMsg.KickUserId != 0 {
+				return netMsg.ConnCtrlMsg.KickUserId
+			}
+			return netMsg.ConnCtrlMsg.UserId
+		}
+	case MsgTypeServer:
+		if netMsg.ServerMsg != nil {
+			return netMsg.ServerMsg.UserId
+		}
+	}
+	return 0
+}
+
+type userKey struct {
+	topic  string
+	userId uint32
+}
+
+// 玩家在各通道中待取出的消息
+type userMsgElem struct {
+	laneType int
+	elem     *list.Element
+}
+
+type coalesceKey struct {
+	topic  string
+	userId uint32
+	cmdId  uint16
+}
+
+type msgLane struct {
+	name          string
+	policy        string
+	size          int
+	lossyCmdIdMap map[uint16]bool
+	msgList       *list.List
+	coalesceMap   map[coalesceKey]*list.Element
+	notFull       *sync.Cond
+	maxDepth      int
+	dropCount     uint64
+	coalesceCount uint64
+}
+
+// LaneStat 优先级通道统计
+type LaneStat struct {
+	Policy        string `json:"policy"`
+	Size          int    `json:"size"`
+	Depth         int    `json:"depth"`
+	MaxDepth      int    `json:"max_depth"`
+	DropCount     uint64 `json:"drop_count"`
+	CoalesceCount uint64 `json:"coalesce_count"`
+}
+
+type laneQueue struct {
+	laneList     []*msgLane
+	userMsgMap   map[userKey]*list.List // 每个玩家跨通道按写入顺序排列的待取出消息
+	lock         sync.Mutex
+	notEmptyChan chan struct{}
+	output       chan *NetMsg
+	closeChan    chan struct{}
+}
+
+func (m *MessageQueue) newLaneQueue(output chan *NetMsg) (r *laneQueue) {
+	r = new(laneQueue)
+	r.laneList = make([]*msgLane, LaneNum)
+	for laneType := 0; laneType < LaneNum; laneType++ {
+		lane := &msgLane{
+			name:          laneNameList[laneType],
+			policy:        LanePolicyBlock,
+			size:          DefaultLaneSize,
+			lossyCmdIdMap: make(map[uint16]bool),
+			msgList:       list.New(),
+			coalesceMap:   make(map[coalesceKey]*list.Element),
+			notFull:       sync.NewCond(&r.lock),
+		}
+		if config.GetConfig() != nil {
+			m.loadLaneConfig(lane, config.GetConfig().MQ.Lane[lane.name])
+		}
+		r.laneList[laneType] = lane
+	}
+	r.userMsgMap = make(map[userKey]*list.List)
+	r.notEmptyChan = make(chan struct{}, 1)
+	r.output = output
+	r.closeChan = make(chan struct{})
+	go r.scheduleHandler()
+	return r
+}
+
+func (m *MessageQueue) loadLaneConfig(lane *msgLane, laneConfig *config.MQLane) {
+	if laneConfig == nil {
+		return
+	}
+	if laneConfig.Size > 0 {
+		lane.size = int(laneConfig.Size)
+	}
+	switch laneConfig.Policy {
+	case "":
+	case LanePolicyBlock, LanePolicyDrop, LanePolicyCoalesce:
+		lane.policy = laneConfig.Policy
+	default:
+		logger.Error("unknown mq lane policy: %v, lane: %v", laneConfig.Policy, lane.name)
+	}
+	for _, cmdName := range laneConfig.LossyCmdList {
+		cmdId := m.cmdProtoMap.GetCmdIdByCmdName(cmdName)
+		if cmdId == 0 {
+			logger.Error("mq lane lossy cmd not found: %v, lane: %v", cmdName, lane.name)
+			continue
+		}
+		lane.lossyCmdIdMap[cmdId] = true
+	}
+}
+
+func (l *msgLane) isLossy(netMsg *NetMsg) bool {
+	if l.policy != LanePolicyCoalesce || netMsg.GameMsg == nil {
+		return false
+	}
+	return l.lossyCmdIdMap[netMsg.GameMsg.CmdId]
+}
+
+// 写入消息 按通道策略处理通道满的情况
+func (q *laneQueue) push(netMsg *NetMsg) {
+	laneType := getNetMsgLane(netMsg)
+	lane := q.laneList[laneType]
+	q.lock.Lock()
+	lossy := lane.isLossy(netMsg)
+	key := coalesceKey{}
+	if lossy {
+		key = coalesceKey{
+			topic:  netMsg.Topic,
+			userId: netMsg.GameMsg.UserId,
+			cmdId:  netMsg.GameMsg.CmdId,
+		}
+		elem, exist := lane.coalesceMap[key]
+		if exist {
+			elem.Value = netMsg
+			lane.coalesceCount++
+			q.lock.Unlock()
+			return
+		}
+	}
+	for lane.msgList.Len() >= lane.size {
+		if lane.policy == LanePolicyDrop || lossy {
+			lane.dropCount++
+			q.lock.Unlock()
+			return
+		}
+		lane.notFull.Wait()
+	}
+	elem := lane.msgList.PushBack(netMsg)
+	if lossy {
+		lane.coalesceMap[key] = elem
+	}
+	userId := getNetMsgUserId(netMsg)
+	if userId != 0 {
+		uk := userKey{topic: netMsg.Topic, userId: userId}
+		userMsgList, exist := q.userMsgMap[uk]
+		if !exist {
+			userMsgList = list.New()
+			q.userMsgMap[uk] = userMsgList
+		}
+		userMsgList.PushBack(&userMsgElem{laneType: laneType, elem: elem})
+	}
+	if lane.msgList.Len() > lane.maxDepth {
+		lane.maxDepth = lane.msgList.Len()
+	}
+	q.lock.Unlock()
+	select {
+	case q.notEmptyChan <- struct{}{}:
+	default:
+	}
+}
+
+// 按优先级取出消息 全部通道为空时返回nil
+func (q *laneQueue) pop() *NetMsg {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, lane := range q.laneList {
+		elem := lane.msgList.Front()
+		if elem == nil {
+			continue
+		}
+		// 该玩家有更早写入的消息时先取出更早的消息
+		netMsg := elem.Value.(*NetMsg)
+		userId := getNetMsgUserId(netMsg)
+		if userId != 0 {
+			uk := userKey{topic: netMsg.Topic, userId: userId}
+			userMsgList := q.userMsgMap[uk]
+			first := userMsgList.Remove(userMsgList.Front()).(*userMsgElem)
+			if userMsgList.Len() == 0 {
+				delete(q.userMsgMap, uk)
+			}
+			lane = q.laneList[first.laneType]
+			elem = first.elem
+		}
+		lane.msgList.Remove(elem)
+		netMsg = elem.Value.(*NetMsg)
+		if lane.isLossy(netMsg) {
+			key := coalesceKey{
+				topic:  netMsg.Topic,
+				userId: netMsg.GameMsg.UserId,
+				cmdId:  netMsg.GameMsg.CmdId,
+			}
+			if lane.coalesceMap[key] == elem {
+				delete(lane.coalesceMap, key)
+			}
+		}
+		lane.notFull.Signal()
+		return netMsg
+	}
+	return nil
+}
+
+func (q *laneQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	total := 0
+	for _, lane := range q.laneList {
+		total += lane.msgList.Len()
+	}
+	return total
+}
+
+func (q *laneQueue) scheduleHandler() {
+	for {
+		netMsg := q.pop()
+		if netMsg == nil {
+			select {
+			case <-q.notEmptyChan:
+				continue
+			case <-q.closeChan:
+				return
+			}
+		}
+		select {
+		case q.output <- netMsg:
+		case <-q.closeChan:
+			return
+		}
+	}
+}
+
+func (q *laneQueue) close() {
+	close(q.closeChan)
+}
+
+func (q *laneQueue) getStat() map[string]*LaneStat {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	stat := make(map[string]*LaneStat, len(q.laneList))
+	for _, lane := range q.laneList {
+		stat[lane.name] = &LaneStat{
+			Policy:        lane.policy,
+			Size:          lane.size,
+			Depth:         lane.msgList.Len(),
+			MaxDepth:      lane.maxDepth,
+			DropCount:     lane.dropCount,
+			CoalesceCount: lane.coalesceCount,
+		}
+	}
+	return stat
+}
+
+// GetLaneStat 获取各优先级通道的统计 key1:input发送方向 output接收方向 key2:通道名
+func (m *MessageQueue) GetLaneStat() map[string]map[string]*LaneStat {
+	return map[string]map[string]*LaneStat{
+		"input":  m.inputLane.getStat(),
+		"output": m.outputLane.getStat(),
+	}
+}
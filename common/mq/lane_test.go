@@ -0,0 +1,90 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"hk4e/common/config"
+	"hk4e/protocol/cmd"
+)
+
+func TestLaneQueue(t *testing.T) {
+	config.CONF.MQ.Lane = map[string]*config.MQLane{
+		"game": {Size: 2, Policy: LanePolicyCoalesce, LossyCmdList: []string{"CombatInvocationsNotify"}},
+	}
+	defer func() {
+		config.CONF.MQ.Lane = nil
+	}()
+	m := &MessageQueue{cmdProtoMap: cmd.NewCmdProtoMap()}
+	output := make(chan *NetMsg)
+	q := m.newLaneQueue(output)
+	defer q.close()
+
+	newGameMsg := func(seq uint32) *NetMsg {
+		return &NetMsg{
+			MsgType: MsgTypeGame,
+			Topic:   "GS_gs000001_HK4E",
+			GameMsg: &GameMsg{UserId: 100, CmdId: cmd.CombatInvocationsNotify, ClientSeq: seq},
+		}
+	}
+	// 第一条消息被调度协程取出后阻塞在输出通道上
+	q.push(newGameMsg(1))
+	time.Sleep(time.Millisecond * 50)
+	q.push(newGameMsg(2))
+	// 同一玩家同一有损协议的旧消息被覆盖
+	q.push(newGameMsg(3))
+	q.push(&NetMsg{MsgType: MsgTypeServer, EventId: ServerUserOnlineStateChangeNotify})
+
+	netMsg := <-output
+	if netMsg.GameMsg == nil || netMsg.GameMsg.ClientSeq != 1 {
+		t.Fatalf("first msg error: %v", netMsg)
+	}
+	// 服务器控制消息优先于游戏数据消息
+	netMsg = <-output
+	if netMsg.MsgType != MsgTypeServer {
+		t.Fatalf("priority error: %v", netMsg)
+	}
+	netMsg = <-output
+	if netMsg.GameMsg == nil || netMsg.GameMsg.ClientSeq != 3 {
+		t.Fatalf("coalesce error: %v", netMsg)
+	}
+	stat := q.getStat()
+	if stat["game"].CoalesceCount != 1 {
+		t.Fatalf("coalesce count error: %v", stat["game"])
+	}
+}
+
+func TestLaneQueueUserOrder(t *testing.T) {
+	m := &MessageQueue{cmdProtoMap: cmd.NewCmdProtoMap()}
+	output := make(chan *NetMsg)
+	q := m.newLaneQueue(output)
+	defer q.close()
+
+	// 第一条消息被调度协程取出后阻塞在输出通道上
+	q.push(&NetMsg{MsgType: MsgTypeServer, EventId: ServerUserOnlineStateChangeNotify})
+	time.Sleep(time.Millisecond * 50)
+	q.push(&NetMsg{MsgType: MsgTypeGame, Topic: "GATE_gate00001_HK4E", GameMsg: &GameMsg{UserId: 100, ClientSeq: 1}})
+	q.push(&NetMsg{MsgType: MsgTypeGame, Topic: "GATE_gate00001_HK4E", GameMsg: &GameMsg{UserId: 200, ClientSeq: 2}})
+	q.push(&NetMsg{MsgType: MsgTypeConnCtrl, Topic: "GATE_gate00001_HK4E", EventId: KickPlayerNotify, ConnCtrlMsg: &ConnCtrlMsg{KickUserId: 100}})
+
+	netMsg := <-output
+	if netMsg.MsgType != MsgTypeServer {
+		t.Fatalf("first msg error: %v", netMsg)
+	}
+	// 踢人消息不能越过同一玩家更早的游戏数据消息
+	netMsg = <-output
+	if netMsg.GameMsg == nil || netMsg.GameMsg.UserId != 100 {
+		t.Fatalf("user order error: %v", netMsg)
+	}
+	netMsg = <-output
+	if netMsg.MsgType != MsgTypeConnCtrl {
+		t.Fatalf("priority error: %v", netMsg)
+	}
+	netMsg = <-output
+	if netMsg.GameMsg == nil || netMsg.GameMsg.UserId != 200 {
+		t.Fatalf("last msg error: %v", netMsg)
+	}
+	if len(q.userMsgMap) != 0 {
+		t.Fatalf("user msg map not empty: %v", q.userMsgMap)
+	}
+}
@@ -0,0 +1,131 @@
+package mq
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"hk4e/pkg/logger"
+)
+
+// LocalBroker 进程内的消息代理 按Topic将消息路由到订阅者
+type LocalBroker struct {
+	subMap     map[string][]chan []byte // key:topic value:订阅者列表
+	subMapLock sync.RWMutex
+	dropCount  uint64 // 订阅者接收缓冲已满而丢弃的消息数量
+}
+
+func NewLocalBroker() (r *LocalBroker) {
+	r = new(LocalBroker)
+	r.subMap = make(map[string][]chan []byte)
+	return r
+}
+
+func (b *LocalBroker) subscribe(topic string, ch chan []byte) {
+	b.subMapLock.Lock()
+	defer b.subMapLock.Unlock()
+	b.subMap[topic] = append(b.subMap[topic], ch)
+}
+
+func (b *LocalBroker) unsubscribe(ch chan []byte) {
+	b.subMapLock.Lock()
+	defer b.subMapLock.Unlock()
+	for topic, subList := range b.subMap {
+		newSubList := make([]chan []byte, 0, len(subList))
+		for _, sub := range subList {
+			if sub != ch {
+				newSubList = append(newSubList, sub)
+			}
+		}
+		if len(newSubList) == 0 {
+			delete(b.subMap, topic)
+		} else {
+			b.subMap[topic] = newSubList
+		}
+	}
+}
+
+// 发送时不阻塞 订阅者接收缓冲已满时丢弃消息 避免一个处理缓慢的订阅者阻塞进程内的全部发送者
+// 持有读锁发送 取消订阅后不会再向该订阅者发送消息
+func (b *LocalBroker) publish(topic string, data []byte) {
+	b.subMapLock.RLock()
+	defer b.subMapLock.RUnlock()
+	subList := b.subMap[topic]
+	if len(subList) == 0 {
+		logger.Error("local broker topic no subscriber, topic: %v", topic)
+		return
+	}
+	for _, sub := range subList {
+		select {
+		case sub <- data:
+		default:
+			dropCount := atomic.AddUint64(&b.dropCount, 1)
+			logger.Error("local broker subscriber chan is full, drop msg, topic: %v, total drop count: %v", topic, dropCount)
+		}
+	}
+}
+
+// GetDropCount 获取订阅者接收缓冲已满而丢弃的消息数量
+func (b *LocalBroker) GetDropCount() uint64 {
+	return atomic.LoadUint64(&b.dropCount)
+}
+
+// LocalTransport 进程内的传输 用于测试和单进程部署
+// 消息仍然经过序列化 保证与NATS传输的行为一致
+type LocalTransport struct {
+	mq        *MessageQueue
+	broker    *LocalBroker
+	recvChan  chan []byte
+	closeChan chan struct{}
+}
+
+func NewLocalTransport(broker *LocalBroker) (r *LocalTransport) {
+	r = new(LocalTransport)
+	r.broker = broker
+	r.recvChan = make(chan []byte, 1000)
+	r.closeChan = make(chan struct{})
+	return r
+}
+
+func (t *LocalTransport) Start(m *MessageQueue) error {
+	t.mq = m
+	t.broker.subscribe(m.getTopic(m.serverType, m.appId), t.recvChan)
+	t.broker.subscribe("ALL_SERVER_HK4E", t.recvChan)
+	go t.recvHandler()
+	go t.sendHandler()
+	return nil
+}
+
+func (t *LocalTransport) Close() {
+	t.broker.unsubscribe(t.recvChan)
+	close(t.closeChan)
+}
+
+func (t *LocalTransport) recvHandler() {
+	for {
+		select {
+		case <-t.closeChan:
+			return
+		case rawData := <-t.recvChan:
+			netMsg := t.mq.parseNetMsg(rawData)
+			if netMsg == nil {
+				continue
+			}
+			t.mq.recvNetMsg(netMsg)
+		}
+	}
+}
+
+func (t *LocalTransport) sendHandler() {
+	for {
+		select {
+		case <-t.closeChan:
+			return
+		case netMsg := <-t.mq.netMsgInput:
+			rawData := t.mq.buildNetMsg(netMsg)
+			if rawData == nil {
+				continue
+			}
+			t.broker.publish(netMsg.Topic, rawData)
+		}
+	}
+}
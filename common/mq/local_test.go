@@ -0,0 +1,158 @@
+package mq
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"hk4e/common/config"
+	"hk4e/node/api"
+	"hk4e/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	config.CONF = &config.Config{Logger: config.Logger{Level: "DEBUG", Mode: "CONSOLE", Track: true}}
+	logger.InitLogger("mq_test")
+	code := m.Run()
+	logger.CloseLogger()
+	os.Exit(code)
+}
+
+func recvNetMsg(t *testing.T, m *MessageQueue) *NetMsg {
+	select {
+	case netMsg := <-m.GetNetMsg():
+		return netMsg
+	case <-time.After(time.Second):
+		t.Fatal("recv net msg timeout")
+		return nil
+	}
+}
+
+func TestLocalMessageQueue(t *testing.T) {
+	broker := NewLocalBroker()
+	gate := NewLocalMessageQueue(api.GATE, "gate0001", broker)
+	gs := NewLocalMessageQueue(api.GS, "gs000001", broker)
+	anticheat := NewLocalMessageQueue(api.ANTICHEAT, "ac000001", broker)
+	defer gate.Close()
+	defer gs.Close()
+	defer anticheat.Close()
+
+	gate.SendToGs("gs000001", &NetMsg{
+		MsgType: MsgTypeServer,
+		EventId: ServerUserOnlineStateChangeNotify,
+		ServerMsg: &ServerMsg{
+			UserId:   100,
+			IsOnline: true,
+		},
+	})
+	netMsg := recvNetMsg(t, gs)
+	if netMsg.OriginServerType != api.GATE || netMsg.OriginServerAppId != "gate0001" {
+		t.Fatalf("origin server error: %v %v", netMsg.OriginServerType, netMsg.OriginServerAppId)
+	}
+	if netMsg.ServerMsg.UserId != 100 || !netMsg.ServerMsg.IsOnline {
+		t.Fatalf("server msg error: %v", netMsg.ServerMsg)
+	}
+
+	// 广播消息不会发给自己
+	gs.SendToAll(&NetMsg{
+		MsgType: MsgTypeServer,
+		EventId: ServerUserOnlineStateChangeNotify,
+		ServerMsg: &ServerMsg{
+			UserId: 200,
+		},
+	})
+	for _, m := range []*MessageQueue{gate, anticheat} {
+		netMsg = recvNetMsg(t, m)
+		if netMsg.ServerMsg.UserId != 200 {
+			t.Fatalf("broadcast msg error: %v", netMsg.ServerMsg)
+		}
+	}
+	select {
+	case netMsg = <-gs.GetNetMsg():
+		t.Fatalf("recv self broadcast msg: %v", netMsg)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestLocalMessageQueueReliable(t *testing.T) {
+	broker := NewLocalBroker()
+	gs1 := NewLocalMessageQueue(api.GS, "gs000001", broker)
+	gs2 := NewLocalMessageQueue(api.GS, "gs000002", broker)
+	defer gs1.Close()
+	defer gs2.Close()
+
+	gs1.SendToGsReliable("gs000002", &NetMsg{
+		MsgType: MsgTypeServer,
+		EventId: ServerUserMpReq,
+		ServerMsg: &ServerMsg{
+			UserId: 100,
+		},
+	})
+	netMsg := recvNetMsg(t, gs2)
+	if netMsg.MsgId == 0 || netMsg.ServerMsg.UserId != 100 {
+		t.Fatalf("reliable msg error: %v", netMsg)
+	}
+	// 重复的消息会被丢弃
+	_ = gs2.recvReliableMsg(netMsg)
+	if gs2.recvReliableMsg(netMsg) {
+		t.Fatalf("recv duplicate reliable msg")
+	}
+	// 确认之后发送方不会再重发
+	time.Sleep(time.Millisecond * 100)
+	gs1.reliable.pendingMsgLock.Lock()
+	pendingCount := len(gs1.reliable.pendingMsgMap)
+	gs1.reliable.pendingMsgLock.Unlock()
+	if pendingCount != 0 {
+		t.Fatalf("reliable msg not acked, pending count: %v", pendingCount)
+	}
+
+	// 接收方不存在时超时
+	gs1.SendToGsReliable("gs000003", &NetMsg{
+		MsgType: MsgTypeServer,
+		EventId: ServerUserMpReq,
+		ServerMsg: &ServerMsg{
+			UserId: 200,
+		},
+	})
+	select {
+	case netMsg = <-gs1.GetNetMsg():
+		if !netMsg.IsTimeout || netMsg.ServerMsg.UserId != 200 {
+			t.Fatalf("reliable msg timeout error: %v", netMsg)
+		}
+	case <-time.After(ReliableMsgRetryInterval * 2 * (ReliableMsgMaxRetry + 1)):
+		t.Fatal("reliable msg timeout not recv")
+	}
+}
+
+func TestLocalBrokerDropWhenFull(t *testing.T) {
+	broker := NewLocalBroker()
+	slow := make(chan []byte, 1)
+	fast := make(chan []byte, 10)
+	broker.subscribe("TOPIC", slow)
+	broker.subscribe("TOPIC", fast)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			broker.publish("TOPIC", []byte{byte(i)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked by full subscriber")
+	}
+	if len(fast) != 3 {
+		t.Fatalf("fast subscriber recv count error: %v", len(fast))
+	}
+	if broker.GetDropCount() != 2 {
+		t.Fatalf("drop count error: %v", broker.GetDropCount())
+	}
+	// 取消订阅后不再向该订阅者发送消息
+	broker.unsubscribe(slow)
+	<-slow
+	broker.publish("TOPIC", []byte{3})
+	if len(slow) != 0 {
+		t.Fatalf("recv msg after unsubscribe")
+	}
+}
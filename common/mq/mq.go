@@ -0,0 +1,167 @@
+package mq
+
+import (
+	"time"
+
+	"hk4e/node/api"
+	"hk4e/pkg/logger"
+	"hk4e/protocol/cmd"
+
+	"github.com/vmihailenco/msgpack/v5"
+	pb "google.golang.org/protobuf/proto"
+)
+
+// 用于服务器之间传输游戏协议
+// 仅用于传递数据平面(client<--->server)和控制平面(server<--->server)的消息
+// 底层传输可替换 默认为NATS+网关tcp直连 测试和单进程部署可使用进程内传输
+// 请不要用这个来搞RPC写一大堆异步回调!!!
+// 要用RPC有专门的NATSRPC
+
+type MessageQueue struct {
+	netMsgInput  chan *NetMsg // 按优先级从inputLane取出的待发送消息
+	netMsgOutput chan *NetMsg // 按优先级从outputLane取出的已接收消息
+	inputLane    *laneQueue
+	outputLane   *laneQueue
+	cmdProtoMap  *cmd.CmdProtoMap
+	serverType   string
+	appId        string
+	transport    Transport
+	reliable     *reliableManager
+	trace        *traceManager
+}
+
+// Transport 消息队列的底层传输
+// 从MessageQueue的netMsgInput读取待发送的消息按Topic投递 收到的消息交给MessageQueue的recvNetMsg
+type Transport interface {
+	Start(m *MessageQueue) error
+	Close()
+}
+
+// NewMessageQueue 创建基于NATS+网关tcp直连的消息队列
+func NewMessageQueue(serverType string, appId string, discoveryClient api.DiscoveryNATSRPCClient) (r *MessageQueue) {
+	return NewMessageQueueWithTransport(serverType, appId, NewNatsTransport(discoveryClient))
+}
+
+// NewMessageQueueByNatsUrl 创建连接指定NATS的消息队列 用于连接其它节点服务器集群
+func NewMessageQueueByNatsUrl(serverType string, appId string, natsUrl string, discoveryClient api.DiscoveryNATSRPCClient) (r *MessageQueue) {
+	return NewMessageQueueWithTransport(serverType, appId, NewNatsTransportByNatsUrl(natsUrl, discoveryClient))
+}
+
+// NewLocalMessageQueue 创建进程内的消息队列 同一个LocalBroker下的消息队列之间互相可达
+func NewLocalMessageQueue(serverType string, appId string, broker *LocalBroker) (r *MessageQueue) {
+	return NewMessageQueueWithTransport(serverType, appId, NewLocalTransport(broker))
+}
+
+func NewMessageQueueWithTransport(serverType string, appId string, transport Transport) (r *MessageQueue) {
+	r = new(MessageQueue)
+	r.netMsgInput = make(chan *NetMsg)
+	r.netMsgOutput = make(chan *NetMsg)
+	r.cmdProtoMap = cmd.NewCmdProtoMap()
+	r.inputLane = r.newLaneQueue(r.netMsgInput)
+	r.outputLane = r.newLaneQueue(r.netMsgOutput)
+	r.serverType = serverType
+	r.appId = appId
+	r.transport = transport
+	r.reliable = newReliableManager()
+	r.trace = newTraceManager()
+	err := r.transport.Start(r)
+	if err != nil {
+		logger.Error("message queue transport start error: %v", err)
+		return nil
+	}
+	go r.reliableMsgHandler()
+	return r
+}
+
+func (m *MessageQueue) Close() {
+	// 等待所有待发送的消息发送完毕
+	for {
+		if m.inputLane.len() == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	m.inputLane.close()
+	m.outputLane.close()
+	close(m.reliable.closeChan)
+	m.transport.Close()
+}
+
+func (m *MessageQueue) GetNetMsg() chan *NetMsg {
+	return m.netMsgOutput
+}
+
+// 传输层收到消息后的统一处理
+func (m *MessageQueue) recvNetMsg(netMsg *NetMsg) {
+	// 忽略自己发出的广播消息
+	if netMsg.OriginServerType == m.serverType && netMsg.OriginServerAppId == m.appId {
+		return
+	}
+	if netMsg.MsgType == MsgTypeServer {
+		ok := m.recvReliableMsg(netMsg)
+		if !ok {
+			return
+		}
+	}
+	m.outputLane.push(netMsg)
+}
+
+func (m *MessageQueue) buildNetMsg(netMsg *NetMsg) []byte {
+	switch netMsg.MsgType {
+	case MsgTypeGame:
+		gameMsg := netMsg.GameMsg
+		if gameMsg == nil {
+			logger.Error("send game msg is nil")
+			return nil
+		}
+		if gameMsg.PayloadMessageData == nil {
+			// protobuf PayloadMessage
+			payloadMessageData, err := pb.Marshal(gameMsg.PayloadMessage)
+			if err != nil {
+				logger.Error("parse payload msg to bin error: %v", err)
+				return nil
+			}
+			gameMsg.PayloadMessageData = payloadMessageData
+		}
+	}
+	// msgpack NetMsg
+	rawData, err := msgpack.Marshal(netMsg)
+	if err != nil {
+		logger.Error("parse net msg to bin error: %v", err)
+		return nil
+	}
+	return rawData
+}
+
+func (m *MessageQueue) parseNetMsg(rawData []byte) *NetMsg {
+	// msgpack NetMsg
+	netMsg := new(NetMsg)
+	err := msgpack.Unmarshal(rawData, netMsg)
+	if err != nil {
+		logger.Error("parse bin to net msg error: %v", err)
+		return nil
+	}
+	switch netMsg.MsgType {
+	case MsgTypeGame:
+		gameMsg := netMsg.GameMsg
+		if gameMsg == nil {
+			logger.Error("recv game msg is nil")
+			return nil
+		}
+		if netMsg.EventId == NormalMsg {
+			// protobuf PayloadMessage
+			payloadMessage := m.cmdProtoMap.GetProtoObjFastNewByCmdId(gameMsg.CmdId)
+			if payloadMessage == nil {
+				logger.Error("get protobuf obj by cmd id error: %v", err)
+				return nil
+			}
+			err = pb.Unmarshal(gameMsg.PayloadMessageData, payloadMessage)
+			if err != nil {
+				logger.Error("parse bin to payload msg error: %v", err)
+				return nil
+			}
+			gameMsg.PayloadMessage = payloadMessage
+		}
+	}
+	return netMsg
+}
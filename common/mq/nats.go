@@ -9,164 +9,88 @@ import (
 	"time"
 
 	"hk4e/common/config"
-	"hk4e/common/rpc"
 	"hk4e/node/api"
 	"hk4e/pkg/logger"
-	"hk4e/protocol/cmd"
 
 	"github.com/nats-io/nats.go"
-	"github.com/vmihailenco/msgpack/v5"
-	pb "google.golang.org/protobuf/proto"
 )
 
-// 用于服务器之间传输游戏协议
-// 仅用于传递数据平面(client<--->server)和控制平面(server<--->server)的消息
+// NatsTransport 基于NATS的传输
 // 服务器之间消息优先走tcp socket直连 tcp连接断开或不存在时降级回NATS
-// 请不要用这个来搞RPC写一大堆异步回调!!!
-// 要用RPC有专门的NATSRPC
-
-type MessageQueue struct {
+type NatsTransport struct {
+	mq                     *MessageQueue
 	natsConn               *nats.Conn
 	natsMsgChan            chan *nats.Msg
-	netMsgInput            chan *NetMsg
-	netMsgOutput           chan *NetMsg
-	cmdProtoMap            *cmd.CmdProtoMap
-	serverType             string
-	appId                  string
 	gateTcpMqEventChan     chan *GateTcpMqEvent
 	gateTcpMqDeadEventChan chan string
-	discoveryClient        *rpc.DiscoveryClient
+	discoveryClient        api.DiscoveryNATSRPCClient
+	natsUrl                string
+}
+
+func NewNatsTransport(discoveryClient api.DiscoveryNATSRPCClient) (r *NatsTransport) {
+	return NewNatsTransportByNatsUrl(config.GetConfig().MQ.NatsUrl, discoveryClient)
+}
+
+// NewNatsTransportByNatsUrl 连接指定的NATS 用于连接其它节点服务器集群
+func NewNatsTransportByNatsUrl(natsUrl string, discoveryClient api.DiscoveryNATSRPCClient) (r *NatsTransport) {
+	r = new(NatsTransport)
+	r.natsUrl = natsUrl
+	natsRecvChanSize := 1000
+	if config.GetConfig().MQ.NatsRecvChanSize > 0 {
+		natsRecvChanSize = int(config.GetConfig().MQ.NatsRecvChanSize)
+	}
+	r.natsMsgChan = make(chan *nats.Msg, natsRecvChanSize)
+	r.gateTcpMqEventChan = make(chan *GateTcpMqEvent, 1000)
+	r.gateTcpMqDeadEventChan = make(chan string, 1000)
+	r.discoveryClient = discoveryClient
+	return r
 }
 
-func NewMessageQueue(serverType string, appId string, discoveryClient *rpc.DiscoveryClient) (r *MessageQueue) {
-	r = new(MessageQueue)
-	conn, err := nats.Connect(config.GetConfig().MQ.NatsUrl)
+func (t *NatsTransport) Start(m *MessageQueue) error {
+	t.mq = m
+	conn, err := nats.Connect(t.natsUrl)
 	if err != nil {
 		logger.Error("connect nats error: %v", err)
-		return nil
+		return err
 	}
-	r.natsConn = conn
-	r.natsMsgChan = make(chan *nats.Msg, 1000)
-	_, err = r.natsConn.ChanSubscribe(r.getTopic(serverType, appId), r.natsMsgChan)
+	t.natsConn = conn
+	_, err = t.natsConn.ChanSubscribe(m.getTopic(m.serverType, m.appId), t.natsMsgChan)
 	if err != nil {
 		logger.Error("nats subscribe error: %v", err)
-		return nil
+		return err
 	}
-	_, err = r.natsConn.ChanSubscribe("ALL_SERVER_HK4E", r.natsMsgChan)
+	_, err = t.natsConn.ChanSubscribe("ALL_SERVER_HK4E", t.natsMsgChan)
 	if err != nil {
 		logger.Error("nats subscribe error: %v", err)
-		return nil
+		return err
 	}
-	r.netMsgInput = make(chan *NetMsg, 1000)
-	r.netMsgOutput = make(chan *NetMsg, 1000)
-	r.cmdProtoMap = cmd.NewCmdProtoMap()
-	r.serverType = serverType
-	r.appId = appId
-	r.gateTcpMqEventChan = make(chan *GateTcpMqEvent, 1000)
-	r.gateTcpMqDeadEventChan = make(chan string, 1000)
-	r.discoveryClient = discoveryClient
-	if serverType == api.GATE {
-		go r.runGateTcpMqServer()
-	} else if serverType == api.GS || serverType == api.ANTICHEAT || serverType == api.PATHFINDING {
-		go r.runGateTcpMqClient()
-	}
-	go r.natsMsgRecvHandler()
-	go r.sendHandler()
-	return r
-}
-
-func (m *MessageQueue) Close() {
-	// 等待所有待发送的消息发送完毕
-	for {
-		if len(m.netMsgInput) == 0 {
-			break
-		}
-		time.Sleep(time.Millisecond * 100)
+	if m.serverType == api.GATE {
+		go t.runGateTcpMqServer()
+	} else if m.serverType == api.GS || m.serverType == api.ANTICHEAT || m.serverType == api.PATHFINDING {
+		go t.runGateTcpMqClient()
 	}
-	m.natsConn.Close()
+	go t.natsMsgRecvHandler()
+	go t.sendHandler()
+	return nil
 }
 
-func (m *MessageQueue) GetNetMsg() chan *NetMsg {
-	return m.netMsgOutput
+func (t *NatsTransport) Close() {
+	t.natsConn.Close()
 }
 
-func (m *MessageQueue) natsMsgRecvHandler() {
+func (t *NatsTransport) natsMsgRecvHandler() {
 	for {
-		natsMsg := <-m.natsMsgChan
+		natsMsg := <-t.natsMsgChan
 		rawData := natsMsg.Data
-		netMsg := m.parseNetMsg(rawData)
+		netMsg := t.mq.parseNetMsg(rawData)
 		if netMsg == nil {
 			continue
 		}
-		// 忽略自己发出的广播消息
-		if netMsg.OriginServerType == m.serverType && netMsg.OriginServerAppId == m.appId {
-			continue
-		}
-		m.netMsgOutput <- netMsg
-	}
-}
-
-func (m *MessageQueue) buildNetMsg(netMsg *NetMsg) []byte {
-	switch netMsg.MsgType {
-	case MsgTypeGame:
-		gameMsg := netMsg.GameMsg
-		if gameMsg == nil {
-			logger.Error("send game msg is nil")
-			return nil
-		}
-		if gameMsg.PayloadMessageData == nil {
-			// protobuf PayloadMessage
-			payloadMessageData, err := pb.Marshal(gameMsg.PayloadMessage)
-			if err != nil {
-				logger.Error("parse payload msg to bin error: %v", err)
-				return nil
-			}
-			gameMsg.PayloadMessageData = payloadMessageData
-		}
-	}
-	// msgpack NetMsg
-	rawData, err := msgpack.Marshal(netMsg)
-	if err != nil {
-		logger.Error("parse net msg to bin error: %v", err)
-		return nil
-	}
-	return rawData
-}
-
-func (m *MessageQueue) parseNetMsg(rawData []byte) *NetMsg {
-	// msgpack NetMsg
-	netMsg := new(NetMsg)
-	err := msgpack.Unmarshal(rawData, netMsg)
-	if err != nil {
-		logger.Error("parse bin to net msg error: %v", err)
-		return nil
-	}
-	switch netMsg.MsgType {
-	case MsgTypeGame:
-		gameMsg := netMsg.GameMsg
-		if gameMsg == nil {
-			logger.Error("recv game msg is nil")
-			return nil
-		}
-		if netMsg.EventId == NormalMsg {
-			// protobuf PayloadMessage
-			payloadMessage := m.cmdProtoMap.GetProtoObjFastNewByCmdId(gameMsg.CmdId)
-			if payloadMessage == nil {
-				logger.Error("get protobuf obj by cmd id error: %v", err)
-				return nil
-			}
-			err = pb.Unmarshal(gameMsg.PayloadMessageData, payloadMessage)
-			if err != nil {
-				logger.Error("parse bin to payload msg error: %v", err)
-				return nil
-			}
-			gameMsg.PayloadMessage = payloadMessage
-		}
+		t.mq.recvNetMsg(netMsg)
 	}
-	return netMsg
 }
 
-func (m *MessageQueue) sendHandler() {
+func (t *NatsTransport) sendHandler() {
 	// 网关tcp连接消息收发快速通道 key1:服务器类型 key2:服务器appid value:连接实例
 	gateTcpMqInstMap := map[string]map[string]*GateTcpMqInst{
 		api.GATE:        make(map[string]*GateTcpMqInst),
@@ -176,8 +100,8 @@ func (m *MessageQueue) sendHandler() {
 	}
 	for {
 		select {
-		case netMsg := <-m.netMsgInput:
-			rawData := m.buildNetMsg(netMsg)
+		case netMsg := <-t.mq.netMsgInput:
+			rawData := t.mq.buildNetMsg(netMsg)
 			if rawData == nil {
 				continue
 			}
@@ -185,7 +109,7 @@ func (m *MessageQueue) sendHandler() {
 				// 找不到tcp快速通道就fallback回nats
 				natsMsg := nats.NewMsg(netMsg.Topic)
 				natsMsg.Data = rawData
-				err := m.natsConn.PublishMsg(natsMsg)
+				err := t.natsConn.PublishMsg(natsMsg)
 				if err != nil {
 					logger.Error("nats publish msg error: %v", err)
 					return
@@ -219,7 +143,7 @@ func (m *MessageQueue) sendHandler() {
 					// 发送失败关闭连接fallback回nats
 					logger.Error("gate tcp mq send error: %v", err)
 					_ = inst.conn.Close()
-					m.gateTcpMqEventChan <- &GateTcpMqEvent{
+					t.gateTcpMqEventChan <- &GateTcpMqEvent{
 						event: EventDisconnect,
 						inst:  inst,
 					}
@@ -239,7 +163,7 @@ func (m *MessageQueue) sendHandler() {
 			if !ok {
 				continue
 			}
-		case gateTcpMqEvent := <-m.gateTcpMqEventChan:
+		case gateTcpMqEvent := <-t.gateTcpMqEventChan:
 			inst := gateTcpMqEvent.inst
 			switch gateTcpMqEvent.event {
 			case EventConnect:
@@ -248,7 +172,7 @@ func (m *MessageQueue) sendHandler() {
 			case EventDisconnect:
 				logger.Warn("gate tcp mq disconnect, addr: %v, server type: %v, appid: %v", inst.conn.RemoteAddr().String(), inst.serverType, inst.appId)
 				delete(gateTcpMqInstMap[inst.serverType], inst.appId)
-				m.gateTcpMqDeadEventChan <- inst.conn.RemoteAddr().String()
+				t.gateTcpMqDeadEventChan <- inst.conn.RemoteAddr().String()
 			}
 		}
 	}
@@ -270,7 +194,7 @@ type GateTcpMqEvent struct {
 	inst  *GateTcpMqInst
 }
 
-func (m *MessageQueue) runGateTcpMqServer() {
+func (t *NatsTransport) runGateTcpMqServer() {
 	addr, err := net.ResolveTCPAddr("tcp4", "0.0.0.0:"+strconv.Itoa(int(config.GetConfig().Hk4e.GateTcpMqPort)))
 	if err != nil {
 		logger.Error("gate tcp mq parse port error: %v", err)
@@ -288,11 +212,11 @@ func (m *MessageQueue) runGateTcpMqServer() {
 			return
 		}
 		logger.Info("accept gate tcp mq, server addr: %v", conn.RemoteAddr().String())
-		go m.gateTcpMqHandshake(conn)
+		go t.gateTcpMqHandshake(conn)
 	}
 }
 
-func (m *MessageQueue) gateTcpMqHandshake(conn net.Conn) {
+func (t *NatsTransport) gateTcpMqHandshake(conn net.Conn) {
 	recvBuf := make([]byte, 1500)
 	recvLen, err := conn.Read(recvBuf)
 	if err != nil {
@@ -330,32 +254,32 @@ func (m *MessageQueue) gateTcpMqHandshake(conn net.Conn) {
 		return
 	}
 	inst.appId = split[1]
-	go m.gateTcpMqRecvHandle(inst)
-	m.gateTcpMqEventChan <- &GateTcpMqEvent{
+	go t.gateTcpMqRecvHandle(inst)
+	t.gateTcpMqEventChan <- &GateTcpMqEvent{
 		event: EventConnect,
 		inst:  inst,
 	}
 }
 
-func (m *MessageQueue) runGateTcpMqClient() {
+func (t *NatsTransport) runGateTcpMqClient() {
 	// 已存在的GATE连接列表
 	gateServerConnAddrMap := make(map[string]bool)
-	m.gateTcpMqConn(gateServerConnAddrMap)
+	t.gateTcpMqConn(gateServerConnAddrMap)
 	ticker := time.NewTicker(time.Minute)
 	for {
 		select {
-		case addr := <-m.gateTcpMqDeadEventChan:
+		case addr := <-t.gateTcpMqDeadEventChan:
 			// GATE连接断开
 			delete(gateServerConnAddrMap, addr)
 		case <-ticker.C:
 			// 定时获取全部GATE实例地址并建立连接
-			m.gateTcpMqConn(gateServerConnAddrMap)
+			t.gateTcpMqConn(gateServerConnAddrMap)
 		}
 	}
 }
 
-func (m *MessageQueue) gateTcpMqConn(gateServerConnAddrMap map[string]bool) {
-	rsp, err := m.discoveryClient.GetAllGateServerInfoList(context.TODO(), new(api.NullMsg))
+func (t *NatsTransport) gateTcpMqConn(gateServerConnAddrMap map[string]bool) {
+	rsp, err := t.discoveryClient.GetAllGateServerInfoList(context.TODO(), new(api.NullMsg))
 	if err != nil {
 		logger.Error("gate tcp mq get gate list error: %v", err)
 		return
@@ -378,7 +302,7 @@ func (m *MessageQueue) gateTcpMqConn(gateServerConnAddrMap map[string]bool) {
 			logger.Error("gate tcp mq conn error: %v", err)
 			return
 		}
-		_, err = conn.Write([]byte(m.serverType + "@" + m.appId))
+		_, err = conn.Write([]byte(t.mq.serverType + "@" + t.mq.appId))
 		if err != nil {
 			logger.Error("gate tcp mq handshake send error: %v", err)
 			return
@@ -388,17 +312,17 @@ func (m *MessageQueue) gateTcpMqConn(gateServerConnAddrMap map[string]bool) {
 			serverType: api.GATE,
 			appId:      gateServerInfo.AppId,
 		}
-		m.gateTcpMqEventChan <- &GateTcpMqEvent{
+		t.gateTcpMqEventChan <- &GateTcpMqEvent{
 			event: EventConnect,
 			inst:  inst,
 		}
 		gateServerConnAddrMap[gateServerAddr] = true
 		logger.Info("connect gate tcp mq, gate addr: %v", conn.RemoteAddr().String())
-		go m.gateTcpMqRecvHandle(inst)
+		go t.gateTcpMqRecvHandle(inst)
 	}
 }
 
-func (m *MessageQueue) gateTcpMqRecvHandle(inst *GateTcpMqInst) {
+func (t *NatsTransport) gateTcpMqRecvHandle(inst *GateTcpMqInst) {
 	header := make([]byte, 4)
 	payload := make([]byte, 1024)
 	for {
@@ -408,7 +332,7 @@ func (m *MessageQueue) gateTcpMqRecvHandle(inst *GateTcpMqInst) {
 			n, err := inst.conn.Read(header[recvLen:])
 			if err != nil {
 				logger.Error("gate tcp mq recv error: %v", err)
-				m.gateTcpMqEventChan <- &GateTcpMqEvent{
+				t.gateTcpMqEventChan <- &GateTcpMqEvent{
 					event: EventDisconnect,
 					inst:  inst,
 				}
@@ -427,7 +351,7 @@ func (m *MessageQueue) gateTcpMqRecvHandle(inst *GateTcpMqInst) {
 			n, err := inst.conn.Read(payload[recvLen:msgLen])
 			if err != nil {
 				logger.Error("gate tcp mq recv error: %v", err)
-				m.gateTcpMqEventChan <- &GateTcpMqEvent{
+				t.gateTcpMqEventChan <- &GateTcpMqEvent{
 					event: EventDisconnect,
 					inst:  inst,
 				}
@@ -436,9 +360,9 @@ func (m *MessageQueue) gateTcpMqRecvHandle(inst *GateTcpMqInst) {
 			}
 			recvLen += n
 		}
-		netMsg := m.parseNetMsg(payload[:msgLen])
+		netMsg := t.mq.parseNetMsg(payload[:msgLen])
 		if netMsg != nil {
-			m.netMsgOutput <- netMsg
+			t.mq.recvNetMsg(netMsg)
 		}
 	}
 }
@@ -19,6 +19,9 @@ type NetMsg struct {
 	ServerMsg         *ServerMsg
 	OriginServerType  string
 	OriginServerAppId string
+	MsgId             uint64 // 可靠消息id 为0代表普通消息
+	AckMsgId          uint64 // 确认收到的可靠消息id
+	IsTimeout         bool   `msgpack:"-"` // 可靠消息发送超时 由发送方本地的消息队列产生
 }
 
 const (
@@ -31,6 +34,7 @@ type GameMsg struct {
 	ClientSeq          uint32
 	PayloadMessage     pb.Message `msgpack:"-"`
 	PayloadMessageData []byte
+	Trace              *TraceInfo // 链路追踪信息 为nil代表不追踪
 }
 
 const (
@@ -38,6 +42,8 @@ const (
 	ClientTimeNotify         // 客户端本地时间上报
 	KickPlayerNotify         // 通知GATE剔除玩家
 	UserOfflineNotify        // 玩家离线通知GS
+	UserPauseNotify          // 玩家连接异常断开等待恢复通知GS
+	UserResumeNotify         // 玩家连接恢复通知GS
 )
 
 type ConnCtrlMsg struct {
@@ -46,6 +52,7 @@ type ConnCtrlMsg struct {
 	ClientTime uint32
 	KickUserId uint32
 	KickReason uint32
+	MsgLost    bool // 连接恢复前已有下行消息丢失
 }
 
 const (
@@ -56,6 +63,9 @@ const (
 	ServerUserMpRsp                          // 跨服多人世界相关响应
 	ServerChatMsgNotify                      // 跨服玩家聊天消息通知
 	ServerAddFriendNotify                    // 跨服添加好友通知
+	ServerDrainStateChangeNotify             // 服务器排空状态变更通知
+	ServerMainGsChangeNotify                 // 主GS变更通知
+	ServerMsgAck                             // 可靠消息确认
 )
 
 type ServerMsg struct {
@@ -67,6 +77,7 @@ type ServerMsg struct {
 	UserMpInfo           *UserMpInfo
 	ChatMsgInfo          *ChatMsgInfo
 	AddFriendInfo        *AddFriendInfo
+	IsDraining           bool
 }
 
 type OriginInfo struct {
@@ -111,4 +122,5 @@ type AddFriendInfo struct {
 	OriginInfo            *OriginInfo
 	TargetUserId          uint32
 	ApplyPlayerOnlineInfo *UserBaseInfo
+	SendCount             uint32 // 同意好友申请的通知已发送的次数 超时重发和转发时累加
 }
@@ -0,0 +1,172 @@
+package mq
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"hk4e/node/api"
+	"hk4e/pkg/logger"
+)
+
+// 服务器之间的可靠消息
+// 发送方为消息分配id并等待接收方确认 超时未确认则重发 重发次数耗尽后由本地消息队列产生超时消息
+// 接收方按照发送方appid和消息id去重 保证同一条消息只处理一次
+
+const (
+	ReliableMsgRetryInterval = time.Second      // 可靠消息重发间隔
+	ReliableMsgMaxRetry      = 3                // 可靠消息最大重发次数
+	ReliableMsgDedupTime     = time.Second * 60 // 接收方去重记录的保留时间
+)
+
+type reliableMsg struct {
+	netMsg     *NetMsg
+	sendTime   time.Time
+	retryCount int
+}
+
+type reliableManager struct {
+	msgIdCounter   uint64
+	pendingMsgMap  map[uint64]*reliableMsg // 等待确认的消息 key:消息id
+	pendingMsgLock sync.Mutex
+	recvMsgIdMap   map[string]time.Time // 已收到的消息 key:发送方appid_消息id value:收到时间
+	recvMsgIdLock  sync.Mutex
+	closeChan      chan struct{}
+}
+
+func newReliableManager() (r *reliableManager) {
+	r = new(reliableManager)
+	// 以启动时间作为起始id 避免重启后与接收方的去重记录冲突
+	r.msgIdCounter = uint64(time.Now().UnixNano())
+	r.pendingMsgMap = make(map[uint64]*reliableMsg)
+	r.recvMsgIdMap = make(map[string]time.Time)
+	r.closeChan = make(chan struct{})
+	return r
+}
+
+// SendToGsReliable 发送可靠消息到GS 超时未确认时GetNetMsg会收到IsTimeout为true的原消息
+func (m *MessageQueue) SendToGsReliable(appId string, netMsg *NetMsg) {
+	m.addReliableMsg(netMsg)
+	m.SendToGs(appId, netMsg)
+}
+
+// SendToGateReliable 发送可靠消息到GATE 超时未确认时GetNetMsg会收到IsTimeout为true的原消息
+func (m *MessageQueue) SendToGateReliable(appId string, netMsg *NetMsg) {
+	m.addReliableMsg(netMsg)
+	m.SendToGate(appId, netMsg)
+}
+
+func (m *MessageQueue) addReliableMsg(netMsg *NetMsg) {
+	netMsg.MsgId = atomic.AddUint64(&m.reliable.msgIdCounter, 1)
+	m.reliable.pendingMsgLock.Lock()
+	m.reliable.pendingMsgMap[netMsg.MsgId] = &reliableMsg{
+		netMsg:     netMsg,
+		sendTime:   time.Now(),
+		retryCount: 0,
+	}
+	m.reliable.pendingMsgLock.Unlock()
+}
+
+// 处理收到的可靠消息和确认消息 返回false代表该消息不需要继续处理
+func (m *MessageQueue) recvReliableMsg(netMsg *NetMsg) bool {
+	if netMsg.EventId == ServerMsgAck {
+		m.reliable.pendingMsgLock.Lock()
+		delete(m.reliable.pendingMsgMap, netMsg.AckMsgId)
+		m.reliable.pendingMsgLock.Unlock()
+		return false
+	}
+	if netMsg.MsgId == 0 {
+		return true
+	}
+	m.sendReliableMsgAck(netMsg)
+	key := netMsg.OriginServerAppId + "_" + strconv.FormatUint(netMsg.MsgId, 10)
+	m.reliable.recvMsgIdLock.Lock()
+	_, exist := m.reliable.recvMsgIdMap[key]
+	if !exist {
+		m.reliable.recvMsgIdMap[key] = time.Now()
+	}
+	m.reliable.recvMsgIdLock.Unlock()
+	if exist {
+		logger.Debug("recv duplicate reliable msg, origin appid: %v, msg id: %v", netMsg.OriginServerAppId, netMsg.MsgId)
+		return false
+	}
+	return true
+}
+
+func (m *MessageQueue) sendReliableMsgAck(netMsg *NetMsg) {
+	ackMsg := &NetMsg{
+		MsgType:  MsgTypeServer,
+		EventId:  ServerMsgAck,
+		AckMsgId: netMsg.MsgId,
+	}
+	switch netMsg.OriginServerType {
+	case api.GATE:
+		m.SendToGate(netMsg.OriginServerAppId, ackMsg)
+	case api.GS:
+		m.SendToGs(netMsg.OriginServerAppId, ackMsg)
+	case api.ANTICHEAT:
+		m.SendToAnticheat(netMsg.OriginServerAppId, ackMsg)
+	case api.PATHFINDING:
+		m.SendToPathfinding(netMsg.OriginServerAppId, ackMsg)
+	default:
+		logger.Error("reliable msg ack unknown server type: %v", netMsg.OriginServerType)
+	}
+}
+
+// 定时重发未确认的消息和清理过期的去重记录
+func (m *MessageQueue) reliableMsgHandler() {
+	ticker := time.NewTicker(ReliableMsgRetryInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.reliable.closeChan:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		retryMsgList := make([]*NetMsg, 0)
+		timeoutMsgList := make([]*NetMsg, 0)
+		m.reliable.pendingMsgLock.Lock()
+		for msgId, msg := range m.reliable.pendingMsgMap {
+			if now.Sub(msg.sendTime) < ReliableMsgRetryInterval {
+				continue
+			}
+			if msg.retryCount >= ReliableMsgMaxRetry {
+				delete(m.reliable.pendingMsgMap, msgId)
+				timeoutMsgList = append(timeoutMsgList, msg.netMsg)
+				continue
+			}
+			msg.retryCount++
+			msg.sendTime = now
+			retryMsgList = append(retryMsgList, msg.netMsg)
+		}
+		m.reliable.pendingMsgLock.Unlock()
+		for _, netMsg := range retryMsgList {
+			logger.Debug("reliable msg retry, topic: %v, msg id: %v", netMsg.Topic, netMsg.MsgId)
+			m.inputLane.push(netMsg)
+		}
+		for _, netMsg := range timeoutMsgList {
+			logger.Error("reliable msg timeout, topic: %v, event id: %v, msg id: %v", netMsg.Topic, netMsg.EventId, netMsg.MsgId)
+			m.outputLane.push(&NetMsg{
+				MsgType:           netMsg.MsgType,
+				EventId:           netMsg.EventId,
+				ServerType:        netMsg.ServerType,
+				AppId:             netMsg.AppId,
+				Topic:             netMsg.Topic,
+				ServerMsg:         netMsg.ServerMsg,
+				OriginServerType:  netMsg.OriginServerType,
+				OriginServerAppId: netMsg.OriginServerAppId,
+				MsgId:             netMsg.MsgId,
+				IsTimeout:         true,
+			})
+		}
+		m.reliable.recvMsgIdLock.Lock()
+		for key, recvTime := range m.reliable.recvMsgIdMap {
+			if now.Sub(recvTime) > ReliableMsgDedupTime {
+				delete(m.reliable.recvMsgIdMap, key)
+			}
+		}
+		m.reliable.recvMsgIdLock.Unlock()
+	}
+}
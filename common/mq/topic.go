@@ -22,7 +22,7 @@ func (m *MessageQueue) SendToGate(appId string, netMsg *NetMsg) {
 	originServerType, originServerAppId := m.getOriginServer()
 	netMsg.OriginServerType = originServerType
 	netMsg.OriginServerAppId = originServerAppId
-	m.netMsgInput <- netMsg
+	m.inputLane.push(netMsg)
 }
 
 func (m *MessageQueue) SendToGs(appId string, netMsg *NetMsg) {
@@ -32,7 +32,7 @@ func (m *MessageQueue) SendToGs(appId string, netMsg *NetMsg) {
 	originServerType, originServerAppId := m.getOriginServer()
 	netMsg.OriginServerType = originServerType
 	netMsg.OriginServerAppId = originServerAppId
-	m.netMsgInput <- netMsg
+	m.inputLane.push(netMsg)
 }
 
 func (m *MessageQueue) SendToAnticheat(appId string, netMsg *NetMsg) {
@@ -42,7 +42,7 @@ func (m *MessageQueue) SendToAnticheat(appId string, netMsg *NetMsg) {
 	originServerType, originServerAppId := m.getOriginServer()
 	netMsg.OriginServerType = originServerType
 	netMsg.OriginServerAppId = originServerAppId
-	m.netMsgInput <- netMsg
+	m.inputLane.push(netMsg)
 }
 
 func (m *MessageQueue) SendToPathfinding(appId string, netMsg *NetMsg) {
@@ -52,7 +52,7 @@ func (m *MessageQueue) SendToPathfinding(appId string, netMsg *NetMsg) {
 	originServerType, originServerAppId := m.getOriginServer()
 	netMsg.OriginServerType = originServerType
 	netMsg.OriginServerAppId = originServerAppId
-	m.netMsgInput <- netMsg
+	m.inputLane.push(netMsg)
 }
 
 func (m *MessageQueue) SendToAll(netMsg *NetMsg) {
@@ -61,5 +61,5 @@ func (m *MessageQueue) SendToAll(netMsg *NetMsg) {
 	originServerType, originServerAppId := m.getOriginServer()
 	netMsg.OriginServerType = originServerType
 	netMsg.OriginServerAppId = originServerAppId
-	m.netMsgInput <- netMsg
+	m.inputLane.push(netMsg)
 }
@@ -0,0 +1,280 @@
+package mq
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"hk4e/pkg/logger"
+)
+
+// 消息链路追踪
+// GATE解码客户端消息时分配追踪id 消息经过的每个服务器追加一个带时间戳的节点
+// 服务器处理请求时发出的响应沿用请求的追踪信息 回到GATE发送给客户端时统计各段耗时
+// 各服务器的时钟不一定完全同步 跨服务器的分段耗时仅供参考
+
+const (
+	TraceStageGateRecv     = iota // GATE收到客户端消息
+	TraceStageServerRecv          // 服务器从消息队列收到消息
+	TraceStageServerHandle        // 服务器处理消息并发出响应
+	TraceStageGateSend            // GATE发送消息给客户端
+)
+
+var traceStageNameMap = map[uint8]string{
+	TraceStageGateRecv:     "GATE_RECV",
+	TraceStageServerRecv:   "SERVER_RECV",
+	TraceStageServerHandle: "SERVER_HANDLE",
+	TraceStageGateSend:     "GATE_SEND",
+}
+
+type TraceInfo struct {
+	TraceId uint64
+	UserId  uint32
+	CmdId   uint16 // 链路起点的客户端请求cmdId
+	IsLog   bool   // 是否打印完整链路日志
+	HopList []*TraceHop
+}
+
+type TraceHop struct {
+	ServerType string
+	AppId      string
+	Stage      uint8
+	Time       int64 // 微秒时间戳
+}
+
+func (t *TraceInfo) getHopTime(stage uint8) int64 {
+	for _, hop := range t.HopList {
+		if hop.Stage == stage {
+			return hop.Time
+		}
+	}
+	return 0
+}
+
+func (t *TraceInfo) String() string {
+	var sb strings.Builder
+	sb.WriteString("trace id: " + strconv.FormatUint(t.TraceId, 10))
+	sb.WriteString(", uid: " + strconv.Itoa(int(t.UserId)))
+	sb.WriteString(", cmdId: " + strconv.Itoa(int(t.CmdId)))
+	sb.WriteString(", hop:")
+	startTime := int64(0)
+	if len(t.HopList) > 0 {
+		startTime = t.HopList[0].Time
+	}
+	for _, hop := range t.HopList {
+		sb.WriteString(" [" + hop.ServerType + ":" + hop.AppId + " " + traceStageNameMap[hop.Stage])
+		sb.WriteString(" +" + strconv.FormatInt(hop.Time-startTime, 10) + "us]")
+	}
+	return sb.String()
+}
+
+// 延迟直方图分桶上界 毫秒
+var latencyBucketList = []int64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+
+// LatencyHistogram 延迟直方图
+type LatencyHistogram struct {
+	Count     uint64            `json:"count"`
+	Sum       int64             `json:"sum_us"`
+	Max       int64             `json:"max_us"`
+	BucketMap map[string]uint64 `json:"bucket_ms"` // key:分桶上界 +Inf为超过最大分桶
+}
+
+func newLatencyHistogram() *LatencyHistogram {
+	h := new(LatencyHistogram)
+	h.BucketMap = make(map[string]uint64)
+	return h
+}
+
+func (h *LatencyHistogram) add(latency int64) {
+	if latency < 0 {
+		latency = 0
+	}
+	h.Count++
+	h.Sum += latency
+	if latency > h.Max {
+		h.Max = latency
+	}
+	bucket := "+Inf"
+	for _, upper := range latencyBucketList {
+		if latency <= upper*1000 {
+			bucket = strconv.FormatInt(upper, 10)
+			break
+		}
+	}
+	h.BucketMap[bucket]++
+}
+
+func (h *LatencyHistogram) copy() *LatencyHistogram {
+	c := newLatencyHistogram()
+	c.Count = h.Count
+	c.Sum = h.Sum
+	c.Max = h.Max
+	for k, v := range h.BucketMap {
+		c.BucketMap[k] = v
+	}
+	return c
+}
+
+// 链路分段
+const (
+	TraceSegmentGateToServer = "gate_to_server" // GATE收到客户端消息到服务器收到
+	TraceSegmentServerHandle = "server_handle"  // 服务器收到到发出响应
+	TraceSegmentServerToGate = "server_to_gate" // 服务器发出响应到GATE发送给客户端
+	TraceSegmentTotal        = "total"          // GATE收到客户端消息到GATE发送响应
+)
+
+type traceManager struct {
+	traceIdCounter uint64
+	traceUserMap   sync.Map                                // 打印完整链路日志的玩家 key:uid
+	latencyMap     map[uint16]map[string]*LatencyHistogram // key1:请求cmdId key2:链路分段
+	latencyLock    sync.Mutex
+}
+
+func newTraceManager() (r *traceManager) {
+	r = new(traceManager)
+	r.traceIdCounter = uint64(time.Now().UnixNano())
+	r.latencyMap = make(map[uint16]map[string]*LatencyHistogram)
+	return r
+}
+
+// SetTraceUser 开启或关闭指定玩家的完整链路日志
+func (m *MessageQueue) SetTraceUser(userId uint32, enable bool) {
+	if enable {
+		m.trace.traceUserMap.Store(userId, true)
+	} else {
+		m.trace.traceUserMap.Delete(userId)
+	}
+}
+
+// GetTraceUserList 获取开启了完整链路日志的玩家列表
+func (m *MessageQueue) GetTraceUserList() []uint32 {
+	userIdList := make([]uint32, 0)
+	m.trace.traceUserMap.Range(func(key, value any) bool {
+		userIdList = append(userIdList, key.(uint32))
+		return true
+	})
+	sort.Slice(userIdList, func(i, j int) bool {
+		return userIdList[i] < userIdList[j]
+	})
+	return userIdList
+}
+
+// NewTrace 为客户端消息分配追踪信息 由GATE在解码客户端消息时调用
+func (m *MessageQueue) NewTrace(userId uint32, cmdId uint16) *TraceInfo {
+	_, isLog := m.trace.traceUserMap.Load(userId)
+	trace := &TraceInfo{
+		TraceId: atomic.AddUint64(&m.trace.traceIdCounter, 1),
+		UserId:  userId,
+		CmdId:   cmdId,
+		IsLog:   isLog,
+		HopList: make([]*TraceHop, 0, 4),
+	}
+	m.AddTraceHop(trace, TraceStageGateRecv)
+	return trace
+}
+
+// AddTraceHop 追加链路节点 trace为nil时忽略
+func (m *MessageQueue) AddTraceHop(trace *TraceInfo, stage uint8) {
+	if trace == nil {
+		return
+	}
+	trace.HopList = append(trace.HopList, &TraceHop{
+		ServerType: m.serverType,
+		AppId:      m.appId,
+		Stage:      stage,
+		Time:       time.Now().UnixMicro(),
+	})
+	if trace.IsLog && stage != TraceStageGateSend {
+		logger.Info("[TRACE] hop %v, %v", traceStageNameMap[stage], trace)
+	}
+}
+
+// ReplyTrace 生成响应消息的追踪信息 复制请求的链路并追加处理完成节点 trace为nil时返回nil
+func (m *MessageQueue) ReplyTrace(trace *TraceInfo) *TraceInfo {
+	if trace == nil {
+		return nil
+	}
+	reply := &TraceInfo{
+		TraceId: trace.TraceId,
+		UserId:  trace.UserId,
+		CmdId:   trace.CmdId,
+		IsLog:   trace.IsLog,
+		HopList: make([]*TraceHop, len(trace.HopList), len(trace.HopList)+2),
+	}
+	copy(reply.HopList, trace.HopList)
+	m.AddTraceHop(reply, TraceStageServerHandle)
+	return reply
+}
+
+// FinishTrace 结束链路并统计各段耗时 由GATE在发送消息给客户端后调用 trace为nil时忽略
+// 只统计请求的响应 同一请求附带发出的通知只打印链路日志
+func (m *MessageQueue) FinishTrace(trace *TraceInfo, cmdId uint16) {
+	if trace == nil {
+		return
+	}
+	m.AddTraceHop(trace, TraceStageGateSend)
+	if trace.IsLog {
+		logger.Info("[TRACE] finish, rsp cmdId: %v, %v", cmdId, trace)
+	}
+	if !m.isTraceReqRsp(trace.CmdId, cmdId) {
+		// 处理请求时附带发出的通知不计入请求的延迟统计
+		return
+	}
+	gateRecvTime := trace.getHopTime(TraceStageGateRecv)
+	serverRecvTime := trace.getHopTime(TraceStageServerRecv)
+	serverHandleTime := trace.getHopTime(TraceStageServerHandle)
+	gateSendTime := trace.getHopTime(TraceStageGateSend)
+	m.trace.latencyLock.Lock()
+	segmentMap, exist := m.trace.latencyMap[trace.CmdId]
+	if !exist {
+		segmentMap = map[string]*LatencyHistogram{
+			TraceSegmentGateToServer: newLatencyHistogram(),
+			TraceSegmentServerHandle: newLatencyHistogram(),
+			TraceSegmentServerToGate: newLatencyHistogram(),
+			TraceSegmentTotal:        newLatencyHistogram(),
+		}
+		m.trace.latencyMap[trace.CmdId] = segmentMap
+	}
+	if gateRecvTime != 0 && serverRecvTime != 0 {
+		segmentMap[TraceSegmentGateToServer].add(serverRecvTime - gateRecvTime)
+	}
+	if serverRecvTime != 0 && serverHandleTime != 0 {
+		segmentMap[TraceSegmentServerHandle].add(serverHandleTime - serverRecvTime)
+	}
+	if serverHandleTime != 0 {
+		segmentMap[TraceSegmentServerToGate].add(gateSendTime - serverHandleTime)
+	}
+	if gateRecvTime != 0 {
+		segmentMap[TraceSegmentTotal].add(gateSendTime - gateRecvTime)
+	}
+	m.trace.latencyLock.Unlock()
+}
+
+// 是否为请求和对应的响应 按协议名的Req和Rsp后缀区分
+func (m *MessageQueue) isTraceReqRsp(reqCmdId uint16, rspCmdId uint16) bool {
+	reqCmdName := m.cmdProtoMap.GetCmdNameByCmdId(reqCmdId)
+	rspCmdName := m.cmdProtoMap.GetCmdNameByCmdId(rspCmdId)
+	return strings.HasSuffix(reqCmdName, "Req") && strings.HasSuffix(rspCmdName, "Rsp")
+}
+
+// GetTraceLatencyStat 获取各请求cmdId的链路分段延迟直方图 key1:请求协议名 key2:链路分段
+func (m *MessageQueue) GetTraceLatencyStat() map[string]map[string]*LatencyHistogram {
+	m.trace.latencyLock.Lock()
+	defer m.trace.latencyLock.Unlock()
+	stat := make(map[string]map[string]*LatencyHistogram, len(m.trace.latencyMap))
+	for cmdId, segmentMap := range m.trace.latencyMap {
+		cmdName := m.cmdProtoMap.GetCmdNameByCmdId(cmdId)
+		if cmdName == "" {
+			cmdName = strconv.Itoa(int(cmdId))
+		}
+		statSegmentMap := make(map[string]*LatencyHistogram, len(segmentMap))
+		for segment, histogram := range segmentMap {
+			statSegmentMap[segment] = histogram.copy()
+		}
+		stat[cmdName] = statSegmentMap
+	}
+	return stat
+}
@@ -0,0 +1,24 @@
+package mq
+
+import (
+	"testing"
+
+	"hk4e/protocol/cmd"
+)
+
+func TestFinishTraceOnlyReqRsp(t *testing.T) {
+	m := &MessageQueue{cmdProtoMap: cmd.NewCmdProtoMap(), trace: newTraceManager()}
+	trace := m.NewTrace(100, cmd.GetPlayerFriendListReq)
+	m.FinishTrace(m.ReplyTrace(trace), cmd.PlayerPropNotify)
+	if len(m.GetTraceLatencyStat()) != 0 {
+		t.Fatalf("notify recorded in latency stat: %v", m.GetTraceLatencyStat())
+	}
+	m.FinishTrace(m.ReplyTrace(trace), cmd.GetPlayerFriendListRsp)
+	segmentMap, exist := m.GetTraceLatencyStat()["GetPlayerFriendListReq"]
+	if !exist {
+		t.Fatal("rsp not recorded in latency stat")
+	}
+	if segmentMap[TraceSegmentTotal].Count != 1 {
+		t.Fatalf("total count error: %v", segmentMap[TraceSegmentTotal].Count)
+	}
+}
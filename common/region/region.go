@@ -4,7 +4,6 @@ import (
 	"encoding/base64"
 	"os"
 
-	"hk4e/common/config"
 	"hk4e/pkg/endec"
 	"hk4e/pkg/logger"
 	"hk4e/pkg/random"
@@ -41,7 +40,7 @@ func NewRegionEc2b() *random.Ec2b {
 	return random.NewEc2b()
 }
 
-func GetRegionList(ec2b *random.Ec2b) *proto.QueryRegionListHttpRsp {
+func GetRegionList(serverList []*proto.RegionSimpleInfo, ec2b *random.Ec2b) *proto.QueryRegionListHttpRsp {
 	dispatchEc2bData := ec2b.Bytes()
 	dispatchXorKey := ec2b.XorKey()
 	// RegionList
@@ -57,14 +56,6 @@ func GetRegionList(ec2b *random.Ec2b) *proto.QueryRegionListHttpRsp {
 	`
 	customConfig := []byte(customConfigStr)
 	endec.Xor(customConfig, dispatchXorKey)
-	serverList := make([]*proto.RegionSimpleInfo, 0)
-	server := &proto.RegionSimpleInfo{
-		Name:        "os_usa",
-		Title:       "America",
-		Type:        "DEV_PUBLIC",
-		DispatchUrl: config.GetConfig().Hk4e.DispatchUrl,
-	}
-	serverList = append(serverList, server)
 	regionList := new(proto.QueryRegionListHttpRsp)
 	regionList.RegionList = serverList
 	regionList.ClientSecretKey = dispatchEc2bData
@@ -85,8 +76,8 @@ func GetRegionCurr(kcpAddr string, kcpPort int32, ec2b *random.Ec2b) *proto.Quer
 	return regionCurr
 }
 
-func GetRegionListBase64(ec2b *random.Ec2b) string {
-	regionList := GetRegionList(ec2b)
+func GetRegionListBase64(serverList []*proto.RegionSimpleInfo, ec2b *random.Ec2b) string {
+	regionList := GetRegionList(serverList, ec2b)
 	regionListData, err := pb.Marshal(regionList)
 	if err != nil {
 		logger.Error("pb marshal QueryRegionListHttpRsp error: %v", err)
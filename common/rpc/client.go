@@ -18,7 +18,12 @@ type DiscoveryClient struct {
 }
 
 func NewDiscoveryClient() (*DiscoveryClient, error) {
-	conn, err := nats.Connect(config.GetConfig().MQ.NatsUrl)
+	return NewDiscoveryClientByNatsUrl(config.GetConfig().MQ.NatsUrl)
+}
+
+// NewDiscoveryClientByNatsUrl 连接指定nats地址上的node 用于访问其它节点服务器集群
+func NewDiscoveryClientByNatsUrl(natsUrl string) (*DiscoveryClient, error) {
+	conn, err := nats.Connect(natsUrl)
 	if err != nil {
 		return nil, err
 	}
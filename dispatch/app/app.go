@@ -2,15 +2,21 @@ package app
 
 import (
 	"context"
+	"errors"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	"hk4e/common/config"
+	"hk4e/common/mq"
 	"hk4e/common/rpc"
 	"hk4e/dispatch/controller"
 	"hk4e/dispatch/dao"
+	"hk4e/dispatch/service"
+	"hk4e/node/api"
 	"hk4e/pkg/logger"
 )
 
@@ -32,7 +38,25 @@ func Run(ctx context.Context, configFile string) error {
 		return err
 	}
 
-	_ = controller.NewController(db, discoveryClient)
+	// 只用于向网关广播踢出玩家 dispatch不注册到节点服务器 appid只需保证唯一
+	messageQueue := mq.NewMessageQueue(api.DISPATCH, "dispatch_"+strconv.FormatInt(time.Now().UnixNano(), 10), discoveryClient)
+	if messageQueue == nil {
+		return errors.New("create message queue error")
+	}
+	defer messageQueue.Close()
+	go func() {
+		// 丢弃收到的广播消息
+		for {
+			<-messageQueue.GetNetMsg()
+		}
+	}()
+
+	svc := service.NewService(db, messageQueue)
+
+	ctrl := controller.NewController(db, discoveryClient, svc)
+	if ctrl == nil {
+		return errors.New("create controller error")
+	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
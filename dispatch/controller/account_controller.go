@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"net/http"
+
+	"hk4e/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AccountForbidReq struct {
+	Uid           uint32 `json:"uid"`
+	ForbidEndTime uint64 `json:"forbid_end_time"` // 秒时间戳
+}
+
+// 封号 在线玩家立即被踢下线
+func (c *Controller) accountForbid(context *gin.Context) {
+	accountForbidReq := new(AccountForbidReq)
+	err := context.ShouldBindJSON(accountForbidReq)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	logger.Warn("AccountForbidReq: %v", accountForbidReq)
+	ok := c.svc.ForbidUser(accountForbidReq.Uid, accountForbidReq.ForbidEndTime)
+	if !ok {
+		context.JSON(http.StatusInternalServerError, gin.H{
+			"msg": "forbid user error",
+		})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{})
+}
+
+type AccountUnForbidReq struct {
+	Uid uint32 `json:"uid"`
+}
+
+// 解封
+func (c *Controller) accountUnForbid(context *gin.Context) {
+	accountUnForbidReq := new(AccountUnForbidReq)
+	err := context.ShouldBindJSON(accountUnForbidReq)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	logger.Warn("AccountUnForbidReq: %v", accountUnForbidReq)
+	ok := c.svc.UnForbidUser(accountUnForbidReq.Uid)
+	if !ok {
+		context.JSON(http.StatusInternalServerError, gin.H{
+			"msg": "unforbid user error",
+		})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{})
+}
@@ -0,0 +1,369 @@
+package controller
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"hk4e/common/config"
+	"hk4e/dispatch/model"
+	"hk4e/pkg/email"
+	"hk4e/pkg/endec"
+	"hk4e/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 账号自助服务
+// 修改密码和绑定邮箱需要登录返回的账号token 绑定邮箱和找回密码通过邮件验证码确认
+// 修改密码和找回密码成功后账号的http登录态失效 在线玩家被踢下线
+
+const (
+	VerifyCodeTypeBindEmail     = "BindEmail"     // 绑定邮箱
+	VerifyCodeTypeResetPassword = "ResetPassword" // 找回密码
+)
+
+const (
+	VerifyCodeExpire       = time.Minute * 10 // 验证码有效期
+	VerifyCodeSendInterval = time.Minute      // 同一账号同类验证码的发送间隔
+	EmailSendTimeout       = time.Second * 10
+	DefaultEmailPoolSize   = 4
+)
+
+// 初始化smtp连接池 未配置smtp服务器时为nil
+func (c *Controller) initEmailPool() {
+	emailConfig := config.GetConfig().Email
+	if emailConfig.SmtpAddr == "" {
+		return
+	}
+	host, _, err := net.SplitHostPort(emailConfig.SmtpAddr)
+	if err != nil {
+		logger.Error("parse smtp addr error: %v", err)
+		return
+	}
+	var auth smtp.Auth = nil
+	if emailConfig.Username != "" {
+		auth = smtp.PlainAuth("", emailConfig.Username, emailConfig.Password, host)
+	}
+	poolSize := int(emailConfig.PoolSize)
+	if poolSize <= 0 {
+		poolSize = DefaultEmailPoolSize
+	}
+	pool, err := email.NewPool(emailConfig.SmtpAddr, poolSize, auth)
+	if err != nil {
+		logger.Error("create email pool error: %v", err)
+		return
+	}
+	c.emailPool = pool
+}
+
+// 发送验证码邮件
+func (c *Controller) sendVerifyCodeEmail(to string, subject string, code string) error {
+	if c.emailPool == nil {
+		return fmt.Errorf("email not config")
+	}
+	e := email.NewEmail()
+	e.From = config.GetConfig().Email.From
+	e.To = []string{to}
+	e.Subject = subject
+	e.Text = []byte(fmt.Sprintf("您的验证码为：%s\n%d分钟内有效，如非本人操作请忽略本邮件。\n", code, int(VerifyCodeExpire.Minutes())))
+	return c.emailPool.Send(e, EmailSendTimeout)
+}
+
+// 生成6位数字验证码
+func genVerifyCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// 生成并发送验证码 返回给客户端的错误信息 成功时为空
+func (c *Controller) sendVerifyCode(codeType string, accountId uint32, to string, subject string) string {
+	if c.emailPool == nil {
+		return "服务器未开启邮件发送"
+	}
+	code, err := genVerifyCode()
+	if err != nil {
+		logger.Error("gen verify code error: %v", err)
+		return "服务器内部错误"
+	}
+	ok, err := c.dao.SetAccountVerifyCode(codeType, accountId, to, code, VerifyCodeExpire, VerifyCodeSendInterval)
+	if err != nil {
+		logger.Error("set verify code error: %v", err)
+		return "服务器内部错误"
+	}
+	if !ok {
+		return "验证码发送过于频繁"
+	}
+	err = c.sendVerifyCodeEmail(to, subject, code)
+	if err != nil {
+		logger.Error("send verify code email error: %v, account id: %v", err, accountId)
+		return "验证码邮件发送失败"
+	}
+	logger.Info("send verify code, type: %v, account id: %v", codeType, accountId)
+	return ""
+}
+
+// 检查密码格式 返回给客户端的错误信息 格式正确时为空
+func checkPasswordFormat(password string) string {
+	if len(password) < 8 || len(password) > 20 {
+		return "密码为8-20位字符"
+	}
+	return ""
+}
+
+// 检查邮箱格式并转为小写
+func parseEmailAddr(addr string) (string, bool) {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil || parsed.Address != addr || len(addr) > 64 {
+		return "", false
+	}
+	return strings.ToLower(addr), true
+}
+
+// 通过账号token获取账号 token错误或过期时返回nil
+func (c *Controller) getAccountByToken(accountId uint32, token string) *model.Account {
+	if token == "" {
+		return nil
+	}
+	account, err := c.dao.QueryAccountByField("AccountID", accountId)
+	if err != nil {
+		logger.Error("query account from db error: %v", err)
+		return nil
+	}
+	if account == nil || c.getAccountToken(account.AccountID, token) == nil {
+		return nil
+	}
+	return account
+}
+
+// 保存新密码 账号登录态失效并踢下线在线玩家
+func (c *Controller) setAccountPassword(account *model.Account, password string) bool {
+	if !c.saveAccountPasswordHash(account, password) {
+		return false
+	}
+	if !c.svc.UserPasswordChange(account.PlayerID) {
+		logger.Error("user password change notify error, uid: %v", account.PlayerID)
+	}
+	logger.Warn("account password change, account id: %v", account.AccountID)
+	return true
+}
+
+func accountSelfRsp(context *gin.Context, retcode int, message string) {
+	context.JSON(http.StatusOK, gin.H{
+		"retcode": retcode,
+		"message": message,
+	})
+}
+
+type AccountPasswordChangeReq struct {
+	AccountId   uint32 `json:"account_id"`
+	Token       string `json:"token"`
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// 修改密码
+func (c *Controller) accountPasswordChange(context *gin.Context) {
+	req := new(AccountPasswordChangeReq)
+	err := context.ShouldBindJSON(req)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		accountSelfRsp(context, -1, "参数错误")
+		return
+	}
+	account := c.getAccountByToken(req.AccountId, req.Token)
+	if account == nil {
+		accountSelfRsp(context, -111, "登录已失效")
+		return
+	}
+	if msg := checkPasswordFormat(req.NewPassword); msg != "" {
+		accountSelfRsp(context, -201, msg)
+		return
+	}
+	if !endec.PasswordVerify(req.OldPassword, account.PasswordAlgo, account.Password) {
+		accountSelfRsp(context, -201, "原密码错误")
+		return
+	}
+	if !c.setAccountPassword(account, req.NewPassword) {
+		accountSelfRsp(context, -201, "服务器内部错误")
+		return
+	}
+	accountSelfRsp(context, 0, "OK")
+}
+
+type AccountBindEmailCodeReq struct {
+	AccountId uint32 `json:"account_id"`
+	Token     string `json:"token"`
+	Email     string `json:"email"`
+}
+
+// 发送绑定邮箱的验证码
+func (c *Controller) accountBindEmailCode(context *gin.Context) {
+	req := new(AccountBindEmailCodeReq)
+	err := context.ShouldBindJSON(req)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		accountSelfRsp(context, -1, "参数错误")
+		return
+	}
+	account := c.getAccountByToken(req.AccountId, req.Token)
+	if account == nil {
+		accountSelfRsp(context, -111, "登录已失效")
+		return
+	}
+	addr, ok := parseEmailAddr(req.Email)
+	if !ok {
+		accountSelfRsp(context, -201, "邮箱格式错误")
+		return
+	}
+	if msg := c.sendVerifyCode(VerifyCodeTypeBindEmail, account.AccountID, addr, "绑定邮箱验证码"); msg != "" {
+		accountSelfRsp(context, -201, msg)
+		return
+	}
+	accountSelfRsp(context, 0, "OK")
+}
+
+type AccountBindEmailReq struct {
+	AccountId uint32 `json:"account_id"`
+	Token     string `json:"token"`
+	Email     string `json:"email"`
+	Code      string `json:"code"`
+}
+
+// 使用验证码绑定邮箱
+func (c *Controller) accountBindEmail(context *gin.Context) {
+	req := new(AccountBindEmailReq)
+	err := context.ShouldBindJSON(req)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		accountSelfRsp(context, -1, "参数错误")
+		return
+	}
+	account := c.getAccountByToken(req.AccountId, req.Token)
+	if account == nil {
+		accountSelfRsp(context, -111, "登录已失效")
+		return
+	}
+	addr, ok := parseEmailAddr(req.Email)
+	if !ok {
+		accountSelfRsp(context, -201, "邮箱格式错误")
+		return
+	}
+	ok, err = c.dao.CheckAccountVerifyCode(VerifyCodeTypeBindEmail, account.AccountID, addr, req.Code)
+	if err != nil {
+		logger.Error("check verify code error: %v", err)
+		accountSelfRsp(context, -201, "服务器内部错误")
+		return
+	}
+	if !ok {
+		accountSelfRsp(context, -201, "验证码错误或已过期")
+		return
+	}
+	_, err = c.dao.UpdateAccountFieldByFieldName("AccountID", account.AccountID, "Email", addr)
+	if err != nil {
+		logger.Error("update account email error: %v", err)
+		accountSelfRsp(context, -201, "服务器内部错误")
+		return
+	}
+	logger.Info("account bind email, account id: %v", account.AccountID)
+	accountSelfRsp(context, 0, "OK")
+}
+
+type AccountResetPasswordCodeReq struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// 发送找回密码的验证码到账号绑定的邮箱
+func (c *Controller) accountResetPasswordCode(context *gin.Context) {
+	req := new(AccountResetPasswordCodeReq)
+	err := context.ShouldBindJSON(req)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		accountSelfRsp(context, -1, "参数错误")
+		return
+	}
+	addr, ok := parseEmailAddr(req.Email)
+	if !ok {
+		accountSelfRsp(context, -201, "邮箱格式错误")
+		return
+	}
+	if c.emailPool == nil {
+		accountSelfRsp(context, -201, "服务器未开启邮件发送")
+		return
+	}
+	account, err := c.dao.QueryAccountByField("Username", req.Username)
+	if err != nil {
+		logger.Error("query account from db error: %v", err)
+		accountSelfRsp(context, -201, "服务器内部错误")
+		return
+	}
+	// 不论账号和邮箱是否匹配都返回相同的结果 避免通过该接口探测账号绑定的邮箱
+	if account != nil && account.Email != "" && account.Email == addr {
+		if msg := c.sendVerifyCode(VerifyCodeTypeResetPassword, account.AccountID, addr, "找回密码验证码"); msg != "" {
+			logger.Error("send reset password verify code fail: %v, account id: %v", msg, account.AccountID)
+		}
+	}
+	accountSelfRsp(context, 0, "如果账号绑定了该邮箱 验证码已发送到该邮箱")
+}
+
+type AccountResetPasswordReq struct {
+	Username    string `json:"username"`
+	Email       string `json:"email"`
+	Code        string `json:"code"`
+	NewPassword string `json:"new_password"`
+}
+
+// 使用验证码重置密码
+func (c *Controller) accountResetPassword(context *gin.Context) {
+	req := new(AccountResetPasswordReq)
+	err := context.ShouldBindJSON(req)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		accountSelfRsp(context, -1, "参数错误")
+		return
+	}
+	if msg := checkPasswordFormat(req.NewPassword); msg != "" {
+		accountSelfRsp(context, -201, msg)
+		return
+	}
+	addr, ok := parseEmailAddr(req.Email)
+	if !ok {
+		accountSelfRsp(context, -201, "邮箱格式错误")
+		return
+	}
+	account, err := c.dao.QueryAccountByField("Username", req.Username)
+	if err != nil {
+		logger.Error("query account from db error: %v", err)
+		accountSelfRsp(context, -201, "服务器内部错误")
+		return
+	}
+	if account == nil || account.Email != addr {
+		accountSelfRsp(context, -201, "验证码错误或已过期")
+		return
+	}
+	ok, err = c.dao.CheckAccountVerifyCode(VerifyCodeTypeResetPassword, account.AccountID, addr, req.Code)
+	if err != nil {
+		logger.Error("check verify code error: %v", err)
+		accountSelfRsp(context, -201, "服务器内部错误")
+		return
+	}
+	if !ok {
+		accountSelfRsp(context, -201, "验证码错误或已过期")
+		return
+	}
+	if !c.setAccountPassword(account, req.NewPassword) {
+		accountSelfRsp(context, -201, "服务器内部错误")
+		return
+	}
+	accountSelfRsp(context, 0, "OK")
+}
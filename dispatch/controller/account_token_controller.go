@@ -0,0 +1,318 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"time"
+
+	"hk4e/common/config"
+	"hk4e/dispatch/dao"
+	"hk4e/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 账号登录态管理
+// 账号密码登录为当前设备签发账号token 同一账号可以在多个设备同时保持登录 同一设备重新登录时原先的token失效
+// 账号token用于token登录和换取combo token combo token用于登录网关 网关在会话恢复时重新校验combo token
+// 用户可以刷新当前设备的token 退出当前设备或全部设备 运维可以查看和吊销玩家的设备登录态
+
+const (
+	DefaultTokenTtl      = 60 * 60 * 24 * 7 // 账号token默认有效期 秒
+	DefaultComboTokenTtl = 60 * 60 * 24     // combo token默认有效期 秒
+	DefaultMaxDevice     = 5
+	DefaultDeviceId      = "default" // 客户端没有携带设备id时使用
+	DeviceIdMaxLen       = 64
+)
+
+func getTokenTtl() time.Duration {
+	ttl := config.GetConfig().Dispatch.Token.TokenTtl
+	if ttl <= 0 {
+		ttl = DefaultTokenTtl
+	}
+	return time.Second * time.Duration(ttl)
+}
+
+func getComboTokenTtl() time.Duration {
+	ttl := config.GetConfig().Dispatch.Token.ComboTokenTtl
+	if ttl <= 0 {
+		ttl = DefaultComboTokenTtl
+	}
+	return time.Second * time.Duration(ttl)
+}
+
+func getMaxDevice() int {
+	maxDevice := config.GetConfig().Dispatch.Token.MaxDevice
+	if maxDevice <= 0 {
+		maxDevice = DefaultMaxDevice
+	}
+	return int(maxDevice)
+}
+
+// 请求头中的设备id
+func getDeviceId(context *gin.Context) string {
+	deviceId := context.GetHeader("x-rpc-device_id")
+	if deviceId == "" {
+		return DefaultDeviceId
+	}
+	if len(deviceId) > DeviceIdMaxLen {
+		deviceId = deviceId[:DeviceIdMaxLen]
+	}
+	return deviceId
+}
+
+// 为账号的当前设备签发新的账号token 该设备原先的token和combo token失效 失败时返回nil
+func (c *Controller) newAccountToken(accountId uint32, deviceId string, ip string) *dao.AccountToken {
+	data := make([]byte, 24)
+	_, err := rand.Read(data)
+	if err != nil {
+		logger.Error("gen token error: %v", err)
+		return nil
+	}
+	now := time.Now()
+	accountToken := &dao.AccountToken{
+		AccountId:   accountId,
+		DeviceId:    deviceId,
+		Token:       base64.StdEncoding.EncodeToString(data),
+		ComboToken:  "",
+		Ip:          ip,
+		CreateTime:  now.Unix(),
+		RefreshTime: now.Unix(),
+		ExpireTime:  now.Add(getTokenTtl()).Unix(),
+	}
+	err = c.dao.SaveAccountToken(accountToken, getTokenTtl(), getComboTokenTtl(), getMaxDevice())
+	if err != nil {
+		logger.Error("save account token error: %v, account id: %v", err, accountId)
+		return nil
+	}
+	return accountToken
+}
+
+// 为设备会话签发新的combo token 原先的combo token失效 失败时返回空
+func (c *Controller) newAccountComboToken(accountToken *dao.AccountToken) string {
+	accountToken.ComboToken = randomHexStr(20)
+	accountToken.RefreshTime = time.Now().Unix()
+	err := c.dao.SaveAccountToken(accountToken, getTokenTtl(), getComboTokenTtl(), 0)
+	if err != nil {
+		logger.Error("save account token error: %v, account id: %v", err, accountToken.AccountId)
+		return ""
+	}
+	return accountToken.ComboToken
+}
+
+// 校验账号token 返回对应的设备会话 token错误或过期时返回nil
+func (c *Controller) getAccountToken(accountId uint32, token string) *dao.AccountToken {
+	accountToken, err := c.dao.GetAccountTokenByToken(token)
+	if err != nil {
+		logger.Error("get account token error: %v", err)
+		return nil
+	}
+	if accountToken == nil || accountToken.AccountId != accountId {
+		return nil
+	}
+	return accountToken
+}
+
+type AccountTokenReq struct {
+	AccountId uint32 `json:"account_id"`
+	Token     string `json:"token"`
+}
+
+// 刷新当前设备的账号token 原先的token失效
+func (c *Controller) accountTokenRefresh(context *gin.Context) {
+	req := new(AccountTokenReq)
+	err := context.ShouldBindJSON(req)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		accountSelfRsp(context, -1, "参数错误")
+		return
+	}
+	accountToken := c.getAccountToken(req.AccountId, req.Token)
+	if accountToken == nil {
+		accountSelfRsp(context, -100, "登录已失效")
+		return
+	}
+	newAccountToken := c.newAccountToken(accountToken.AccountId, accountToken.DeviceId, getClientIp(context))
+	if newAccountToken == nil {
+		accountSelfRsp(context, -1, "服务器内部错误")
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{
+		"retcode": 0,
+		"message": "OK",
+		"data": gin.H{
+			"token":       newAccountToken.Token,
+			"expire_time": newAccountToken.ExpireTime,
+		},
+	})
+}
+
+// 查看账号全部设备的登录态
+func (c *Controller) accountTokenSelfList(context *gin.Context) {
+	req := new(AccountTokenReq)
+	err := context.ShouldBindJSON(req)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		accountSelfRsp(context, -1, "参数错误")
+		return
+	}
+	accountToken := c.getAccountToken(req.AccountId, req.Token)
+	if accountToken == nil {
+		accountSelfRsp(context, -100, "登录已失效")
+		return
+	}
+	accountTokenList, err := c.dao.ListAccountToken(accountToken.AccountId)
+	if err != nil {
+		logger.Error("list account token error: %v", err)
+		accountSelfRsp(context, -1, "服务器内部错误")
+		return
+	}
+	deviceList := make([]gin.H, 0, len(accountTokenList))
+	for _, item := range accountTokenList {
+		deviceList = append(deviceList, gin.H{
+			"device_id":   item.DeviceId,
+			"ip":          item.Ip,
+			"create_time": item.CreateTime,
+			"current":     item.DeviceId == accountToken.DeviceId,
+		})
+	}
+	context.JSON(http.StatusOK, gin.H{
+		"retcode": 0,
+		"message": "OK",
+		"data": gin.H{
+			"device_list": deviceList,
+		},
+	})
+}
+
+type AccountLogoutReq struct {
+	AccountId uint32 `json:"account_id"`
+	Token     string `json:"token"`
+	All       bool   `json:"all"` // 退出全部设备 在线玩家被踢下线
+}
+
+// 退出登录
+func (c *Controller) accountLogout(context *gin.Context) {
+	req := new(AccountLogoutReq)
+	err := context.ShouldBindJSON(req)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		accountSelfRsp(context, -1, "参数错误")
+		return
+	}
+	accountToken := c.getAccountToken(req.AccountId, req.Token)
+	if accountToken == nil {
+		accountSelfRsp(context, -100, "登录已失效")
+		return
+	}
+	if req.All {
+		account, err := c.dao.QueryAccountByField("AccountID", accountToken.AccountId)
+		if err != nil || account == nil {
+			logger.Error("query account from db error: %v, account id: %v", err, accountToken.AccountId)
+			accountSelfRsp(context, -1, "服务器内部错误")
+			return
+		}
+		if !c.svc.LogoutUser(account.PlayerID) {
+			accountSelfRsp(context, -1, "服务器内部错误")
+			return
+		}
+		logger.Warn("account logout all device, account id: %v", accountToken.AccountId)
+		accountSelfRsp(context, 0, "OK")
+		return
+	}
+	err = c.dao.RevokeAccountToken(accountToken.AccountId, accountToken.DeviceId)
+	if err != nil {
+		logger.Error("revoke account token error: %v", err)
+		accountSelfRsp(context, -1, "服务器内部错误")
+		return
+	}
+	logger.Info("account logout, account id: %v, device id: %v", accountToken.AccountId, accountToken.DeviceId)
+	accountSelfRsp(context, 0, "OK")
+}
+
+// 查看玩家账号全部设备的登录态
+func (c *Controller) accountTokenList(context *gin.Context) {
+	uid, err := strconv.ParseUint(context.Query("uid"), 10, 32)
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": "invalid uid",
+		})
+		return
+	}
+	account, err := c.dao.QueryAccountByField("PlayerID", uint32(uid))
+	if err != nil || account == nil {
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": "account not found",
+		})
+		return
+	}
+	accountTokenList, err := c.dao.ListAccountToken(account.AccountID)
+	if err != nil {
+		logger.Error("list account token error: %v", err)
+		context.JSON(http.StatusInternalServerError, gin.H{
+			"msg": "list account token error",
+		})
+		return
+	}
+	deviceList := make([]gin.H, 0, len(accountTokenList))
+	for _, item := range accountTokenList {
+		deviceList = append(deviceList, gin.H{
+			"device_id":    item.DeviceId,
+			"ip":           item.Ip,
+			"create_time":  item.CreateTime,
+			"refresh_time": item.RefreshTime,
+			"expire_time":  item.ExpireTime,
+		})
+	}
+	context.JSON(http.StatusOK, gin.H{
+		"account_id":  account.AccountID,
+		"device_list": deviceList,
+	})
+}
+
+type AccountTokenRevokeReq struct {
+	Uid      uint32 `json:"uid"`
+	DeviceId string `json:"device_id"` // 为空时吊销全部设备并踢下线在线玩家
+}
+
+// 吊销玩家账号的登录态
+func (c *Controller) accountTokenRevoke(context *gin.Context) {
+	req := new(AccountTokenRevokeReq)
+	err := context.ShouldBindJSON(req)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	logger.Warn("AccountTokenRevokeReq: %v", req)
+	if req.DeviceId == "" {
+		if !c.svc.LogoutUser(req.Uid) {
+			context.JSON(http.StatusInternalServerError, gin.H{
+				"msg": "revoke account token error",
+			})
+			return
+		}
+		context.JSON(http.StatusOK, gin.H{})
+		return
+	}
+	account, err := c.dao.QueryAccountByField("PlayerID", req.Uid)
+	if err != nil || account == nil {
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": "account not found",
+		})
+		return
+	}
+	err = c.dao.RevokeAccountToken(account.AccountID, req.DeviceId)
+	if err != nil {
+		logger.Error("revoke account token error: %v", err)
+		context.JSON(http.StatusInternalServerError, gin.H{
+			"msg": "revoke account token error",
+		})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{})
+}
@@ -25,6 +25,12 @@ func (c *Controller) postCompareProtocolVersion(context *gin.Context) {
 // POST https://api-account-os.hoyoverse.com/account/risky/api/check? HTTP/1.1
 // POST https://api-account-os.hoyoverse.com/account/risky/api/check HTTP/1.1
 func (c *Controller) check(context *gin.Context) {
+	// 登录失败次数过多的ip需要完成geetest验证
+	if c.loginProtectNeedGeetest(0, getClientIp(context)) {
+		if c.geetestRequiredRsp(context, 0, "OK") {
+			return
+		}
+	}
 	context.Header("Content-type", "application/json")
 	if strings.Contains(context.Request.RequestURI, "?") {
 		// Windows
@@ -165,7 +171,12 @@ func (c *Controller) gtGet(context *gin.Context) {
 	if len(callback) == 0 {
 		_, _ = context.Writer.WriteString("({\"status\": \"success\", \"data\": {\"theme\": \"wind\", \"theme_version\": \"1.5.8\", \"static_servers\": [\"static.geetest.com\", \"dn-staticdown.qbox.me\"], \"api_server\": \"api-na.geetest.com\", \"logo\": false, \"feedback\": \"\", \"c\": [12, 58, 98, 36, 43, 95, 62, 15, 12], \"s\": \"4958632c\", \"i18n_labels\": {\"copyright\": \"\\u7531\\u6781\\u9a8c\\u63d0\\u4f9b\\u6280\\u672f\\u652f\\u6301\", \"error\": \"\\u7f51\\u7edc\\u4e0d\\u7ed9\\u529b\", \"error_content\": \"\\u8bf7\\u70b9\\u51fb\\u6b64\\u5904\\u91cd\\u8bd5\", \"error_title\": \"\\u7f51\\u7edc\\u8d85\\u65f6\", \"fullpage\": \"\\u667a\\u80fd\\u68c0\\u6d4b\\u4e2d\", \"goto_cancel\": \"\\u53d6\\u6d88\", \"goto_confirm\": \"\\u524d\\u5f80\", \"goto_homepage\": \"\\u662f\\u5426\\u524d\\u5f80\\u9a8c\\u8bc1\\u670d\\u52a1Geetest\\u5b98\\u7f51\", \"loading_content\": \"\\u667a\\u80fd\\u9a8c\\u8bc1\\u68c0\\u6d4b\\u4e2d\", \"next\": \"\\u6b63\\u5728\\u52a0\\u8f7d\\u9a8c\\u8bc1\", \"next_ready\": \"\\u8bf7\\u5b8c\\u6210\\u9a8c\\u8bc1\", \"read_reversed\": false, \"ready\": \"\\u70b9\\u51fb\\u6309\\u94ae\\u8fdb\\u884c\\u9a8c\\u8bc1\", \"refresh_page\": \"\\u9875\\u9762\\u51fa\\u73b0\\u9519\\u8bef\\u5566\\uff01\\u8981\\u7ee7\\u7eed\\u64cd\\u4f5c\\uff0c\\u8bf7\\u5237\\u65b0\\u6b64\\u9875\\u9762\", \"reset\": \"\\u8bf7\\u70b9\\u51fb\\u91cd\\u8bd5\", \"success\": \"\\u9a8c\\u8bc1\\u6210\\u529f\", \"success_title\": \"\\u901a\\u8fc7\\u9a8c\\u8bc1\"}}})")
 	} else {
-		_, _ = context.Writer.WriteString(callback + "({\"gt\": \"16bddce04c7385dbb7282778c29bba3e\", \"challenge\": \"616018607b6940f52fbd349004038686is\", \"id\": \"a616018607b6940f52fbd349004038686\", \"bg\": \"pictures/gt/a330cf996/bg/86f9db021.jpg\", \"fullbg\": \"pictures/gt/a330cf996/a330cf996.jpg\", \"link\": \"\", \"ypos\": 56, \"xpos\": 0, \"height\": 160, \"slice\": \"pictures/gt/a330cf996/slice/86f9db021.png\", \"api_server\": \"https://api-na.geetest.com/\", \"static_servers\": [\"static.geetest.com/\", \"dn-staticdown.qbox.me/\"], \"mobile\": true, \"theme\": \"ant\", \"theme_version\": \"1.2.6\", \"template\": \"\", \"logo\": false, \"clean\": false, \"type\": \"multilink\", \"fullpage\": false, \"feedback\": \"\", \"show_delay\": 250, \"hide_delay\": 800, \"benchmark\": false, \"version\": \"6.0.9\", \"product\": \"embed\", \"https\": true, \"width\": \"100%\", \"c\": [12, 58, 98, 36, 43, 95, 62, 15, 12], \"s\": \"6c722c65\", \"so\": 0, \"i18n_labels\": {\"cancel\": \"\\u53d6\\u6d88\", \"close\": \"\\u5173\\u95ed\\u9a8c\\u8bc1\", \"error\": \"\\u8bf7\\u91cd\\u8bd5\", \"fail\": \"\\u8bf7\\u6b63\\u786e\\u62fc\\u5408\\u56fe\\u50cf\", \"feedback\": \"\\u5e2e\\u52a9\\u53cd\\u9988\", \"forbidden\": \"\\u602a\\u7269\\u5403\\u4e86\\u62fc\\u56fe\\uff0c\\u8bf7\\u91cd\\u8bd5\", \"loading\": \"\\u52a0\\u8f7d\\u4e2d...\", \"logo\": \"\\u7531\\u6781\\u9a8c\\u63d0\\u4f9b\\u6280\\u672f\\u652f\\u6301\", \"read_reversed\": false, \"refresh\": \"\\u5237\\u65b0\\u9a8c\\u8bc1\", \"slide\": \"\\u62d6\\u52a8\\u6ed1\\u5757\\u5b8c\\u6210\\u62fc\\u56fe\", \"success\": \"sec \\u79d2\\u7684\\u901f\\u5ea6\\u8d85\\u8fc7 score% \\u7684\\u7528\\u6237\", \"tip\": \"\\u8bf7\\u5b8c\\u6210\\u4e0b\\u65b9\\u9a8c\\u8bc1\", \"voice\": \"\\u89c6\\u89c9\\u969c\\u788d\"}, \"gct_path\": \"/static/js/gct.e7810b5b525994e2fb1f89135f8df14a.js\"})")
+		// 使用风险检查下发的challenge
+		challenge := parseGeetestChallenge(context.Query("challenge"))
+		if challenge == "" {
+			challenge = GeetestStubChallenge
+		}
+		_, _ = context.Writer.WriteString(callback + "({\"gt\": \"16bddce04c7385dbb7282778c29bba3e\", \"challenge\": \"" + challenge + "is\", \"id\": \"a616018607b6940f52fbd349004038686\", \"bg\": \"pictures/gt/a330cf996/bg/86f9db021.jpg\", \"fullbg\": \"pictures/gt/a330cf996/a330cf996.jpg\", \"link\": \"\", \"ypos\": 56, \"xpos\": 0, \"height\": 160, \"slice\": \"pictures/gt/a330cf996/slice/86f9db021.png\", \"api_server\": \"https://api-na.geetest.com/\", \"static_servers\": [\"static.geetest.com/\", \"dn-staticdown.qbox.me/\"], \"mobile\": true, \"theme\": \"ant\", \"theme_version\": \"1.2.6\", \"template\": \"\", \"logo\": false, \"clean\": false, \"type\": \"multilink\", \"fullpage\": false, \"feedback\": \"\", \"show_delay\": 250, \"hide_delay\": 800, \"benchmark\": false, \"version\": \"6.0.9\", \"product\": \"embed\", \"https\": true, \"width\": \"100%\", \"c\": [12, 58, 98, 36, 43, 95, 62, 15, 12], \"s\": \"6c722c65\", \"so\": 0, \"i18n_labels\": {\"cancel\": \"\\u53d6\\u6d88\", \"close\": \"\\u5173\\u95ed\\u9a8c\\u8bc1\", \"error\": \"\\u8bf7\\u91cd\\u8bd5\", \"fail\": \"\\u8bf7\\u6b63\\u786e\\u62fc\\u5408\\u56fe\\u50cf\", \"feedback\": \"\\u5e2e\\u52a9\\u53cd\\u9988\", \"forbidden\": \"\\u602a\\u7269\\u5403\\u4e86\\u62fc\\u56fe\\uff0c\\u8bf7\\u91cd\\u8bd5\", \"loading\": \"\\u52a0\\u8f7d\\u4e2d...\", \"logo\": \"\\u7531\\u6781\\u9a8c\\u63d0\\u4f9b\\u6280\\u672f\\u652f\\u6301\", \"read_reversed\": false, \"refresh\": \"\\u5237\\u65b0\\u9a8c\\u8bc1\", \"slide\": \"\\u62d6\\u52a8\\u6ed1\\u5757\\u5b8c\\u6210\\u62fc\\u56fe\", \"success\": \"sec \\u79d2\\u7684\\u901f\\u5ea6\\u8d85\\u8fc7 score% \\u7684\\u7528\\u6237\", \"tip\": \"\\u8bf7\\u5b8c\\u6210\\u4e0b\\u65b9\\u9a8c\\u8bc1\", \"voice\": \"\\u89c6\\u89c9\\u969c\\u788d\"}, \"gct_path\": \"/static/js/gct.e7810b5b525994e2fb1f89135f8df14a.js\"})")
 	}
 }
 
@@ -177,6 +188,11 @@ func (c *Controller) gtAjax(context *gin.Context) {
 	if len(callback) == 0 {
 		_, _ = context.Writer.WriteString("{\"status\": \"success\", \"data\": {\"result\": \"slide\"}}")
 	} else {
-		_, _ = context.Writer.WriteString(callback + "({\"success\": 1, \"message\": \"success\", \"validate\": \"af90d1ba691970f759a3c60c908c1499\", \"score\": \"1\"})")
+		// 风险检查下发的challenge生成validate 登录时校验
+		validate := c.passGeetestChallenge(context.Query("challenge"))
+		if validate == "" {
+			validate = "af90d1ba691970f759a3c60c908c1499"
+		}
+		_, _ = context.Writer.WriteString(callback + "({\"success\": 1, \"message\": \"success\", \"validate\": \"" + validate + "\", \"score\": \"1\"})")
 	}
 }
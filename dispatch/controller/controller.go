@@ -1,72 +1,58 @@
 package controller
 
 import (
-	"context"
-	"net"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
 	"hk4e/common/config"
+	"hk4e/common/httpauth"
 	"hk4e/common/region"
 	"hk4e/common/rpc"
 	"hk4e/dispatch/dao"
-	"hk4e/node/api"
+	"hk4e/dispatch/service"
+	"hk4e/pkg/email"
 	"hk4e/pkg/logger"
-	"hk4e/pkg/random"
 
 	"github.com/gin-gonic/gin"
 )
 
 type Controller struct {
-	dao          *dao.Dao
-	discovery    *rpc.DiscoveryClient
-	signRsaKey   []byte
-	encRsaKeyMap map[string][]byte
-	pwdRsaKey    []byte
-	ec2b         *random.Ec2b
+	dao           *dao.Dao
+	discovery     *rpc.DiscoveryClient
+	svc           *service.Service
+	signRsaKey    []byte
+	encRsaKeyMap  map[string][]byte
+	pwdRsaKey     []byte
+	regionList    []*regionState // 第一个为默认区服
+	regionMap     map[string]*regionState
+	regionNodeMap map[string]*regionNode // 各区服集群的连接 key:natsUrl 每个集群只创建一次 只在初始化和同步协程中访问
+	regionLock    sync.RWMutex
+	emailPool     *email.Pool // 验证码邮件发送 未配置smtp服务器时为nil
 }
 
-func NewController(dao *dao.Dao, discovery *rpc.DiscoveryClient) (r *Controller) {
+func NewController(dao *dao.Dao, discovery *rpc.DiscoveryClient, svc *service.Service) (r *Controller) {
 	r = new(Controller)
 	r.dao = dao
 	r.discovery = discovery
+	r.svc = svc
 	r.signRsaKey, r.encRsaKeyMap, r.pwdRsaKey = region.LoadRsaKey()
-	rsp, err := r.discovery.GetRegionEc2B(context.TODO(), &api.NullMsg{})
+	err := r.initRegion()
 	if err != nil {
-		logger.Error("get region ec2b error: %v", err)
 		return nil
 	}
-	ec2b, err := random.LoadEc2bKey(rsp.Data)
-	if err != nil {
-		logger.Error("parse region ec2b error: %v", err)
-		return nil
-	}
-	r.ec2b = ec2b
+	r.initEmailPool()
+	go r.autoSyncRegionEc2b()
 	go r.registerRouter()
 	return r
 }
 
-func (c *Controller) authorize() gin.HandlerFunc {
-	return func(context *gin.Context) {
-		addr := context.ClientIP()
-		if addr == "" {
-			addr = context.Request.RemoteAddr
-		}
-		ip := net.ParseIP(addr)
-		ipv4 := ip.To4()
-		if ip.IsLoopback() ||
-			ipv4[0] == 10 ||
-			ipv4[0] == 169 && ipv4[1] == 254 ||
-			ipv4[0] == 172 && ipv4[1] >= 16 && ipv4[1] <= 31 ||
-			ipv4[0] == 192 && ipv4[1] == 168 {
-			context.Next()
-			return
-		}
-		context.Abort()
-		context.JSON(http.StatusOK, gin.H{
-			"code": "10001",
-			"msg":  "没有访问权限",
-		})
+func (c *Controller) autoSyncRegionEc2b() {
+	ticker := time.NewTicker(time.Second * 60)
+	for {
+		<-ticker.C
+		c.syncRegionEc2b()
 	}
 }
 
@@ -93,6 +79,7 @@ func (c *Controller) registerRouter() {
 		engine.GET("/query_region_list", c.queryRegionList)
 		// osusadispatch.yuanshen.com
 		engine.GET("/query_cur_region", c.queryCurRegion)
+		engine.GET("/query_cur_region/:region", c.queryCurRegion)
 	}
 	{
 		// 登录
@@ -104,6 +91,21 @@ func (c *Controller) registerRouter() {
 		// 获取combo token
 		engine.POST("/hk4e_:name/combo/granter/login/v2/login", c.v2Login)
 	}
+	{
+		// 账号自助服务
+		// 修改密码
+		engine.POST("/account/self/password/change", c.accountPasswordChange)
+		// 绑定邮箱
+		engine.POST("/account/self/email/bind/code", c.accountBindEmailCode)
+		engine.POST("/account/self/email/bind", c.accountBindEmail)
+		// 找回密码
+		engine.POST("/account/self/password/reset/code", c.accountResetPasswordCode)
+		engine.POST("/account/self/password/reset", c.accountResetPassword)
+		// 登录态
+		engine.POST("/account/self/token/refresh", c.accountTokenRefresh)
+		engine.POST("/account/self/token/list", c.accountTokenSelfList)
+		engine.POST("/account/self/logout", c.accountLogout)
+	}
 	{
 		// 日志
 		engine.POST("/sdk/dataUpload", c.sdkDataUpload)
@@ -163,8 +165,16 @@ func (c *Controller) registerRouter() {
 		engine.StaticFS("/static", http.Dir("./static/geetest/static"))
 		engine.StaticFS("/pictures", http.Dir("./static/geetest/pictures"))
 	}
-	engine.Use(c.authorize())
+	httpauth.WarnIfNoTrustedProxy()
+	engine.Use(httpauth.Authorize())
 	engine.POST("/gate/token/verify", c.gateTokenVerify)
+	engine.POST("/account/forbid", c.accountForbid)
+	engine.POST("/account/unforbid", c.accountUnForbid)
+	engine.GET("/login/lock/list", c.loginLockList)
+	engine.POST("/login/lock/clear", c.loginLockClear)
+	engine.GET("/account/token/list", c.accountTokenList)
+	engine.POST("/account/token/revoke", c.accountTokenRevoke)
+	engine.GET("/region/list", c.regionInfoList)
 	port := config.GetConfig().HttpPort
 	addr := ":" + strconv.Itoa(int(port))
 	err := engine.Run(addr)
@@ -32,7 +32,7 @@ func (c *Controller) querySecurityFile(context *gin.Context) {
 
 func (c *Controller) queryRegionList(context *gin.Context) {
 	context.Header("Content-type", "text/html; charset=UTF-8")
-	regionListBase64 := region.GetRegionListBase64(c.ec2b)
+	regionListBase64 := region.GetRegionListBase64(c.getRegionSimpleInfoList(), c.getRegionEc2b(c.getRegion("")))
 	_, _ = context.Writer.WriteString(regionListBase64)
 }
 
@@ -86,15 +86,29 @@ func (c *Controller) queryCurRegion(context *gin.Context) {
 		rspError()
 		return
 	}
-	addr, err := c.discovery.GetGateServerAddr(context.Request.Context(), &api.GetGateServerAddrReq{
+	regionState := c.getRegion(context.Param("region"))
+	if regionState == nil {
+		logger.Error("region not found: %v", context.Param("region"))
+		rspError()
+		return
+	}
+	// 区服集群未连接或密钥未同步时区服不可用
+	discovery := c.getRegionDiscovery(regionState)
+	ec2b := c.getRegionEc2b(regionState)
+	if discovery == nil || ec2b == nil {
+		logger.Error("region not available: %v", regionState.config.Name)
+		rspError()
+		return
+	}
+	addr, err := discovery.GetGateServerAddr(context.Request.Context(), &api.GetGateServerAddrReq{
 		Version: versionStr,
 	})
 	if err != nil {
-		logger.Error("get gate server addr error: %v", err)
+		logger.Error("get gate server addr error: %v, region: %v", err, regionState.config.Name)
 		rspError()
 		return
 	}
-	regionCurrBase64 := region.GetRegionCurrBase64(addr.KcpAddr, int32(addr.KcpPort), c.ec2b)
+	regionCurrBase64 := region.GetRegionCurrBase64(addr.KcpAddr, int32(addr.KcpPort), ec2b)
 	if version < 275 {
 		context.Header("Content-type", "text/html; charset=UTF-8")
 		_, _ = context.Writer.WriteString(regionCurrBase64)
@@ -3,35 +3,23 @@ package controller
 import (
 	"net/http"
 	"strconv"
-	"time"
 
+	"hk4e/common/dispatchapi"
 	"hk4e/pkg/logger"
 
 	"github.com/gin-gonic/gin"
 )
 
-type TokenVerifyReq struct {
-	AccountId    string `json:"accountId"`
-	AccountToken string `json:"accountToken"`
-}
-
-type TokenVerifyRsp struct {
-	Valid         bool   `json:"valid"`
-	Forbid        bool   `json:"forbid"`
-	ForbidEndTime uint32 `json:"forbidEndTime"`
-	PlayerID      uint32 `json:"playerID"`
-}
-
 func (c *Controller) gateTokenVerify(context *gin.Context) {
 	verifyFail := func(playerID uint32) {
-		context.JSON(http.StatusOK, &TokenVerifyRsp{
+		context.JSON(http.StatusOK, &dispatchapi.TokenVerifyRsp{
 			Valid:         false,
 			Forbid:        false,
 			ForbidEndTime: 0,
 			PlayerID:      playerID,
 		})
 	}
-	tokenVerifyReq := new(TokenVerifyReq)
+	tokenVerifyReq := new(dispatchapi.TokenVerifyReq)
 	err := context.ShouldBindJSON(tokenVerifyReq)
 	if err != nil {
 		verifyFail(0)
@@ -48,18 +36,21 @@ func (c *Controller) gateTokenVerify(context *gin.Context) {
 		verifyFail(0)
 		return
 	}
-	if tokenVerifyReq.AccountToken != account.ComboToken {
+	accountToken, err := c.dao.GetAccountTokenByComboToken(tokenVerifyReq.AccountToken)
+	if err != nil {
+		logger.Error("get account combo token error: %v", err)
 		verifyFail(account.PlayerID)
 		return
 	}
-	if time.Now().UnixMilli()-int64(account.ComboTokenCreateTime) > time.Hour.Milliseconds()*24 {
+	if accountToken == nil || accountToken.AccountId != account.AccountID {
 		verifyFail(account.PlayerID)
 		return
 	}
-	context.JSON(http.StatusOK, &TokenVerifyRsp{
+	context.JSON(http.StatusOK, &dispatchapi.TokenVerifyRsp{
 		Valid:         true,
 		Forbid:        account.Forbid,
 		ForbidEndTime: account.ForbidEndTime,
 		PlayerID:      account.PlayerID,
+		ClientVersion: accountToken.ClientVersion,
 	})
 }
@@ -7,13 +7,12 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
 	"hk4e/dispatch/api"
+	"hk4e/dispatch/dao"
 	"hk4e/dispatch/model"
 	"hk4e/pkg/endec"
 	"hk4e/pkg/logger"
-	"hk4e/pkg/random"
 
 	"github.com/gin-gonic/gin"
 )
@@ -48,6 +47,13 @@ func (c *Controller) apiLogin(context *gin.Context) {
 	}
 
 	responseData := api.NewLoginResult()
+	ip := getClientIp(context)
+	if msg := c.loginProtectCheckIp(ip); msg != "" {
+		responseData.Retcode = -201
+		responseData.Message = msg
+		context.JSON(http.StatusOK, responseData)
+		return
+	}
 
 	var username string
 	var password string
@@ -97,6 +103,20 @@ func (c *Controller) apiLogin(context *gin.Context) {
 		logger.Error("query account from db error: %v", err)
 		return
 	}
+	if account != nil {
+		if msg := c.loginProtectCheckAccount(account.AccountID); msg != "" {
+			responseData.Retcode = -201
+			responseData.Message = msg
+			context.JSON(http.StatusOK, responseData)
+			return
+		}
+		// 失败次数过多时需要完成geetest验证
+		if c.loginProtectNeedGeetest(account.AccountID, ip) && !c.loginProtectCheckGeetest(context) {
+			if c.geetestRequiredRsp(context, GeetestRetcode, "请完成人机验证") {
+				return
+			}
+		}
+	}
 	if account == nil {
 		// 自动注册
 		accountId, err := c.dao.GetNextAccountId()
@@ -115,13 +135,20 @@ func (c *Controller) apiLogin(context *gin.Context) {
 			context.JSON(http.StatusOK, responseData)
 			return
 		}
+		passwordAlgo, passwordHash, err := endec.PasswordHash(password)
+		if err != nil {
+			logger.Error("hash password error: %v", err)
+			responseData.Retcode = -201
+			responseData.Message = "服务器内部错误:-6"
+			context.JSON(http.StatusOK, responseData)
+			return
+		}
 		regAccount := &model.Account{
 			AccountID:     accountId,
 			Username:      username,
-			Password:      endec.Md5Str(password),
+			Password:      passwordHash,
+			PasswordAlgo:  passwordAlgo,
 			PlayerID:      playerID,
-			Token:         "",
-			ComboToken:    "",
 			Forbid:        false,
 			ForbidEndTime: 0,
 		}
@@ -135,37 +162,61 @@ func (c *Controller) apiLogin(context *gin.Context) {
 		}
 		account = regAccount
 	}
-	if endec.Md5Str(password) != account.Password {
+	if !endec.PasswordVerify(password, account.PasswordAlgo, account.Password) {
+		c.loginProtectOnFail(account.AccountID, ip)
 		responseData.Retcode = -201
 		responseData.Message = "用户名或密码错误"
 		context.JSON(http.StatusOK, responseData)
 		return
 	}
-	// 生成新的token
-	account.Token = base64.StdEncoding.EncodeToString(random.GetRandomByte(24))
-	_, err = c.dao.UpdateAccountFieldByFieldName("AccountID", account.AccountID, "Token", account.Token)
-	if err != nil {
-		logger.Error("update account token error: %v", err)
-		responseData.Retcode = -201
-		responseData.Message = "服务器内部错误:-4"
-		context.JSON(http.StatusOK, responseData)
-		return
+	c.loginProtectOnSuccess(account.AccountID)
+	// 旧算法的密码在登录成功后重新计算哈希
+	if endec.PasswordNeedRehash(account.PasswordAlgo, account.Password) {
+		c.rehashAccountPassword(account, password)
 	}
-	_, err = c.dao.UpdateAccountFieldByFieldName("AccountID", account.AccountID, "TokenCreateTime", time.Now().UnixMilli())
-	if err != nil {
-		logger.Error("update account token time error: %v", err)
+	// 为当前设备签发新的token
+	accountToken := c.newAccountToken(account.AccountID, getDeviceId(context), ip)
+	if accountToken == nil {
 		responseData.Retcode = -201
-		responseData.Message = "服务器内部错误:-5"
+		responseData.Message = "服务器内部错误:-4"
 		context.JSON(http.StatusOK, responseData)
 		return
 	}
 	responseData.Message = "OK"
 	responseData.Data.Account.Uid = strconv.FormatInt(int64(account.AccountID), 10)
-	responseData.Data.Account.Token = account.Token
+	responseData.Data.Account.Token = accountToken.Token
 	responseData.Data.Account.Email = account.Username
 	context.JSON(http.StatusOK, responseData)
 }
 
+// 使用默认算法计算并保存账号的密码哈希 哈希和算法在同一次更新中写入
+func (c *Controller) saveAccountPasswordHash(account *model.Account, password string) bool {
+	passwordAlgo, passwordHash, err := endec.PasswordHash(password)
+	if err != nil {
+		logger.Error("hash password error: %v", err)
+		return false
+	}
+	_, err = c.dao.UpdateAccountMultiFieldByFieldName("AccountID", account.AccountID, map[string]any{
+		"Password":     passwordHash,
+		"PasswordAlgo": passwordAlgo,
+	})
+	if err != nil {
+		logger.Error("update account password error: %v", err)
+		return false
+	}
+	account.Password = passwordHash
+	account.PasswordAlgo = passwordAlgo
+	return true
+}
+
+// 使用默认算法重新计算并保存账号的密码哈希 失败时保留原先的哈希
+func (c *Controller) rehashAccountPassword(account *model.Account, password string) {
+	if !c.saveAccountPasswordHash(account, password) {
+		return
+	}
+	logger.Info("rehash account password, account id: %v, algo: %v", account.AccountID, account.PasswordAlgo)
+}
+
 func (c *Controller) apiVerify(context *gin.Context) {
 	requestData := new(api.LoginTokenRequest)
 	err := context.ShouldBindJSON(requestData)
@@ -184,13 +235,13 @@ func (c *Controller) apiVerify(context *gin.Context) {
 		return
 	}
 	responseData := api.NewLoginResult()
-	if account == nil || account.Token != requestData.Token {
+	if account == nil {
 		responseData.Retcode = -111
 		responseData.Message = "账号本地缓存信息错误"
 		context.JSON(http.StatusOK, responseData)
 		return
 	}
-	if uint64(time.Now().UnixMilli())-account.TokenCreateTime > uint64(time.Hour.Milliseconds()*24*7) {
+	if c.getAccountToken(account.AccountID, requestData.Token) == nil {
 		responseData.Retcode = -111
 		responseData.Message = "登录已失效"
 		context.JSON(http.StatusOK, responseData)
@@ -227,34 +278,64 @@ func (c *Controller) v2Login(context *gin.Context) {
 		return
 	}
 	responseData := api.NewComboTokenRsp()
-	account, err := c.dao.QueryAccountByField("AccountID", uid)
-	if account == nil || account.Token != loginData.Token {
+	ip := getClientIp(context)
+	if msg := c.loginProtectCheckIp(ip); msg != "" {
 		responseData.Retcode = -201
-		responseData.Message = "token错误"
+		responseData.Message = msg
 		context.JSON(http.StatusOK, responseData)
 		return
 	}
-	// 生成新的comboToken
-	account.ComboToken = random.GetRandomByteHexStr(20)
-	_, err = c.dao.UpdateAccountFieldByFieldName("AccountID", account.AccountID, "ComboToken", account.ComboToken)
-	if err != nil {
-		logger.Error("update combo token error: %v", err)
+	account, err := c.dao.QueryAccountByField("AccountID", uid)
+	if account != nil {
+		if msg := c.loginProtectCheckAccount(account.AccountID); msg != "" {
+			responseData.Retcode = -201
+			responseData.Message = msg
+			context.JSON(http.StatusOK, responseData)
+			return
+		}
+	}
+	var accountToken *dao.AccountToken = nil
+	if account != nil {
+		accountToken = c.getAccountToken(account.AccountID, loginData.Token)
+	}
+	if accountToken == nil {
+		if account != nil {
+			c.loginProtectOnFail(account.AccountID, ip)
+		} else {
+			c.loginProtectOnFail(0, ip)
+		}
 		responseData.Retcode = -201
-		responseData.Message = "服务器内部错误:-1"
+		responseData.Message = "token错误"
 		context.JSON(http.StatusOK, responseData)
 		return
 	}
-	_, err = c.dao.UpdateAccountFieldByFieldName("AccountID", account.AccountID, "ComboTokenCreateTime", time.Now().UnixMilli())
-	if err != nil {
-		logger.Error("update combo token time error: %v", err)
+	c.loginProtectOnSuccess(account.AccountID)
+	// 为当前设备签发新的comboToken 同时记录客户端版本 网关据此选择客户端协议版本
+	accountToken.ClientVersion = c.getComboLoginClientVersion(context)
+	comboToken := c.newAccountComboToken(accountToken)
+	if comboToken == "" {
 		responseData.Retcode = -201
-		responseData.Message = "服务器内部错误:-2"
+		responseData.Message = "服务器内部错误:-1"
 		context.JSON(http.StatusOK, responseData)
 		return
 	}
 	responseData.Message = "OK"
 	responseData.Data.OpenID = loginData.Uid
 	responseData.Data.ComboID = "0"
-	responseData.Data.ComboToken = account.ComboToken
+	responseData.Data.ComboToken = comboToken
 	context.JSON(http.StatusOK, responseData)
 }
+
+// 获取combo登录请求头中的客户端版本 如OSRELWin3.2.0_R123_S456_D789 返回三位数字版本号 未上报或格式错误时返回空
+func (c *Controller) getComboLoginClientVersion(context *gin.Context) string {
+	versionName := context.GetHeader("x-rpc-client_version")
+	if versionName == "" {
+		return ""
+	}
+	versionName = strings.Split(versionName, "_")[0]
+	version, versionStr := c.getClientVersionByName(versionName)
+	if version == 0 {
+		return ""
+	}
+	return versionStr
+}
@@ -0,0 +1,342 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"hk4e/common/config"
+	"hk4e/common/httpauth"
+	"hk4e/dispatch/dao"
+	"hk4e/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 登录防爆破
+// 账号密码登录和combo token登录统计账号和ip在窗口内的失败次数 达到次数后临时锁定 单个ip的登录请求次数也有上限
+// 登录失败的响应按账号连续失败次数延迟 失败次数达到geetest阈值后账号密码登录需要先完成geetest验证
+// geetest为本地桩实现 风险检查接口下发challenge 验证接口为challenge生成validate 登录时通过x-rpc-risky请求头带回
+// redis不可用时不拦截登录
+
+const (
+	GeetestGt              = "16bddce04c7385dbb7282778c29bba3e"
+	GeetestStubChallenge   = "616018607b6940f52fbd349004038686" // 固定数据中的challenge
+	GeetestChallengeExpire = time.Minute * 10
+	GeetestRetcode         = -3101 // 需要完成geetest验证
+)
+
+// 客户端ip 只有请求来自配置的可信反向代理时才采用X-Forwarded-For 避免伪造请求头绕过限流
+func getClientIp(context *gin.Context) string {
+	return httpauth.GetClientIp(context.Request)
+}
+
+func getLoginProtectWindow() time.Duration {
+	window := config.GetConfig().Dispatch.LoginProtect.FailWindow
+	if window <= 0 {
+		window = 600
+	}
+	return time.Second * time.Duration(window)
+}
+
+// 锁定剩余时间的提示
+func getLoginLockMsg(prefix string, endTime int64) string {
+	minute := (endTime - time.Now().Unix() + 59) / 60
+	if minute < 1 {
+		minute = 1
+	}
+	return fmt.Sprintf("%s登录失败次数过多，请%d分钟后再试", prefix, minute)
+}
+
+// 检查ip是否锁定或请求过于频繁 返回给客户端的错误信息 允许登录时为空
+func (c *Controller) loginProtectCheckIp(ip string) string {
+	protect := config.GetConfig().Dispatch.LoginProtect
+	if !protect.Enable {
+		return ""
+	}
+	endTime, err := c.dao.GetLoginLock(dao.LoginProtectTypeIp, ip)
+	if err != nil {
+		logger.Error("get login lock error: %v, ip: %v", err, ip)
+		return ""
+	}
+	if endTime != 0 {
+		return getLoginLockMsg("", endTime)
+	}
+	if protect.IpAttemptLimit > 0 {
+		count, err := c.dao.IncLoginAttempt(ip, getLoginProtectWindow())
+		if err != nil {
+			logger.Error("inc login attempt error: %v, ip: %v", err, ip)
+			return ""
+		}
+		if count > int64(protect.IpAttemptLimit) {
+			if count == int64(protect.IpAttemptLimit)+1 {
+				logger.Warn("login attempt too frequent, ip: %v", ip)
+			}
+			return "登录请求过于频繁，请稍后再试"
+		}
+	}
+	return ""
+}
+
+// 检查账号是否锁定 返回给客户端的错误信息 允许登录时为空
+func (c *Controller) loginProtectCheckAccount(accountId uint32) string {
+	if !config.GetConfig().Dispatch.LoginProtect.Enable {
+		return ""
+	}
+	endTime, err := c.dao.GetLoginLock(dao.LoginProtectTypeAccount, strconv.Itoa(int(accountId)))
+	if err != nil {
+		logger.Error("get login lock error: %v, account id: %v", err, accountId)
+		return ""
+	}
+	if endTime != 0 {
+		return getLoginLockMsg("账号", endTime)
+	}
+	return ""
+}
+
+// 账号或ip的失败次数是否达到geetest阈值 accountId为0时只检查ip
+func (c *Controller) loginProtectNeedGeetest(accountId uint32, ip string) bool {
+	protect := config.GetConfig().Dispatch.LoginProtect
+	if !protect.Enable || protect.GeetestFailCount <= 0 {
+		return false
+	}
+	ipFail, err := c.dao.GetLoginFail(dao.LoginProtectTypeIp, ip)
+	if err != nil {
+		logger.Error("get login fail error: %v, ip: %v", err, ip)
+		return false
+	}
+	if ipFail >= int64(protect.GeetestFailCount) {
+		return true
+	}
+	if accountId == 0 {
+		return false
+	}
+	accountFail, err := c.dao.GetLoginFail(dao.LoginProtectTypeAccount, strconv.Itoa(int(accountId)))
+	if err != nil {
+		logger.Error("get login fail error: %v, account id: %v", err, accountId)
+		return false
+	}
+	return accountFail >= int64(protect.GeetestFailCount)
+}
+
+// 校验请求头中的geetest结果 校验通过后challenge失效
+// x-rpc-risky: id=xxx;c=challenge;s=xxx;v=validate
+func (c *Controller) loginProtectCheckGeetest(context *gin.Context) bool {
+	risky := context.GetHeader("x-rpc-risky")
+	if risky == "" {
+		return false
+	}
+	challenge, validate := "", ""
+	for _, item := range strings.Split(risky, ";") {
+		split := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+		switch split[0] {
+		case "c":
+			challenge = split[1]
+		case "v":
+			validate = split[1]
+		}
+	}
+	challenge = parseGeetestChallenge(challenge)
+	if challenge == "" || validate == "" {
+		return false
+	}
+	ok, err := c.dao.UseGeetestChallenge(challenge, validate)
+	if err != nil {
+		logger.Error("use geetest challenge error: %v", err)
+		return false
+	}
+	return ok
+}
+
+// 取出challenge的前32位十六进制 格式错误时返回空
+func parseGeetestChallenge(challenge string) string {
+	if len(challenge) < 32 {
+		return ""
+	}
+	challenge = challenge[:32]
+	_, err := hex.DecodeString(challenge)
+	if err != nil {
+		return ""
+	}
+	return challenge
+}
+
+// 安全随机数的十六进制字符串
+func randomHexStr(n int) string {
+	data := make([]byte, n)
+	_, _ = rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+// 生成新的geetest challenge 失败时返回空
+func (c *Controller) newGeetestChallenge() string {
+	challenge := randomHexStr(16)
+	err := c.dao.SetGeetestChallenge(challenge, "", GeetestChallengeExpire)
+	if err != nil {
+		logger.Error("set geetest challenge error: %v", err)
+		return ""
+	}
+	return challenge
+}
+
+// 通过geetest验证 为下发过的challenge生成validate challenge不存在时返回空
+func (c *Controller) passGeetestChallenge(challenge string) string {
+	challenge = parseGeetestChallenge(challenge)
+	if challenge == "" {
+		return ""
+	}
+	_, exist, err := c.dao.GetGeetestChallenge(challenge)
+	if err != nil {
+		logger.Error("get geetest challenge error: %v", err)
+		return ""
+	}
+	if !exist {
+		return ""
+	}
+	validate := randomHexStr(16)
+	err = c.dao.SetGeetestChallenge(challenge, validate, GeetestChallengeExpire)
+	if err != nil {
+		logger.Error("set geetest challenge error: %v", err)
+		return ""
+	}
+	return validate
+}
+
+// 返回需要完成geetest验证的响应
+func (c *Controller) geetestRequiredRsp(context *gin.Context, retcode int, message string) bool {
+	challenge := c.newGeetestChallenge()
+	if challenge == "" {
+		return false
+	}
+	context.JSON(http.StatusOK, gin.H{
+		"retcode": retcode,
+		"message": message,
+		"data": gin.H{
+			"id":     challenge,
+			"action": "ACTION_GEETEST",
+			"geetest": gin.H{
+				"challenge":   challenge,
+				"gt":          GeetestGt,
+				"new_captcha": 1,
+				"success":     1,
+			},
+		},
+	})
+	return true
+}
+
+// 登录失败 累计失败次数 达到次数后锁定 并按账号连续失败次数延迟响应 accountId为0时只累计ip
+func (c *Controller) loginProtectOnFail(accountId uint32, ip string) {
+	protect := config.GetConfig().Dispatch.LoginProtect
+	if !protect.Enable {
+		return
+	}
+	window := getLoginProtectWindow()
+	ipFail, err := c.dao.IncLoginFail(dao.LoginProtectTypeIp, ip, window)
+	if err != nil {
+		logger.Error("inc login fail error: %v, ip: %v", err, ip)
+		return
+	}
+	if protect.IpLockFailCount > 0 && ipFail >= int64(protect.IpLockFailCount) {
+		err = c.dao.SetLoginLock(dao.LoginProtectTypeIp, ip, time.Second*time.Duration(protect.IpLockTime))
+		if err != nil {
+			logger.Error("set login lock error: %v, ip: %v", err, ip)
+		} else {
+			logger.Warn("login lock ip, ip: %v, fail count: %v", ip, ipFail)
+		}
+	}
+	if accountId == 0 {
+		return
+	}
+	target := strconv.Itoa(int(accountId))
+	accountFail, err := c.dao.IncLoginFail(dao.LoginProtectTypeAccount, target, window)
+	if err != nil {
+		logger.Error("inc login fail error: %v, account id: %v", err, accountId)
+		return
+	}
+	if protect.AccountLockFailCount > 0 && accountFail >= int64(protect.AccountLockFailCount) {
+		err = c.dao.SetLoginLock(dao.LoginProtectTypeAccount, target, time.Second*time.Duration(protect.AccountLockTime))
+		if err != nil {
+			logger.Error("set login lock error: %v, account id: %v", err, accountId)
+		} else {
+			logger.Warn("login lock account, account id: %v, fail count: %v, ip: %v", accountId, accountFail, ip)
+		}
+	}
+	if protect.FailDelay > 0 {
+		delay := int64(protect.FailDelay)
+		for i := int64(1); i < accountFail && delay < int64(protect.FailDelayMax); i++ {
+			delay *= 2
+		}
+		if protect.FailDelayMax > 0 && delay > int64(protect.FailDelayMax) {
+			delay = int64(protect.FailDelayMax)
+		}
+		time.Sleep(time.Millisecond * time.Duration(delay))
+	}
+}
+
+// 登录成功 清除账号的失败次数
+func (c *Controller) loginProtectOnSuccess(accountId uint32) {
+	if !config.GetConfig().Dispatch.LoginProtect.Enable {
+		return
+	}
+	err := c.dao.DelLoginFail(dao.LoginProtectTypeAccount, strconv.Itoa(int(accountId)))
+	if err != nil {
+		logger.Error("del login fail error: %v, account id: %v", err, accountId)
+	}
+}
+
+// 查看全部登录锁定
+func (c *Controller) loginLockList(context *gin.Context) {
+	lockList, err := c.dao.ListLoginLock()
+	if err != nil {
+		logger.Error("list login lock error: %v", err)
+		context.JSON(http.StatusInternalServerError, gin.H{
+			"msg": "list login lock error",
+		})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{
+		"lock_list": lockList,
+	})
+}
+
+type LoginLockClearReq struct {
+	Type   string `json:"type"`   // account或ip
+	Target string `json:"target"` // 账号id或ip地址
+}
+
+// 解除登录锁定
+func (c *Controller) loginLockClear(context *gin.Context) {
+	req := new(LoginLockClearReq)
+	err := context.ShouldBindJSON(req)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	if (req.Type != dao.LoginProtectTypeAccount && req.Type != dao.LoginProtectTypeIp) || req.Target == "" {
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": "invalid lock type or target",
+		})
+		return
+	}
+	logger.Warn("LoginLockClearReq: %v", req)
+	err = c.dao.DelLoginLock(req.Type, req.Target)
+	if err != nil {
+		logger.Error("del login lock error: %v", err)
+		context.JSON(http.StatusInternalServerError, gin.H{
+			"msg": "clear login lock error",
+		})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{})
+}
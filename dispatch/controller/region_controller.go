@@ -0,0 +1,252 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"hk4e/common/config"
+	"hk4e/common/mq"
+	"hk4e/common/rpc"
+	"hk4e/node/api"
+	"hk4e/pkg/logger"
+	"hk4e/pkg/random"
+	"hk4e/protocol/proto"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 多区服
+// 一个dispatch可以对外提供多个区服 每个区服对应一个节点服务器集群 区服密钥和网关地址从各自的集群获取
+// 客户端按区服列表中的二级dispatch地址/query_cur_region/区服名访问区服 /query_cur_region访问第一个区服
+// 区服列表使用第一个区服的密钥 未配置区服时只有一个使用hk4e.dispatch_url的默认区服
+// 第一个区服不可用时dispatch启动失败 其它区服的集群连接或密钥同步失败时该区服暂不可用 定时重试
+// 连接上其它区服的集群后同时为该集群创建消息队列 踢出玩家等广播发送到全部已连接的集群
+
+const (
+	DefaultRegionName  = "os_usa"
+	DefaultRegionTitle = "America"
+	DefaultRegionType  = "DEV_PUBLIC"
+)
+
+const (
+	// 区服密钥变更后继续下发旧密钥的时间 秒
+	// 网关每60秒同步一次密钥 留出两个同步周期 保证客户端拿到新密钥时全部网关都已经能够解密
+	RegionEc2bServeDelay = 120
+)
+
+// 区服所在的节点服务器集群
+type regionNode struct {
+	discovery    *rpc.DiscoveryClient
+	messageQueue *mq.MessageQueue // 只用于向该集群的网关广播踢出玩家 dispatch所在的集群为nil
+}
+
+type regionState struct {
+	config    *config.Region
+	discovery *rpc.DiscoveryClient // 集群连接失败时为nil
+	ec2b      *random.Ec2b         // 密钥同步失败时为nil
+	// 密钥变更前的旧密钥 变更后的一段时间内继续下发旧密钥
+	ec2bPrev       *random.Ec2b
+	ec2bChangeTime int64
+}
+
+// 加载区服配置 连接各区服所在的节点服务器集群并同步区服密钥 第一个区服不可用时返回错误
+func (c *Controller) initRegion() error {
+	regionConfigList := config.GetConfig().Dispatch.Region
+	if len(regionConfigList) == 0 {
+		regionConfigList = []*config.Region{{
+			Name:        DefaultRegionName,
+			Title:       DefaultRegionTitle,
+			Type:        DefaultRegionType,
+			DispatchUrl: config.GetConfig().Hk4e.DispatchUrl,
+		}}
+	}
+	// 相同集群的区服共用一个连接
+	localNode := &regionNode{discovery: c.discovery}
+	c.regionNodeMap = map[string]*regionNode{
+		"":                            localNode,
+		config.GetConfig().MQ.NatsUrl: localNode,
+	}
+	c.regionList = make([]*regionState, 0, len(regionConfigList))
+	c.regionMap = make(map[string]*regionState)
+	for _, regionConfig := range regionConfigList {
+		if regionConfig == nil || regionConfig.Name == "" {
+			logger.Error("region name is empty")
+			return errors.New("region name is empty")
+		}
+		if _, exist := c.regionMap[regionConfig.Name]; exist {
+			logger.Error("region name repeat: %v", regionConfig.Name)
+			return errors.New("region name repeat")
+		}
+		state := &regionState{
+			config: regionConfig,
+		}
+		c.regionList = append(c.regionList, state)
+		c.regionMap[regionConfig.Name] = state
+		logger.Info("load region, name: %v, env: %v, dispatch url: %v", regionConfig.Name, regionConfig.Env, regionConfig.DispatchUrl)
+	}
+	c.syncRegionEc2b()
+	defaultRegion := c.regionList[0]
+	if c.getRegionDiscovery(defaultRegion) == nil || c.getRegionEc2b(defaultRegion) == nil {
+		logger.Error("default region not available, region: %v", defaultRegion.config.Name)
+		return errors.New("default region not available")
+	}
+	return nil
+}
+
+// 连接还未连接的区服集群 相同集群只连接一次
+func (c *Controller) connectRegionNode() {
+	for _, state := range c.regionList {
+		if c.getRegionDiscovery(state) != nil {
+			continue
+		}
+		node := c.getRegionNode(state.config.NatsUrl)
+		if node == nil {
+			continue
+		}
+		c.regionLock.Lock()
+		state.discovery = node.discovery
+		c.regionLock.Unlock()
+	}
+}
+
+// 获取区服集群 集群连接和消息队列都创建成功后返回 失败时返回nil 已创建的部分保留到下次重试时复用
+func (c *Controller) getRegionNode(natsUrl string) *regionNode {
+	node, exist := c.regionNodeMap[natsUrl]
+	if !exist {
+		discovery, err := rpc.NewDiscoveryClientByNatsUrl(natsUrl)
+		if err != nil {
+			logger.Error("connect region node error: %v, nats url: %v", err, natsUrl)
+			return nil
+		}
+		node = &regionNode{discovery: discovery}
+		c.regionNodeMap[natsUrl] = node
+	}
+	if node.discovery == c.discovery || node.messageQueue != nil {
+		return node
+	}
+	messageQueue := mq.NewMessageQueueByNatsUrl(api.DISPATCH, "dispatch_"+strconv.FormatInt(time.Now().UnixNano(), 10), natsUrl, node.discovery)
+	if messageQueue == nil {
+		logger.Error("create region message queue error, nats url: %v", natsUrl)
+		return nil
+	}
+	go func() {
+		// 丢弃收到的广播消息
+		for {
+			<-messageQueue.GetNetMsg()
+		}
+	}()
+	c.svc.AddRegionMessageQueue(messageQueue)
+	node.messageQueue = messageQueue
+	logger.Info("connect region node ok, nats url: %v", natsUrl)
+	return node
+}
+
+// 同步区服密钥 节点服务器轮换密钥后等网关同步到新密钥再下发 旧密钥在重叠期内仍然可以连接网关
+// 先重连不可用的区服集群 相同集群的区服只同步一次 部分集群同步失败时其它集群照常更新
+func (c *Controller) syncRegionEc2b() {
+	c.connectRegionNode()
+	ec2bMap := make(map[*rpc.DiscoveryClient]*random.Ec2b)
+	syncFailMap := make(map[*rpc.DiscoveryClient]bool)
+	for _, state := range c.regionList {
+		discovery := c.getRegionDiscovery(state)
+		if discovery == nil || syncFailMap[discovery] {
+			continue
+		}
+		if _, exist := ec2bMap[discovery]; exist {
+			continue
+		}
+		rsp, err := discovery.GetRegionEc2B(context.TODO(), &api.NullMsg{})
+		if err != nil {
+			logger.Error("get region ec2b error: %v, region: %v", err, state.config.Name)
+			syncFailMap[discovery] = true
+			continue
+		}
+		ec2b, err := random.LoadEc2bKey(rsp.Data)
+		if err != nil {
+			logger.Error("parse region ec2b error: %v, region: %v", err, state.config.Name)
+			syncFailMap[discovery] = true
+			continue
+		}
+		ec2bMap[discovery] = ec2b
+	}
+	nowTime := time.Now().Unix()
+	c.regionLock.Lock()
+	for _, state := range c.regionList {
+		ec2b, exist := ec2bMap[state.discovery]
+		if !exist {
+			continue
+		}
+		if state.ec2b != nil && state.ec2b.Seed() != ec2b.Seed() {
+			logger.Warn("region ec2b change, region: %v, seed: %v", state.config.Name, ec2b.Seed())
+			state.ec2bPrev = state.ec2b
+			state.ec2bChangeTime = nowTime
+		}
+		state.ec2b = ec2b
+	}
+	c.regionLock.Unlock()
+}
+
+// 获取区服 区服名为空时返回第一个区服 不存在时返回nil
+func (c *Controller) getRegion(name string) *regionState {
+	if name == "" {
+		return c.regionList[0]
+	}
+	return c.regionMap[name]
+}
+
+func (c *Controller) getRegionDiscovery(state *regionState) *rpc.DiscoveryClient {
+	c.regionLock.RLock()
+	defer c.regionLock.RUnlock()
+	return state.discovery
+}
+
+// 获取下发给客户端的区服密钥 密钥刚变更时网关可能还没有同步到新密钥 继续下发旧密钥
+func (c *Controller) getRegionEc2b(state *regionState) *random.Ec2b {
+	c.regionLock.RLock()
+	defer c.regionLock.RUnlock()
+	if state.ec2bPrev != nil && time.Now().Unix() < state.ec2bChangeTime+RegionEc2bServeDelay {
+		return state.ec2bPrev
+	}
+	return state.ec2b
+}
+
+// 客户端区服列表
+func (c *Controller) getRegionSimpleInfoList() []*proto.RegionSimpleInfo {
+	serverList := make([]*proto.RegionSimpleInfo, 0, len(c.regionList))
+	for _, state := range c.regionList {
+		serverList = append(serverList, &proto.RegionSimpleInfo{
+			Name:        state.config.Name,
+			Title:       state.config.Title,
+			Type:        state.config.Type,
+			DispatchUrl: state.config.DispatchUrl,
+		})
+	}
+	return serverList
+}
+
+// 查看全部区服
+func (c *Controller) regionInfoList(context *gin.Context) {
+	regionInfoList := make([]gin.H, 0, len(c.regionList))
+	for _, state := range c.regionList {
+		natsUrl := state.config.NatsUrl
+		if natsUrl == "" {
+			natsUrl = config.GetConfig().MQ.NatsUrl
+		}
+		regionInfoList = append(regionInfoList, gin.H{
+			"name":         state.config.Name,
+			"title":        state.config.Title,
+			"type":         state.config.Type,
+			"dispatch_url": state.config.DispatchUrl,
+			"env":          state.config.Env,
+			"nats_url":     natsUrl,
+			"available":    c.getRegionDiscovery(state) != nil,
+			"ec2b_ready":   c.getRegionEc2b(state) != nil,
+		})
+	}
+	context.JSON(http.StatusOK, gin.H{
+		"region_list": regionInfoList,
+	})
+}
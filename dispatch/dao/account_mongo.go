@@ -45,6 +45,29 @@ func (d *Dao) UpdateAccountFieldByFieldName(fieldName string, fieldValue any, fi
 	}
 }
 
+// UpdateAccountMultiFieldByFieldName 在同一次更新中修改多个字段
+func (d *Dao) UpdateAccountMultiFieldByFieldName(fieldName string, fieldValue any, fieldUpdateMap map[string]any) (int64, error) {
+	db := d.db.Collection("account")
+	fieldUpdate := bson.D{}
+	for fieldUpdateName, fieldUpdateValue := range fieldUpdateMap {
+		fieldUpdate = append(fieldUpdate, bson.E{Key: fieldUpdateName, Value: fieldUpdateValue})
+	}
+	updateCount, err := db.UpdateMany(
+		context.TODO(),
+		bson.D{
+			{Key: fieldName, Value: fieldValue},
+		},
+		bson.D{
+			{Key: "$set", Value: fieldUpdate},
+		},
+	)
+	if err != nil {
+		return 0, err
+	} else {
+		return updateCount.ModifiedCount, nil
+	}
+}
+
 func (d *Dao) QueryAccountByField(fieldName string, fieldValue any) (*model.Account, error) {
 	db := d.db.Collection("account")
 	find, err := db.Find(
@@ -2,6 +2,10 @@ package dao
 
 import (
 	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
 )
 
 const RedisPlayerKeyPrefix = "HK4E"
@@ -60,3 +64,62 @@ func (d *Dao) redisInc(keyName string) (uint32, error) {
 	}
 	return uint32(id), nil
 }
+
+const (
+	AccountVerifyCodeRedisKey     = "AccountVerifyCode"
+	AccountVerifyCodeSendRedisKey = "AccountVerifyCodeSend"
+	AccountVerifyCodeMaxFail      = 5                // 验证码最大错误次数
+	AccountVerifyCodeFailExpire   = time.Minute * 30 // 验证码错误次数的保留时间
+)
+
+// 验证码和错误次数在同一个lua脚本中操作 用hash tag保证集群模式下两个key在同一个slot
+func (d *Dao) getAccountVerifyCodeKey(codeType string, accountId uint32, target string) string {
+	return RedisPlayerKeyPrefix + ":" + AccountVerifyCodeRedisKey + ":{" + codeType + ":" + strconv.Itoa(int(accountId)) + ":" + target + "}"
+}
+
+// SetAccountVerifyCode 保存账号验证码 同一账号同类验证码在发送间隔内已经发送过时返回false
+func (d *Dao) SetAccountVerifyCode(codeType string, accountId uint32, target string, code string, expire time.Duration, sendInterval time.Duration) (bool, error) {
+	sendKeyName := RedisPlayerKeyPrefix + ":" + AccountVerifyCodeSendRedisKey + ":" + codeType + ":" + strconv.Itoa(int(accountId))
+	ok, err := d.redisCmd().SetNX(context.TODO(), sendKeyName, 1, sendInterval).Result()
+	if err != nil || !ok {
+		return false, err
+	}
+	keyName := d.getAccountVerifyCodeKey(codeType, accountId, target)
+	err = d.redisCmd().Set(context.TODO(), keyName, code, expire).Err()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 校验验证码 校验通过或错误次数达到上限时删除验证码和错误次数 在redis内原子执行 避免并发请求绕过错误次数限制
+// 返回1校验通过 0验证码错误 -1验证码不存在或已过期
+var checkAccountVerifyCodeScript = redis.NewScript(`
+local value = redis.call("GET", KEYS[1])
+if not value then
+	return -1
+end
+if value == ARGV[1] then
+	redis.call("DEL", KEYS[1], KEYS[2])
+	return 1
+end
+local failCount = redis.call("INCR", KEYS[2])
+if failCount == 1 then
+	redis.call("PEXPIRE", KEYS[2], ARGV[2])
+end
+if failCount >= tonumber(ARGV[3]) then
+	redis.call("DEL", KEYS[1], KEYS[2])
+end
+return 0
+`)
+
+// CheckAccountVerifyCode 校验账号验证码 校验通过后验证码失效 验证码不存在或已过期时返回false
+func (d *Dao) CheckAccountVerifyCode(codeType string, accountId uint32, target string, code string) (bool, error) {
+	keyName := d.getAccountVerifyCodeKey(codeType, accountId, target)
+	result, err := checkAccountVerifyCodeScript.Run(context.TODO(), d.redisCmd(), []string{keyName, keyName + ":Fail"},
+		code, AccountVerifyCodeFailExpire.Milliseconds(), AccountVerifyCodeMaxFail).Int64()
+	if err != nil {
+		return false, err
+	}
+	return result == 1, nil
+}
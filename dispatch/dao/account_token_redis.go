@@ -0,0 +1,266 @@
+package dao
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 账号登录态
+// 每个账号按设备保存登录会话 会话包含账号token和combo token
+// token和combo token分别以自身为key指向账号id和设备id 过期时间即有效期
+// 同一设备重新登录时替换原先的token 其它设备的登录态不受影响
+
+const (
+	AccountTokenRedisKey      = "AccountToken"
+	AccountComboTokenRedisKey = "AccountComboToken"
+	AccountDeviceRedisKey     = "AccountDevice" // 账号的全部设备会话 field为设备id
+)
+
+type AccountToken struct {
+	AccountId     uint32 `json:"account_id"`
+	DeviceId      string `json:"device_id"`
+	Token         string `json:"token"`
+	ComboToken    string `json:"combo_token"`
+	Ip            string `json:"ip"`
+	CreateTime    int64  `json:"create_time"`    // 登录时间 秒时间戳
+	RefreshTime   int64  `json:"refresh_time"`   // 最近一次签发token或combo token的时间 秒时间戳
+	ExpireTime    int64  `json:"expire_time"`    // token过期时间 秒时间戳
+	ClientVersion string `json:"client_version"` // 签发combo token时客户端上报的版本 三位数字 未上报时为空
+}
+
+func getAccountTokenKey(token string) string {
+	return RedisPlayerKeyPrefix + ":" + AccountTokenRedisKey + ":" + token
+}
+
+func getAccountComboTokenKey(comboToken string) string {
+	return RedisPlayerKeyPrefix + ":" + AccountComboTokenRedisKey + ":" + comboToken
+}
+
+func getAccountDeviceKey(accountId uint32) string {
+	return RedisPlayerKeyPrefix + ":" + AccountDeviceRedisKey + ":" + strconv.Itoa(int(accountId))
+}
+
+func getAccountTokenValue(accountId uint32, deviceId string) string {
+	return strconv.Itoa(int(accountId)) + ":" + deviceId
+}
+
+func parseAccountTokenValue(value string) (uint32, string, bool) {
+	split := strings.SplitN(value, ":", 2)
+	if len(split) != 2 {
+		return 0, "", false
+	}
+	accountId, err := strconv.ParseUint(split[0], 10, 32)
+	if err != nil {
+		return 0, "", false
+	}
+	return uint32(accountId), split[1], true
+}
+
+// 删除设备会话的token和combo token
+func (d *Dao) delAccountTokenKey(accountToken *AccountToken) error {
+	if accountToken.Token != "" {
+		err := d.redisCmd().Del(context.TODO(), getAccountTokenKey(accountToken.Token)).Err()
+		if err != nil {
+			return err
+		}
+	}
+	if accountToken.ComboToken != "" {
+		err := d.redisCmd().Del(context.TODO(), getAccountComboTokenKey(accountToken.ComboToken)).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAccountDeviceToken 获取账号指定设备的会话 不存在时返回nil
+func (d *Dao) GetAccountDeviceToken(accountId uint32, deviceId string) (*AccountToken, error) {
+	data, err := d.redisCmd().HGet(context.TODO(), getAccountDeviceKey(accountId), deviceId).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	accountToken := new(AccountToken)
+	err = json.Unmarshal([]byte(data), accountToken)
+	if err != nil {
+		return nil, err
+	}
+	return accountToken, nil
+}
+
+// SaveAccountToken 保存设备会话 替换该设备原先的token和combo token 设备数超出上限时移除最早登录的设备
+func (d *Dao) SaveAccountToken(accountToken *AccountToken, tokenTtl time.Duration, comboTokenTtl time.Duration, maxDevice int) error {
+	oldAccountToken, err := d.GetAccountDeviceToken(accountToken.AccountId, accountToken.DeviceId)
+	if err != nil {
+		return err
+	}
+	if oldAccountToken != nil {
+		if oldAccountToken.Token == accountToken.Token {
+			oldAccountToken.Token = ""
+		}
+		if oldAccountToken.ComboToken == accountToken.ComboToken {
+			oldAccountToken.ComboToken = ""
+		}
+		err = d.delAccountTokenKey(oldAccountToken)
+		if err != nil {
+			return err
+		}
+	}
+	value := getAccountTokenValue(accountToken.AccountId, accountToken.DeviceId)
+	if accountToken.Token != "" {
+		// 沿用的token不延长有效期
+		err = d.redisCmd().SetNX(context.TODO(), getAccountTokenKey(accountToken.Token), value, tokenTtl).Err()
+		if err != nil {
+			return err
+		}
+	}
+	if accountToken.ComboToken != "" {
+		err = d.redisCmd().Set(context.TODO(), getAccountComboTokenKey(accountToken.ComboToken), value, comboTokenTtl).Err()
+		if err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(accountToken)
+	if err != nil {
+		return err
+	}
+	deviceKey := getAccountDeviceKey(accountToken.AccountId)
+	err = d.redisCmd().HSet(context.TODO(), deviceKey, accountToken.DeviceId, data).Err()
+	if err != nil {
+		return err
+	}
+	err = d.redisCmd().Expire(context.TODO(), deviceKey, tokenTtl).Err()
+	if err != nil {
+		return err
+	}
+	if maxDevice <= 0 {
+		return nil
+	}
+	accountTokenList, err := d.ListAccountToken(accountToken.AccountId)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(accountTokenList)-maxDevice; i++ {
+		err = d.RevokeAccountToken(accountToken.AccountId, accountTokenList[i].DeviceId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 通过token或combo token获取设备会话 已失效或已被替换时返回nil
+func (d *Dao) getAccountTokenByKey(keyName string, match func(accountToken *AccountToken) bool) (*AccountToken, error) {
+	value, err := d.redisCmd().Get(context.TODO(), keyName).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	accountId, deviceId, ok := parseAccountTokenValue(value)
+	if !ok {
+		return nil, nil
+	}
+	accountToken, err := d.GetAccountDeviceToken(accountId, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	if accountToken == nil || !match(accountToken) {
+		return nil, nil
+	}
+	return accountToken, nil
+}
+
+// GetAccountTokenByToken 通过账号token获取设备会话 token无效时返回nil
+func (d *Dao) GetAccountTokenByToken(token string) (*AccountToken, error) {
+	if token == "" {
+		return nil, nil
+	}
+	return d.getAccountTokenByKey(getAccountTokenKey(token), func(accountToken *AccountToken) bool {
+		return accountToken.Token == token
+	})
+}
+
+// GetAccountTokenByComboToken 通过combo token获取设备会话 combo token无效时返回nil
+func (d *Dao) GetAccountTokenByComboToken(comboToken string) (*AccountToken, error) {
+	if comboToken == "" {
+		return nil, nil
+	}
+	return d.getAccountTokenByKey(getAccountComboTokenKey(comboToken), func(accountToken *AccountToken) bool {
+		return accountToken.ComboToken == comboToken
+	})
+}
+
+// ListAccountToken 获取账号的全部有效设备会话 按登录时间排序 顺带清理token已过期的会话
+func (d *Dao) ListAccountToken(accountId uint32) ([]*AccountToken, error) {
+	deviceKey := getAccountDeviceKey(accountId)
+	dataMap, err := d.redisCmd().HGetAll(context.TODO(), deviceKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	accountTokenList := make([]*AccountToken, 0, len(dataMap))
+	for deviceId, data := range dataMap {
+		accountToken := new(AccountToken)
+		err = json.Unmarshal([]byte(data), accountToken)
+		if err != nil {
+			return nil, err
+		}
+		if accountToken.ExpireTime <= now {
+			err = d.delAccountTokenKey(accountToken)
+			if err != nil {
+				return nil, err
+			}
+			err = d.redisCmd().HDel(context.TODO(), deviceKey, deviceId).Err()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		accountTokenList = append(accountTokenList, accountToken)
+	}
+	sort.Slice(accountTokenList, func(i, j int) bool {
+		return accountTokenList[i].CreateTime < accountTokenList[j].CreateTime
+	})
+	return accountTokenList, nil
+}
+
+// RevokeAccountToken 吊销账号指定设备的会话
+func (d *Dao) RevokeAccountToken(accountId uint32, deviceId string) error {
+	accountToken, err := d.GetAccountDeviceToken(accountId, deviceId)
+	if err != nil {
+		return err
+	}
+	if accountToken == nil {
+		return nil
+	}
+	err = d.delAccountTokenKey(accountToken)
+	if err != nil {
+		return err
+	}
+	return d.redisCmd().HDel(context.TODO(), getAccountDeviceKey(accountId), deviceId).Err()
+}
+
+// RevokeAllAccountToken 吊销账号全部设备的会话
+func (d *Dao) RevokeAllAccountToken(accountId uint32) error {
+	accountTokenList, err := d.ListAccountToken(accountId)
+	if err != nil {
+		return err
+	}
+	for _, accountToken := range accountTokenList {
+		err = d.delAccountTokenKey(accountToken)
+		if err != nil {
+			return err
+		}
+	}
+	return d.redisCmd().Del(context.TODO(), getAccountDeviceKey(accountId)).Err()
+}
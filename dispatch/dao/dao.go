@@ -84,3 +84,11 @@ func (d *Dao) CloseDao() {
 		logger.Error("redis close error: %v", err)
 	}
 }
+
+// 单机和集群模式通用的redis命令接口
+func (d *Dao) redisCmd() redis.Cmdable {
+	if d.redisCluster != nil {
+		return d.redisCluster
+	}
+	return d.redis
+}
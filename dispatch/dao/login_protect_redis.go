@@ -0,0 +1,178 @@
+package dao
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 登录防爆破相关的计数和锁定
+
+const (
+	LoginProtectTypeAccount = "account" // 账号 目标为账号id
+	LoginProtectTypeIp      = "ip"      // ip 目标为ip地址
+)
+
+const (
+	LoginAttemptRedisKey     = "LoginAttempt"
+	LoginFailRedisKey        = "LoginFail"
+	LoginLockRedisKey        = "LoginLock"
+	LoginLockSetRedisKey     = "LoginLockSet" // 全部锁定的索引 成员为类型:目标 分数为锁定结束时间
+	GeetestChallengeRedisKey = "GeetestChallenge"
+)
+
+type LoginLock struct {
+	Type    string `json:"type"`
+	Target  string `json:"target"`
+	EndTime int64  `json:"end_time"` // 秒时间戳
+}
+
+func getLoginProtectKey(keyName string, lockType string, target string) string {
+	return RedisPlayerKeyPrefix + ":" + keyName + ":" + lockType + ":" + target
+}
+
+// 计数加一 第一次计数时设置过期时间 在redis内原子执行 避免设置过期时间前中断导致计数永不过期
+var redisIncWithExpireScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+func (d *Dao) redisIncWithExpire(keyName string, expire time.Duration) (int64, error) {
+	return redisIncWithExpireScript.Run(context.TODO(), d.redisCmd(), []string{keyName}, expire.Milliseconds()).Int64()
+}
+
+// IncLoginAttempt 单个ip在统计窗口内的登录请求次数加一
+func (d *Dao) IncLoginAttempt(ip string, window time.Duration) (int64, error) {
+	return d.redisIncWithExpire(getLoginProtectKey(LoginAttemptRedisKey, LoginProtectTypeIp, ip), window)
+}
+
+// IncLoginFail 统计窗口内的登录失败次数加一
+func (d *Dao) IncLoginFail(lockType string, target string, window time.Duration) (int64, error) {
+	return d.redisIncWithExpire(getLoginProtectKey(LoginFailRedisKey, lockType, target), window)
+}
+
+// GetLoginFail 获取统计窗口内的登录失败次数
+func (d *Dao) GetLoginFail(lockType string, target string) (int64, error) {
+	count, err := d.redisCmd().Get(context.TODO(), getLoginProtectKey(LoginFailRedisKey, lockType, target)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return count, err
+}
+
+// DelLoginFail 清除登录失败次数
+func (d *Dao) DelLoginFail(lockType string, target string) error {
+	return d.redisCmd().Del(context.TODO(), getLoginProtectKey(LoginFailRedisKey, lockType, target)).Err()
+}
+
+// SetLoginLock 锁定账号或ip
+func (d *Dao) SetLoginLock(lockType string, target string, lockTime time.Duration) error {
+	endTime := time.Now().Add(lockTime).Unix()
+	err := d.redisCmd().Set(context.TODO(), getLoginProtectKey(LoginLockRedisKey, lockType, target), endTime, lockTime).Err()
+	if err != nil {
+		return err
+	}
+	return d.redisCmd().ZAdd(context.TODO(), RedisPlayerKeyPrefix+":"+LoginLockSetRedisKey, &redis.Z{
+		Score:  float64(endTime),
+		Member: lockType + ":" + target,
+	}).Err()
+}
+
+// GetLoginLock 获取锁定结束时间 未锁定时为0
+func (d *Dao) GetLoginLock(lockType string, target string) (int64, error) {
+	endTime, err := d.redisCmd().Get(context.TODO(), getLoginProtectKey(LoginLockRedisKey, lockType, target)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return endTime, err
+}
+
+// ListLoginLock 获取全部未过期的锁定
+func (d *Dao) ListLoginLock() ([]*LoginLock, error) {
+	keyName := RedisPlayerKeyPrefix + ":" + LoginLockSetRedisKey
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	err := d.redisCmd().ZRemRangeByScore(context.TODO(), keyName, "-inf", "("+now).Err()
+	if err != nil {
+		return nil, err
+	}
+	zList, err := d.redisCmd().ZRangeWithScores(context.TODO(), keyName, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	lockList := make([]*LoginLock, 0, len(zList))
+	for _, z := range zList {
+		member, ok := z.Member.(string)
+		if !ok {
+			continue
+		}
+		split := strings.SplitN(member, ":", 2)
+		if len(split) != 2 {
+			continue
+		}
+		lockList = append(lockList, &LoginLock{
+			Type:    split[0],
+			Target:  split[1],
+			EndTime: int64(z.Score),
+		})
+	}
+	return lockList, nil
+}
+
+// DelLoginLock 解除锁定并清除登录失败次数
+func (d *Dao) DelLoginLock(lockType string, target string) error {
+	err := d.redisCmd().Del(context.TODO(), getLoginProtectKey(LoginLockRedisKey, lockType, target)).Err()
+	if err != nil {
+		return err
+	}
+	err = d.redisCmd().ZRem(context.TODO(), RedisPlayerKeyPrefix+":"+LoginLockSetRedisKey, lockType+":"+target).Err()
+	if err != nil {
+		return err
+	}
+	return d.DelLoginFail(lockType, target)
+}
+
+// SetGeetestChallenge 保存下发的geetest challenge validate为空表示未通过验证
+func (d *Dao) SetGeetestChallenge(challenge string, validate string, expire time.Duration) error {
+	keyName := RedisPlayerKeyPrefix + ":" + GeetestChallengeRedisKey + ":" + challenge
+	return d.redisCmd().Set(context.TODO(), keyName, validate, expire).Err()
+}
+
+// GetGeetestChallenge 获取challenge对应的validate challenge不存在时返回false
+func (d *Dao) GetGeetestChallenge(challenge string) (string, bool, error) {
+	keyName := RedisPlayerKeyPrefix + ":" + GeetestChallengeRedisKey + ":" + challenge
+	validate, err := d.redisCmd().Get(context.TODO(), keyName).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return validate, true, nil
+}
+
+// 校验通过验证的challenge并使其失效 在redis内原子执行 避免并发请求重复使用同一个validate
+// 返回1校验通过 0challenge不存在 未通过验证或validate不匹配
+var useGeetestChallengeScript = redis.NewScript(`
+local validate = redis.call("GET", KEYS[1])
+if not validate or validate == "" or validate ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[1])
+return 1
+`)
+
+// UseGeetestChallenge 校验challenge对应的validate 校验通过后challenge失效
+func (d *Dao) UseGeetestChallenge(challenge string, validate string) (bool, error) {
+	keyName := RedisPlayerKeyPrefix + ":" + GeetestChallengeRedisKey + ":" + challenge
+	result, err := useGeetestChallengeScript.Run(context.TODO(), d.redisCmd(), []string{keyName}, validate).Int64()
+	if err != nil {
+		return false, err
+	}
+	return result == 1, nil
+}
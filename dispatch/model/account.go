@@ -3,15 +3,13 @@ package model
 import "go.mongodb.org/mongo-driver/bson/primitive"
 
 type Account struct {
-	ID                   primitive.ObjectID `bson:"_id,omitempty"`
-	AccountID            uint32             `bson:"AccountID"`
-	PlayerID             uint32             `bson:"PlayerID"`
-	Username             string             `bson:"Username"`
-	Password             string             `bson:"Password"`
-	Token                string             `bson:"Token"`
-	TokenCreateTime      uint64             `bson:"TokenCreateTime"` // 毫秒时间戳
-	ComboToken           string             `bson:"ComboToken"`
-	ComboTokenCreateTime uint64             `bson:"ComboTokenCreateTime"` // 毫秒时间戳
-	Forbid               bool               `bson:"Forbid"`
-	ForbidEndTime        uint32             `bson:"ForbidEndTime"` // 秒时间戳
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	AccountID     uint32             `bson:"AccountID"`
+	PlayerID      uint32             `bson:"PlayerID"`
+	Username      string             `bson:"Username"`
+	Password      string             `bson:"Password"`
+	PasswordAlgo  string             `bson:"PasswordAlgo"` // 密码哈希算法 为空时是旧账号的md5
+	Email         string             `bson:"Email"`        // 绑定的邮箱 用于找回密码
+	Forbid        bool               `bson:"Forbid"`
+	ForbidEndTime uint32             `bson:"ForbidEndTime"` // 秒时间戳
 }
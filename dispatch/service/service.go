@@ -1,21 +1,88 @@
 package service
 
 import (
+	"sync"
+
+	"hk4e/common/mq"
 	"hk4e/dispatch/dao"
+	"hk4e/gate/kcp"
+	"hk4e/pkg/logger"
 )
 
 type Service struct {
-	dao *dao.Dao
+	dao                  *dao.Dao
+	messageQueue         *mq.MessageQueue
+	regionMessageQueue   []*mq.MessageQueue // 其它区服所在节点服务器集群的消息队列
+	regionMessageQueueMu sync.RWMutex
+}
+
+func NewService(dao *dao.Dao, messageQueue *mq.MessageQueue) (r *Service) {
+	r = new(Service)
+	r.dao = dao
+	r.messageQueue = messageQueue
+	r.regionMessageQueue = make([]*mq.MessageQueue, 0)
+	return r
+}
+
+// AddRegionMessageQueue 连接上其它区服所在的节点服务器集群后 踢出玩家等广播同时发送到该集群
+func (s *Service) AddRegionMessageQueue(messageQueue *mq.MessageQueue) {
+	s.regionMessageQueueMu.Lock()
+	s.regionMessageQueue = append(s.regionMessageQueue, messageQueue)
+	s.regionMessageQueueMu.Unlock()
+}
+
+// 广播通知全部区服集群的全部网关踢出在线玩家
+func (s *Service) kickPlayer(uid uint32, reason uint32) {
+	s.regionMessageQueueMu.RLock()
+	messageQueueList := append([]*mq.MessageQueue{s.messageQueue}, s.regionMessageQueue...)
+	s.regionMessageQueueMu.RUnlock()
+	for _, messageQueue := range messageQueueList {
+		messageQueue.SendToAll(&mq.NetMsg{
+			MsgType: mq.MsgTypeConnCtrl,
+			EventId: mq.KickPlayerNotify,
+			ConnCtrlMsg: &mq.ConnCtrlMsg{
+				KickUserId: uid,
+				KickReason: reason,
+			},
+		})
+	}
+	logger.Warn("broadcast kick player, uid: %v, reason: %v, cluster num: %v", uid, reason, len(messageQueueList))
+}
+
+// 吊销玩家账号全部设备的http登录态
+func (s *Service) revokeUserToken(uid uint32) bool {
+	account, err := s.dao.QueryAccountByField("PlayerID", uid)
+	if err != nil || account == nil {
+		logger.Error("query account error: %v, uid: %v", err, uid)
+		return false
+	}
+	err = s.dao.RevokeAllAccountToken(account.AccountID)
+	if err != nil {
+		logger.Error("revoke account token error: %v, uid: %v", err, uid)
+		return false
+	}
+	return true
 }
 
 // UserPasswordChange 用户密码改变
 func (s *Service) UserPasswordChange(uid uint32) bool {
 	// http登录态失效
-	_, err := s.dao.UpdateAccountFieldByFieldName("PlayerID", uid, "TokenCreateTime", 0)
-	if err != nil {
+	if !s.revokeUserToken(uid) {
+		return false
+	}
+	// 游戏内登录态失效
+	s.kickPlayer(uid, kcp.EnetAccountPasswordChange)
+	return true
+}
+
+// LogoutUser 全部设备退出登录
+func (s *Service) LogoutUser(uid uint32) bool {
+	// http登录态失效
+	if !s.revokeUserToken(uid) {
 		return false
 	}
-	// TODO 游戏内登录态失效
+	// 游戏强制下线
+	s.kickPlayer(uid, kcp.EnetServerKick)
 	return true
 }
 
@@ -30,7 +97,8 @@ func (s *Service) ForbidUser(uid uint32, forbidEndTime uint64) bool {
 	if err != nil {
 		return false
 	}
-	// TODO 游戏强制下线
+	// 游戏强制下线
+	s.kickPlayer(uid, kcp.EnetServerKillClient)
 	return true
 }
 
@@ -2,17 +2,24 @@ package app
 
 import (
 	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"hk4e/common/config"
+	"hk4e/common/httpauth"
 	"hk4e/common/mq"
 	"hk4e/common/rpc"
+	"hk4e/gate/controller"
+	"hk4e/gate/kcp"
 	"hk4e/gate/net"
 	"hk4e/node/api"
 	"hk4e/pkg/logger"
@@ -30,7 +37,7 @@ func Run(ctx context.Context, configFile string) error {
 	}
 
 	// 注册到节点服务器
-	rsp, err := discoveryClient.RegisterServer(context.TODO(), &api.RegisterServerReq{
+	registerReq := &api.RegisterServerReq{
 		ServerType: api.GATE,
 		GateServerAddr: &api.GateServerAddr{
 			KcpAddr: config.GetConfig().Hk4e.KcpAddr,
@@ -39,7 +46,8 @@ func Run(ctx context.Context, configFile string) error {
 			MqPort:  uint32(config.GetConfig().Hk4e.GateTcpMqPort),
 		},
 		Version: strings.Split(config.GetConfig().Hk4e.Version, ","),
-	})
+	}
+	rsp, err := discoveryClient.RegisterServer(context.TODO(), registerReq)
 	if err != nil {
 		return err
 	}
@@ -52,9 +60,16 @@ func Run(ctx context.Context, configFile string) error {
 				ServerType: api.GATE,
 				AppId:      APPID,
 				LoadCount:  uint32(atomic.LoadInt32(&net.CLIENT_CONN_NUM)),
+				Capacity:   uint32(config.GetConfig().Hk4e.Capacity),
 			})
 			if err != nil {
 				logger.Error("keepalive error: %v", err)
+				// 节点服务器重启或主备切换后可能丢失了注册信息 沿用原来的appid重新注册
+				registerReq.AppId = APPID
+				_, err = discoveryClient.RegisterServer(context.TODO(), registerReq)
+				if err != nil {
+					logger.Error("re-register error: %v", err)
+				}
 			}
 		}
 	}()
@@ -73,9 +88,38 @@ func Run(ctx context.Context, configFile string) error {
 
 	messageQueue := mq.NewMessageQueue(api.GATE, APPID, discoveryClient)
 	defer messageQueue.Close()
+	initMessageTrace(messageQueue)
+	// 消息队列各优先级通道的深度 见/debug/vars
+	expvar.Publish("mq_lane", expvar.Func(func() any {
+		return messageQueue.GetLaneStat()
+	}))
 
 	connectManager := net.NewKcpConnectManager(messageQueue, discoveryClient)
 	defer connectManager.Close()
+	// 各限流规则的触发次数 见/debug/vars
+	expvar.Publish("rate_limit", expvar.Func(func() any {
+		return connectManager.GetRateLimitStat()
+	}))
+	// KCP统计计数 每个统计周期清零 以及各KCP配置的连接数 见/debug/vars
+	expvar.Publish("kcp_snmp", expvar.Func(func() any {
+		return kcp.DefaultSnmp.Copy()
+	}))
+	expvar.Publish("kcp_profile", expvar.Func(func() any {
+		return connectManager.GetKcpProfileStat()
+	}))
+	// 上行协议过滤的违规次数 见/debug/vars
+	expvar.Publish("cmd_filter", expvar.Func(func() any {
+		return connectManager.GetCmdFilterStat()
+	}))
+	// 响应缓存的命中 合并和转发次数 见/debug/vars
+	expvar.Publish("resp_cache", expvar.Func(func() any {
+		return connectManager.GetRespCacheStat()
+	}))
+	initPacketRecord(connectManager.GetPacketRecorder())
+	// 运维管理接口
+	if config.GetConfig().HttpPort != 0 {
+		_ = controller.NewController(connectManager)
+	}
 
 	go func() {
 		outputChan := connectManager.GetKcpEventOutputChan()
@@ -105,3 +149,65 @@ func Run(ctx context.Context, configFile string) error {
 
 	}
 }
+
+// 抓包记录 开启或关闭指定玩家或连接的记录
+// /debug/packet/record?uid=10001&enable=true 或 /debug/packet/record?conv=123456&enable=true 不带参数时返回当前列表 只允许内网访问
+func initPacketRecord(recorder *net.PacketRecorder) {
+	http.HandleFunc("/debug/packet/record", httpauth.AuthorizeHandler(func(w http.ResponseWriter, r *http.Request) {
+		enable := r.URL.Query().Get("enable") != "false"
+		uidStr := r.URL.Query().Get("uid")
+		if uidStr != "" {
+			uid, err := strconv.ParseUint(uidStr, 10, 32)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			recorder.SetRecordUser(uint32(uid), enable)
+			logger.Info("set packet record user, uid: %v, enable: %v", uid, enable)
+		}
+		convStr := r.URL.Query().Get("conv")
+		if convStr != "" {
+			convId, err := strconv.ParseUint(convStr, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			recorder.SetRecordConv(convId, enable)
+			logger.Info("set packet record conv, convId: %v, enable: %v", convId, enable)
+		}
+		userIdList, convIdList := recorder.GetRecordTarget()
+		data, _ := json.Marshal(map[string]any{
+			"uid_list":  userIdList,
+			"conv_list": convIdList,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}))
+}
+
+// 消息链路追踪 分段延迟直方图见/debug/vars
+func initMessageTrace(messageQueue *mq.MessageQueue) {
+	for _, uid := range config.GetConfig().MQ.TraceUidList {
+		messageQueue.SetTraceUser(uid, true)
+	}
+	expvar.Publish("trace_latency", expvar.Func(func() any {
+		return messageQueue.GetTraceLatencyStat()
+	}))
+	// 开启或关闭指定玩家的完整链路日志 /debug/trace/user?uid=10001&enable=true 不带参数时返回当前列表 只允许内网访问
+	http.HandleFunc("/debug/trace/user", httpauth.AuthorizeHandler(func(w http.ResponseWriter, r *http.Request) {
+		uidStr := r.URL.Query().Get("uid")
+		if uidStr != "" {
+			uid, err := strconv.Atoi(uidStr)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			enable := r.URL.Query().Get("enable") != "false"
+			messageQueue.SetTraceUser(uint32(uid), enable)
+			logger.Info("set trace user, uid: %v, enable: %v", uid, enable)
+		}
+		data, _ := json.Marshal(messageQueue.GetTraceUserList())
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}))
+}
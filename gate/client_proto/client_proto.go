@@ -6,22 +6,35 @@ import (
 	"hk4e/pkg/logger"
 )
 
+// ClientCmdProtoMap 单个客户端版本的协议号和协议对象映射
+// 各版本的映射方法由代码生成 方法名以版本号为后缀 如LoadClientCmdIdAndCmdName320
 type ClientCmdProtoMap struct {
+	version               string
 	clientCmdIdCmdNameMap map[uint16]string
 	clientCmdNameCmdIdMap map[string]uint16
 	RefValue              reflect.Value
 }
 
-func NewClientCmdProtoMap() (r *ClientCmdProtoMap) {
+// NewClientCmdProtoMap 创建指定客户端版本的协议映射 该版本没有生成代码时返回nil
+func NewClientCmdProtoMap(version string) (r *ClientCmdProtoMap) {
 	r = new(ClientCmdProtoMap)
+	r.version = version
 	r.clientCmdIdCmdNameMap = make(map[uint16]string)
 	r.clientCmdNameCmdIdMap = make(map[string]uint16)
 	r.RefValue = reflect.ValueOf(r)
-	fn := r.RefValue.MethodByName("LoadClientCmdIdAndCmdName")
+	fn := r.RefValue.MethodByName("LoadClientCmdIdAndCmdName" + version)
+	if !fn.IsValid() {
+		logger.Error("client proto not generated, version: %v", version)
+		return nil
+	}
 	fn.Call([]reflect.Value{})
 	return r
 }
 
+func (c *ClientCmdProtoMap) GetVersion() string {
+	return c.version
+}
+
 func (c *ClientCmdProtoMap) GetClientCmdNameByCmdId(cmdId uint16) string {
 	cmdName, exist := c.clientCmdIdCmdNameMap[cmdId]
 	if !exist {
@@ -39,3 +52,8 @@ func (c *ClientCmdProtoMap) GetClientCmdIdByCmdName(cmdName string) uint16 {
 	}
 	return cmdId
 }
+
+// IsClientCmd 协议号在该版本中是否为指定的协议 不存在时不打印错误日志
+func (c *ClientCmdProtoMap) IsClientCmd(cmdId uint16, cmdName string) bool {
+	return c.clientCmdIdCmdNameMap[cmdId] == cmdName
+}
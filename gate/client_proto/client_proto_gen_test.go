@@ -7,8 +7,22 @@ import (
 )
 
 func TestClientProtoGen(t *testing.T) {
+	// proto目录下每个子目录为一个客户端版本 目录名为版本号
+	versionDir, err := os.ReadDir("./proto")
+	if err != nil {
+		panic(err)
+	}
+	for _, versionEntry := range versionDir {
+		if !versionEntry.IsDir() {
+			continue
+		}
+		clientProtoGen(versionEntry.Name())
+	}
+}
+
+func clientProtoGen(version string) {
 	// 生成根据proto类名获取对象实例的switch方法
-	dir, err := os.ReadDir("./proto")
+	dir, err := os.ReadDir("./proto/" + version)
 	if err != nil {
 		panic(err)
 	}
@@ -24,20 +38,21 @@ func TestClientProtoGen(t *testing.T) {
 		protoObjNameList = append(protoObjNameList, split[len(split)-2])
 	}
 	// 生成初始化cmdId和cmdName的方法
-	clientCmdFile, err := os.ReadFile("./proto/client_cmd.csv")
+	clientCmdFile, err := os.ReadFile("./proto/" + version + "/client_cmd.csv")
 	if err != nil {
 		panic(err)
 	}
 	clientCmdData := string(clientCmdFile)
 	clientCmdLineList := strings.Split(clientCmdData, "\n")
 	// 生成代码文件
+	pkgName := "proto" + version
 	fileData := "package client_proto\n"
 	fileData += "\n"
 	fileData += "import (\n"
-	fileData += "\t\"hk4e/gate/client_proto/proto\"\n"
+	fileData += "\t" + pkgName + " \"hk4e/gate/client_proto/proto/" + version + "\"\n"
 	fileData += ")\n"
 	fileData += "\n"
-	fileData += "func (c *ClientCmdProtoMap) LoadClientCmdIdAndCmdName() {\n"
+	fileData += "func (c *ClientCmdProtoMap) LoadClientCmdIdAndCmdName" + version + "() {\n"
 	for _, clientCmdLine := range clientCmdLineList {
 		// 清理空格以及换行符之类的
 		clientCmdLine = strings.TrimSpace(clientCmdLine)
@@ -55,16 +70,16 @@ func TestClientProtoGen(t *testing.T) {
 	}
 	fileData += "}\n"
 	fileData += "\n"
-	fileData += "func (c *ClientCmdProtoMap) GetClientProtoObjByName(protoObjName string) any {\n"
+	fileData += "func (c *ClientCmdProtoMap) GetClientProtoObjByName" + version + "(protoObjName string) any {\n"
 	fileData += "\tswitch protoObjName {\n"
 	for _, protoObjName := range protoObjNameList {
-		fileData += "\tcase \"" + protoObjName + "\":\n\t\treturn new(proto." + protoObjName + ")\n"
+		fileData += "\tcase \"" + protoObjName + "\":\n\t\treturn new(" + pkgName + "." + protoObjName + ")\n"
 	}
 	fileData += "\tdefault:\n"
 	fileData += "\t\treturn nil\n"
 	fileData += "\t}\n"
 	fileData += "}\n"
-	err = os.WriteFile("./client_proto_gen.go", []byte(fileData), 0644)
+	err = os.WriteFile("./client_proto_gen_"+version+".go", []byte(fileData), 0644)
 	if err != nil {
 		panic(err)
 	}
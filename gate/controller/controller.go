@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"strconv"
+
+	"hk4e/common/config"
+	"hk4e/common/httpauth"
+	gatenet "hk4e/gate/net"
+	"hk4e/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 网关运维管理接口 只允许内网访问
+
+type Controller struct {
+	connectManager *gatenet.KcpConnectManager
+}
+
+func NewController(connectManager *gatenet.KcpConnectManager) (r *Controller) {
+	r = new(Controller)
+	r.connectManager = connectManager
+	go r.registerRouter()
+	return r
+}
+
+func (c *Controller) registerRouter() {
+	if config.GetConfig().Logger.Level == "DEBUG" {
+		gin.SetMode(gin.DebugMode)
+	} else {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	engine := gin.Default()
+	httpauth.WarnIfNoTrustedProxy()
+	engine.Use(httpauth.Authorize())
+	engine.GET("/gate/session/list", c.sessionList)
+	engine.POST("/gate/session/kick", c.sessionKick)
+	engine.POST("/gate/session/kcp/profile", c.sessionKcpProfile)
+	engine.GET("/gate/open/state", c.getOpenState)
+	engine.POST("/gate/open/state", c.setOpenState)
+	engine.POST("/gate/notify/push", c.pushNotify)
+	engine.GET("/gate/ip/ban/list", c.banIpList)
+	engine.POST("/gate/ip/ban", c.banIp)
+	engine.POST("/gate/ip/unban", c.unbanIp)
+	port := config.GetConfig().HttpPort
+	addr := ":" + strconv.Itoa(int(port))
+	err := engine.Run(addr)
+	if err != nil {
+		logger.Error("gin run error: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	gatenet "hk4e/gate/net"
+	"hk4e/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 获取全部会话列表
+func (c *Controller) sessionList(context *gin.Context) {
+	context.JSON(http.StatusOK, gin.H{
+		"session_list": c.connectManager.GetSessionInfoList(),
+	})
+}
+
+type SessionKickReq struct {
+	Uid    uint32 `json:"uid"`
+	Reason uint32 `json:"reason"` // enet断开原因 见kcp包的Enet事件类型
+}
+
+// 按uid踢出玩家
+func (c *Controller) sessionKick(context *gin.Context) {
+	sessionKickReq := new(SessionKickReq)
+	err := context.ShouldBindJSON(sessionKickReq)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	logger.Warn("SessionKickReq: %v", sessionKickReq)
+	if !gatenet.IsValidEnetReason(sessionKickReq.Reason) {
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": "invalid enet reason",
+		})
+		return
+	}
+	ok := c.connectManager.KickUser(sessionKickReq.Uid, sessionKickReq.Reason)
+	if !ok {
+		context.JSON(http.StatusNotFound, gin.H{
+			"msg": "user not found",
+		})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{})
+}
+
+type SessionKcpProfileReq struct {
+	Uid     uint32 `json:"uid"`
+	Profile string `json:"profile"` // KCP配置名 为空时恢复自动切换
+}
+
+// 手动指定玩家连接的KCP配置
+func (c *Controller) sessionKcpProfile(context *gin.Context) {
+	sessionKcpProfileReq := new(SessionKcpProfileReq)
+	err := context.ShouldBindJSON(sessionKcpProfileReq)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	logger.Warn("SessionKcpProfileReq: %v", sessionKcpProfileReq)
+	ok := c.connectManager.SetUserKcpProfile(sessionKcpProfileReq.Uid, sessionKcpProfileReq.Profile)
+	if !ok {
+		context.JSON(http.StatusNotFound, gin.H{
+			"msg": "user or profile not found",
+		})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{})
+}
+
+// 获取网关开放状态
+func (c *Controller) getOpenState(context *gin.Context) {
+	context.JSON(http.StatusOK, gin.H{
+		"open": c.connectManager.GetOpenState(),
+	})
+}
+
+type SetOpenStateReq struct {
+	Open bool `json:"open"`
+}
+
+// 改变网关开放状态 关闭时断开全部连接
+func (c *Controller) setOpenState(context *gin.Context) {
+	setOpenStateReq := new(SetOpenStateReq)
+	err := context.ShouldBindJSON(setOpenStateReq)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	logger.Warn("SetOpenStateReq: %v", setOpenStateReq)
+	c.connectManager.SetOpenState(setOpenStateReq.Open)
+	context.JSON(http.StatusOK, gin.H{})
+}
+
+type PushNotifyReq struct {
+	Uid         uint32          `json:"uid"` // 为0代表全部玩家
+	CmdName     string          `json:"cmd_name"`
+	Payload     []byte          `json:"payload"`      // protobuf二进制数据 base64编码
+	PayloadJson json.RawMessage `json:"payload_json"` // json格式的协议内容 优先使用
+}
+
+// 向指定玩家或全部玩家推送协议
+func (c *Controller) pushNotify(context *gin.Context) {
+	pushNotifyReq := new(PushNotifyReq)
+	err := context.ShouldBindJSON(pushNotifyReq)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	logger.Warn("PushNotifyReq, uid: %v, cmdName: %v", pushNotifyReq.Uid, pushNotifyReq.CmdName)
+	ok := c.connectManager.PushNotify(pushNotifyReq.Uid, pushNotifyReq.CmdName, pushNotifyReq.Payload, pushNotifyReq.PayloadJson)
+	if !ok {
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": "invalid notify",
+		})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{})
+}
+
+// 获取临时封禁的ip列表
+func (c *Controller) banIpList(context *gin.Context) {
+	context.JSON(http.StatusOK, gin.H{
+		"ban_ip_list": c.connectManager.GetBanIpList(),
+	})
+}
+
+type BanIpReq struct {
+	Ip       string `json:"ip"`
+	Duration int64  `json:"duration"` // 封禁时长 秒 0为永久
+}
+
+// 临时封禁ip并断开该ip的全部连接
+func (c *Controller) banIp(context *gin.Context) {
+	banIpReq := new(BanIpReq)
+	err := context.ShouldBindJSON(banIpReq)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	logger.Warn("BanIpReq: %v", banIpReq)
+	ok := c.connectManager.BanIp(banIpReq.Ip, time.Second*time.Duration(banIpReq.Duration))
+	if !ok {
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": "invalid ip",
+		})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{})
+}
+
+type UnbanIpReq struct {
+	Ip string `json:"ip"`
+}
+
+// 解除ip的临时封禁
+func (c *Controller) unbanIp(context *gin.Context) {
+	unbanIpReq := new(UnbanIpReq)
+	err := context.ShouldBindJSON(unbanIpReq)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	logger.Warn("UnbanIpReq: %v", unbanIpReq)
+	ok := c.connectManager.UnbanIp(unbanIpReq.Ip)
+	if !ok {
+		context.JSON(http.StatusNotFound, gin.H{
+			"msg": "ip not banned",
+		})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{})
+}
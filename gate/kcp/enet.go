@@ -56,8 +56,20 @@ const (
 	EnetAccountPasswordChange  = 14
 	EnetClientEditorConnectKey = 987654321
 	EnetClientConnectKey       = 1234567890
+	EnetClientResumeKey        = 1234567891 // 会话恢复握手 convId字段携带恢复令牌
+	EnetClientFecConnectKey    = 1234567892 // 开启前向纠错的握手 convId字段携带分片参数
 )
 
+// BuildEnetFecShards 将前向纠错的分片参数编码到握手包的convId字段
+func BuildEnetFecShards(dataShards, parityShards int) uint64 {
+	return uint64(dataShards)<<8 | uint64(parityShards)
+}
+
+// ParseEnetFecShards 从握手包的convId字段解析前向纠错的分片参数
+func ParseEnetFecShards(conv uint64) (dataShards, parityShards int) {
+	return int(conv >> 8 & 0xff), int(conv & 0xff)
+}
+
 func BuildEnet(connType uint8, enetType uint32, conv uint64) []byte {
 	data := make([]byte, 20)
 	if connType == ConnEnetSyn {
@@ -0,0 +1,321 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// 前向纠错
+// 原神KCP的监听器按包头的8字节conv分发会话 所以FEC包头放在conv之后
+// 数据包 CC CC CC CC CC CC CC CC | SS SS SS SS | FF FF | LL LL | KCP数据
+// 校验包 CC CC CC CC CC CC CC CC | SS SS SS SS | FF FF | 校验数据
+// CC为conv SS为分片序号 FF为分片类型 LL为包含自身2字节在内的KCP数据长度
+// 每dataShards个数据包生成parityShards个校验包 同一组内丢失的数据包不超过parityShards个时可以恢复
+
+const (
+	fecHeaderOffset    = 8                                    // FEC包头前保留的conv长度
+	fecHeaderSize      = 6                                    // 分片序号和分片类型
+	fecHeaderSizePlus2 = fecHeaderSize + 2                    // 数据包额外带2字节长度
+	fecReserveBytes    = fecHeaderOffset + fecHeaderSizePlus2 // KCP输出时预留的字节数
+	typeData           = 0xf1
+	typeParity         = 0xf2
+	fecExpire          = 60000 // 接收队列中分片的过期时间 毫秒
+	rxFECMulti         = 3     // 接收队列最多缓存的分片组数
+)
+
+const (
+	FecMaxDataShards   = 32 // 最大数据分片数
+	FecMaxParityShards = 16 // 最大校验分片数
+)
+
+// IsValidFecShards 分片参数是否有效
+func IsValidFecShards(dataShards, parityShards int) bool {
+	return dataShards > 0 && dataShards <= FecMaxDataShards && parityShards > 0 && parityShards <= FecMaxParityShards
+}
+
+// fecPacket 去掉conv后的FEC包
+type fecPacket []byte
+
+func (p fecPacket) seqid() uint32 { return binary.LittleEndian.Uint32(p) }
+func (p fecPacket) flag() uint16  { return binary.LittleEndian.Uint16(p[4:]) }
+func (p fecPacket) data() []byte  { return p[fecHeaderSize:] }
+
+type fecElement struct {
+	fecPacket
+	ts uint32
+}
+
+// fecDecoder FEC解码器 调用方需要加锁
+type fecDecoder struct {
+	rxlimit      int // 接收队列长度限制
+	dataShards   int
+	parityShards int
+	shardSize    int
+	rx           []fecElement // 按分片序号排序的接收队列
+
+	decodeCache [][]byte
+	flagCache   []bool
+	zeros       []byte
+
+	codec reedsolomon.Encoder
+}
+
+func newFECDecoder(dataShards, parityShards int) *fecDecoder {
+	if !IsValidFecShards(dataShards, parityShards) {
+		return nil
+	}
+	dec := new(fecDecoder)
+	dec.dataShards = dataShards
+	dec.parityShards = parityShards
+	dec.shardSize = dataShards + parityShards
+	dec.rxlimit = rxFECMulti * dec.shardSize
+	codec, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil
+	}
+	dec.codec = codec
+	dec.decodeCache = make([][]byte, dec.shardSize)
+	dec.flagCache = make([]bool, dec.shardSize)
+	dec.zeros = make([]byte, mtuLimit)
+	return dec
+}
+
+// decode 输入一个分片 返回恢复出来的数据分片 数据分片使用后需要放回xmitBuf
+func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
+	// 按分片序号插入接收队列 重复的分片直接丢弃
+	n := len(dec.rx) - 1
+	insertIdx := 0
+	for i := n; i >= 0; i-- {
+		if in.seqid() == dec.rx[i].seqid() {
+			return nil
+		} else if _itimediff(in.seqid(), dec.rx[i].seqid()) > 0 {
+			insertIdx = i + 1
+			break
+		}
+	}
+	pkt := fecPacket(xmitBuf.Get().([]byte)[:len(in)])
+	copy(pkt, in)
+	elem := fecElement{pkt, currentMs()}
+	if insertIdx == n+1 {
+		dec.rx = append(dec.rx, elem)
+	} else {
+		dec.rx = append(dec.rx, fecElement{})
+		copy(dec.rx[insertIdx+1:], dec.rx[insertIdx:])
+		dec.rx[insertIdx] = elem
+	}
+
+	// 当前分片所在的分片组
+	shardBegin := pkt.seqid() - pkt.seqid()%uint32(dec.shardSize)
+	shardEnd := shardBegin + uint32(dec.shardSize) - 1
+
+	// 接收队列中可能属于当前分片组的范围
+	searchBegin := insertIdx - int(pkt.seqid()%uint32(dec.shardSize))
+	if searchBegin < 0 {
+		searchBegin = 0
+	}
+	searchEnd := searchBegin + dec.shardSize - 1
+	if searchEnd >= len(dec.rx) {
+		searchEnd = len(dec.rx) - 1
+	}
+
+	if searchEnd-searchBegin+1 >= dec.dataShards {
+		var numShard, numDataShard, first, maxLen int
+		shards := dec.decodeCache
+		shardsFlag := dec.flagCache
+		for k := range dec.decodeCache {
+			shards[k] = nil
+			shardsFlag[k] = false
+		}
+		for i := searchBegin; i <= searchEnd; i++ {
+			seqid := dec.rx[i].seqid()
+			if _itimediff(seqid, shardEnd) > 0 {
+				break
+			} else if _itimediff(seqid, shardBegin) >= 0 {
+				shards[seqid%uint32(dec.shardSize)] = dec.rx[i].data()
+				shardsFlag[seqid%uint32(dec.shardSize)] = true
+				numShard++
+				if dec.rx[i].flag() == typeData {
+					numDataShard++
+				}
+				if numShard == 1 {
+					first = i
+				}
+				if len(dec.rx[i].data()) > maxLen {
+					maxLen = len(dec.rx[i].data())
+				}
+			}
+		}
+		if numDataShard == dec.dataShards {
+			// 数据分片没有丢失
+			dec.rx = dec.freeRange(first, numShard, dec.rx)
+		} else if numShard >= dec.dataShards {
+			// 数据分片有丢失 但是可以通过校验分片恢复
+			for k := range shards {
+				if shards[k] != nil {
+					dataLen := len(shards[k])
+					shards[k] = shards[k][:maxLen]
+					copy(shards[k][dataLen:], dec.zeros)
+				} else if k < dec.dataShards {
+					shards[k] = xmitBuf.Get().([]byte)[:0]
+				}
+			}
+			err := dec.codec.ReconstructData(shards)
+			if err == nil {
+				for k := range shards[:dec.dataShards] {
+					if !shardsFlag[k] {
+						recovered = append(recovered, shards[k])
+					}
+				}
+			} else {
+				atomic.AddUint64(&DefaultSnmp.FECErrs, 1)
+			}
+			dec.rx = dec.freeRange(first, numShard, dec.rx)
+		}
+	}
+
+	// 限制接收队列长度
+	if len(dec.rx) > dec.rxlimit {
+		if dec.rx[0].flag() == typeData {
+			// 无法恢复的数据分片
+			atomic.AddUint64(&DefaultSnmp.FECShortShards, 1)
+		}
+		dec.rx = dec.freeRange(0, 1, dec.rx)
+	}
+
+	// 清理过期的分片
+	current := currentMs()
+	numExpired := 0
+	for k := range dec.rx {
+		if _itimediff(current, dec.rx[k].ts) > fecExpire {
+			numExpired++
+			continue
+		}
+		break
+	}
+	if numExpired > 0 {
+		dec.rx = dec.freeRange(0, numExpired, dec.rx)
+	}
+	return recovered
+}
+
+// 释放接收队列中的一段分片
+func (dec *fecDecoder) freeRange(first, n int, q []fecElement) []fecElement {
+	for i := first; i < first+n; i++ {
+		xmitBuf.Put([]byte(q[i].fecPacket))
+	}
+	if first == 0 && n < cap(q)/2 {
+		return q[n:]
+	}
+	copy(q[first:], q[first+n:])
+	return q[:len(q)-n]
+}
+
+// 释放接收队列中的全部分片
+func (dec *fecDecoder) release() {
+	dec.rx = dec.freeRange(0, len(dec.rx), dec.rx)
+}
+
+// fecEncoder FEC编码器 调用方需要加锁
+type fecEncoder struct {
+	dataShards   int
+	parityShards int
+	shardSize    int
+	paws         uint32 // 分片序号回绕的上限 保证回绕时分片组对齐
+	next         uint32 // 下一个分片序号
+
+	shardCount int // 当前分片组已有的数据分片数
+	maxSize    int // 当前分片组中最大的数据分片长度
+
+	shardCache  [][]byte
+	encodeCache [][]byte
+
+	codec reedsolomon.Encoder
+}
+
+func newFECEncoder(dataShards, parityShards int) *fecEncoder {
+	if !IsValidFecShards(dataShards, parityShards) {
+		return nil
+	}
+	enc := new(fecEncoder)
+	enc.dataShards = dataShards
+	enc.parityShards = parityShards
+	enc.shardSize = dataShards + parityShards
+	enc.paws = 0xffffffff / uint32(enc.shardSize) * uint32(enc.shardSize)
+	codec, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil
+	}
+	enc.codec = codec
+	enc.shardCache = make([][]byte, enc.shardSize)
+	for k := range enc.shardCache {
+		enc.shardCache[k] = make([]byte, mtuLimit)
+	}
+	enc.encodeCache = make([][]byte, enc.parityShards)
+	for k := range enc.encodeCache {
+		enc.encodeCache[k] = make([]byte, mtuLimit)
+	}
+	return enc
+}
+
+// encode 为数据包填充FEC包头 分片组满时返回生成的校验包
+// b的开头为conv 之后预留了fecHeaderSizePlus2字节 返回的校验包在下一次调用前有效
+func (enc *fecEncoder) encode(b []byte) (ps [][]byte) {
+	enc.markData(b[fecHeaderOffset:])
+	binary.LittleEndian.PutUint16(b[fecHeaderOffset+fecHeaderSize:], uint16(len(b[fecHeaderOffset+fecHeaderSize:])))
+
+	// 缓存数据分片
+	size := len(b) - fecHeaderOffset - fecHeaderSize
+	enc.shardCache[enc.shardCount] = enc.shardCache[enc.shardCount][:size]
+	copy(enc.shardCache[enc.shardCount], b[fecHeaderOffset+fecHeaderSize:])
+	enc.shardCount++
+	if size > enc.maxSize {
+		enc.maxSize = size
+	}
+
+	if enc.shardCount == enc.dataShards {
+		// 数据分片补零对齐
+		for i := 0; i < enc.dataShards; i++ {
+			shard := enc.shardCache[i]
+			shardLen := len(shard)
+			shard = shard[:enc.maxSize]
+			for j := shardLen; j < enc.maxSize; j++ {
+				shard[j] = 0
+			}
+			enc.shardCache[i] = shard
+		}
+		for i := enc.dataShards; i < enc.shardSize; i++ {
+			enc.shardCache[i] = enc.shardCache[i][:enc.maxSize]
+		}
+		// 生成校验分片
+		err := enc.codec.Encode(enc.shardCache)
+		if err == nil {
+			for i := 0; i < enc.parityShards; i++ {
+				pkt := enc.encodeCache[i][:fecHeaderOffset+fecHeaderSize+enc.maxSize]
+				copy(pkt, b[:fecHeaderOffset])
+				enc.markParity(pkt[fecHeaderOffset:])
+				copy(pkt[fecHeaderOffset+fecHeaderSize:], enc.shardCache[enc.dataShards+i])
+				ps = append(ps, pkt)
+			}
+		} else {
+			// 跳过本组的校验分片序号 保持分片组对齐
+			enc.next = (enc.next + uint32(enc.parityShards)) % enc.paws
+		}
+		enc.shardCount = 0
+		enc.maxSize = 0
+	}
+	return ps
+}
+
+func (enc *fecEncoder) markData(data []byte) {
+	binary.LittleEndian.PutUint32(data, enc.next)
+	binary.LittleEndian.PutUint16(data[4:], typeData)
+	enc.next = (enc.next + 1) % enc.paws
+}
+
+func (enc *fecEncoder) markParity(data []byte) {
+	binary.LittleEndian.PutUint32(data, enc.next)
+	binary.LittleEndian.PutUint16(data[4:], typeParity)
+	enc.next = (enc.next + 1) % enc.paws
+}
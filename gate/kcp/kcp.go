@@ -168,6 +168,9 @@ type KCP struct {
 	buffer   []byte
 	reserved int
 	output   output_callback
+
+	// 会话级的数据段发送统计 用于估算单个会话的丢包率
+	xmitSegs, retransSegs uint64
 }
 
 type ackItem struct {
@@ -842,6 +845,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		if needsend {
 			current = currentMs()
 			segment.xmit++
+			kcp.xmitSegs++
 			segment.ts = current
 			segment.wnd = seg.wnd
 			segment.una = seg.una
@@ -881,6 +885,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	}
 	if sum > 0 {
 		atomic.AddUint64(&DefaultSnmp.RetransSegs, sum)
+		kcp.retransSegs += sum
 	}
 
 	// cwnd update
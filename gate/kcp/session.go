@@ -87,6 +87,10 @@ type (
 		writeDelay bool      // delay kcp.flush() for Write() for bulk transfer
 		dup        int       // duplicate udp packets(testing purpose)
 
+		// FEC codec
+		fecDecoder *fecDecoder
+		fecEncoder *fecEncoder
+
 		// notifications
 		die          chan struct{} // notify current session has Closed
 		dieOnce      sync.Once
@@ -124,6 +128,11 @@ type (
 
 // newUDPSession create a new udp session for client or server
 func newUDPSession(conv uint64, l *Listener, conn net.PacketConn, ownConn bool, remote net.Addr) *UDPSession {
+	return newUDPSessionWithFEC(conv, l, conn, ownConn, remote, 0, 0)
+}
+
+// newUDPSessionWithFEC 创建会话 分片参数有效时开启前向纠错
+func newUDPSessionWithFEC(conv uint64, l *Listener, conn net.PacketConn, ownConn bool, remote net.Addr, dataShards, parityShards int) *UDPSession {
 	sess := new(UDPSession)
 	sess.die = make(chan struct{})
 	sess.chReadEvent = make(chan struct{}, 1)
@@ -154,6 +163,9 @@ func newUDPSession(conv uint64, l *Listener, conn net.PacketConn, ownConn bool,
 		}
 	})
 	sess.kcp.ReserveBytes(sess.headerSize)
+	if IsValidFecShards(dataShards, parityShards) {
+		sess.setFEC(dataShards, parityShards)
+	}
 
 	if sess.l == nil { // it's a client connection
 		go sess.readLoop()
@@ -349,6 +361,9 @@ func (s *UDPSession) Close() error {
 		s.uncork()
 		// release pending segments
 		s.kcp.ReleaseTX()
+		if s.fecDecoder != nil {
+			s.fecDecoder.release()
+		}
 		s.mu.Unlock()
 
 		if s.l != nil { // belongs to listener
@@ -425,6 +440,34 @@ func (s *UDPSession) SetMtu(mtu int) bool {
 	return true
 }
 
+// 开启前向纠错 只能在收发数据之前调用
+// FEC包头占用的字节从mtu中额外扩展 保持mss不变 避免改变最大应用层包长度
+func (s *UDPSession) setFEC(dataShards, parityShards int) bool {
+	fecEncoder := newFECEncoder(dataShards, parityShards)
+	fecDecoder := newFECDecoder(dataShards, parityShards)
+	if fecEncoder == nil || fecDecoder == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fecEncoder = fecEncoder
+	s.fecDecoder = fecDecoder
+	s.headerSize = fecReserveBytes
+	s.kcp.ReserveBytes(fecReserveBytes)
+	s.kcp.SetMtu(int(s.kcp.mtu) + fecReserveBytes)
+	return true
+}
+
+// GetFEC 获取前向纠错的分片参数 未开启时返回0
+func (s *UDPSession) GetFEC() (dataShards, parityShards int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fecEncoder == nil {
+		return 0, 0
+	}
+	return s.fecEncoder.dataShards, s.fecEncoder.parityShards
+}
+
 // SetStreamMode toggles the stream mode on/off
 func (s *UDPSession) SetStreamMode(enable bool) {
 	s.mu.Lock()
@@ -527,6 +570,13 @@ func (s *UDPSession) SetWriteBuffer(bytes int) error {
 func (s *UDPSession) output(buf []byte) {
 	var ecc [][]byte
 
+	// 1. FEC encoding
+	// KCP数据的开头就是conv 复制到包头供监听器分发会话
+	if s.fecEncoder != nil {
+		copy(buf[:fecHeaderOffset], buf[s.headerSize:s.headerSize+fecHeaderOffset])
+		ecc = s.fecEncoder.encode(buf)
+	}
+
 	// 4. TxQueue
 	var msg ipv4.Message
 	for i := 0; i < s.dup+1; i++ {
@@ -537,6 +587,9 @@ func (s *UDPSession) output(buf []byte) {
 		s.txqueue = append(s.txqueue, msg)
 	}
 
+	if len(ecc) > 0 {
+		atomic.AddUint64(&DefaultSnmp.FECParityShards, uint64(len(ecc)))
+	}
 	for k := range ecc {
 		bts := xmitBuf.Get().([]byte)[:len(ecc[k])]
 		copy(bts, ecc[k])
@@ -567,6 +620,20 @@ func (s *UDPSession) update() {
 // GetConv gets conversation id of a session
 func (s *UDPSession) GetConv() uint64 { return s.kcp.conv }
 
+// GetWaitSnd 获取会话还未发送或还未被确认的数据段数
+func (s *UDPSession) GetWaitSnd() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kcp.WaitSnd()
+}
+
+// GetSegStat 获取会话发送的数据段数和重传的数据段数
+func (s *UDPSession) GetSegStat() (xmitSegs, retransSegs uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kcp.xmitSegs, s.kcp.retransSegs
+}
+
 // GetRTO gets current rto of the session
 func (s *UDPSession) GetRTO() uint32 {
 	s.mu.Lock()
@@ -618,11 +685,79 @@ func (s *UDPSession) notifyWriteError(err error) {
 
 // packet input stage
 func (s *UDPSession) packetInput(data []byte) {
+	if s.fecDecoder != nil {
+		if len(data) > fecHeaderOffset+fecHeaderSize {
+			s.fecInput(data)
+		}
+		return
+	}
 	if len(data) >= IKCP_OVERHEAD {
 		s.kcpInput(data)
 	}
 }
 
+// 带FEC包头的数据包 去掉包头输入KCP 并尝试用校验包恢复丢失的数据包
+func (s *UDPSession) fecInput(data []byte) {
+	var kcpInErrors, fecErrs, fecRecovered, fecParityShards uint64
+
+	pkt := fecPacket(data[fecHeaderOffset:])
+	s.mu.Lock()
+	if pkt.flag() == typeData {
+		if len(pkt) >= fecHeaderSizePlus2+IKCP_OVERHEAD {
+			if ret := s.kcp.Input(pkt[fecHeaderSizePlus2:], true, s.ackNoDelay); ret != 0 {
+				kcpInErrors++
+			}
+		}
+	} else if pkt.flag() == typeParity {
+		fecParityShards++
+	}
+	if pkt.flag() == typeData || pkt.flag() == typeParity {
+		recovers := s.fecDecoder.decode(pkt)
+		for _, r := range recovers {
+			if len(r) >= 2 {
+				sz := binary.LittleEndian.Uint16(r)
+				if int(sz) <= len(r) && sz >= 2 {
+					if ret := s.kcp.Input(r[2:sz], false, s.ackNoDelay); ret == 0 {
+						fecRecovered++
+					} else {
+						kcpInErrors++
+					}
+				} else {
+					fecErrs++
+				}
+			} else {
+				fecErrs++
+			}
+			// recycle the recovers
+			xmitBuf.Put(r)
+		}
+	}
+	if n := s.kcp.PeekSize(); n > 0 {
+		s.notifyReadEvent()
+	}
+	waitsnd := s.kcp.WaitSnd()
+	if waitsnd < int(s.kcp.snd_wnd) && waitsnd < int(s.kcp.rmt_wnd) {
+		s.notifyWriteEvent()
+	}
+	s.uncork()
+	s.mu.Unlock()
+
+	atomic.AddUint64(&DefaultSnmp.InPkts, 1)
+	atomic.AddUint64(&DefaultSnmp.InBytes, uint64(len(data)))
+	if fecParityShards > 0 {
+		atomic.AddUint64(&DefaultSnmp.FECParityShards, fecParityShards)
+	}
+	if kcpInErrors > 0 {
+		atomic.AddUint64(&DefaultSnmp.KCPInErrors, kcpInErrors)
+	}
+	if fecErrs > 0 {
+		atomic.AddUint64(&DefaultSnmp.FECErrs, fecErrs)
+	}
+	if fecRecovered > 0 {
+		atomic.AddUint64(&DefaultSnmp.FECRecovered, fecRecovered)
+	}
+}
+
 func (s *UDPSession) kcpInput(data []byte) {
 	var kcpInErrors uint64
 	s.mu.Lock()
@@ -669,9 +804,51 @@ type (
 		rd atomic.Value // read deadline for Accept()
 
 		EnetNotify chan *Enet // 原神Enet协议上报管道
+
+		fecConvMap     map[uint64]*fecConv // 握手阶段协商了前向纠错的conv
+		fecConvMapLock sync.Mutex
+	}
+
+	fecConv struct {
+		dataShards   int
+		parityShards int
+		expireTime   int64
 	}
 )
 
+// SetConvFEC 设置conv的前向纠错参数 在该conv的第一个KCP包到达创建会话时生效
+// 需要在回复握手包之前调用 超时未建立连接的设置会被清理
+func (l *Listener) SetConvFEC(conv uint64, dataShards, parityShards int) bool {
+	if !IsValidFecShards(dataShards, parityShards) {
+		return false
+	}
+	now := time.Now().UnixNano()
+	l.fecConvMapLock.Lock()
+	defer l.fecConvMapLock.Unlock()
+	for c, fc := range l.fecConvMap {
+		if now > fc.expireTime {
+			delete(l.fecConvMap, c)
+		}
+	}
+	l.fecConvMap[conv] = &fecConv{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		expireTime:   now + int64(time.Millisecond*fecExpire),
+	}
+	return true
+}
+
+func (l *Listener) takeConvFEC(conv uint64) *fecConv {
+	l.fecConvMapLock.Lock()
+	defer l.fecConvMapLock.Unlock()
+	fc, exist := l.fecConvMap[conv]
+	if !exist {
+		return nil
+	}
+	delete(l.fecConvMap, conv)
+	return fc
+}
+
 // packet input stage
 func (l *Listener) packetInput(data []byte, addr net.Addr, convId uint64) {
 	if len(data) >= IKCP_OVERHEAD {
@@ -690,7 +867,7 @@ func (l *Listener) packetInput(data []byte, addr net.Addr, convId uint64) {
 
 		if ok { // existing connection
 			if !convRecovered || conv == s.kcp.conv { // parity data or valid conversation
-				s.kcpInput(data)
+				s.packetInput(data)
 			} else if sn == 0 { // should replace current connection
 				// 网络切换会话保持改造后 这里的逻辑可能永远也执行不到了
 				s.Close()
@@ -700,8 +877,13 @@ func (l *Listener) packetInput(data []byte, addr net.Addr, convId uint64) {
 
 		if s == nil && convRecovered { // new session
 			if len(l.chAccepts) < cap(l.chAccepts) { // do not let the new sessions overwhelm accept queue
-				s := newUDPSession(conv, l, l.conn, false, addr)
-				s.kcpInput(data)
+				var s *UDPSession
+				if fc := l.takeConvFEC(conv); fc != nil {
+					s = newUDPSessionWithFEC(conv, l, l.conn, false, addr, fc.dataShards, fc.parityShards)
+				} else {
+					s = newUDPSession(conv, l, l.conn, false, addr)
+				}
+				s.packetInput(data)
 				l.sessionLock.Lock()
 				l.sessions[convId] = s
 				l.sessionLock.Unlock()
@@ -878,6 +1060,7 @@ func serveConn(conn net.PacketConn, ownConn bool) (*Listener, error) {
 	l.die = make(chan struct{})
 	l.chSocketReadError = make(chan struct{})
 	l.EnetNotify = make(chan *Enet, 1000)
+	l.fecConvMap = make(map[uint64]*fecConv)
 	go l.monitor()
 	return l, nil
 }
@@ -893,6 +1076,18 @@ func Dial(raddr string) (net.Conn, error) { return DialWithOptions(raddr) }
 //
 // Check https://github.com/klauspost/reedsolomon for details
 func DialWithOptions(raddr string) (*UDPSession, error) {
+	return dial(raddr, 0, 0)
+}
+
+// DialWithFEC 连接时请求开启前向纠错 服务器未开启时退化为普通连接
+func DialWithFEC(raddr string, dataShards, parityShards int) (*UDPSession, error) {
+	if !IsValidFecShards(dataShards, parityShards) {
+		return nil, errors.WithStack(errors.New("invalid fec shards"))
+	}
+	return dial(raddr, dataShards, parityShards)
+}
+
+func dial(raddr string, dataShards, parityShards int) (*UDPSession, error) {
 	// network type detection
 	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
 	if err != nil {
@@ -913,6 +1108,11 @@ func DialWithOptions(raddr string) (*UDPSession, error) {
 		ConnType: ConnEnetSyn,
 		EnetType: EnetClientConnectKey,
 	}
+	if dataShards > 0 {
+		// 请求开启前向纠错 convId字段携带分片参数
+		enet.ConvId = BuildEnetFecShards(dataShards, parityShards)
+		enet.EnetType = EnetClientFecConnectKey
+	}
 	data := BuildEnet(enet.ConnType, enet.EnetType, enet.ConvId)
 	_, err = conn.Write(data)
 	if err != nil {
@@ -928,11 +1128,14 @@ func DialWithOptions(raddr string) (*UDPSession, error) {
 	}
 	udpPayload := buf[:n]
 	connType, enetType, conv, err := ParseEnet(udpPayload)
-	if err != nil || connType != ConnEnetEst || enetType != EnetClientConnectKey {
+	if err != nil || connType != ConnEnetEst || (enetType != EnetClientConnectKey && enetType != EnetClientFecConnectKey) {
 		return nil, errors.WithStack(errors.New("recv packet format error"))
 	}
+	if enetType != EnetClientFecConnectKey {
+		dataShards, parityShards = 0, 0
+	}
 
-	return newUDPSession(conv, nil, conn, true, udpaddr), nil
+	return newUDPSessionWithFEC(conv, nil, conn, true, udpaddr, dataShards, parityShards), nil
 }
 
 // NewConn3 establishes a session and talks KCP protocol over a packet connection.
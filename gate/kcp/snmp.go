@@ -25,6 +25,10 @@ type Snmp struct {
 	EarlyRetransSegs uint64 // accmulated early retransmitted segments
 	LostSegs         uint64 // number of segs inferred as lost
 	RepeatSegs       uint64 // number of segs duplicated
+	FECRecovered     uint64 // correct packets recovered from FEC
+	FECErrs          uint64 // incorrect packets recovered from FEC
+	FECParityShards  uint64 // FEC segments received
+	FECShortShards   uint64 // number of data shards that's not enough for recovery
 }
 
 func newSnmp() *Snmp {
@@ -52,6 +56,10 @@ func (s *Snmp) Header() []string {
 		"EarlyRetransSegs",
 		"LostSegs",
 		"RepeatSegs",
+		"FECRecovered",
+		"FECErrs",
+		"FECParityShards",
+		"FECShortShards",
 	}
 }
 
@@ -77,6 +85,10 @@ func (s *Snmp) ToSlice() []string {
 		fmt.Sprint(snmp.EarlyRetransSegs),
 		fmt.Sprint(snmp.LostSegs),
 		fmt.Sprint(snmp.RepeatSegs),
+		fmt.Sprint(snmp.FECRecovered),
+		fmt.Sprint(snmp.FECErrs),
+		fmt.Sprint(snmp.FECParityShards),
+		fmt.Sprint(snmp.FECShortShards),
 	}
 }
 
@@ -101,6 +113,10 @@ func (s *Snmp) Copy() *Snmp {
 	d.EarlyRetransSegs = atomic.LoadUint64(&s.EarlyRetransSegs)
 	d.LostSegs = atomic.LoadUint64(&s.LostSegs)
 	d.RepeatSegs = atomic.LoadUint64(&s.RepeatSegs)
+	d.FECRecovered = atomic.LoadUint64(&s.FECRecovered)
+	d.FECErrs = atomic.LoadUint64(&s.FECErrs)
+	d.FECParityShards = atomic.LoadUint64(&s.FECParityShards)
+	d.FECShortShards = atomic.LoadUint64(&s.FECShortShards)
 	return d
 }
 
@@ -124,6 +140,10 @@ func (s *Snmp) Reset() {
 	atomic.StoreUint64(&s.EarlyRetransSegs, 0)
 	atomic.StoreUint64(&s.LostSegs, 0)
 	atomic.StoreUint64(&s.RepeatSegs, 0)
+	atomic.StoreUint64(&s.FECRecovered, 0)
+	atomic.StoreUint64(&s.FECErrs, 0)
+	atomic.StoreUint64(&s.FECParityShards, 0)
+	atomic.StoreUint64(&s.FECShortShards, 0)
 }
 
 // DefaultSnmp is the global KCP connection statistics collector
@@ -0,0 +1,229 @@
+package net
+
+import (
+	gonet "net"
+	"sort"
+	"time"
+
+	"hk4e/common/httpauth"
+	"hk4e/gate/kcp"
+	"hk4e/pkg/logger"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	pb "google.golang.org/protobuf/proto"
+)
+
+// 网关运维管理 供管理接口调用
+
+var connStateNameMap = map[uint8]string{
+	ConnEst:       "EST",
+	ConnWaitLogin: "WAIT_LOGIN",
+	ConnActive:    "ACTIVE",
+	ConnClose:     "CLOSE",
+}
+
+// SessionInfo 会话信息
+type SessionInfo struct {
+	UserId                 uint32  `json:"uid"`
+	ConvId                 uint64  `json:"conv_id"`
+	RemoteAddr             string  `json:"remote_addr"`
+	Rto                    uint32  `json:"rto"`
+	SRtt                   int32   `json:"srtt"`
+	SRttVar                int32   `json:"srtt_var"`
+	ConnState              string  `json:"conn_state"`
+	GsServerAppId          string  `json:"gs_app_id"`
+	AnticheatServerAppId   string  `json:"anticheat_app_id"`
+	PathfindingServerAppId string  `json:"pathfinding_app_id"`
+	ClientVersion          string  `json:"client_version"` // 客户端协议版本 未开启客户端协议代理时为空
+	Transport              string  `json:"transport"`      // 传输协议 kcp tcp ws
+	KcpProfile             string  `json:"kcp_profile"`
+	LossRate               float64 `json:"loss_rate"`         // 最近一个检测周期的重传率
+	FecDataShards          int     `json:"fec_data_shards"`   // 前向纠错数据分片数 未开启时为0
+	FecParityShards        int     `json:"fec_parity_shards"` // 前向纠错校验分片数 未开启时为0
+}
+
+// GetSessionInfoList 获取全部会话信息 按uid排序
+func (k *KcpConnectManager) GetSessionInfoList() []*SessionInfo {
+	sessionList := make([]*Session, 0)
+	k.sessionMapLock.RLock()
+	for _, session := range k.sessionConvIdMap {
+		sessionList = append(sessionList, session)
+	}
+	k.sessionMapLock.RUnlock()
+	sessionInfoList := make([]*SessionInfo, 0, len(sessionList))
+	for _, session := range sessionList {
+		conn := session.conn
+		clientVersion := ""
+		if session.clientCmdProtoMap != nil {
+			clientVersion = session.clientCmdProtoMap.GetVersion()
+		}
+		kcpProfile, lossRate := k.kcpProfileManager.getConnProfile(conn.GetConv())
+		fecDataShards, fecParityShards := 0, 0
+		if kcpConn, ok := conn.(*kcp.UDPSession); ok {
+			fecDataShards, fecParityShards = kcpConn.GetFEC()
+		}
+		sessionInfoList = append(sessionInfoList, &SessionInfo{
+			UserId:                 session.userId,
+			ConvId:                 conn.GetConv(),
+			RemoteAddr:             conn.RemoteAddr().String(),
+			Rto:                    conn.GetRTO(),
+			SRtt:                   conn.GetSRTT(),
+			SRttVar:                conn.GetSRTTVar(),
+			ConnState:              connStateNameMap[session.connState],
+			GsServerAppId:          session.gsServerAppId,
+			AnticheatServerAppId:   session.anticheatServerAppId,
+			PathfindingServerAppId: session.pathfindingServerAppId,
+			ClientVersion:          clientVersion,
+			Transport:              getConnTransport(conn),
+			KcpProfile:             kcpProfile,
+			LossRate:               lossRate,
+			FecDataShards:          fecDataShards,
+			FecParityShards:        fecParityShards,
+		})
+	}
+	sort.Slice(sessionInfoList, func(i, j int) bool {
+		return sessionInfoList[i].UserId < sessionInfoList[j].UserId
+	})
+	return sessionInfoList
+}
+
+// KickUser 按uid踢出玩家 玩家不在本网关时返回false
+func (k *KcpConnectManager) KickUser(userId uint32, reason uint32) bool {
+	session := k.GetSessionByUserId(userId)
+	if session == nil {
+		// 断线等待恢复的会话直接超时
+		return k.expireResumeSession(userId)
+	}
+	k.kcpEventInput <- &KcpEvent{
+		ConvId:       session.conn.GetConv(),
+		EventId:      KcpConnForceClose,
+		EventMessage: reason,
+	}
+	logger.Warn("admin kick user, uid: %v, reason: %v", userId, reason)
+	return true
+}
+
+// GetOpenState 获取网关开放状态
+func (k *KcpConnectManager) GetOpenState() bool {
+	return k.openState
+}
+
+// SetOpenState 改变网关开放状态 关闭时断开全部连接
+func (k *KcpConnectManager) SetOpenState(openState bool) {
+	k.kcpEventInput <- &KcpEvent{
+		EventId:      KcpGateOpenState,
+		EventMessage: openState,
+	}
+	logger.Warn("admin set gate open state: %v", openState)
+}
+
+type pushNotify struct {
+	userId         uint32
+	cmdId          uint16
+	payloadMessage pb.Message
+}
+
+// PushNotify 向指定玩家或全部已登录玩家推送协议 uid为0代表全部玩家
+// 协议内容为protobuf二进制数据或者json 优先使用json
+func (k *KcpConnectManager) PushNotify(userId uint32, cmdName string, payloadData []byte, payloadJson []byte) bool {
+	cmdId := k.serverCmdProtoMap.GetCmdIdByCmdName(cmdName)
+	if cmdId == 0 {
+		logger.Error("push notify cmd not found: %v", cmdName)
+		return false
+	}
+	payloadMessage := k.serverCmdProtoMap.GetProtoObjByCmdId(cmdId)
+	if payloadMessage == nil {
+		logger.Error("push notify proto obj is nil, cmdName: %v", cmdName)
+		return false
+	}
+	var err error = nil
+	if len(payloadJson) != 0 {
+		err = protojson.Unmarshal(payloadJson, payloadMessage)
+	} else {
+		err = pb.Unmarshal(payloadData, payloadMessage)
+	}
+	if err != nil {
+		logger.Error("unmarshal push notify payload error: %v, cmdName: %v", err, cmdName)
+		return false
+	}
+	k.pushNotifyChan <- &pushNotify{
+		userId:         userId,
+		cmdId:          cmdId,
+		payloadMessage: payloadMessage,
+	}
+	logger.Warn("admin push notify, uid: %v, cmdName: %v", userId, cmdName)
+	return true
+}
+
+// 在发送协程内分发推送的协议 避免向已关闭的会话发送管道写入
+func (k *KcpConnectManager) dispatchPushNotify(notify *pushNotify, convSessionMap map[uint64]*Session, userIdConvMap map[uint32]uint64) {
+	sessionList := make([]*Session, 0)
+	if notify.userId == 0 {
+		for _, session := range convSessionMap {
+			sessionList = append(sessionList, session)
+		}
+	} else {
+		convId, exist := userIdConvMap[notify.userId]
+		if !exist {
+			logger.Error("push notify user not found, uid: %v", notify.userId)
+			return
+		}
+		sessionList = append(sessionList, convSessionMap[convId])
+	}
+	for _, session := range sessionList {
+		if session == nil || session.connState != ConnActive {
+			continue
+		}
+		if len(session.kcpRawSendChan) == cap(session.kcpRawSendChan) {
+			logger.Error("kcpRawSendChan is full, convId: %v", session.conn.GetConv())
+			continue
+		}
+		session.kcpRawSendChan <- &ProtoMsg{
+			ConvId:         session.conn.GetConv(),
+			CmdId:          notify.cmdId,
+			HeadMessage:    k.getHeadMsg(0),
+			PayloadMessage: notify.payloadMessage,
+		}
+	}
+}
+
+// BanIp 临时封禁ip并断开该ip的全部连接 时长为0代表永久 ip格式错误时返回false
+func (k *KcpConnectManager) BanIp(ip string, duration time.Duration) bool {
+	if !k.ipFilter.BanIp(ip, duration) {
+		return false
+	}
+	logger.Warn("admin ban ip: %v, duration: %v", ip, duration)
+	convIdList := make([]uint64, 0)
+	k.sessionMapLock.RLock()
+	banIp := gonet.ParseIP(ip)
+	for convId, session := range k.sessionConvIdMap {
+		if gonet.ParseIP(httpauth.GetAddrIp(session.conn.RemoteAddr().String())).Equal(banIp) {
+			convIdList = append(convIdList, convId)
+		}
+	}
+	k.sessionMapLock.RUnlock()
+	for _, convId := range convIdList {
+		k.kcpEventInput <- &KcpEvent{
+			ConvId:       convId,
+			EventId:      KcpConnForceClose,
+			EventMessage: uint32(kcp.EnetServerKillClient),
+		}
+	}
+	return true
+}
+
+// UnbanIp 解除ip的临时封禁 不存在封禁时返回false
+func (k *KcpConnectManager) UnbanIp(ip string) bool {
+	logger.Warn("admin unban ip: %v", ip)
+	return k.ipFilter.UnbanIp(ip)
+}
+
+// GetBanIpList 获取临时封禁的ip列表
+func (k *KcpConnectManager) GetBanIpList() []*BanIpInfo {
+	return k.ipFilter.GetBanIpList()
+}
+
+// IsValidEnetReason 是否为有效的enet断开原因
+func IsValidEnetReason(reason uint32) bool {
+	return reason <= kcp.EnetAccountPasswordChange
+}
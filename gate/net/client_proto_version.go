@@ -0,0 +1,102 @@
+package net
+
+import (
+	"hk4e/gate/client_proto"
+	"hk4e/pkg/logger"
+
+	pb "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// 客户端协议版本协商
+// 开启客户端协议代理时 连接的第一个包必须是GetPlayerTokenReq
+// 只有一个版本能解析出有效账号信息时直接使用该版本
+// 多个版本都能解析时 以该连接的账号combo token签发时客户端上报的版本为准 没有上报记录时使用默认版本
+// 都不能解析时使用默认版本 默认版本为配置的第一个版本
+// 之后该连接的上下行协议都使用选出的版本转换
+
+// 选择连接使用的客户端版本
+func (k *KcpConnectManager) selectClientCmdProtoMap(kcpMsg *KcpMsg, session *Session) *client_proto.ClientCmdProtoMap {
+	defaultClientCmdProtoMap := k.clientCmdProtoMapList[0]
+	matchList := make([]*client_proto.ClientCmdProtoMap, 0)
+	for _, clientCmdProtoMap := range k.clientCmdProtoMapList {
+		if isValidGetPlayerTokenReq(kcpMsg, clientCmdProtoMap) {
+			matchList = append(matchList, clientCmdProtoMap)
+		}
+	}
+	if len(matchList) == 0 {
+		logger.Warn("no client proto version match, use default version: %v", defaultClientCmdProtoMap.GetVersion())
+		return defaultClientCmdProtoMap
+	}
+	if len(matchList) == 1 {
+		return matchList[0]
+	}
+	reportVersion := k.getTokenClientVersion(kcpMsg, matchList[0], session)
+	for _, clientCmdProtoMap := range matchList {
+		if clientCmdProtoMap.GetVersion() == reportVersion {
+			return clientCmdProtoMap
+		}
+	}
+	for _, clientCmdProtoMap := range matchList {
+		if clientCmdProtoMap == defaultClientCmdProtoMap {
+			return clientCmdProtoMap
+		}
+	}
+	return matchList[0]
+}
+
+// 使用指定版本的协议号和协议解析GetPlayerTokenReq 是否能解析出有效的账号信息
+func isValidGetPlayerTokenReq(kcpMsg *KcpMsg, clientCmdProtoMap *client_proto.ClientCmdProtoMap) bool {
+	if !clientCmdProtoMap.IsClientCmd(kcpMsg.CmdId, "GetPlayerTokenReq") {
+		return false
+	}
+	req := GetClientProtoObjByName("GetPlayerTokenReq", clientCmdProtoMap)
+	if req == nil {
+		return false
+	}
+	err := pb.Unmarshal(kcpMsg.ProtoData, req)
+	if err != nil {
+		return false
+	}
+	// 协议字段序号随版本变化 用错版本解析时账号信息通常为空或不是数字账号id
+	accountUid := getProtoStringField(req, "account_uid")
+	if accountUid == "" || getProtoStringField(req, "account_token") == "" {
+		return false
+	}
+	for _, c := range accountUid {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// 获取连接的账号combo token签发时客户端上报的版本 获取失败时返回空
+// 能解析出有效账号信息的版本之间账号字段相同 使用其中任意一个版本解析即可
+// 校验结果缓存在会话上 处理GetPlayerTokenReq时不再重复请求dispatch
+func (k *KcpConnectManager) getTokenClientVersion(kcpMsg *KcpMsg, clientCmdProtoMap *client_proto.ClientCmdProtoMap, session *Session) string {
+	req := GetClientProtoObjByName("GetPlayerTokenReq", clientCmdProtoMap)
+	if req == nil {
+		return ""
+	}
+	err := pb.Unmarshal(kcpMsg.ProtoData, req)
+	if err != nil {
+		return ""
+	}
+	tokenVerifyRsp, err := k.verifyToken(getProtoStringField(req, "account_uid"), getProtoStringField(req, "account_token"), session)
+	if err != nil {
+		return ""
+	}
+	if !tokenVerifyRsp.Valid {
+		return ""
+	}
+	return tokenVerifyRsp.ClientVersion
+}
+
+func getProtoStringField(message pb.Message, fieldName string) string {
+	field := message.ProtoReflect().Descriptor().Fields().ByName(protoreflect.Name(fieldName))
+	if field == nil || field.Kind() != protoreflect.StringKind {
+		return ""
+	}
+	return message.ProtoReflect().Get(field).String()
+}
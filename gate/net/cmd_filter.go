@@ -0,0 +1,198 @@
+package net
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"hk4e/common/config"
+	"hk4e/gate/kcp"
+	"hk4e/pkg/logger"
+	"hk4e/protocol/cmd"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// 上行协议过滤
+// 按连接状态声明允许客户端上行的协议 不在表中的协议在转发到GS之前按配置的动作处理
+// 协议定义的CmdId枚举中的IS_ALLOW_CLIENT标记不可信 不少服务器下行的Notify和Rsp也带有该标记
+// 已激活状态按协议方向放行 允许标记了IS_ALLOW_CLIENT的Req和明确列出的客户端上行Notify 任何Rsp都不允许上行
+// 聚合消息UnionCmdNotify解包后的每个协议单独过滤
+
+const (
+	CmdFilterActionLog  = "log"  // 只记录日志
+	CmdFilterActionDrop = "drop" // 丢弃
+	CmdFilterActionKick = "kick" // 断开连接
+)
+
+const (
+	CmdFilterPass = iota // 放行
+	CmdFilterDrop        // 丢弃
+	CmdFilterKick        // 断开连接
+)
+
+type cmdAllowRule struct {
+	cmdNameList     []string // 允许的协议名
+	allowClientReq  bool     // 是否允许全部标记了IS_ALLOW_CLIENT的Req
+	denyCmdNameList []string // 在allowClient基础上排除的协议名
+}
+
+// 各连接状态允许的上行协议
+var connStateCmdAllowTable = map[uint8]*cmdAllowRule{
+	ConnEst: {
+		cmdNameList: []string{"GetPlayerTokenReq", "PingReq"},
+	},
+	ConnWaitLogin: {
+		cmdNameList: []string{"PlayerLoginReq", "PingReq"},
+	},
+	ConnActive: {
+		cmdNameList:     clientNotifyCmdNameList,
+		allowClientReq:  true,
+		denyCmdNameList: []string{"GetPlayerTokenReq", "PlayerLoginReq"},
+	},
+}
+
+// 客户端上行的Notify 服务器下行的Notify不能加在这里
+var clientNotifyCmdNameList = []string{
+	"UnionCmdNotify",
+	"CombatInvocationsNotify",
+	"AbilityInvocationsNotify",
+	"ClientAbilityInitFinishNotify",
+	"ClientAbilityChangeNotify",
+	"MassiveEntityElementOpBatchNotify",
+	"EntityAiSyncNotify",
+	"EntityConfigHashNotify",
+	"MonsterAIConfigHashNotify",
+	"SetEntityClientDataNotify",
+	"EvtDoSkillSuccNotify",
+	"EvtAiSyncCombatThreatInfoNotify",
+	"EvtAiSyncSkillCdNotify",
+	"EvtAnimatorParameterNotify",
+	"EvtAnimatorStateChangedNotify",
+	"EvtAvatarEnterFocusNotify",
+	"EvtAvatarUpdateFocusNotify",
+	"EvtAvatarExitFocusNotify",
+	"EvtEntityRenderersChangedNotify",
+	"EvtCreateGadgetNotify",
+	"EvtDestroyGadgetNotify",
+	"ObstacleModifyNotify",
+	"NavMeshStatsNotify",
+	"SceneAudioNotify",
+}
+
+type CmdFilter struct {
+	cmdProtoMap   *cmd.CmdProtoMap
+	allowCmdMap   map[uint8]map[uint16]bool // key1:connState key2:cmdId
+	action        string
+	kickReason    uint32
+	violateCount  uint64
+	violateCmdMap map[string]uint64 // key:连接状态和协议名
+	violateLock   sync.Mutex
+}
+
+func NewCmdFilter(cmdProtoMap *cmd.CmdProtoMap) (r *CmdFilter) {
+	r = new(CmdFilter)
+	r.cmdProtoMap = cmdProtoMap
+	cmdFilterConfig := config.GetConfig().Gate.CmdFilter
+	r.action = cmdFilterConfig.Action
+	switch r.action {
+	case CmdFilterActionLog, CmdFilterActionDrop, CmdFilterActionKick:
+	default:
+		if r.action != "" {
+			logger.Error("unknown cmd filter action: %v", r.action)
+		}
+		r.action = CmdFilterActionDrop
+	}
+	r.kickReason = cmdFilterConfig.KickReason
+	if r.kickReason == 0 {
+		r.kickReason = kcp.EnetServerKick
+	}
+	allowClientReqIdList := make([]uint16, 0)
+	for _, cmdId := range cmdProtoMap.GetCmdIdList() {
+		if isAllowClientReq(cmdProtoMap, cmdId) {
+			allowClientReqIdList = append(allowClientReqIdList, cmdId)
+		}
+	}
+	r.allowCmdMap = make(map[uint8]map[uint16]bool)
+	for connState, rule := range connStateCmdAllowTable {
+		allowCmdMap := make(map[uint16]bool)
+		if rule.allowClientReq {
+			for _, cmdId := range allowClientReqIdList {
+				allowCmdMap[cmdId] = true
+			}
+		}
+		cmdNameList := append([]string{}, rule.cmdNameList...)
+		if connState == ConnActive {
+			cmdNameList = append(cmdNameList, cmdFilterConfig.AllowCmdList...)
+		}
+		for _, cmdName := range cmdNameList {
+			cmdId := cmdProtoMap.GetCmdIdByCmdName(cmdName)
+			if cmdId == 0 {
+				continue
+			}
+			allowCmdMap[cmdId] = true
+		}
+		for _, cmdName := range rule.denyCmdNameList {
+			delete(allowCmdMap, cmdProtoMap.GetCmdIdByCmdName(cmdName))
+		}
+		r.allowCmdMap[connState] = allowCmdMap
+	}
+	r.violateCmdMap = make(map[string]uint64)
+	return r
+}
+
+// 是否为协议定义的CmdId枚举中标记了IS_ALLOW_CLIENT的Req
+func isAllowClientReq(cmdProtoMap *cmd.CmdProtoMap, cmdId uint16) bool {
+	if !strings.HasSuffix(cmdProtoMap.GetCmdNameByCmdId(cmdId), "Req") {
+		return false
+	}
+	protoObj := cmdProtoMap.GetProtoObjByCmdId(cmdId)
+	if protoObj == nil {
+		return false
+	}
+	enum := protoObj.ProtoReflect().Descriptor().Enums().ByName("CmdId")
+	if enum == nil {
+		return false
+	}
+	value := enum.Values().ByName(protoreflect.Name("IS_ALLOW_CLIENT"))
+	return value != nil && value.Number() == 1
+}
+
+// Check 检查当前连接状态下是否允许客户端上行该协议
+func (f *CmdFilter) Check(connState uint8, cmdId uint16, convId uint64, userId uint32) int {
+	if f.allowCmdMap[connState][cmdId] {
+		return CmdFilterPass
+	}
+	cmdName := f.cmdProtoMap.GetCmdNameByCmdId(cmdId)
+	atomic.AddUint64(&f.violateCount, 1)
+	f.violateLock.Lock()
+	f.violateCmdMap[connStateNameMap[connState]+":"+cmdName]++
+	f.violateLock.Unlock()
+	logger.Error("cmd not allowed in conn state, state: %v, cmdId: %v, cmdName: %v, action: %v, convId: %v, uid: %v",
+		connStateNameMap[connState], cmdId, cmdName, f.action, convId, userId)
+	switch f.action {
+	case CmdFilterActionLog:
+		return CmdFilterPass
+	case CmdFilterActionKick:
+		return CmdFilterKick
+	default:
+		return CmdFilterDrop
+	}
+}
+
+// GetKickReason kick动作的enet原因
+func (f *CmdFilter) GetKickReason() uint32 {
+	return f.kickReason
+}
+
+// GetCmdFilterStat 获取各连接状态下违规协议的次数 key:连接状态和协议名
+func (f *CmdFilter) GetCmdFilterStat() map[string]uint64 {
+	stat := make(map[string]uint64)
+	f.violateLock.Lock()
+	for key, count := range f.violateCmdMap {
+		stat[key] = count
+	}
+	f.violateLock.Unlock()
+	stat["TOTAL"] = atomic.LoadUint64(&f.violateCount)
+	return stat
+}
@@ -0,0 +1,36 @@
+package net
+
+import (
+	"os"
+	"testing"
+
+	"hk4e/common/config"
+	"hk4e/pkg/logger"
+	"hk4e/protocol/cmd"
+)
+
+func TestMain(m *testing.M) {
+	config.CONF = &config.Config{Logger: config.Logger{Level: "DEBUG", Mode: "CONSOLE", Track: true}}
+	logger.InitLogger("net_test")
+	code := m.Run()
+	logger.CloseLogger()
+	os.Exit(code)
+}
+
+func TestCmdFilterActiveDirection(t *testing.T) {
+	cmdProtoMap := cmd.NewCmdProtoMap()
+	cmdFilter := NewCmdFilter(cmdProtoMap)
+	passCmdIdList := []uint16{cmd.SceneInitFinishReq, cmd.CombatInvocationsNotify, cmd.UnionCmdNotify, cmd.PingReq}
+	for _, cmdId := range passCmdIdList {
+		if cmdFilter.Check(ConnActive, cmdId, 0, 0) != CmdFilterPass {
+			t.Errorf("client cmd rejected in active state, cmdName: %v", cmdProtoMap.GetCmdNameByCmdId(cmdId))
+		}
+	}
+	// 服务器下行的协议即使带有IS_ALLOW_CLIENT标记也不允许上行
+	dropCmdIdList := []uint16{cmd.SceneKickPlayerNotify, cmd.PlayerEnterSceneInfoNotify, cmd.SceneInitFinishRsp, cmd.GetPlayerTokenReq}
+	for _, cmdId := range dropCmdIdList {
+		if cmdFilter.Check(ConnActive, cmdId, 0, 0) != CmdFilterDrop {
+			t.Errorf("server cmd allowed in active state, cmdName: %v", cmdProtoMap.GetCmdNameByCmdId(cmdId))
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package net
+
+import (
+	gonet "net"
+	"time"
+
+	"hk4e/gate/kcp"
+)
+
+// 客户端连接
+// KCP连接和TCP WebSocket连接共用同一套会话和登录流程
+// 每次Read读取一个完整的消息 每次Write写入一个完整的消息
+
+const (
+	TransportKcp       = "kcp"
+	TransportTcp       = "tcp"
+	TransportWebSocket = "ws"
+)
+
+type Conn interface {
+	GetConv() uint64
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+	Close() error
+	RemoteAddr() gonet.Addr
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SendEnetNotifyToPeer(enet *kcp.Enet)
+	GetRTO() uint32
+	GetSRTT() int32
+	GetSRTTVar() int32
+}
+
+// 获取连接的传输协议
+func getConnTransport(conn Conn) string {
+	switch c := conn.(type) {
+	case *kcp.UDPSession:
+		return TransportKcp
+	case *streamConn:
+		return c.transport
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,207 @@
+package net
+
+import (
+	gonet "net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"hk4e/common/config"
+	"hk4e/pkg/logger"
+)
+
+// 网关ip过滤
+// 配置的CIDR允许列表和禁止列表 以及运行时的临时封禁
+// 单个ip在时间窗口内频繁触发握手包限流时自动临时封禁
+
+type ipConnSynHit struct {
+	count     int32
+	startTime int64
+}
+
+// BanIpInfo 封禁ip信息
+type BanIpInfo struct {
+	Ip         string `json:"ip"`
+	ExpireTime int64  `json:"expire_time"` // 解封时间 秒级时间戳 0为永久
+}
+
+type IpFilter struct {
+	allowList     []*gonet.IPNet
+	denyList      []*gonet.IPNet
+	autoBanHit    int32
+	autoBanWindow time.Duration
+	autoBanTime   time.Duration
+	banIpMap      map[string]int64 // key:ip value:解封时间 纳秒级时间戳 0为永久
+	connSynHitMap map[string]*ipConnSynHit
+	lock          sync.RWMutex
+}
+
+func NewIpFilter() (r *IpFilter) {
+	r = new(IpFilter)
+	ipFilterConfig := config.GetConfig().Gate.IpFilter
+	r.allowList = parseIpNetList(ipFilterConfig.AllowList)
+	r.denyList = parseIpNetList(ipFilterConfig.DenyList)
+	r.autoBanHit = ipFilterConfig.AutoBanHit
+	r.autoBanWindow = time.Second * time.Duration(ipFilterConfig.AutoBanWindow)
+	r.autoBanTime = time.Second * time.Duration(ipFilterConfig.AutoBanTime)
+	r.banIpMap = make(map[string]int64)
+	r.connSynHitMap = make(map[string]*ipConnSynHit)
+	go r.cleanHandle()
+	return r
+}
+
+// 解析ip或CIDR列表 单个ip视为掩码全长的CIDR
+func parseIpNetList(list []string) []*gonet.IPNet {
+	ipNetList := make([]*gonet.IPNet, 0, len(list))
+	for _, item := range list {
+		if !strings.Contains(item, "/") {
+			ip := gonet.ParseIP(item)
+			if ip == nil {
+				logger.Error("parse ip error, ip: %v", item)
+				continue
+			}
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipNet, err := gonet.ParseCIDR(item)
+		if err != nil {
+			logger.Error("parse cidr error: %v, cidr: %v", err, item)
+			continue
+		}
+		ipNetList = append(ipNetList, ipNet)
+	}
+	return ipNetList
+}
+
+func ipNetListContains(ipNetList []*gonet.IPNet, ip gonet.IP) bool {
+	for _, ipNet := range ipNetList {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsIpAllowed ip是否允许连接
+func (f *IpFilter) IsIpAllowed(ipStr string) bool {
+	ip := gonet.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	if ipNetListContains(f.denyList, ip) {
+		return false
+	}
+	if len(f.allowList) != 0 && !ipNetListContains(f.allowList, ip) {
+		return false
+	}
+	f.lock.RLock()
+	expireTime, exist := f.banIpMap[ip.String()]
+	f.lock.RUnlock()
+	if exist && (expireTime == 0 || time.Now().UnixNano() < expireTime) {
+		return false
+	}
+	return true
+}
+
+// 单个ip触发握手包限流 时间窗口内次数达到阈值时自动临时封禁
+func (f *IpFilter) onConnSynLimit(ipStr string) {
+	if f.autoBanHit <= 0 || f.autoBanTime <= 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	f.lock.Lock()
+	hit, exist := f.connSynHitMap[ipStr]
+	if !exist || now-hit.startTime > int64(f.autoBanWindow) {
+		hit = &ipConnSynHit{
+			count:     0,
+			startTime: now,
+		}
+		f.connSynHitMap[ipStr] = hit
+	}
+	hit.count++
+	ban := hit.count >= f.autoBanHit
+	if ban {
+		delete(f.connSynHitMap, ipStr)
+	}
+	f.lock.Unlock()
+	if ban {
+		f.BanIp(ipStr, f.autoBanTime)
+		logger.Warn("ip conn syn too frequent, auto ban ip: %v, duration: %v", ipStr, f.autoBanTime)
+	}
+}
+
+// BanIp 临时封禁ip 时长为0代表永久 ip格式错误时返回false
+func (f *IpFilter) BanIp(ipStr string, duration time.Duration) bool {
+	ip := gonet.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	expireTime := int64(0)
+	if duration > 0 {
+		expireTime = time.Now().Add(duration).UnixNano()
+	}
+	f.lock.Lock()
+	f.banIpMap[ip.String()] = expireTime
+	f.lock.Unlock()
+	return true
+}
+
+// UnbanIp 解除ip的临时封禁 不存在封禁时返回false
+func (f *IpFilter) UnbanIp(ipStr string) bool {
+	ip := gonet.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	f.lock.Lock()
+	_, exist := f.banIpMap[ip.String()]
+	delete(f.banIpMap, ip.String())
+	f.lock.Unlock()
+	return exist
+}
+
+// GetBanIpList 获取临时封禁的ip列表 按ip排序
+func (f *IpFilter) GetBanIpList() []*BanIpInfo {
+	banIpList := make([]*BanIpInfo, 0)
+	f.lock.RLock()
+	for ip, expireTime := range f.banIpMap {
+		banIpInfo := &BanIpInfo{
+			Ip:         ip,
+			ExpireTime: 0,
+		}
+		if expireTime != 0 {
+			banIpInfo.ExpireTime = expireTime / int64(time.Second)
+		}
+		banIpList = append(banIpList, banIpInfo)
+	}
+	f.lock.RUnlock()
+	sort.Slice(banIpList, func(i, j int) bool {
+		return banIpList[i].Ip < banIpList[j].Ip
+	})
+	return banIpList
+}
+
+// 清理过期的封禁和限流触发统计
+func (f *IpFilter) cleanHandle() {
+	ticker := time.NewTicker(time.Second * 10)
+	for {
+		<-ticker.C
+		now := time.Now().UnixNano()
+		f.lock.Lock()
+		for ip, expireTime := range f.banIpMap {
+			if expireTime != 0 && now >= expireTime {
+				delete(f.banIpMap, ip)
+				logger.Info("ip ban expire, ip: %v", ip)
+			}
+		}
+		for ip, hit := range f.connSynHitMap {
+			if now-hit.startTime > int64(f.autoBanWindow) {
+				delete(f.connSynHitMap, ip)
+			}
+		}
+		f.lock.Unlock()
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"hk4e/common/config"
+	"hk4e/common/httpauth"
 	"hk4e/common/mq"
 	"hk4e/common/region"
 	"hk4e/common/rpc"
@@ -23,20 +24,18 @@ import (
 )
 
 const (
-	ConnSynPacketFreqLimit = 100        // 连接建立握手包每秒发包频率限制
-	RecvPacketFreqLimit    = 1000       // 客户端上行每秒发包频率限制
-	SendPacketFreqLimit    = 1000       // 服务器下行每秒发包频率限制
-	PacketMaxLen           = 343 * 1024 // 最大应用层包长度
-	ConnRecvTimeout        = 30         // 收包超时时间 秒
-	ConnSendTimeout        = 10         // 发包超时时间 秒
-	MaxClientConnNumLimit  = 1000       // 最大客户端连接数限制
+	PacketMaxLen          = 343 * 1024 // 最大应用层包长度
+	ConnRecvTimeout       = 30         // 收包超时时间 秒
+	ConnSendTimeout       = 10         // 发包超时时间 秒
+	MaxClientConnNumLimit = 1000       // 默认最大客户端连接数限制
 )
 
 var CLIENT_CONN_NUM int32 = 0 // 当前客户端连接数
 
 type KcpConnectManager struct {
-	discovery *rpc.DiscoveryClient // node服务器客户端
-	openState bool                 // 网关开放状态
+	discovery  *rpc.DiscoveryClient // node服务器客户端
+	openState  bool                 // 网关开放状态
+	drainState bool                 // 网关排空状态 排空时不再接受新连接 已有连接保持不变
 	// 会话
 	sessionConvIdMap      map[uint64]*Session
 	sessionUserIdMap      map[uint32]*Session
@@ -45,19 +44,38 @@ type KcpConnectManager struct {
 	destroySessionChan    chan *Session
 	globalGsOnlineMap     map[uint32]string
 	globalGsOnlineMapLock sync.RWMutex
+	// 会话恢复
+	resumeSessionMap     map[uint64]*resumeSession // 断线等待恢复的会话 key:convId
+	resumeTokenConvIdMap map[uint64]uint64         // key:恢复令牌 value:convId
+	resumeLock           sync.Mutex
 	// 连接事件
 	kcpEventInput            chan *KcpEvent
 	kcpEventOutput           chan *KcpEvent
 	reLoginRemoteKickRegChan chan *RemoteKick
+	pushNotifyChan           chan *pushNotify
 	// 协议
-	serverCmdProtoMap *cmd.CmdProtoMap
-	clientCmdProtoMap *client_proto.ClientCmdProtoMap
+	serverCmdProtoMap     *cmd.CmdProtoMap
+	clientCmdProtoMapList []*client_proto.ClientCmdProtoMap // 各客户端版本的协议映射 按配置的版本顺序
+	// 限流
+	rateLimiter *RateLimiter
+	// ip过滤
+	ipFilter *IpFilter
+	// 上行协议过滤
+	cmdFilter *CmdFilter
+	// KCP配置
+	kcpProfileManager *kcpProfileManager
+	// 响应缓存
+	respCache *RespCache
+	// 抓包记录
+	packetRecorder *PacketRecorder
 	// 输入输出管道
 	messageQueue *mq.MessageQueue
 	// 密钥
-	dispatchKey  []byte
-	signRsaKey   []byte
-	encRsaKeyMap map[string][]byte
+	dispatchKey     []byte
+	dispatchKeyPrev []byte // 区服密钥轮换后的重叠期内仍然有效的旧密钥
+	dispatchKeyLock sync.RWMutex
+	signRsaKey      []byte
+	encRsaKeyMap    map[string][]byte
 }
 
 func NewKcpConnectManager(messageQueue *mq.MessageQueue, discovery *rpc.DiscoveryClient) (r *KcpConnectManager) {
@@ -69,13 +87,33 @@ func NewKcpConnectManager(messageQueue *mq.MessageQueue, discovery *rpc.Discover
 	r.createSessionChan = make(chan *Session, 1000)
 	r.destroySessionChan = make(chan *Session, 1000)
 	r.globalGsOnlineMap = make(map[uint32]string)
+	r.resumeSessionMap = make(map[uint64]*resumeSession)
+	r.resumeTokenConvIdMap = make(map[uint64]uint64)
 	r.kcpEventInput = make(chan *KcpEvent, 1000)
 	r.kcpEventOutput = make(chan *KcpEvent, 1000)
 	r.reLoginRemoteKickRegChan = make(chan *RemoteKick, 1000)
+	r.pushNotifyChan = make(chan *pushNotify, 1000)
 	r.serverCmdProtoMap = cmd.NewCmdProtoMap()
 	if config.GetConfig().Hk4e.ClientProtoProxyEnable {
-		r.clientCmdProtoMap = client_proto.NewClientCmdProtoMap()
+		r.clientCmdProtoMapList = make([]*client_proto.ClientCmdProtoMap, 0)
+		for _, version := range strings.Split(config.GetConfig().Hk4e.Version, ",") {
+			clientCmdProtoMap := client_proto.NewClientCmdProtoMap(version)
+			if clientCmdProtoMap == nil {
+				continue
+			}
+			r.clientCmdProtoMapList = append(r.clientCmdProtoMapList, clientCmdProtoMap)
+		}
+		if len(r.clientCmdProtoMapList) == 0 {
+			logger.Error("no client proto version loaded, client proto proxy disable, version: %v", config.GetConfig().Hk4e.Version)
+			r.clientCmdProtoMapList = nil
+		}
 	}
+	r.rateLimiter = NewRateLimiter(r.serverCmdProtoMap)
+	r.ipFilter = NewIpFilter()
+	r.cmdFilter = NewCmdFilter(r.serverCmdProtoMap)
+	r.kcpProfileManager = newKcpProfileManager()
+	r.respCache = NewRespCache(r.serverCmdProtoMap)
+	r.packetRecorder = NewPacketRecorder(r.serverCmdProtoMap)
 	r.messageQueue = messageQueue
 	r.run()
 	return r
@@ -85,25 +123,10 @@ func (k *KcpConnectManager) run() {
 	// 读取密钥相关文件
 	k.signRsaKey, k.encRsaKeyMap, _ = region.LoadRsaKey()
 	// key
-	rsp, err := k.discovery.GetRegionEc2B(context.TODO(), &api.NullMsg{})
-	if err != nil {
-		logger.Error("get region ec2b error: %v", err)
-		return
-	}
-	ec2b, err := random.LoadEc2bKey(rsp.Data)
+	err := k.syncRegionEc2b()
 	if err != nil {
-		logger.Error("parse region ec2b error: %v", err)
 		return
 	}
-	regionEc2b := random.NewEc2b()
-	regionEc2b.SetSeed(ec2b.Seed())
-	// 3.7的时候修改了xor 首包无需使用加密密钥
-	if k.getGateMaxVersion() < 370 {
-		k.dispatchKey = regionEc2b.XorKey()
-	} else {
-		// 全部填充为0 不然会出问题
-		k.dispatchKey = make([]byte, 4096)
-	}
 	// kcp
 	port := strconv.Itoa(int(config.GetConfig().Hk4e.KcpPort))
 	listener, err := kcp.ListenWithOptions("0.0.0.0:" + port)
@@ -115,15 +138,49 @@ func (k *KcpConnectManager) run() {
 	go k.eventHandle()
 	go k.sendMsgHandle()
 	go k.acceptHandle(listener)
+	k.runStreamTransport()
 	go k.gateNetInfo()
+	go k.resumeSessionExpireHandle()
+	go k.respCacheTimeoutHandle()
+	go k.kcpProfileHandle()
 	k.syncGlobalGsOnlineMap()
 	go k.autoSyncGlobalGsOnlineMap()
+	go k.autoSyncRegionEc2b()
 }
 
 func (k *KcpConnectManager) Close() {
 	k.closeAllKcpConn()
 }
 
+// GetRateLimitStat 获取各限流规则的触发次数
+func (k *KcpConnectManager) GetRateLimitStat() map[string]uint64 {
+	return k.rateLimiter.GetRateLimitStat()
+}
+
+// GetCmdFilterStat 获取上行协议过滤的违规次数
+func (k *KcpConnectManager) GetCmdFilterStat() map[string]uint64 {
+	return k.cmdFilter.GetCmdFilterStat()
+}
+
+// GetRespCacheStat 获取响应缓存的命中 合并和转发次数
+func (k *KcpConnectManager) GetRespCacheStat() map[string]uint64 {
+	return k.respCache.GetRespCacheStat()
+}
+
+// GetPacketRecorder 获取抓包记录器
+func (k *KcpConnectManager) GetPacketRecorder() *PacketRecorder {
+	return k.packetRecorder
+}
+
+// 获取最大客户端连接数限制
+func (k *KcpConnectManager) getMaxClientConnNum() int32 {
+	maxClientConnNum := config.GetConfig().Gate.MaxClientConnNum
+	if maxClientConnNum <= 0 {
+		return MaxClientConnNumLimit
+	}
+	return maxClientConnNum
+}
+
 // getGateMaxVersion 获取gate最大可兼容的版本
 func (k *KcpConnectManager) getGateMaxVersion() (maxVersion int) {
 	versionSplit := strings.Split(config.GetConfig().Hk4e.Version, ",")
@@ -152,7 +209,10 @@ func (k *KcpConnectManager) gateNetInfo() {
 		logger.Info("udp send: %v pps, udp recv: %v pps", snmp.OutPkts/60, snmp.InPkts/60)
 		clientConnNum := atomic.LoadInt32(&CLIENT_CONN_NUM)
 		logger.Info("conn num: %v, new conn num: %v, kcp error num: %v", clientConnNum, snmp.CurrEstab, kcpErrorCount)
+		logger.Info("kcp retrans seg: %v, lost seg: %v, fec recovered: %v, fec parity shard: %v, fec short shard: %v",
+			snmp.RetransSegs, snmp.LostSegs, snmp.FECRecovered, snmp.FECParityShards, snmp.FECShortShards)
 		kcp.DefaultSnmp.Reset()
+		k.rateLimiter.logRateLimitStat()
 	}
 }
 
@@ -166,38 +226,89 @@ func (k *KcpConnectManager) acceptHandle(listener *kcp.Listener) {
 			return
 		}
 		convId := conn.GetConv()
-		if k.openState == false {
-			logger.Error("gate not open, convId: %v", convId)
+		if !k.checkNewConn(conn) {
 			_ = conn.Close()
 			continue
 		}
 		conn.SetACKNoDelay(true)
 		conn.SetWriteDelay(false)
-		conn.SetWindowSize(255, 255)
+		k.kcpProfileManager.initConn(conn)
 		atomic.AddInt32(&CLIENT_CONN_NUM, 1)
 		logger.Info("client connect, convId: %v", convId)
-		kcpRawSendChan := make(chan *ProtoMsg, 1000)
-		session := &Session{
-			conn:                   conn,
-			connState:              ConnEst,
-			userId:                 0,
-			kcpRawSendChan:         kcpRawSendChan,
-			seed:                   0,
-			xorKey:                 k.dispatchKey,
-			changeXorKeyFin:        false,
-			gsServerAppId:          "",
-			anticheatServerAppId:   "",
-			pathfindingServerAppId: "",
-			useMagicSeed:           false,
-		}
-		go k.recvHandle(session)
-		go k.sendHandle(session)
-		// 连接建立成功通知
-		k.kcpEventOutput <- &KcpEvent{
-			ConvId:       convId,
-			EventId:      KcpConnEstNotify,
-			EventMessage: conn.RemoteAddr().String(),
+		// 恢复断线等待中的会话
+		if k.resumeSession(conn) {
+			k.kcpEventOutput <- &KcpEvent{
+				ConvId:       convId,
+				EventId:      KcpConnEstNotify,
+				EventMessage: conn.RemoteAddr().String(),
+			}
+			continue
 		}
+		k.newSession(conn)
+	}
+}
+
+// 检查是否允许建立新连接
+func (k *KcpConnectManager) checkNewConn(conn Conn) bool {
+	convId := conn.GetConv()
+	if k.openState == false {
+		logger.Error("gate not open, convId: %v", convId)
+		return false
+	}
+	if k.drainState == true {
+		logger.Error("gate is draining, convId: %v", convId)
+		return false
+	}
+	addr := conn.RemoteAddr().String()
+	if !k.ipFilter.IsIpAllowed(httpauth.GetAddrIp(addr)) {
+		logger.Error("ip not allowed, convId: %v, addr: %v", convId, addr)
+		return false
+	}
+	return true
+}
+
+// 检查连接建立握手 ip过滤和握手频率限制 握手阶段没有连接可断开 不通过一律丢弃
+func (k *KcpConnectManager) checkConnSyn(addr string) bool {
+	ip := httpauth.GetAddrIp(addr)
+	if !k.ipFilter.IsIpAllowed(ip) {
+		logger.Info("ip not allowed, ignore conn syn, addr: %v", addr)
+		return false
+	}
+	if k.rateLimiter.CheckIpConnSyn(ip) != RateLimitPass {
+		k.ipFilter.onConnSynLimit(ip)
+		return false
+	}
+	if k.rateLimiter.CheckConnSyn() != RateLimitPass {
+		return false
+	}
+	return true
+}
+
+// 为新连接创建会话并开始收发
+func (k *KcpConnectManager) newSession(conn Conn) {
+	addr := conn.RemoteAddr().String()
+	kcpRawSendChan := make(chan *ProtoMsg, 1000)
+	session := &Session{
+		conn:                   conn,
+		connState:              ConnEst,
+		userId:                 0,
+		kcpRawSendChan:         kcpRawSendChan,
+		seed:                   0,
+		xorKey:                 k.getDispatchKey(),
+		changeXorKeyFin:        false,
+		gsServerAppId:          "",
+		anticheatServerAppId:   "",
+		pathfindingServerAppId: "",
+		useMagicSeed:           false,
+		rateLimit:              k.rateLimiter.newSessionRateLimit(httpauth.GetAddrIp(addr)),
+	}
+	go k.recvHandle(session)
+	go k.sendHandle(session)
+	// 连接建立成功通知
+	k.kcpEventOutput <- &KcpEvent{
+		ConvId:       conn.GetConv(),
+		EventId:      KcpConnEstNotify,
+		EventMessage: addr,
 	}
 }
 
@@ -206,25 +317,43 @@ func (k *KcpConnectManager) enetHandle(listener *kcp.Listener) {
 	logger.Info("enet handle start")
 	// conv短时间内唯一生成
 	convGenMap := make(map[uint64]int64)
-	pktFreqLimitCounter := 0
-	pktFreqLimitTimer := time.Now().UnixNano()
 	for {
 		enetNotify := <-listener.EnetNotify
 		logger.Info("[Enet Notify], addr: %v, conv: %v, conn: %v, enet: %v", enetNotify.Addr, enetNotify.ConvId, enetNotify.ConnType, enetNotify.EnetType)
 		switch enetNotify.ConnType {
 		case kcp.ConnEnetSyn:
-			// 连接建立握手包频率限制
-			pktFreqLimitCounter++
-			if pktFreqLimitCounter > ConnSynPacketFreqLimit {
-				now := time.Now().UnixNano()
-				if now-pktFreqLimitTimer > int64(time.Second) {
-					pktFreqLimitCounter = 0
-					pktFreqLimitTimer = now
-				} else {
+			if !k.checkConnSyn(enetNotify.Addr) {
+				continue
+			}
+			if enetNotify.EnetType == kcp.EnetClientResumeKey {
+				// 会话恢复握手 返回原先的conv
+				conv, ok := k.prepareResumeSession(enetNotify.ConvId)
+				if !ok {
+					logger.Info("resume session not exist, addr: %v", enetNotify.Addr)
+					listener.SendEnetNotifyToPeer(&kcp.Enet{
+						Addr:     enetNotify.Addr,
+						ConvId:   enetNotify.ConvId,
+						ConnType: kcp.ConnEnetFin,
+						EnetType: kcp.EnetClientRebindFail,
+					})
 					continue
 				}
+				// 沿用原先连接的前向纠错参数
+				k.resumeConvFec(listener, conv)
+				listener.SendEnetNotifyToPeer(&kcp.Enet{
+					Addr:     enetNotify.Addr,
+					ConvId:   conv,
+					ConnType: kcp.ConnEnetEst,
+					EnetType: enetNotify.EnetType,
+				})
+				continue
+			}
+			if enetNotify.EnetType != kcp.EnetClientConnectKey && enetNotify.EnetType != kcp.EnetClientFecConnectKey {
+				continue
 			}
-			if enetNotify.EnetType != kcp.EnetClientConnectKey {
+			// 排空中不再分配新的conv
+			if k.drainState == true {
+				logger.Info("gate is draining, ignore new conn, addr: %v", enetNotify.Addr)
 				continue
 			}
 			// 清理老旧的conv
@@ -260,11 +389,16 @@ func (k *KcpConnectManager) enetHandle(listener *kcp.Listener) {
 					break
 				}
 			}
+			// 请求开启前向纠错时 convId字段携带分片参数 不允许开启时按普通连接回复
+			enetType := enetNotify.EnetType
+			if enetType == kcp.EnetClientFecConnectKey && !k.negotiateConvFec(listener, conv, enetNotify.ConvId) {
+				enetType = kcp.EnetClientConnectKey
+			}
 			listener.SendEnetNotifyToPeer(&kcp.Enet{
 				Addr:     enetNotify.Addr,
 				ConvId:   conv,
 				ConnType: kcp.ConnEnetEst,
-				EnetType: enetNotify.EnetType,
+				EnetType: enetType,
 			})
 		case kcp.ConnEnetEst:
 		case kcp.ConnEnetFin:
@@ -273,11 +407,8 @@ func (k *KcpConnectManager) enetHandle(listener *kcp.Listener) {
 				logger.Error("session not exist, conv: %v", enetNotify.ConvId)
 				continue
 			}
-			session.conn.SendEnetNotifyToPeer(&kcp.Enet{
-				ConnType: kcp.ConnEnetFin,
-				EnetType: enetNotify.EnetType,
-			})
-			_ = session.conn.Close()
+			// 客户端主动断开 不保留会话
+			k.closeKcpConn(session, enetNotify.EnetType)
 		case kcp.ConnEnetAddrChange:
 			// 连接地址改变通知
 			k.kcpEventOutput <- &KcpEvent{
@@ -292,7 +423,7 @@ func (k *KcpConnectManager) enetHandle(listener *kcp.Listener) {
 
 // Session 连接会话结构 只允许定义并发安全或者简单的基础数据结构
 type Session struct {
-	conn                   *kcp.UDPSession
+	conn                   Conn
 	connState              uint8
 	userId                 uint32
 	kcpRawSendChan         chan *ProtoMsg
@@ -303,6 +434,19 @@ type Session struct {
 	anticheatServerAppId   string
 	pathfindingServerAppId string
 	useMagicSeed           bool
+	rateLimit              *sessionRateLimit
+	resumeToken            uint64
+	clientCmdProtoMap      *client_proto.ClientCmdProtoMap // 协商出的客户端版本的协议映射 未开启客户端协议代理时为nil
+	accountUid             string
+	accountToken           string            // 登录网关使用的combo token 会话恢复时重新校验
+	tokenVerifyCache       *tokenVerifyCache // 协商客户端版本时的token校验结果 供随后的GetPlayerTokenReq复用
+	resumeMsgLost          bool              // 恢复的会话在断开期间有下行消息丢失
+	closed                 int32             // 连接已关闭或已断开等待恢复 关闭和断开可能在不同协程发生 通过CAS保证只处理一次
+}
+
+// 标记会话已关闭 已经被标记过时返回false
+func (s *Session) setClosed() bool {
+	return atomic.CompareAndSwapInt32(&s.closed, 0, 1)
 }
 
 // 接收
@@ -311,35 +455,58 @@ func (k *KcpConnectManager) recvHandle(session *Session) {
 	conn := session.conn
 	convId := conn.GetConv()
 	recvBuf := make([]byte, PacketMaxLen)
-	pktFreqLimitCounter := 0
-	pktFreqLimitTimer := time.Now().UnixNano()
 	for {
 		_ = conn.SetReadDeadline(time.Now().Add(time.Second * ConnRecvTimeout))
 		recvLen, err := conn.Read(recvBuf)
 		if err != nil {
 			logger.Error("exit recv loop, conn read err: %v, convId: %v", err, convId)
-			k.closeKcpConn(session, kcp.EnetServerKick)
+			k.dropKcpConn(session)
 			break
 		}
 		// 收包频率限制
-		pktFreqLimitCounter++
-		if pktFreqLimitCounter > RecvPacketFreqLimit {
-			now := time.Now().UnixNano()
-			if now-pktFreqLimitTimer > int64(time.Second) {
-				pktFreqLimitCounter = 0
-				pktFreqLimitTimer = now
-			} else {
-				logger.Error("exit recv loop, client packet send freq too high, convId: %v, pps: %v", convId, pktFreqLimitCounter)
-				k.closeKcpConn(session, kcp.EnetPacketFreqTooHigh)
-				break
-			}
+		ret, kickReason := k.rateLimiter.CheckRecv(session.rateLimit)
+		if ret == RateLimitDrop {
+			continue
+		} else if ret == RateLimitKick {
+			logger.Error("exit recv loop, client packet send freq too high, convId: %v", convId)
+			k.closeKcpConn(session, kickReason)
+			break
 		}
 		recvData := recvBuf[:recvLen]
 		kcpMsgList := make([]*KcpMsg, 0)
-		DecodeBinToPayload(recvData, convId, &kcpMsgList, session.xorKey)
+		if !session.changeXorKeyFin {
+			k.decodeByDispatchKey(recvData, convId, &kcpMsgList, session)
+		} else {
+			DecodeBinToPayload(recvData, convId, &kcpMsgList, session.xorKey)
+		}
 		for _, v := range kcpMsgList {
-			protoMsgList := ProtoDecode(v, k.serverCmdProtoMap, k.clientCmdProtoMap)
+			if k.clientCmdProtoMapList != nil && session.clientCmdProtoMap == nil {
+				// 根据第一个包协商客户端版本
+				session.clientCmdProtoMap = k.selectClientCmdProtoMap(v, session)
+				logger.Info("select client proto version: %v, convId: %v", session.clientCmdProtoMap.GetVersion(), convId)
+			}
+			protoMsgList := ProtoDecode(v, k.serverCmdProtoMap, session.clientCmdProtoMap)
 			for _, vv := range protoMsgList {
+				// 连接状态协议过滤
+				ret = k.cmdFilter.Check(session.connState, vv.CmdId, convId, session.userId)
+				if ret == CmdFilterDrop {
+					continue
+				} else if ret == CmdFilterKick {
+					logger.Error("exit recv loop, client cmd not allowed, cmdId: %v, convId: %v", vv.CmdId, convId)
+					k.closeKcpConn(session, k.cmdFilter.GetKickReason())
+					return
+				}
+				// 协议预算限流
+				ret, kickReason = k.rateLimiter.CheckCmd(session.rateLimit, vv.CmdId)
+				if ret == RateLimitDrop {
+					continue
+				} else if ret == RateLimitKick {
+					logger.Error("exit recv loop, client cmd send freq too high, cmdId: %v, convId: %v", vv.CmdId, convId)
+					k.closeKcpConn(session, kickReason)
+					return
+				}
+				k.packetRecorder.record(vv, session.userId, PacketRecordDirUp)
+				vv.Trace = k.messageQueue.NewTrace(session.userId, vv.CmdId)
 				k.recvMsgHandle(vv, session)
 			}
 		}
@@ -351,8 +518,6 @@ func (k *KcpConnectManager) sendHandle(session *Session) {
 	logger.Info("send handle start")
 	conn := session.conn
 	convId := conn.GetConv()
-	pktFreqLimitCounter := 0
-	pktFreqLimitTimer := time.Now().UnixNano()
 	for {
 		protoMsg, ok := <-session.kcpRawSendChan
 		if !ok {
@@ -360,7 +525,17 @@ func (k *KcpConnectManager) sendHandle(session *Session) {
 			k.closeKcpConn(session, kcp.EnetServerKick)
 			break
 		}
-		kcpMsg := ProtoEncode(protoMsg, k.serverCmdProtoMap, k.clientCmdProtoMap)
+		// 发包频率限制
+		ret, kickReason := k.rateLimiter.CheckSend(session.rateLimit)
+		if ret == RateLimitDrop {
+			continue
+		} else if ret == RateLimitKick {
+			logger.Error("exit send loop, server packet send freq too high, convId: %v", convId)
+			k.closeKcpConn(session, kickReason)
+			break
+		}
+		k.packetRecorder.record(protoMsg, session.userId, PacketRecordDirDown)
+		kcpMsg := ProtoEncode(protoMsg, k.serverCmdProtoMap, session.clientCmdProtoMap)
 		if kcpMsg == nil {
 			logger.Error("decode kcp msg is nil, convId: %v", convId)
 			continue
@@ -370,22 +545,10 @@ func (k *KcpConnectManager) sendHandle(session *Session) {
 		_, err := conn.Write(bin)
 		if err != nil {
 			logger.Error("exit send loop, conn write err: %v, convId: %v", err, convId)
-			k.closeKcpConn(session, kcp.EnetServerKick)
+			k.dropKcpConn(session)
 			break
 		}
-		// 发包频率限制
-		pktFreqLimitCounter++
-		if pktFreqLimitCounter > SendPacketFreqLimit {
-			now := time.Now().UnixNano()
-			if now-pktFreqLimitTimer > int64(time.Second) {
-				pktFreqLimitCounter = 0
-				pktFreqLimitTimer = now
-			} else {
-				logger.Error("exit send loop, server packet send freq too high, convId: %v, pps: %v", convId, pktFreqLimitCounter)
-				k.closeKcpConn(session, kcp.EnetPacketFreqTooHigh)
-				break
-			}
-		}
+		k.messageQueue.FinishTrace(protoMsg.Trace, protoMsg.CmdId)
 		if session.changeXorKeyFin == false && protoMsg.CmdId == cmd.GetPlayerTokenRsp {
 			// XOR密钥切换
 			logger.Info("change session xor key, convId: %v", convId)
@@ -412,7 +575,7 @@ func (k *KcpConnectManager) forceCloseKcpConn(convId uint64, reason uint32) {
 
 // 关闭指定连接
 func (k *KcpConnectManager) closeKcpConn(session *Session, enetType uint32) {
-	if session.connState == ConnClose {
+	if !session.setClosed() {
 		return
 	}
 	session.connState = ConnClose
@@ -434,6 +597,14 @@ func (k *KcpConnectManager) closeKcpConn(session *Session, enetType uint32) {
 		EventId: KcpConnCloseNotify,
 	}
 	// 通知GS玩家下线
+	k.deleteResumeToken(session)
+	k.sendUserOffline(session)
+	k.destroySessionChan <- session
+	atomic.AddInt32(&CLIENT_CONN_NUM, -1)
+}
+
+// 通知GS玩家下线
+func (k *KcpConnectManager) sendUserOffline(session *Session) {
 	connCtrlMsg := new(mq.ConnCtrlMsg)
 	connCtrlMsg.UserId = session.userId
 	k.messageQueue.SendToGs(session.gsServerAppId, &mq.NetMsg{
@@ -441,9 +612,7 @@ func (k *KcpConnectManager) closeKcpConn(session *Session, enetType uint32) {
 		EventId:     mq.UserOfflineNotify,
 		ConnCtrlMsg: connCtrlMsg,
 	})
-	logger.Info("send to gs user offline, ConvId: %v, UserId: %v", convId, connCtrlMsg.UserId)
-	k.destroySessionChan <- session
-	atomic.AddInt32(&CLIENT_CONN_NUM, -1)
+	logger.Info("send to gs user offline, ConvId: %v, UserId: %v", session.conn.GetConv(), connCtrlMsg.UserId)
 }
 
 // 关闭所有连接
@@ -457,6 +626,7 @@ func (k *KcpConnectManager) closeAllKcpConn() {
 	for _, session := range sessionList {
 		k.closeKcpConn(session, kcp.EnetServerShutdown)
 	}
+	k.expireAllResumeSession()
 }
 
 func (k *KcpConnectManager) GetSessionByConvId(convId uint64) *Session {
@@ -485,6 +655,91 @@ func (k *KcpConnectManager) DeleteSession(convId uint64, userId uint32) {
 	delete(k.sessionConvIdMap, convId)
 	delete(k.sessionUserIdMap, userId)
 	k.sessionMapLock.Unlock()
+	k.kcpProfileManager.deleteConn(convId)
+	k.respCache.DeleteUser(userId)
+}
+
+func (k *KcpConnectManager) autoSyncRegionEc2b() {
+	ticker := time.NewTicker(time.Second * 60)
+	for {
+		<-ticker.C
+		_ = k.syncRegionEc2b()
+	}
+}
+
+// 同步区服密钥 节点服务器轮换密钥后的重叠期内同时保留新旧密钥
+func (k *KcpConnectManager) syncRegionEc2b() error {
+	rsp, err := k.discovery.GetRegionEc2B(context.TODO(), &api.NullMsg{})
+	if err != nil {
+		logger.Error("get region ec2b error: %v", err)
+		return err
+	}
+	dispatchKey, err := k.getDispatchXorKey(rsp.Data)
+	if err != nil {
+		return err
+	}
+	var dispatchKeyPrev []byte = nil
+	// 3.7以后首包无需使用加密密钥 新旧密钥没有区别
+	if rsp.PrevData != nil && k.getGateMaxVersion() < 370 {
+		dispatchKeyPrev, err = k.getDispatchXorKey(rsp.PrevData)
+		if err != nil {
+			return err
+		}
+	}
+	k.dispatchKeyLock.Lock()
+	k.dispatchKey = dispatchKey
+	k.dispatchKeyPrev = dispatchKeyPrev
+	k.dispatchKeyLock.Unlock()
+	return nil
+}
+
+func (k *KcpConnectManager) getDispatchXorKey(data []byte) ([]byte, error) {
+	ec2b, err := random.LoadEc2bKey(data)
+	if err != nil {
+		logger.Error("parse region ec2b error: %v", err)
+		return nil, err
+	}
+	regionEc2b := random.NewEc2b()
+	regionEc2b.SetSeed(ec2b.Seed())
+	// 3.7的时候修改了xor 首包无需使用加密密钥
+	if k.getGateMaxVersion() < 370 {
+		return regionEc2b.XorKey(), nil
+	} else {
+		// 全部填充为0 不然会出问题
+		return make([]byte, 4096), nil
+	}
+}
+
+func (k *KcpConnectManager) getDispatchKey() []byte {
+	k.dispatchKeyLock.RLock()
+	defer k.dispatchKeyLock.RUnlock()
+	return k.dispatchKey
+}
+
+func (k *KcpConnectManager) getDispatchKeyPrev() []byte {
+	k.dispatchKeyLock.RLock()
+	defer k.dispatchKeyLock.RUnlock()
+	return k.dispatchKeyPrev
+}
+
+// 使用区服密钥解密首包 当前密钥解密失败时尝试使用旧密钥
+func (k *KcpConnectManager) decodeByDispatchKey(data []byte, convId uint64, kcpMsgList *[]*KcpMsg, session *Session) {
+	dispatchKeyPrev := k.getDispatchKeyPrev()
+	if dispatchKeyPrev == nil {
+		DecodeBinToPayload(data, convId, kcpMsgList, session.xorKey)
+		return
+	}
+	rawData := make([]byte, len(data))
+	copy(rawData, data)
+	DecodeBinToPayload(data, convId, kcpMsgList, session.xorKey)
+	if len(*kcpMsgList) != 0 {
+		return
+	}
+	DecodeBinToPayload(rawData, convId, kcpMsgList, dispatchKeyPrev)
+	if len(*kcpMsgList) != 0 {
+		logger.Info("session use prev dispatch key, convId: %v", convId)
+		session.xorKey = dispatchKeyPrev
+	}
 }
 
 func (k *KcpConnectManager) autoSyncGlobalGsOnlineMap() {
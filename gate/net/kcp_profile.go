@@ -0,0 +1,268 @@
+package net
+
+import (
+	"sync"
+	"time"
+
+	"hk4e/common/config"
+	"hk4e/gate/kcp"
+	"hk4e/pkg/logger"
+)
+
+// KCP传输参数
+// 内置fast normal low_bandwidth三种配置 可由配置文件覆盖或新增
+// 新连接使用默认配置 开启自动切换时按会话在检测周期内的重传率和平滑延迟重新选择
+// 通过运维管理接口手动指定配置的会话不再自动切换
+// 客户端握手时可以请求开启前向纠错 分片参数超出配置的上限时退化为普通连接
+
+const (
+	KcpProfileFast         = "fast"
+	KcpProfileNormal       = "normal"
+	KcpProfileLowBandwidth = "low_bandwidth"
+)
+
+const (
+	kcpProfileMinXmitSegs     = 50 // 检测周期内发送的数据段少于该值时不重新选择配置
+	kcpProfileDefaultInterval = 10 // 默认检测间隔 秒
+	kcpProfileDefaultLossRate = 0.05
+	kcpProfileDefaultRttLimit = 300 // 毫秒
+)
+
+// 内置配置 normal与原先的固定配置一致
+var defaultKcpProfileMap = map[string]*config.KcpProfile{
+	KcpProfileFast:         {NoDelay: 1, Interval: 10, Resend: 2, Nc: 1, SndWnd: 255, RcvWnd: 255},
+	KcpProfileNormal:       {NoDelay: 0, Interval: 100, Resend: 0, Nc: 0, SndWnd: 255, RcvWnd: 255},
+	KcpProfileLowBandwidth: {NoDelay: 0, Interval: 100, Resend: 0, Nc: 0, SndWnd: 64, RcvWnd: 255},
+}
+
+type kcpProfileState struct {
+	conn        *kcp.UDPSession
+	profile     string
+	manual      bool    // 手动指定的配置 不参与自动切换
+	xmitSegs    uint64  // 上次检测时的发送数据段数
+	retransSegs uint64  // 上次检测时的重传数据段数
+	lossRate    float64 // 最近一个检测周期的重传率
+}
+
+type kcpProfileManager struct {
+	profileMap    map[string]*config.KcpProfile
+	stateMap      map[uint64]*kcpProfileState // key:convId
+	stateMapLock  sync.Mutex
+	defaultName   string
+	fastLossRate  float64
+	lowBwRttLimit int32
+}
+
+func newKcpProfileManager() (r *kcpProfileManager) {
+	r = new(kcpProfileManager)
+	kcpConfig := config.GetConfig().Gate.Kcp
+	r.profileMap = make(map[string]*config.KcpProfile)
+	for name, profile := range defaultKcpProfileMap {
+		r.profileMap[name] = profile
+	}
+	for name, profile := range kcpConfig.Profile {
+		if profile == nil {
+			continue
+		}
+		r.profileMap[name] = profile
+	}
+	r.stateMap = make(map[uint64]*kcpProfileState)
+	r.defaultName = kcpConfig.DefaultProfile
+	if _, exist := r.profileMap[r.defaultName]; !exist {
+		if r.defaultName != "" {
+			logger.Error("kcp default profile not found: %v", r.defaultName)
+		}
+		r.defaultName = KcpProfileNormal
+	}
+	r.fastLossRate = kcpConfig.FastLossRate
+	if r.fastLossRate <= 0 {
+		r.fastLossRate = kcpProfileDefaultLossRate
+	}
+	r.lowBwRttLimit = kcpConfig.LowBandwidthRtt
+	if r.lowBwRttLimit <= 0 {
+		r.lowBwRttLimit = kcpProfileDefaultRttLimit
+	}
+	return r
+}
+
+func (m *kcpProfileManager) applyProfile(conn *kcp.UDPSession, name string) bool {
+	profile, exist := m.profileMap[name]
+	if !exist {
+		return false
+	}
+	conn.SetNoDelay(int(profile.NoDelay), int(profile.Interval), int(profile.Resend), int(profile.Nc))
+	conn.SetWindowSize(int(profile.SndWnd), int(profile.RcvWnd))
+	return true
+}
+
+// 新连接使用默认配置
+func (m *kcpProfileManager) initConn(conn *kcp.UDPSession) {
+	m.applyProfile(conn, m.defaultName)
+	m.stateMapLock.Lock()
+	m.stateMap[conn.GetConv()] = &kcpProfileState{
+		conn:    conn,
+		profile: m.defaultName,
+	}
+	m.stateMapLock.Unlock()
+}
+
+func (m *kcpProfileManager) deleteConn(convId uint64) {
+	m.stateMapLock.Lock()
+	delete(m.stateMap, convId)
+	m.stateMapLock.Unlock()
+}
+
+// 手动指定连接的配置 配置名为空时恢复自动切换
+func (m *kcpProfileManager) setConnProfile(convId uint64, name string) bool {
+	if name != "" {
+		if _, exist := m.profileMap[name]; !exist {
+			return false
+		}
+	}
+	m.stateMapLock.Lock()
+	defer m.stateMapLock.Unlock()
+	state, exist := m.stateMap[convId]
+	if !exist {
+		return false
+	}
+	if name == "" {
+		state.manual = false
+		return true
+	}
+	m.applyProfile(state.conn, name)
+	state.profile = name
+	state.manual = true
+	return true
+}
+
+func (m *kcpProfileManager) getConnProfile(convId uint64) (name string, lossRate float64) {
+	m.stateMapLock.Lock()
+	defer m.stateMapLock.Unlock()
+	state, exist := m.stateMap[convId]
+	if !exist {
+		return "", 0
+	}
+	return state.profile, state.lossRate
+}
+
+// 按重传率和平滑延迟选择配置
+func (m *kcpProfileManager) selectProfile(lossRate float64, srtt int32) string {
+	if srtt >= m.lowBwRttLimit {
+		return KcpProfileLowBandwidth
+	} else if lossRate >= m.fastLossRate {
+		return KcpProfileFast
+	} else {
+		return KcpProfileNormal
+	}
+}
+
+// 统计各连接的重传率 开启自动切换时重新选择配置
+func (m *kcpProfileManager) update(autoProfile bool) {
+	m.stateMapLock.Lock()
+	defer m.stateMapLock.Unlock()
+	for convId, state := range m.stateMap {
+		xmitSegs, retransSegs := state.conn.GetSegStat()
+		if xmitSegs < state.xmitSegs || retransSegs < state.retransSegs {
+			state.xmitSegs, state.retransSegs = xmitSegs, retransSegs
+			continue
+		}
+		xmitDelta := xmitSegs - state.xmitSegs
+		if xmitDelta < kcpProfileMinXmitSegs {
+			continue
+		}
+		retransDelta := retransSegs - state.retransSegs
+		state.xmitSegs, state.retransSegs = xmitSegs, retransSegs
+		state.lossRate = float64(retransDelta) / float64(xmitDelta)
+		if !autoProfile || state.manual {
+			continue
+		}
+		name := m.selectProfile(state.lossRate, state.conn.GetSRTT())
+		if name == state.profile {
+			continue
+		}
+		if !m.applyProfile(state.conn, name) {
+			continue
+		}
+		logger.Info("kcp profile change, convId: %v, %v -> %v, loss rate: %.3f, srtt: %v", convId, state.profile, name, state.lossRate, state.conn.GetSRTT())
+		state.profile = name
+	}
+}
+
+// 各配置的连接数
+func (m *kcpProfileManager) getProfileStat() map[string]int {
+	stat := make(map[string]int)
+	for name := range m.profileMap {
+		stat[name] = 0
+	}
+	m.stateMapLock.Lock()
+	for _, state := range m.stateMap {
+		stat[state.profile]++
+	}
+	m.stateMapLock.Unlock()
+	return stat
+}
+
+// 定时检测连接质量
+func (k *KcpConnectManager) kcpProfileHandle() {
+	kcpConfig := config.GetConfig().Gate.Kcp
+	interval := kcpConfig.AutoProfileInterval
+	if interval <= 0 {
+		interval = kcpProfileDefaultInterval
+	}
+	ticker := time.NewTicker(time.Second * time.Duration(interval))
+	for {
+		<-ticker.C
+		k.kcpProfileManager.update(kcpConfig.AutoProfile)
+	}
+}
+
+// 握手时协商前向纠错 允许开启时为conv登记分片参数并返回true
+func (k *KcpConnectManager) negotiateConvFec(listener *kcp.Listener, conv uint64, fecShards uint64) bool {
+	kcpConfig := config.GetConfig().Gate.Kcp
+	if !kcpConfig.FecEnable {
+		return false
+	}
+	dataShards, parityShards := kcp.ParseEnetFecShards(fecShards)
+	if dataShards > int(kcpConfig.FecMaxDataShards) || parityShards > int(kcpConfig.FecMaxParityShards) {
+		logger.Info("fec shards exceed limit, conv: %v, data shards: %v, parity shards: %v", conv, dataShards, parityShards)
+		return false
+	}
+	return listener.SetConvFEC(conv, dataShards, parityShards)
+}
+
+// 会话恢复时沿用原先连接的前向纠错参数
+func (k *KcpConnectManager) resumeConvFec(listener *kcp.Listener, conv uint64) {
+	k.resumeLock.Lock()
+	resume, exist := k.resumeSessionMap[conv]
+	k.resumeLock.Unlock()
+	if !exist {
+		return
+	}
+	kcpConn, ok := resume.session.conn.(*kcp.UDPSession)
+	if !ok {
+		return
+	}
+	dataShards, parityShards := kcpConn.GetFEC()
+	if dataShards == 0 {
+		return
+	}
+	listener.SetConvFEC(conv, dataShards, parityShards)
+}
+
+// GetKcpProfileStat 获取各KCP配置的连接数
+func (k *KcpConnectManager) GetKcpProfileStat() map[string]int {
+	return k.kcpProfileManager.getProfileStat()
+}
+
+// SetUserKcpProfile 手动指定玩家连接的KCP配置 配置名为空时恢复自动切换 玩家或配置不存在时返回false
+func (k *KcpConnectManager) SetUserKcpProfile(userId uint32, name string) bool {
+	session := k.GetSessionByUserId(userId)
+	if session == nil {
+		return false
+	}
+	if !k.kcpProfileManager.setConnProfile(session.conn.GetConv(), name) {
+		return false
+	}
+	logger.Warn("admin set kcp profile, uid: %v, profile: %v", userId, name)
+	return true
+}
@@ -0,0 +1,295 @@
+package net
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"hk4e/common/config"
+	"hk4e/pkg/logger"
+	"hk4e/protocol/cmd"
+
+	pb "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// 网关抓包记录
+// 按玩家uid或convId选择需要记录的会话 将解码后的上下行协议按json行格式写入记录文件
+// 登录握手协议中的账号token和密钥等敏感字段在写入前清空
+// 记录文件超过最大大小后轮换 只保留最近的若干个轮换文件
+// 上行记录可以通过replay工具经由消息队列重放到GS 用于复现问题
+
+const (
+	PacketRecordDirUp   = "up"   // 上行 客户端到服务器
+	PacketRecordDirDown = "down" // 下行 服务器到客户端
+)
+
+const (
+	DefaultPacketRecordPath        = "./packet_record"
+	DefaultPacketRecordMaxFileSize = 64 * 1024 * 1024
+	DefaultPacketRecordMaxFileNum  = 10
+)
+
+// 写入记录前清空的敏感字段 key:协议名 value:字段名列表
+var packetRecordRedactFieldMap = map[string][]string{
+	"GetPlayerTokenReq": {"account_token", "client_rand_key"},
+	"GetPlayerTokenRsp": {"token", "secret_key", "secret_key_seed", "server_rand_key", "sign", "extra_bin_data"}, // extra_bin_data为会话恢复令牌
+	"PlayerLoginReq":    {"token"},
+}
+
+// PacketRecord 抓包记录 每条记录为记录文件中的一行json
+type PacketRecord struct {
+	Time        int64  `json:"time"` // 微秒时间戳
+	Dir         string `json:"dir"`
+	ConvId      uint64 `json:"conv_id"`
+	UserId      uint32 `json:"uid"`
+	CmdId       uint16 `json:"cmd_id"`
+	CmdName     string `json:"cmd_name"`
+	HeadData    []byte `json:"head"`
+	PayloadData []byte `json:"payload"`
+}
+
+type PacketRecorder struct {
+	cmdProtoMap *cmd.CmdProtoMap
+	path        string
+	maxFileSize int64
+	maxFileNum  int
+	uidMap      sync.Map // key:uid
+	convIdMap   sync.Map // key:convId
+	recordChan  chan *PacketRecord
+	file        *os.File
+	fileSize    int64
+}
+
+func NewPacketRecorder(cmdProtoMap *cmd.CmdProtoMap) (r *PacketRecorder) {
+	r = new(PacketRecorder)
+	recordConfig := config.GetConfig().Gate.PacketRecord
+	r.cmdProtoMap = cmdProtoMap
+	r.path = recordConfig.Path
+	if r.path == "" {
+		r.path = DefaultPacketRecordPath
+	}
+	r.maxFileSize = int64(recordConfig.MaxFileSize)
+	if r.maxFileSize <= 0 {
+		r.maxFileSize = DefaultPacketRecordMaxFileSize
+	}
+	r.maxFileNum = int(recordConfig.MaxFileNum)
+	if r.maxFileNum <= 0 {
+		r.maxFileNum = DefaultPacketRecordMaxFileNum
+	}
+	for _, uid := range recordConfig.UidList {
+		r.SetRecordUser(uid, true)
+	}
+	r.recordChan = make(chan *PacketRecord, 10000)
+	go r.writeHandle()
+	return r
+}
+
+// SetRecordUser 开启或关闭指定玩家的抓包记录
+func (r *PacketRecorder) SetRecordUser(userId uint32, enable bool) {
+	if enable {
+		r.uidMap.Store(userId, true)
+	} else {
+		r.uidMap.Delete(userId)
+	}
+}
+
+// SetRecordConv 开启或关闭指定连接的抓包记录 用于记录登录完成前的协议
+func (r *PacketRecorder) SetRecordConv(convId uint64, enable bool) {
+	if enable {
+		r.convIdMap.Store(convId, true)
+	} else {
+		r.convIdMap.Delete(convId)
+	}
+}
+
+// GetRecordTarget 获取开启了抓包记录的玩家和连接列表
+func (r *PacketRecorder) GetRecordTarget() (userIdList []uint32, convIdList []uint64) {
+	userIdList = make([]uint32, 0)
+	r.uidMap.Range(func(key, value any) bool {
+		userIdList = append(userIdList, key.(uint32))
+		return true
+	})
+	sort.Slice(userIdList, func(i, j int) bool {
+		return userIdList[i] < userIdList[j]
+	})
+	convIdList = make([]uint64, 0)
+	r.convIdMap.Range(func(key, value any) bool {
+		convIdList = append(convIdList, key.(uint64))
+		return true
+	})
+	sort.Slice(convIdList, func(i, j int) bool {
+		return convIdList[i] < convIdList[j]
+	})
+	return userIdList, convIdList
+}
+
+func (r *PacketRecorder) isRecord(convId uint64, userId uint32) bool {
+	if userId != 0 {
+		_, exist := r.uidMap.Load(userId)
+		if exist {
+			return true
+		}
+	}
+	_, exist := r.convIdMap.Load(convId)
+	return exist
+}
+
+// 记录协议 未开启记录的会话直接忽略
+func (r *PacketRecorder) record(protoMsg *ProtoMsg, userId uint32, dir string) {
+	if !r.isRecord(protoMsg.ConvId, userId) {
+		return
+	}
+	packetRecord := &PacketRecord{
+		Time:    time.Now().UnixMicro(),
+		Dir:     dir,
+		ConvId:  protoMsg.ConvId,
+		UserId:  userId,
+		CmdId:   protoMsg.CmdId,
+		CmdName: r.cmdProtoMap.GetCmdNameByCmdId(protoMsg.CmdId),
+	}
+	if protoMsg.HeadMessage != nil {
+		headData, err := pb.Marshal(protoMsg.HeadMessage)
+		if err != nil {
+			logger.Error("marshal record head data error: %v", err)
+			return
+		}
+		packetRecord.HeadData = headData
+	}
+	if protoMsg.PayloadMessage != nil {
+		payloadData, err := pb.Marshal(redactPacketRecordPayload(packetRecord.CmdName, protoMsg.PayloadMessage))
+		if err != nil {
+			logger.Error("marshal record payload data error: %v", err)
+			return
+		}
+		packetRecord.PayloadData = payloadData
+	}
+	select {
+	case r.recordChan <- packetRecord:
+	default:
+		logger.Error("packet record chan is full, drop record, convId: %v, cmdId: %v", protoMsg.ConvId, protoMsg.CmdId)
+	}
+}
+
+// 清空协议中的账号token和密钥等敏感字段 返回清空后的副本 不修改原协议
+func redactPacketRecordPayload(cmdName string, payloadMessage pb.Message) pb.Message {
+	fieldNameList, exist := packetRecordRedactFieldMap[cmdName]
+	if !exist {
+		return payloadMessage
+	}
+	redactMessage := pb.Clone(payloadMessage)
+	fieldList := redactMessage.ProtoReflect().Descriptor().Fields()
+	for _, fieldName := range fieldNameList {
+		field := fieldList.ByName(protoreflect.Name(fieldName))
+		if field == nil {
+			continue
+		}
+		redactMessage.ProtoReflect().Clear(field)
+	}
+	return redactMessage
+}
+
+func (r *PacketRecorder) writeHandle() {
+	for {
+		packetRecord := <-r.recordChan
+		data, err := json.Marshal(packetRecord)
+		if err != nil {
+			logger.Error("marshal packet record error: %v", err)
+			continue
+		}
+		data = append(data, '\n')
+		r.writeRecordFile(data)
+	}
+}
+
+func (r *PacketRecorder) writeRecordFile(data []byte) {
+	if r.file != nil && r.fileSize+int64(len(data)) > r.maxFileSize {
+		// 轮换记录文件
+		err := r.file.Close()
+		if err != nil {
+			logger.Error("close old packet record file error: %v", err)
+		}
+		r.file = nil
+		timeNowStr := time.Now().Format("2006-01-02-15_04_05.000")
+		err = os.Rename(r.path+".jsonl", r.path+"."+timeNowStr+".jsonl")
+		if err != nil {
+			logger.Error("rename old packet record file error: %v", err)
+		}
+		r.cleanRecordFile()
+	}
+	if r.file == nil {
+		file, err := os.OpenFile(r.path+".jsonl", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			logger.Error("open packet record file error: %v", err)
+			return
+		}
+		fileStat, err := file.Stat()
+		if err != nil {
+			logger.Error("get packet record file stat error: %v", err)
+			_ = file.Close()
+			return
+		}
+		r.file = file
+		r.fileSize = fileStat.Size()
+	}
+	n, err := r.file.Write(data)
+	r.fileSize += int64(n)
+	if err != nil {
+		logger.Error("write packet record file error: %v", err)
+	}
+}
+
+// 删除超出保留数量的旧轮换文件
+func (r *PacketRecorder) cleanRecordFile() {
+	fileList, err := filepath.Glob(r.path + ".*-*.jsonl")
+	if err != nil {
+		logger.Error("glob packet record file error: %v", err)
+		return
+	}
+	if len(fileList) <= r.maxFileNum {
+		return
+	}
+	// 文件名中的时间格式保证字典序即时间顺序
+	sort.Strings(fileList)
+	for _, fileName := range fileList[:len(fileList)-r.maxFileNum] {
+		err = os.Remove(fileName)
+		if err != nil {
+			logger.Error("remove old packet record file error: %v", err)
+		}
+	}
+}
+
+// ReadPacketRecordFile 读取记录文件中的全部抓包记录
+func ReadPacketRecordFile(fileName string) ([]*PacketRecord, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	packetRecordList := make([]*PacketRecord, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), PacketMaxLen*2)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		packetRecord := new(PacketRecord)
+		err = json.Unmarshal(line, packetRecord)
+		if err != nil {
+			return nil, err
+		}
+		packetRecordList = append(packetRecordList, packetRecord)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return packetRecordList, nil
+}
@@ -3,7 +3,7 @@ package net
 import (
 	"reflect"
 
-	"hk4e/common/config"
+	"hk4e/common/mq"
 	"hk4e/gate/client_proto"
 	"hk4e/pkg/logger"
 	"hk4e/pkg/object"
@@ -18,6 +18,7 @@ type ProtoMsg struct {
 	CmdId          uint16
 	HeadMessage    *proto.PacketHead
 	PayloadMessage pb.Message
+	Trace          *mq.TraceInfo
 }
 
 type ProtoMessage struct {
@@ -25,10 +26,11 @@ type ProtoMessage struct {
 	message pb.Message
 }
 
+// ProtoDecode clientCmdProtoMap为nil时不做客户端协议转换
 func ProtoDecode(kcpMsg *KcpMsg,
 	serverCmdProtoMap *cmd.CmdProtoMap, clientCmdProtoMap *client_proto.ClientCmdProtoMap) (protoMsgList []*ProtoMsg) {
 	protoMsgList = make([]*ProtoMsg, 0)
-	if config.GetConfig().Hk4e.ClientProtoProxyEnable {
+	if clientCmdProtoMap != nil {
 		clientCmdId := kcpMsg.CmdId
 		clientProtoData := kcpMsg.ProtoData
 		cmdName := clientCmdProtoMap.GetClientCmdNameByCmdId(clientCmdId)
@@ -137,7 +139,7 @@ func ProtoDecodePayloadLoop(cmdId uint16, protoData []byte, protoMessageList *[]
 			return
 		}
 		for _, unionCmd := range unionCmdNotify.GetCmdList() {
-			if config.GetConfig().Hk4e.ClientProtoProxyEnable {
+			if clientCmdProtoMap != nil {
 				clientCmdId := uint16(unionCmd.MessageId)
 				clientProtoData := unionCmd.Body
 				cmdName := clientCmdProtoMap.GetClientCmdNameByCmdId(clientCmdId)
@@ -189,6 +191,7 @@ func ProtoDecodePayloadLoop(cmdId uint16, protoData []byte, protoMessageList *[]
 	})
 }
 
+// ProtoEncode clientCmdProtoMap为nil时不做客户端协议转换
 func ProtoEncode(protoMsg *ProtoMsg,
 	serverCmdProtoMap *cmd.CmdProtoMap, clientCmdProtoMap *client_proto.ClientCmdProtoMap) (kcpMsg *KcpMsg) {
 	cmdName := ""
@@ -222,7 +225,7 @@ func ProtoEncode(protoMsg *ProtoMsg,
 	} else {
 		kcpMsg.ProtoData = nil
 	}
-	if config.GetConfig().Hk4e.ClientProtoProxyEnable {
+	if clientCmdProtoMap != nil {
 		serverCmdId := kcpMsg.CmdId
 		serverProtoData := kcpMsg.ProtoData
 		serverProtoObj := serverCmdProtoMap.GetProtoObjByCmdId(serverCmdId)
@@ -294,7 +297,7 @@ func EncodeProtoToPayload(protoObj pb.Message, serverCmdProtoMap *cmd.CmdProtoMa
 // 网关客户端协议代理相关反射方法
 
 func GetClientProtoObjByName(protoObjName string, clientCmdProtoMap *client_proto.ClientCmdProtoMap) pb.Message {
-	fn := clientCmdProtoMap.RefValue.MethodByName("GetClientProtoObjByName")
+	fn := clientCmdProtoMap.RefValue.MethodByName("GetClientProtoObjByName" + clientCmdProtoMap.GetVersion())
 	if !fn.IsValid() {
 		logger.Error("fn is nil")
 		return nil
@@ -0,0 +1,342 @@
+package net
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"hk4e/common/config"
+	"hk4e/gate/kcp"
+	"hk4e/pkg/logger"
+	"hk4e/protocol/cmd"
+)
+
+// 网关限流
+// 基于令牌桶 分别限制全局和单个ip的连接建立握手包 单个会话和单个ip的上下行包 以及单个会话的协议预算
+// 超限时按规则执行丢弃 延迟或断开连接 并统计每条规则的触发次数
+
+const (
+	RateLimitActionDrop  = "drop"  // 丢弃
+	RateLimitActionDelay = "delay" // 延迟等待令牌 超过最大等待时间则丢弃
+	RateLimitActionKick  = "kick"  // 断开连接
+)
+
+const (
+	RateLimitPass = iota // 放行
+	RateLimitDrop        // 丢弃
+	RateLimitKick        // 断开连接
+)
+
+const (
+	DefaultRateLimitMaxDelay = 1000             // delay动作的默认最大等待时间 毫秒
+	RateLimitIpBucketTimeout = time.Minute * 10 // ip令牌桶闲置超时时间
+)
+
+// 令牌桶 并发安全
+type tokenBucket struct {
+	rate     float64
+	burst    float64
+	tokens   float64
+	lastTime int64
+	lock     sync.Mutex
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:     rate,
+		burst:    burst,
+		tokens:   burst,
+		lastTime: time.Now().UnixNano(),
+	}
+}
+
+// 获取一个令牌 令牌不足时预支并返回需要等待的时间 等待时间超过maxWait时不预支并返回false
+func (b *tokenBucket) take(maxWait time.Duration) (time.Duration, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now().UnixNano()
+	b.tokens += float64(now-b.lastTime) / float64(time.Second) * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.lastTime = now
+	if b.tokens >= 1.0 {
+		b.tokens -= 1.0
+		return 0, true
+	}
+	wait := time.Duration((1.0 - b.tokens) / b.rate * float64(time.Second))
+	if wait > maxWait {
+		return wait, false
+	}
+	b.tokens -= 1.0
+	return wait, true
+}
+
+type rateLimitRule struct {
+	name       string
+	rate       float64
+	burst      float64
+	action     string
+	maxDelay   time.Duration
+	kickReason uint32
+	hitCount   uint64
+}
+
+func newRateLimitRule(name string, ruleConfig *config.RateLimitRule, defaultRule *config.RateLimitRule) *rateLimitRule {
+	if ruleConfig == nil {
+		ruleConfig = defaultRule
+	}
+	if ruleConfig == nil || ruleConfig.Rate <= 0 {
+		return nil
+	}
+	rule := &rateLimitRule{
+		name:       name,
+		rate:       ruleConfig.Rate,
+		burst:      float64(ruleConfig.Burst),
+		action:     ruleConfig.Action,
+		maxDelay:   time.Millisecond * time.Duration(ruleConfig.MaxDelay),
+		kickReason: ruleConfig.KickReason,
+	}
+	if rule.burst <= 0 {
+		rule.burst = rule.rate
+	}
+	switch rule.action {
+	case RateLimitActionDrop, RateLimitActionDelay, RateLimitActionKick:
+	default:
+		logger.Error("unknown rate limit action: %v, rule: %v, use drop", rule.action, name)
+		rule.action = RateLimitActionDrop
+	}
+	if rule.maxDelay <= 0 {
+		rule.maxDelay = time.Millisecond * DefaultRateLimitMaxDelay
+	}
+	if rule.kickReason == 0 {
+		rule.kickReason = kcp.EnetPacketFreqTooHigh
+	}
+	return rule
+}
+
+func (r *rateLimitRule) newBucket() *tokenBucket {
+	if r == nil {
+		return nil
+	}
+	return newTokenBucket(r.rate, r.burst)
+}
+
+// 消耗令牌并按规则执行超限动作 规则或令牌桶为nil时直接放行
+func (r *rateLimitRule) check(bucket *tokenBucket) int {
+	if r == nil || bucket == nil {
+		return RateLimitPass
+	}
+	maxWait := time.Duration(0)
+	if r.action == RateLimitActionDelay {
+		maxWait = r.maxDelay
+	}
+	wait, ok := bucket.take(maxWait)
+	if ok && wait == 0 {
+		return RateLimitPass
+	}
+	atomic.AddUint64(&r.hitCount, 1)
+	if ok {
+		time.Sleep(wait)
+		return RateLimitPass
+	}
+	if r.action == RateLimitActionKick {
+		return RateLimitKick
+	}
+	return RateLimitDrop
+}
+
+type ipBucket struct {
+	connSynBucket *tokenBucket
+	recvBucket    *tokenBucket
+	lastTime      int64 // 原子操作
+}
+
+type RateLimiter struct {
+	connSynRule     *rateLimitRule
+	ipConnSynRule   *rateLimitRule
+	sessionRecvRule *rateLimitRule
+	sessionSendRule *rateLimitRule
+	ipRecvRule      *rateLimitRule
+	cmdRuleMap      map[uint16]*rateLimitRule // key:cmdId
+	connSynBucket   *tokenBucket
+	ipBucketMap     map[string]*ipBucket // key:ip
+	ipBucketMapLock sync.Mutex
+}
+
+func NewRateLimiter(cmdProtoMap *cmd.CmdProtoMap) (r *RateLimiter) {
+	r = new(RateLimiter)
+	rateLimitConfig := config.GetConfig().Gate.RateLimit
+	// 默认值与原先硬编码的频率限制一致
+	r.connSynRule = newRateLimitRule("conn_syn", rateLimitConfig.ConnSyn, &config.RateLimitRule{
+		Rate:   100,
+		Action: RateLimitActionDrop,
+	})
+	r.ipConnSynRule = newRateLimitRule("ip_conn_syn", rateLimitConfig.IpConnSyn, nil)
+	r.sessionRecvRule = newRateLimitRule("session_recv", rateLimitConfig.SessionRecv, &config.RateLimitRule{
+		Rate:       1000,
+		Action:     RateLimitActionKick,
+		KickReason: kcp.EnetPacketFreqTooHigh,
+	})
+	r.sessionSendRule = newRateLimitRule("session_send", rateLimitConfig.SessionSend, &config.RateLimitRule{
+		Rate:       1000,
+		Action:     RateLimitActionKick,
+		KickReason: kcp.EnetPacketFreqTooHigh,
+	})
+	r.ipRecvRule = newRateLimitRule("ip_recv", rateLimitConfig.IpRecv, nil)
+	r.cmdRuleMap = make(map[uint16]*rateLimitRule)
+	for cmdName, ruleConfig := range rateLimitConfig.Cmd {
+		cmdId := cmdProtoMap.GetCmdIdByCmdName(cmdName)
+		if cmdId == 0 {
+			logger.Error("rate limit cmd not found: %v", cmdName)
+			continue
+		}
+		rule := newRateLimitRule("cmd:"+cmdName, ruleConfig, nil)
+		if rule == nil {
+			continue
+		}
+		r.cmdRuleMap[cmdId] = rule
+	}
+	r.connSynBucket = r.connSynRule.newBucket()
+	r.ipBucketMap = make(map[string]*ipBucket)
+	go r.cleanIpBucket()
+	return r
+}
+
+func (r *RateLimiter) getIpBucket(ip string) *ipBucket {
+	r.ipBucketMapLock.Lock()
+	defer r.ipBucketMapLock.Unlock()
+	bucket, exist := r.ipBucketMap[ip]
+	if !exist {
+		bucket = &ipBucket{
+			connSynBucket: r.ipConnSynRule.newBucket(),
+			recvBucket:    r.ipRecvRule.newBucket(),
+		}
+		r.ipBucketMap[ip] = bucket
+	}
+	atomic.StoreInt64(&bucket.lastTime, time.Now().UnixNano())
+	return bucket
+}
+
+func (r *RateLimiter) cleanIpBucket() {
+	ticker := time.NewTicker(time.Minute)
+	for {
+		<-ticker.C
+		now := time.Now().UnixNano()
+		r.ipBucketMapLock.Lock()
+		for ip, bucket := range r.ipBucketMap {
+			if now-atomic.LoadInt64(&bucket.lastTime) > int64(RateLimitIpBucketTimeout) {
+				delete(r.ipBucketMap, ip)
+			}
+		}
+		r.ipBucketMapLock.Unlock()
+	}
+}
+
+// CheckConnSyn 全局连接建立握手包限流 握手包在单个协程内处理 delay动作会阻塞全部握手
+func (r *RateLimiter) CheckConnSyn() int {
+	return r.connSynRule.check(r.connSynBucket)
+}
+
+// CheckIpConnSyn 单个ip连接建立握手包限流
+func (r *RateLimiter) CheckIpConnSyn(ip string) int {
+	if r.ipConnSynRule == nil {
+		return RateLimitPass
+	}
+	return r.ipConnSynRule.check(r.getIpBucket(ip).connSynBucket)
+}
+
+// 会话令牌桶
+type sessionRateLimit struct {
+	recvBucket   *tokenBucket
+	sendBucket   *tokenBucket
+	ipBucket     *ipBucket
+	cmdBucketMap map[uint16]*tokenBucket // 创建后只读
+}
+
+func (r *RateLimiter) newSessionRateLimit(ip string) *sessionRateLimit {
+	s := &sessionRateLimit{
+		recvBucket:   r.sessionRecvRule.newBucket(),
+		sendBucket:   r.sessionSendRule.newBucket(),
+		ipBucket:     nil,
+		cmdBucketMap: make(map[uint16]*tokenBucket, len(r.cmdRuleMap)),
+	}
+	if r.ipRecvRule != nil {
+		s.ipBucket = r.getIpBucket(ip)
+	}
+	for cmdId, rule := range r.cmdRuleMap {
+		s.cmdBucketMap[cmdId] = rule.newBucket()
+	}
+	return s
+}
+
+// CheckRecv 会话上行包限流 以收到的udp包为单位 返回值为限流结果和kick时的enet原因
+func (r *RateLimiter) CheckRecv(s *sessionRateLimit) (int, uint32) {
+	ret := r.sessionRecvRule.check(s.recvBucket)
+	if ret != RateLimitPass {
+		return ret, r.sessionRecvRule.kickReason
+	}
+	if s.ipBucket == nil {
+		return RateLimitPass, 0
+	}
+	atomic.StoreInt64(&s.ipBucket.lastTime, time.Now().UnixNano())
+	ret = r.ipRecvRule.check(s.ipBucket.recvBucket)
+	if ret != RateLimitPass {
+		return ret, r.ipRecvRule.kickReason
+	}
+	return RateLimitPass, 0
+}
+
+// CheckSend 会话下行包限流 返回值为限流结果和kick时的enet原因
+func (r *RateLimiter) CheckSend(s *sessionRateLimit) (int, uint32) {
+	ret := r.sessionSendRule.check(s.sendBucket)
+	if ret != RateLimitPass {
+		return ret, r.sessionSendRule.kickReason
+	}
+	return RateLimitPass, 0
+}
+
+// CheckCmd 会话协议预算限流 返回值为限流结果和kick时的enet原因
+func (r *RateLimiter) CheckCmd(s *sessionRateLimit, cmdId uint16) (int, uint32) {
+	rule, exist := r.cmdRuleMap[cmdId]
+	if !exist {
+		return RateLimitPass, 0
+	}
+	ret := rule.check(s.cmdBucketMap[cmdId])
+	if ret != RateLimitPass {
+		return ret, rule.kickReason
+	}
+	return RateLimitPass, 0
+}
+
+// GetRateLimitStat 获取各限流规则的触发次数 key:规则名
+func (r *RateLimiter) GetRateLimitStat() map[string]uint64 {
+	ruleList := []*rateLimitRule{r.connSynRule, r.ipConnSynRule, r.sessionRecvRule, r.sessionSendRule, r.ipRecvRule}
+	for _, rule := range r.cmdRuleMap {
+		ruleList = append(ruleList, rule)
+	}
+	stat := make(map[string]uint64)
+	for _, rule := range ruleList {
+		if rule == nil {
+			continue
+		}
+		stat[rule.name] = atomic.LoadUint64(&rule.hitCount)
+	}
+	return stat
+}
+
+func (r *RateLimiter) logRateLimitStat() {
+	stat := r.GetRateLimitStat()
+	nameList := make([]string, 0, len(stat))
+	for name := range stat {
+		nameList = append(nameList, name)
+	}
+	sort.Strings(nameList)
+	for _, name := range nameList {
+		if stat[name] == 0 {
+			continue
+		}
+		logger.Info("rate limit hit, rule: %v, count: %v", name, stat[name])
+	}
+}
@@ -0,0 +1,299 @@
+package net
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"hk4e/common/config"
+	"hk4e/common/mq"
+	"hk4e/pkg/logger"
+	"hk4e/protocol/cmd"
+
+	pb "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// 只读查询的响应缓存和重复请求合并
+// 对配置的请求协议 按玩家和请求内容缓存GS的响应 缓存有效期内的相同请求由网关直接返回
+// 相同请求在GS响应之前再次到达时不再转发 等GS响应后使用同一个响应返回
+// 请求和响应按客户端序列号对应 序列号为0的请求不缓存 返回码不为0的响应只合并不缓存
+// 进行中的请求超时未收到对应的响应时(GS未响应或返回了其它响应) 合并等待的请求各自转发到GS 等待的请求不会超过超时时间
+
+const (
+	RespCacheForward = iota // 转发到GS
+	RespCacheHit            // 命中缓存 直接返回
+	RespCacheWait           // 合并到进行中的相同请求 等待响应
+)
+
+const (
+	DefaultRespCacheInflightTimeout = 3000 // 进行中请求等待响应的默认超时时间 毫秒
+	RespCacheUserEntryLimit         = 64   // 单个玩家的缓存条目上限
+	RespCacheTimeoutCheckInterval   = 100  // 检查进行中请求超时的间隔时间 毫秒
+)
+
+type respCacheRule struct {
+	reqCmdId uint16
+	rspCmdId uint16
+	ttl      time.Duration
+}
+
+type respCacheKey struct {
+	cmdId   uint16
+	payload string
+}
+
+type respCacheEntry struct {
+	key         respCacheKey
+	rule        *respCacheRule
+	rsp         pb.Message // 缓存的响应 为nil时请求进行中
+	expireTime  time.Time  // 缓存的过期时间 请求进行中时为等待响应的超时时间
+	sendSeq     uint32     // 转发到GS的请求的客户端序列号
+	waitSeqList []uint32   // 合并的相同请求的客户端序列号
+}
+
+// 超时未收到响应 需要转发到GS的合并等待的请求
+type respCacheWaitReq struct {
+	userId    uint32
+	cmdId     uint16
+	clientSeq uint32
+	payload   []byte
+}
+
+type userRespCache struct {
+	entryMap   map[respCacheKey]*respCacheEntry
+	pendingMap map[uint32]*respCacheEntry // 进行中的请求 key:sendSeq
+}
+
+type RespCache struct {
+	reqRuleMap      map[uint16]*respCacheRule // key:请求cmdId
+	rspRuleMap      map[uint16]*respCacheRule // key:响应cmdId
+	inflightTimeout time.Duration
+	userMap         map[uint32]*userRespCache // key:uid
+	userMapLock     sync.Mutex
+	timeoutWaitList []*respCacheWaitReq // 进行中请求被移除时还在合并等待的请求 由超时处理协程转发
+	hitCount        uint64
+	waitCount       uint64
+	forwardCount    uint64
+}
+
+func NewRespCache(cmdProtoMap *cmd.CmdProtoMap) (r *RespCache) {
+	r = new(RespCache)
+	respCacheConfig := config.GetConfig().Gate.RespCache
+	r.reqRuleMap = make(map[uint16]*respCacheRule)
+	r.rspRuleMap = make(map[uint16]*respCacheRule)
+	for cmdName, ruleConfig := range respCacheConfig.Cmd {
+		if ruleConfig == nil {
+			continue
+		}
+		reqCmdId := cmdProtoMap.GetCmdIdByCmdName(cmdName)
+		if reqCmdId == 0 {
+			logger.Error("resp cache cmd not found: %v", cmdName)
+			continue
+		}
+		rspCmdName := ruleConfig.RspCmd
+		if rspCmdName == "" {
+			rspCmdName = strings.TrimSuffix(cmdName, "Req") + "Rsp"
+		}
+		rspCmdId := cmdProtoMap.GetCmdIdByCmdName(rspCmdName)
+		if rspCmdId == 0 {
+			logger.Error("resp cache rsp cmd not found: %v", rspCmdName)
+			continue
+		}
+		rule := &respCacheRule{
+			reqCmdId: reqCmdId,
+			rspCmdId: rspCmdId,
+			ttl:      time.Millisecond * time.Duration(ruleConfig.Ttl),
+		}
+		r.reqRuleMap[reqCmdId] = rule
+		r.rspRuleMap[rspCmdId] = rule
+	}
+	inflightTimeout := respCacheConfig.InflightTimeout
+	if inflightTimeout <= 0 {
+		inflightTimeout = DefaultRespCacheInflightTimeout
+	}
+	r.inflightTimeout = time.Millisecond * time.Duration(inflightTimeout)
+	r.userMap = make(map[uint32]*userRespCache)
+	return r
+}
+
+// 移除进行中的请求 合并等待的请求留给超时处理协程转发
+func (c *RespCache) removePending(userId uint32, u *userRespCache, entry *respCacheEntry) {
+	delete(u.pendingMap, entry.sendSeq)
+	for _, clientSeq := range entry.waitSeqList {
+		c.timeoutWaitList = append(c.timeoutWaitList, &respCacheWaitReq{
+			userId:    userId,
+			cmdId:     entry.key.cmdId,
+			clientSeq: clientSeq,
+			payload:   []byte(entry.key.payload),
+		})
+	}
+	entry.waitSeqList = nil
+}
+
+// 清理玩家过期的缓存和超时的进行中请求
+func (c *RespCache) purge(userId uint32, u *userRespCache, now time.Time) {
+	for key, entry := range u.entryMap {
+		if now.Before(entry.expireTime) {
+			continue
+		}
+		delete(u.entryMap, key)
+		if entry.rsp == nil {
+			c.removePending(userId, u, entry)
+		}
+	}
+}
+
+// Check 上行请求查询缓存 命中时返回响应cmdId和缓存的响应
+func (c *RespCache) Check(userId uint32, cmdId uint16, clientSeq uint32, payload []byte) (int, uint16, pb.Message) {
+	rule, exist := c.reqRuleMap[cmdId]
+	if !exist || clientSeq == 0 {
+		return RespCacheForward, 0, nil
+	}
+	key := respCacheKey{cmdId: cmdId, payload: string(payload)}
+	now := time.Now()
+	c.userMapLock.Lock()
+	defer c.userMapLock.Unlock()
+	u, exist := c.userMap[userId]
+	if !exist {
+		u = &userRespCache{
+			entryMap:   make(map[respCacheKey]*respCacheEntry),
+			pendingMap: make(map[uint32]*respCacheEntry),
+		}
+		c.userMap[userId] = u
+	}
+	entry, exist := u.entryMap[key]
+	if exist && now.Before(entry.expireTime) {
+		if entry.rsp != nil {
+			atomic.AddUint64(&c.hitCount, 1)
+			return RespCacheHit, rule.rspCmdId, entry.rsp
+		}
+		entry.waitSeqList = append(entry.waitSeqList, clientSeq)
+		atomic.AddUint64(&c.waitCount, 1)
+		return RespCacheWait, 0, nil
+	}
+	atomic.AddUint64(&c.forwardCount, 1)
+	if len(u.entryMap) >= RespCacheUserEntryLimit {
+		c.purge(userId, u, now)
+		if len(u.entryMap) >= RespCacheUserEntryLimit {
+			return RespCacheForward, 0, nil
+		}
+	}
+	if exist && entry.rsp == nil {
+		c.removePending(userId, u, entry)
+	}
+	entry = &respCacheEntry{
+		key:        key,
+		rule:       rule,
+		expireTime: now.Add(c.inflightTimeout),
+		sendSeq:    clientSeq,
+	}
+	u.entryMap[key] = entry
+	u.pendingMap[clientSeq] = entry
+	return RespCacheForward, 0, nil
+}
+
+// OnRsp 收到GS的响应 缓存响应并返回合并等待的请求的客户端序列号
+func (c *RespCache) OnRsp(userId uint32, cmdId uint16, clientSeq uint32, rsp pb.Message) []uint32 {
+	if _, exist := c.rspRuleMap[cmdId]; !exist || rsp == nil {
+		return nil
+	}
+	c.userMapLock.Lock()
+	defer c.userMapLock.Unlock()
+	u, exist := c.userMap[userId]
+	if !exist {
+		return nil
+	}
+	entry, exist := u.pendingMap[clientSeq]
+	if !exist || entry.rule.rspCmdId != cmdId {
+		return nil
+	}
+	delete(u.pendingMap, clientSeq)
+	waitSeqList := entry.waitSeqList
+	entry.waitSeqList = nil
+	if entry.rule.ttl > 0 && getRspRetcode(rsp) == 0 {
+		entry.rsp = pb.Clone(rsp)
+		entry.expireTime = time.Now().Add(entry.rule.ttl)
+	} else {
+		delete(u.entryMap, entry.key)
+	}
+	return waitSeqList
+}
+
+// DeleteUser 清理玩家的缓存 玩家下线或切换GS时调用 合并等待的请求转发到玩家当前所在的GS
+func (c *RespCache) DeleteUser(userId uint32) {
+	c.userMapLock.Lock()
+	u, exist := c.userMap[userId]
+	if exist {
+		for _, entry := range u.pendingMap {
+			c.removePending(userId, u, entry)
+		}
+		delete(c.userMap, userId)
+	}
+	c.userMapLock.Unlock()
+}
+
+// 取出全部超时和被移除的进行中请求的合并等待的请求
+func (c *RespCache) popTimeoutWait(now time.Time) []*respCacheWaitReq {
+	c.userMapLock.Lock()
+	defer c.userMapLock.Unlock()
+	for userId, u := range c.userMap {
+		for _, entry := range u.pendingMap {
+			if now.Before(entry.expireTime) {
+				continue
+			}
+			delete(u.entryMap, entry.key)
+			c.removePending(userId, u, entry)
+		}
+		if len(u.entryMap) == 0 {
+			delete(c.userMap, userId)
+		}
+	}
+	timeoutWaitList := c.timeoutWaitList
+	c.timeoutWaitList = nil
+	return timeoutWaitList
+}
+
+// 定时将超时的合并等待的请求转发到GS 玩家连接已断开时丢弃
+func (k *KcpConnectManager) respCacheTimeoutHandle() {
+	ticker := time.NewTicker(time.Millisecond * RespCacheTimeoutCheckInterval)
+	for {
+		<-ticker.C
+		for _, waitReq := range k.respCache.popTimeoutWait(time.Now()) {
+			session := k.GetSessionByUserId(waitReq.userId)
+			if session == nil {
+				continue
+			}
+			k.messageQueue.SendToGs(session.gsServerAppId, &mq.NetMsg{
+				MsgType: mq.MsgTypeGame,
+				EventId: mq.NormalMsg,
+				GameMsg: &mq.GameMsg{
+					UserId:             waitReq.userId,
+					CmdId:              waitReq.cmdId,
+					ClientSeq:          waitReq.clientSeq,
+					PayloadMessageData: waitReq.payload,
+				},
+			})
+		}
+	}
+}
+
+// GetRespCacheStat 获取响应缓存的命中 合并和转发次数
+func (c *RespCache) GetRespCacheStat() map[string]uint64 {
+	return map[string]uint64{
+		"HIT":     atomic.LoadUint64(&c.hitCount),
+		"WAIT":    atomic.LoadUint64(&c.waitCount),
+		"FORWARD": atomic.LoadUint64(&c.forwardCount),
+	}
+}
+
+// 响应的返回码 没有retcode字段时为0
+func getRspRetcode(rsp pb.Message) int32 {
+	msg := rsp.ProtoReflect()
+	field := msg.Descriptor().Fields().ByName(protoreflect.Name("retcode"))
+	if field == nil || field.Kind() != protoreflect.Int32Kind {
+		return 0
+	}
+	return int32(msg.Get(field).Int())
+}
@@ -13,8 +13,8 @@ import (
 	"time"
 
 	"hk4e/common/config"
+	"hk4e/common/dispatchapi"
 	"hk4e/common/mq"
-	"hk4e/dispatch/controller"
 	"hk4e/gate/kcp"
 	"hk4e/node/api"
 	"hk4e/pkg/endec"
@@ -126,6 +126,7 @@ func (k *KcpConnectManager) recvMsgHandle(protoMsg *ProtoMsg, session *Session)
 			CmdId:          protoMsg.CmdId,
 			ClientSeq:      protoMsg.HeadMessage.ClientSequenceId,
 			PayloadMessage: playerLoginReq,
+			Trace:          protoMsg.Trace,
 		}
 		// 转发到GS
 		k.messageQueue.SendToGs(session.gsServerAppId, &mq.NetMsg{
@@ -143,6 +144,7 @@ func (k *KcpConnectManager) recvMsgHandle(protoMsg *ProtoMsg, session *Session)
 			CmdId:              protoMsg.CmdId,
 			ClientSeq:          protoMsg.HeadMessage.ClientSequenceId,
 			PayloadMessageData: nil,
+			Trace:              protoMsg.Trace,
 		}
 		// 在这里直接序列化成二进制数据 终结PayloadMessage的生命周期并回收进缓存池
 		payloadMessageData, err := pb.Marshal(protoMsg.PayloadMessage)
@@ -152,6 +154,20 @@ func (k *KcpConnectManager) recvMsgHandle(protoMsg *ProtoMsg, session *Session)
 		}
 		k.serverCmdProtoMap.PutProtoObjCache(protoMsg.CmdId, protoMsg.PayloadMessage)
 		gameMsg.PayloadMessageData = payloadMessageData
+		// 只读查询的响应缓存和重复请求合并
+		ret, rspCmdId, rspMsg := k.respCache.Check(userId, protoMsg.CmdId, gameMsg.ClientSeq, payloadMessageData)
+		if ret == RespCacheHit {
+			rsp := &ProtoMsg{
+				ConvId:         protoMsg.ConvId,
+				CmdId:          rspCmdId,
+				HeadMessage:    k.getHeadMsg(gameMsg.ClientSeq),
+				PayloadMessage: rspMsg,
+			}
+			session.kcpRawSendChan <- rsp
+			return
+		} else if ret == RespCacheWait {
+			return
+		}
 		// 转发到寻路服务器
 		if session.pathfindingServerAppId != "" {
 			if protoMsg.CmdId == cmd.QueryPathReq ||
@@ -204,6 +220,8 @@ func (k *KcpConnectManager) sendMsgHandle() {
 		case remoteKick := <-k.reLoginRemoteKickRegChan:
 			reLoginRemoteKickRegMap[remoteKick.userId] = remoteKick.kickFinishNotifyChan
 			remoteKick.regFinishNotifyChan <- true
+		case notify := <-k.pushNotifyChan:
+			k.dispatchPushNotify(notify, convSessionMap, userIdConvMap)
 		case netMsg := <-k.messageQueue.GetNetMsg():
 			switch netMsg.MsgType {
 			case mq.MsgTypeGame:
@@ -213,6 +231,9 @@ func (k *KcpConnectManager) sendMsgHandle() {
 					// 分发到每个连接具体的发送协程
 					convId, exist := userIdConvMap[gameMsg.UserId]
 					if !exist {
+						if k.markResumeSessionMsgLost(gameMsg.UserId) {
+							continue
+						}
 						logger.Error("can not find convId by userId")
 						continue
 					}
@@ -221,6 +242,7 @@ func (k *KcpConnectManager) sendMsgHandle() {
 						CmdId:          gameMsg.CmdId,
 						HeadMessage:    k.getHeadMsg(gameMsg.ClientSeq),
 						PayloadMessage: gameMsg.PayloadMessage,
+						Trace:          gameMsg.Trace,
 					}
 					session := convSessionMap[protoMsg.ConvId]
 					if session == nil {
@@ -251,6 +273,19 @@ func (k *KcpConnectManager) sendMsgHandle() {
 						})
 					}
 					kcpRawSendChan <- protoMsg
+					// 合并等待的相同请求使用同一个响应返回
+					for _, clientSeq := range k.respCache.OnRsp(gameMsg.UserId, gameMsg.CmdId, gameMsg.ClientSeq, gameMsg.PayloadMessage) {
+						if len(kcpRawSendChan) == 1000 {
+							logger.Error("kcpRawSendChan is full, convId: %v", protoMsg.ConvId)
+							break
+						}
+						kcpRawSendChan <- &ProtoMsg{
+							ConvId:         convId,
+							CmdId:          gameMsg.CmdId,
+							HeadMessage:    k.getHeadMsg(clientSeq),
+							PayloadMessage: gameMsg.PayloadMessage,
+						}
+					}
 				}
 			case mq.MsgTypeConnCtrl:
 				connCtrlMsg := netMsg.ConnCtrlMsg
@@ -258,6 +293,14 @@ func (k *KcpConnectManager) sendMsgHandle() {
 				case mq.KickPlayerNotify:
 					convId, exist := userIdConvMap[connCtrlMsg.KickUserId]
 					if !exist {
+						if k.expireResumeSession(connCtrlMsg.KickUserId) {
+							continue
+						}
+						if netMsg.OriginServerType == api.DISPATCH || netMsg.OriginServerType == api.GATE {
+							// 广播的踢出通知 玩家不在本网关属于正常情况
+							logger.Debug("can not find convId by userId, broadcast kick, uid: %v", connCtrlMsg.KickUserId)
+							continue
+						}
 						logger.Error("can not find convId by userId")
 						continue
 					}
@@ -283,6 +326,7 @@ func (k *KcpConnectManager) sendMsgHandle() {
 					}
 					session.gsServerAppId = serverMsg.GameServerAppId
 					session.anticheatServerAppId = ""
+					k.respCache.DeleteUser(serverMsg.UserId)
 					// 网关代发登录请求到新的GS
 					gameMsg := &mq.GameMsg{
 						UserId:    serverMsg.UserId,
@@ -319,6 +363,12 @@ func (k *KcpConnectManager) sendMsgHandle() {
 						kickFinishNotifyChan <- true
 						delete(reLoginRemoteKickRegMap, serverMsg.UserId)
 					}
+				case mq.ServerDrainStateChangeNotify:
+					if netMsg.OriginServerType != api.NODE {
+						continue
+					}
+					logger.Warn("gate drain state change, draining: %v", serverMsg.IsDraining)
+					k.drainState = serverMsg.IsDraining
 				}
 			}
 		}
@@ -340,6 +390,37 @@ type RemoteKick struct {
 	kickFinishNotifyChan chan bool
 }
 
+// 连接登录时的token校验结果
+type tokenVerifyCache struct {
+	accountUid   string
+	accountToken string
+	rsp          *dispatchapi.TokenVerifyRsp
+}
+
+// 向dispatch校验combo token 同一连接登录过程中已校验过相同token时复用结果
+func (k *KcpConnectManager) verifyToken(accountUid string, accountToken string, session *Session) (*dispatchapi.TokenVerifyRsp, error) {
+	cache := session.tokenVerifyCache
+	if cache != nil && cache.accountUid == accountUid && cache.accountToken == accountToken {
+		return cache.rsp, nil
+	}
+	tokenVerifyRsp, err := httpclient.PostJson[dispatchapi.TokenVerifyRsp](
+		config.GetConfig().Hk4e.LoginSdkUrl+"/gate/token/verify",
+		&dispatchapi.TokenVerifyReq{
+			AccountId:    accountUid,
+			AccountToken: accountToken,
+		})
+	if err != nil {
+		logger.Error("verify token error: %v, account uid: %v", err, accountUid)
+		return nil, err
+	}
+	session.tokenVerifyCache = &tokenVerifyCache{
+		accountUid:   accountUid,
+		accountToken: accountToken,
+		rsp:          tokenVerifyRsp,
+	}
+	return tokenVerifyRsp, nil
+}
+
 func (k *KcpConnectManager) getPlayerToken(req *proto.GetPlayerTokenReq, session *Session) *proto.GetPlayerTokenRsp {
 	loginFailClose := func() {
 		k.kcpEventInput <- &KcpEvent{
@@ -348,14 +429,9 @@ func (k *KcpConnectManager) getPlayerToken(req *proto.GetPlayerTokenReq, session
 			EventMessage: uint32(kcp.EnetLoginUnfinished),
 		}
 	}
-	tokenVerifyRsp, err := httpclient.PostJson[controller.TokenVerifyRsp](
-		config.GetConfig().Hk4e.LoginSdkUrl+"/gate/token/verify",
-		&controller.TokenVerifyReq{
-			AccountId:    req.AccountUid,
-			AccountToken: req.AccountToken,
-		})
+	tokenVerifyRsp, err := k.verifyToken(req.AccountUid, req.AccountToken, session)
+	session.tokenVerifyCache = nil
 	if err != nil {
-		logger.Error("verify token error: %v, account uid: %v", err, req.AccountUid)
 		loginFailClose()
 		return nil
 	}
@@ -388,8 +464,10 @@ func (k *KcpConnectManager) getPlayerToken(req *proto.GetPlayerTokenReq, session
 		// 封号通知
 		return loginFailRsp(int32(proto.Retcode_RET_BLACK_UID), true, tokenVerifyRsp.ForbidEndTime)
 	}
+	session.accountUid = req.AccountUid
+	session.accountToken = req.AccountToken
 	clientConnNum := atomic.LoadInt32(&CLIENT_CONN_NUM)
-	if clientConnNum > MaxClientConnNumLimit {
+	if clientConnNum > k.getMaxClientConnNum() {
 		logger.Error("gate conn num limit, uid: %v", uid)
 		return loginFailRsp(int32(proto.Retcode_RET_MAX_PLAYER), false, 0)
 	}
@@ -424,6 +502,9 @@ func (k *KcpConnectManager) getPlayerToken(req *proto.GetPlayerTokenReq, session
 				ConvId:  oldSession.conn.GetConv(),
 				EventId: KcpConnRelogin,
 			}
+		} else if k.expireResumeSession(uid) {
+			// 本地断线等待恢复的会话 直接通知GS下线
+			logger.Info("expire resume session for relogin, uid: %v", uid)
 		} else {
 			// 远程顶号
 			connCtrlMsg := new(mq.ConnCtrlMsg)
@@ -455,6 +536,7 @@ func (k *KcpConnectManager) getPlayerToken(req *proto.GetPlayerTokenReq, session
 	// 绑定各个服务器appid
 	gsServerAppId, err := k.discovery.GetServerAppId(context.TODO(), &api.GetServerAppIdReq{
 		ServerType: api.GS,
+		Uid:        uid,
 	})
 	if err != nil {
 		logger.Error("get gs server appid error: %v, uid: %v", err, uid)
@@ -464,6 +546,7 @@ func (k *KcpConnectManager) getPlayerToken(req *proto.GetPlayerTokenReq, session
 	session.gsServerAppId = gsServerAppId.AppId
 	anticheatServerAppId, err := k.discovery.GetServerAppId(context.TODO(), &api.GetServerAppIdReq{
 		ServerType: api.ANTICHEAT,
+		Uid:        uid,
 	})
 	if err != nil {
 		logger.Error("get anticheat server appid error: %v, uid: %v", err, uid)
@@ -471,6 +554,7 @@ func (k *KcpConnectManager) getPlayerToken(req *proto.GetPlayerTokenReq, session
 	session.anticheatServerAppId = anticheatServerAppId.AppId
 	pathfindingServerAppId, err := k.discovery.GetServerAppId(context.TODO(), &api.GetServerAppIdReq{
 		ServerType: api.PATHFINDING,
+		Uid:        uid,
 	})
 	if err != nil {
 		logger.Error("get pathfinding server appid error: %v, uid: %v", err, uid)
@@ -479,11 +563,15 @@ func (k *KcpConnectManager) getPlayerToken(req *proto.GetPlayerTokenReq, session
 	logger.Debug("session gs appid: %v, uid: %v", session.gsServerAppId, uid)
 	logger.Debug("session anticheat appid: %v, uid: %v", session.anticheatServerAppId, uid)
 	logger.Debug("session pathfinding appid: %v, uid: %v", session.pathfindingServerAppId, uid)
+	if session.clientCmdProtoMap != nil {
+		logger.Debug("session client proto version: %v, uid: %v", session.clientCmdProtoMap.GetVersion(), uid)
+	}
 	// 返回响应
 	rsp := new(proto.GetPlayerTokenRsp)
 	rsp.Uid = uid
 	rsp.AccountUid = req.AccountUid
 	rsp.Token = req.AccountToken
+	rsp.ExtraBinData = k.newResumeToken(session)
 	data := make([]byte, 16+32)
 	rand.Read(data)
 	rsp.SecurityCmdBuffer = data[16:]
@@ -0,0 +1,305 @@
+package net
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"hk4e/common/config"
+	"hk4e/common/dispatchapi"
+	"hk4e/common/httpauth"
+	"hk4e/common/mq"
+	"hk4e/gate/kcp"
+	"hk4e/pkg/httpclient"
+	"hk4e/pkg/logger"
+	"hk4e/pkg/random"
+)
+
+// 会话恢复
+// 登录成功后为会话分配恢复令牌 通过GetPlayerTokenRsp的extra_bin_data下发给客户端
+// 已激活的连接异常断开时不通知GS下线 而是保留会话并通知GS暂停玩家 等待客户端在超时时间内恢复
+// 客户端使用EnetClientResumeKey发起握手 convId字段携带恢复令牌 网关返回原先的convId
+// 客户端使用原先的convId建立连接后 网关沿用原先会话的密钥和各个服务器appid 并通知GS恢复玩家
+// 超时未恢复的会话按正常流程通知GS玩家下线
+// 恢复前向登录服务器重新校验登录网关的combo token 登录态已吊销或账号已封禁时关闭连接并通知GS玩家下线
+// 登录服务器不可用无法校验时同样关闭连接 客户端重新登录
+// 断开时还有未送达客户端的下行消息或等待恢复期间有消息无法送达时 通知GS消息已丢失 由GS让客户端重新登录
+
+type resumeSession struct {
+	session    *Session
+	connState  uint8
+	expireTime int64
+	msgLost    bool // 有下行消息未送达客户端
+}
+
+// 获取会话保留等待恢复的超时时间 为0代表关闭会话恢复
+func (k *KcpConnectManager) getResumeTimeout() time.Duration {
+	return time.Second * time.Duration(config.GetConfig().Gate.ResumeTimeout)
+}
+
+// 为登录成功的会话分配恢复令牌 关闭会话恢复时返回nil
+func (k *KcpConnectManager) newResumeToken(session *Session) []byte {
+	if k.getResumeTimeout() <= 0 {
+		return nil
+	}
+	// TCP和WebSocket连接不支持会话恢复
+	if _, ok := session.conn.(*kcp.UDPSession); !ok {
+		return nil
+	}
+	k.resumeLock.Lock()
+	for {
+		token := binary.LittleEndian.Uint64(random.GetRandomByte(8))
+		if token == 0 {
+			continue
+		}
+		_, exist := k.resumeTokenConvIdMap[token]
+		if exist {
+			continue
+		}
+		k.resumeTokenConvIdMap[token] = session.conn.GetConv()
+		session.resumeToken = token
+		break
+	}
+	k.resumeLock.Unlock()
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, session.resumeToken)
+	return data
+}
+
+func (k *KcpConnectManager) deleteResumeToken(session *Session) {
+	if session.resumeToken == 0 {
+		return
+	}
+	k.resumeLock.Lock()
+	delete(k.resumeTokenConvIdMap, session.resumeToken)
+	k.resumeLock.Unlock()
+}
+
+// 连接异常断开 已激活的会话保留等待客户端恢复 否则直接关闭连接
+func (k *KcpConnectManager) dropKcpConn(session *Session) {
+	if session.connState != ConnActive || session.resumeToken == 0 || k.getResumeTimeout() <= 0 {
+		k.closeKcpConn(session, kcp.EnetServerKick)
+		return
+	}
+	// 接收协程和握手协程可能同时检测到断开
+	if !session.setClosed() {
+		return
+	}
+	connState := session.connState
+	session.connState = ConnClose
+	conn := session.conn
+	convId := conn.GetConv()
+	// 发送队列和kcp发送窗口内还有数据时 这部分下行消息随连接一起丢失
+	msgLost := len(session.kcpRawSendChan) > 0
+	if udpConn, ok := conn.(*kcp.UDPSession); ok && udpConn.GetWaitSnd() > 0 {
+		msgLost = true
+	}
+	// 清理数据
+	k.DeleteSession(convId, session.userId)
+	// 关闭连接 不发送断开通知 避免客户端收到后放弃恢复
+	_ = conn.Close()
+	// 连接关闭通知
+	k.kcpEventOutput <- &KcpEvent{
+		ConvId:  convId,
+		EventId: KcpConnCloseNotify,
+	}
+	// 保留会话
+	k.resumeLock.Lock()
+	k.resumeSessionMap[convId] = &resumeSession{
+		session:    session,
+		connState:  connState,
+		expireTime: time.Now().Add(k.getResumeTimeout()).UnixNano(),
+		msgLost:    msgLost,
+	}
+	k.resumeLock.Unlock()
+	// 通知GS暂停玩家
+	k.messageQueue.SendToGs(session.gsServerAppId, &mq.NetMsg{
+		MsgType: mq.MsgTypeConnCtrl,
+		EventId: mq.UserPauseNotify,
+		ConnCtrlMsg: &mq.ConnCtrlMsg{
+			UserId: session.userId,
+		},
+	})
+	logger.Info("session wait resume, convId: %v, uid: %v", convId, session.userId)
+	k.destroySessionChan <- session
+	atomic.AddInt32(&CLIENT_CONN_NUM, -1)
+}
+
+// 处理会话恢复握手 返回需要恢复的会话的convId
+// 原先的连接还未检测到断开时 先将其断开并保留会话 与接收协程同时断开时只有一方生效
+func (k *KcpConnectManager) prepareResumeSession(resumeToken uint64) (uint64, bool) {
+	k.resumeLock.Lock()
+	convId, exist := k.resumeTokenConvIdMap[resumeToken]
+	k.resumeLock.Unlock()
+	if !exist {
+		return 0, false
+	}
+	session := k.GetSessionByConvId(convId)
+	if session != nil {
+		k.dropKcpConn(session)
+	}
+	k.resumeLock.Lock()
+	_, exist = k.resumeSessionMap[convId]
+	k.resumeLock.Unlock()
+	return convId, exist
+}
+
+// 使用新建立的连接恢复会话 不存在等待恢复的会话时返回false
+func (k *KcpConnectManager) resumeSession(conn *kcp.UDPSession) bool {
+	convId := conn.GetConv()
+	k.resumeLock.Lock()
+	resume, exist := k.resumeSessionMap[convId]
+	if exist {
+		delete(k.resumeSessionMap, convId)
+	}
+	k.resumeLock.Unlock()
+	if !exist {
+		return false
+	}
+	oldSession := resume.session
+	addr := conn.RemoteAddr().String()
+	session := &Session{
+		conn:                   conn,
+		connState:              resume.connState,
+		userId:                 oldSession.userId,
+		kcpRawSendChan:         make(chan *ProtoMsg, 1000),
+		seed:                   oldSession.seed,
+		xorKey:                 oldSession.xorKey,
+		changeXorKeyFin:        oldSession.changeXorKeyFin,
+		gsServerAppId:          oldSession.gsServerAppId,
+		anticheatServerAppId:   oldSession.anticheatServerAppId,
+		pathfindingServerAppId: oldSession.pathfindingServerAppId,
+		useMagicSeed:           oldSession.useMagicSeed,
+		rateLimit:              k.rateLimiter.newSessionRateLimit(httpauth.GetAddrIp(addr)),
+		resumeToken:            oldSession.resumeToken,
+		clientCmdProtoMap:      oldSession.clientCmdProtoMap,
+		accountUid:             oldSession.accountUid,
+		accountToken:           oldSession.accountToken,
+		resumeMsgLost:          resume.msgLost,
+	}
+	k.SetSession(session, convId, session.userId)
+	k.createSessionChan <- session
+	go k.resumeSessionVerify(session)
+	return true
+}
+
+// 重新校验恢复的会话的combo token 校验通过后开始收发并通知GS恢复玩家
+func (k *KcpConnectManager) resumeSessionVerify(session *Session) {
+	convId := session.conn.GetConv()
+	tokenVerifyRsp, err := httpclient.PostJson[dispatchapi.TokenVerifyRsp](
+		config.GetConfig().Hk4e.LoginSdkUrl+"/gate/token/verify",
+		&dispatchapi.TokenVerifyReq{
+			AccountId:    session.accountUid,
+			AccountToken: session.accountToken,
+		})
+	if err != nil {
+		// 无法确认账号状态时不恢复 避免dispatch不可用期间已封禁或已失效的账号恢复会话 客户端重新登录
+		logger.Error("resume verify token error: %v, convId: %v, uid: %v", err, convId, session.userId)
+		k.kcpEventInput <- &KcpEvent{
+			ConvId:       convId,
+			EventId:      KcpConnForceClose,
+			EventMessage: uint32(kcp.EnetServerKick),
+		}
+		return
+	} else if !tokenVerifyRsp.Valid || tokenVerifyRsp.PlayerID != session.userId {
+		logger.Error("resume token invalid, convId: %v, uid: %v", convId, session.userId)
+		k.kcpEventInput <- &KcpEvent{
+			ConvId:       convId,
+			EventId:      KcpConnForceClose,
+			EventMessage: uint32(kcp.EnetServerKick),
+		}
+		return
+	} else if tokenVerifyRsp.Forbid {
+		logger.Error("resume user forbid, convId: %v, uid: %v", convId, session.userId)
+		k.kcpEventInput <- &KcpEvent{
+			ConvId:       convId,
+			EventId:      KcpConnForceClose,
+			EventMessage: uint32(kcp.EnetServerKillClient),
+		}
+		return
+	}
+	go k.recvHandle(session)
+	go k.sendHandle(session)
+	// 通知GS恢复玩家
+	k.messageQueue.SendToGs(session.gsServerAppId, &mq.NetMsg{
+		MsgType: mq.MsgTypeConnCtrl,
+		EventId: mq.UserResumeNotify,
+		ConnCtrlMsg: &mq.ConnCtrlMsg{
+			UserId:  session.userId,
+			MsgLost: session.resumeMsgLost,
+		},
+	})
+	logger.Info("session resume, convId: %v, uid: %v, msgLost: %v", convId, session.userId, session.resumeMsgLost)
+}
+
+// 等待恢复期间收到发给该玩家的下行消息 标记消息已丢失 不存在等待恢复的会话时返回false
+func (k *KcpConnectManager) markResumeSessionMsgLost(userId uint32) bool {
+	k.resumeLock.Lock()
+	defer k.resumeLock.Unlock()
+	for _, resume := range k.resumeSessionMap {
+		if resume.session.userId == userId {
+			resume.msgLost = true
+			return true
+		}
+	}
+	return false
+}
+
+// 使指定玩家等待恢复的会话立即超时 不存在等待恢复的会话时返回false
+func (k *KcpConnectManager) expireResumeSession(userId uint32) bool {
+	k.resumeLock.Lock()
+	var session *Session = nil
+	for convId, resume := range k.resumeSessionMap {
+		if resume.session.userId == userId {
+			session = resume.session
+			delete(k.resumeSessionMap, convId)
+			delete(k.resumeTokenConvIdMap, session.resumeToken)
+			break
+		}
+	}
+	k.resumeLock.Unlock()
+	if session == nil {
+		return false
+	}
+	k.sendUserOffline(session)
+	return true
+}
+
+// 使全部等待恢复的会话立即超时
+func (k *KcpConnectManager) expireAllResumeSession() {
+	k.resumeLock.Lock()
+	sessionList := make([]*Session, 0, len(k.resumeSessionMap))
+	for convId, resume := range k.resumeSessionMap {
+		sessionList = append(sessionList, resume.session)
+		delete(k.resumeSessionMap, convId)
+		delete(k.resumeTokenConvIdMap, resume.session.resumeToken)
+	}
+	k.resumeLock.Unlock()
+	for _, session := range sessionList {
+		k.sendUserOffline(session)
+	}
+}
+
+// 清理超时未恢复的会话
+func (k *KcpConnectManager) resumeSessionExpireHandle() {
+	ticker := time.NewTicker(time.Second)
+	for {
+		<-ticker.C
+		now := time.Now().UnixNano()
+		k.resumeLock.Lock()
+		sessionList := make([]*Session, 0)
+		for convId, resume := range k.resumeSessionMap {
+			if now < resume.expireTime {
+				continue
+			}
+			sessionList = append(sessionList, resume.session)
+			delete(k.resumeSessionMap, convId)
+			delete(k.resumeTokenConvIdMap, resume.session.resumeToken)
+		}
+		k.resumeLock.Unlock()
+		for _, session := range sessionList {
+			logger.Info("session resume timeout, convId: %v, uid: %v", session.conn.GetConv(), session.userId)
+			k.sendUserOffline(session)
+		}
+	}
+}
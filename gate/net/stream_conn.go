@@ -0,0 +1,357 @@
+package net
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	gonet "net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"hk4e/common/config"
+	"hk4e/gate/kcp"
+	"hk4e/pkg/logger"
+	"hk4e/pkg/random"
+
+	"github.com/gorilla/websocket"
+)
+
+// TCP和WebSocket客户端连接
+// 与KCP连接使用相同的数据包格式和xor加密 供机器人压测 浏览器工具和经过代理调试使用
+// TCP连接的每个消息前带4字节大端序长度 WebSocket连接的每个二进制消息为一个消息
+// 连接建立后网关先发送一个Enet连接建立包告知客户端conv 断开时发送Enet连接断开包告知原因
+// 这类连接没有KCP的往返时延统计 也不支持会话恢复
+
+const (
+	streamFrameHeadLen   = 4
+	streamConnLingerTime = time.Second // 关闭连接后等待发送断开通知的时间
+	DefaultWebSocketPath = "/gate"
+	enetPacketLen        = 20
+)
+
+var errStreamConnClosed = errors.New("stream conn closed")
+
+// 按消息收发的底层连接
+type frameConn interface {
+	ReadFrame() ([]byte, error)
+	WriteFrame(data []byte) error
+	Close() error
+	RemoteAddr() gonet.Addr
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+type tcpFrameConn struct {
+	conn   gonet.Conn
+	reader *bufio.Reader
+}
+
+func newTcpFrameConn(conn gonet.Conn) *tcpFrameConn {
+	return &tcpFrameConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+func (c *tcpFrameConn) ReadFrame() ([]byte, error) {
+	head := make([]byte, streamFrameHeadLen)
+	_, err := io.ReadFull(c.reader, head)
+	if err != nil {
+		return nil, err
+	}
+	frameLen := binary.BigEndian.Uint32(head)
+	if frameLen > PacketMaxLen {
+		return nil, errors.New("frame len too long")
+	}
+	data := make([]byte, frameLen)
+	_, err = io.ReadFull(c.reader, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *tcpFrameConn) WriteFrame(data []byte) error {
+	frame := make([]byte, streamFrameHeadLen+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[streamFrameHeadLen:], data)
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *tcpFrameConn) Close() error                       { return c.conn.Close() }
+func (c *tcpFrameConn) RemoteAddr() gonet.Addr             { return c.conn.RemoteAddr() }
+func (c *tcpFrameConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *tcpFrameConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+type wsFrameConn struct {
+	conn *websocket.Conn
+}
+
+func (c *wsFrameConn) ReadFrame() ([]byte, error) {
+	for {
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		return data, nil
+	}
+}
+
+func (c *wsFrameConn) WriteFrame(data []byte) error {
+	return c.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (c *wsFrameConn) Close() error                       { return c.conn.Close() }
+func (c *wsFrameConn) RemoteAddr() gonet.Addr             { return c.conn.RemoteAddr() }
+func (c *wsFrameConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *wsFrameConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// streamConn 基于TCP或WebSocket的客户端连接
+type streamConn struct {
+	conv      uint64
+	transport string
+	conn      frameConn
+	closed    bool
+	lock      sync.Mutex
+	closeOnce sync.Once
+}
+
+func newStreamConn(conv uint64, transport string, conn frameConn) *streamConn {
+	return &streamConn{
+		conv:      conv,
+		transport: transport,
+		conn:      conn,
+	}
+}
+
+func (c *streamConn) GetConv() uint64 { return c.conv }
+
+// Read 读取一个消息 客户端发送的Enet连接断开包视为连接关闭
+func (c *streamConn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	closed := c.closed
+	c.lock.Unlock()
+	if closed {
+		return 0, errStreamConnClosed
+	}
+	data, err := c.conn.ReadFrame()
+	if err != nil {
+		return 0, err
+	}
+	if len(data) == enetPacketLen {
+		connType, _, _, err := kcp.ParseEnet(data)
+		if err == nil && connType == kcp.ConnEnetFin {
+			return 0, io.EOF
+		}
+	}
+	if len(data) > len(b) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(b, data), nil
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return 0, errStreamConnClosed
+	}
+	err := c.conn.WriteFrame(b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close 关闭连接 底层连接保留一小段时间用于发送断开通知
+func (c *streamConn) Close() error {
+	err := errStreamConnClosed
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		c.closed = true
+		c.lock.Unlock()
+		// 唤醒阻塞中的读取
+		_ = c.conn.SetReadDeadline(time.Now())
+		time.AfterFunc(streamConnLingerTime, func() {
+			_ = c.conn.Close()
+		})
+		err = nil
+	})
+	return err
+}
+
+func (c *streamConn) RemoteAddr() gonet.Addr             { return c.conn.RemoteAddr() }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// SendEnetNotifyToPeer 发送Enet通知 连接断开通知发送后立即关闭底层连接
+func (c *streamConn) SendEnetNotifyToPeer(enet *kcp.Enet) {
+	data := kcp.BuildEnet(enet.ConnType, enet.EnetType, c.conv)
+	if data == nil {
+		return
+	}
+	c.lock.Lock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(time.Second * ConnSendTimeout))
+	_ = c.conn.WriteFrame(data)
+	c.lock.Unlock()
+	if enet.ConnType == kcp.ConnEnetFin {
+		_ = c.conn.Close()
+	}
+}
+
+func (c *streamConn) GetRTO() uint32    { return 0 }
+func (c *streamConn) GetSRTT() int32    { return 0 }
+func (c *streamConn) GetSRTTVar() int32 { return 0 }
+
+// 生成没用过的conv
+func (k *KcpConnectManager) genStreamConv() uint64 {
+	for {
+		conv := binary.LittleEndian.Uint64(random.GetRandomByte(8))
+		if conv == 0 || k.GetSessionByConvId(conv) != nil {
+			continue
+		}
+		k.resumeLock.Lock()
+		_, exist := k.resumeSessionMap[conv]
+		k.resumeLock.Unlock()
+		if exist {
+			continue
+		}
+		return conv
+	}
+}
+
+// 接收TCP或WebSocket连接 告知客户端conv后创建会话
+func (k *KcpConnectManager) acceptStreamConn(transport string, conn frameConn) {
+	// 与KCP握手包相同的ip过滤和握手频率限制 在创建会话之前检查 不通过时直接关闭连接
+	if !k.checkConnSyn(conn.RemoteAddr().String()) {
+		_ = conn.Close()
+		return
+	}
+	sConn := newStreamConn(k.genStreamConv(), transport, conn)
+	if !k.checkNewConn(sConn) {
+		sConn.SendEnetNotifyToPeer(&kcp.Enet{
+			ConnType: kcp.ConnEnetFin,
+			EnetType: kcp.EnetServerKick,
+		})
+		return
+	}
+	sConn.SendEnetNotifyToPeer(&kcp.Enet{
+		ConnType: kcp.ConnEnetEst,
+		EnetType: kcp.EnetClientConnectKey,
+	})
+	atomic.AddInt32(&CLIENT_CONN_NUM, 1)
+	logger.Info("client connect, transport: %v, convId: %v, addr: %v", transport, sConn.GetConv(), sConn.RemoteAddr())
+	k.newSession(sConn)
+}
+
+// TCP连接接收处理函数
+func (k *KcpConnectManager) tcpAcceptHandle(listener gonet.Listener) {
+	logger.Info("tcp accept handle start")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Error("accept tcp err: %v", err)
+			return
+		}
+		if tcpConn, ok := conn.(*gonet.TCPConn); ok {
+			_ = tcpConn.SetNoDelay(true)
+		}
+		go k.acceptStreamConn(TransportTcp, newTcpFrameConn(conn))
+	}
+}
+
+// WebSocket连接接收处理函数
+func (k *KcpConnectManager) wsServe(port int32, path string) {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		// 供浏览器工具跨域连接
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logger.Error("websocket upgrade err: %v", err)
+			return
+		}
+		conn.SetReadLimit(PacketMaxLen)
+		k.acceptStreamConn(TransportWebSocket, &wsFrameConn{conn: conn})
+	})
+	logger.Info("websocket serve start, port: %v, path: %v", port, path)
+	err := http.ListenAndServe("0.0.0.0:"+strconv.Itoa(int(port)), mux)
+	if err != nil {
+		logger.Error("websocket serve err: %v", err)
+	}
+}
+
+// 开启配置的TCP和WebSocket监听
+func (k *KcpConnectManager) runStreamTransport() {
+	transportConfig := config.GetConfig().Gate.Transport
+	if transportConfig.TcpPort != 0 {
+		listener, err := gonet.Listen("tcp", "0.0.0.0:"+strconv.Itoa(int(transportConfig.TcpPort)))
+		if err != nil {
+			logger.Error("listen tcp err: %v", err)
+		} else {
+			go k.tcpAcceptHandle(listener)
+		}
+	}
+	if transportConfig.WsPort != 0 {
+		path := transportConfig.WsPath
+		if path == "" {
+			path = DefaultWebSocketPath
+		}
+		go k.wsServe(transportConfig.WsPort, path)
+	}
+}
+
+// 客户端握手 读取网关发送的Enet连接建立包获取conv
+func dialStream(transport string, conn frameConn) (Conn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * ConnRecvTimeout))
+	data, err := conn.ReadFrame()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if len(data) != enetPacketLen {
+		_ = conn.Close()
+		return nil, errors.New("recv packet format error")
+	}
+	connType, enetType, conv, err := kcp.ParseEnet(data)
+	if err != nil || connType != kcp.ConnEnetEst {
+		_ = conn.Close()
+		return nil, errors.New("conn refused, enet: " + strconv.Itoa(int(enetType)))
+	}
+	return newStreamConn(conv, transport, conn), nil
+}
+
+// DialTcp 客户端使用TCP连接网关
+func DialTcp(addr string) (Conn, error) {
+	conn, err := gonet.DialTimeout("tcp", addr, time.Second*ConnSendTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return dialStream(TransportTcp, newTcpFrameConn(conn))
+}
+
+// DialWebSocket 客户端使用WebSocket连接网关 url形如ws://127.0.0.1:22223/gate
+func DialWebSocket(url string) (Conn, error) {
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: time.Second * ConnSendTimeout,
+	}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(PacketMaxLen)
+	return dialStream(TransportWebSocket, &wsFrameConn{conn: conn})
+}
@@ -0,0 +1,281 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"hk4e/common/config"
+	"hk4e/common/mq"
+	"hk4e/common/rpc"
+	"hk4e/gate/net"
+	"hk4e/node/api"
+	"hk4e/pkg/logger"
+	"hk4e/protocol/cmd"
+	"hk4e/protocol/proto"
+
+	pb "google.golang.org/protobuf/proto"
+)
+
+// 抓包记录重放工具
+// 伪装成一个未注册到节点服务器的网关 将记录文件中指定玩家的上行协议按原始时间间隔经由消息队列发送到GS
+// GS的下行协议会回到本工具 只打印协议名不做处理
+// 重放会真实地登录和修改玩家数据 请只在测试环境使用并确保玩家不在线
+
+const (
+	LoginWaitTimeout = 10 // 等待登录完成的超时时间 秒
+	FinishWaitTime   = 3  // 重放完成后等待GS处理剩余消息的时间 秒
+)
+
+// Option 重放参数
+type Option struct {
+	FileList []string // 记录文件列表
+	UserId   uint32   // 重放的玩家uid
+	GsAppId  string   // 目标GS的appid 为空时由节点服务器分配
+	Speed    float64  // 重放速度倍数 为0时不等待原始时间间隔
+}
+
+// 网关本地处理的请求 不转发到GS
+var gateLocalCmdIdMap = map[uint16]bool{
+	cmd.GetPlayerTokenReq:  true,
+	cmd.PingReq:            true,
+	cmd.PlayerForceExitReq: true,
+}
+
+func Run(ctx context.Context, configFile string, option *Option) error {
+	config.InitConfig(configFile)
+
+	logger.InitLogger("replay")
+	defer func() {
+		logger.CloseLogger()
+	}()
+
+	recordList, err := loadRecord(option)
+	if err != nil {
+		logger.Error("load packet record error: %v", err)
+		return err
+	}
+	logger.Warn("load packet record finish, uid: %v, count: %v", option.UserId, len(recordList))
+
+	discoveryClient, err := rpc.NewDiscoveryClient()
+	if err != nil {
+		return err
+	}
+	gsAppId := option.GsAppId
+	if gsAppId == "" {
+		rsp, err := discoveryClient.GetServerAppId(context.TODO(), &api.GetServerAppIdReq{
+			ServerType: api.GS,
+			Uid:        option.UserId,
+		})
+		if err != nil {
+			logger.Error("get gs server appid error: %v", err)
+			return err
+		}
+		gsAppId = rsp.AppId
+	}
+	appId := "replay_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	logger.Warn("replay start, uid: %v, gs appid: %v, replay appid: %v", option.UserId, gsAppId, appId)
+
+	messageQueue := mq.NewMessageQueue(api.GATE, appId, discoveryClient)
+	if messageQueue == nil {
+		return errors.New("create message queue error")
+	}
+	defer messageQueue.Close()
+
+	r := &replayer{
+		messageQueue: messageQueue,
+		gsAppId:      gsAppId,
+		userId:       option.UserId,
+		loginRspChan: make(chan struct{}, 1),
+		kickChan:     make(chan struct{}),
+	}
+	go r.recvHandle()
+
+	if recordList[0].CmdId != cmd.PlayerLoginReq {
+		// 记录中没有登录请求 先代发一个登录请求
+		err = r.login(new(proto.PlayerLoginReq), 0)
+		if err != nil {
+			return err
+		}
+	}
+	defer r.logout()
+	startTime := time.Now()
+	for _, record := range recordList {
+		if option.Speed > 0 {
+			offset := time.Duration(float64(record.Time-recordList[0].Time)/option.Speed) * time.Microsecond
+			wait := time.Until(startTime.Add(offset))
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-r.kickChan:
+					return errors.New("kick by gs")
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}
+		select {
+		case <-r.kickChan:
+			return errors.New("kick by gs")
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		err = r.sendRecord(record)
+		if err != nil {
+			return err
+		}
+	}
+	logger.Warn("replay finish, uid: %v, count: %v", option.UserId, len(recordList))
+	time.Sleep(time.Second * FinishWaitTime)
+	return nil
+}
+
+// 读取记录文件中指定玩家的上行协议 按时间排序
+func loadRecord(option *Option) ([]*net.PacketRecord, error) {
+	recordList := make([]*net.PacketRecord, 0)
+	for _, fileName := range option.FileList {
+		fileRecordList, err := net.ReadPacketRecordFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range fileRecordList {
+			if record.Dir != net.PacketRecordDirUp || record.UserId != option.UserId {
+				continue
+			}
+			if gateLocalCmdIdMap[record.CmdId] {
+				continue
+			}
+			recordList = append(recordList, record)
+		}
+	}
+	if len(recordList) == 0 {
+		return nil, errors.New("no packet record to replay")
+	}
+	sort.SliceStable(recordList, func(i, j int) bool {
+		return recordList[i].Time < recordList[j].Time
+	})
+	return recordList, nil
+}
+
+type replayer struct {
+	messageQueue *mq.MessageQueue
+	gsAppId      string
+	userId       uint32
+	loginRspChan chan struct{}
+	kickChan     chan struct{}
+}
+
+func (r *replayer) sendRecord(record *net.PacketRecord) error {
+	clientSeq := uint32(0)
+	if len(record.HeadData) != 0 {
+		headMsg := new(proto.PacketHead)
+		err := pb.Unmarshal(record.HeadData, headMsg)
+		if err != nil {
+			logger.Error("unmarshal record head data error: %v, cmdId: %v", err, record.CmdId)
+			return err
+		}
+		clientSeq = headMsg.ClientSequenceId
+	}
+	if record.CmdId == cmd.PlayerLoginReq {
+		req := new(proto.PlayerLoginReq)
+		err := pb.Unmarshal(record.PayloadData, req)
+		if err != nil {
+			logger.Error("unmarshal record login req error: %v", err)
+			return err
+		}
+		return r.login(req, clientSeq)
+	}
+	logger.Info("[REPLAY SEND], cmdId: %v, cmdName: %v, clientSeq: %v", record.CmdId, record.CmdName, clientSeq)
+	payloadData := record.PayloadData
+	if payloadData == nil {
+		payloadData = make([]byte, 0)
+	}
+	r.messageQueue.SendToGs(r.gsAppId, &mq.NetMsg{
+		MsgType: mq.MsgTypeGame,
+		EventId: mq.NormalMsg,
+		GameMsg: &mq.GameMsg{
+			UserId:             r.userId,
+			CmdId:              record.CmdId,
+			ClientSeq:          clientSeq,
+			PayloadMessageData: payloadData,
+		},
+	})
+	return nil
+}
+
+// 发送登录请求并等待登录完成
+func (r *replayer) login(req *proto.PlayerLoginReq, clientSeq uint32) error {
+	// 与网关一致 不允许客户端指定进入的世界
+	req.TargetUid = 0
+	req.TargetHomeOwnerUid = 0
+	logger.Info("[REPLAY SEND], cmdId: %v, cmdName: PlayerLoginReq, clientSeq: %v", cmd.PlayerLoginReq, clientSeq)
+	r.messageQueue.SendToGs(r.gsAppId, &mq.NetMsg{
+		MsgType: mq.MsgTypeGame,
+		EventId: mq.NormalMsg,
+		GameMsg: &mq.GameMsg{
+			UserId:         r.userId,
+			CmdId:          cmd.PlayerLoginReq,
+			ClientSeq:      clientSeq,
+			PayloadMessage: req,
+		},
+	})
+	timer := time.NewTimer(time.Second * LoginWaitTimeout)
+	defer timer.Stop()
+	select {
+	case <-r.loginRspChan:
+		return nil
+	case <-r.kickChan:
+		return errors.New("kick by gs")
+	case <-timer.C:
+		logger.Error("wait login rsp timeout, uid: %v", r.userId)
+		return errors.New("wait login rsp timeout")
+	}
+}
+
+// 通知GS玩家下线
+func (r *replayer) logout() {
+	r.messageQueue.SendToGs(r.gsAppId, &mq.NetMsg{
+		MsgType: mq.MsgTypeConnCtrl,
+		EventId: mq.UserOfflineNotify,
+		ConnCtrlMsg: &mq.ConnCtrlMsg{
+			UserId: r.userId,
+		},
+	})
+	logger.Warn("send to gs user offline, uid: %v", r.userId)
+}
+
+// 接收GS的下行协议
+func (r *replayer) recvHandle() {
+	for {
+		netMsg := <-r.messageQueue.GetNetMsg()
+		switch netMsg.MsgType {
+		case mq.MsgTypeGame:
+			gameMsg := netMsg.GameMsg
+			if gameMsg.UserId != r.userId {
+				continue
+			}
+			cmdName := ""
+			if gameMsg.PayloadMessage != nil {
+				cmdName = string(gameMsg.PayloadMessage.ProtoReflect().Descriptor().FullName())
+			}
+			logger.Info("[REPLAY RECV], cmdId: %v, cmdName: %v, clientSeq: %v", gameMsg.CmdId, cmdName, gameMsg.ClientSeq)
+			if gameMsg.CmdId == cmd.PlayerLoginRsp {
+				select {
+				case r.loginRspChan <- struct{}{}:
+				default:
+				}
+			}
+		case mq.MsgTypeConnCtrl:
+			connCtrlMsg := netMsg.ConnCtrlMsg
+			if netMsg.EventId != mq.KickPlayerNotify || connCtrlMsg.KickUserId != r.userId {
+				continue
+			}
+			logger.Warn("kick by gs, uid: %v, reason: %v", r.userId, connCtrlMsg.KickReason)
+			close(r.kickChan)
+			return
+		}
+	}
+}
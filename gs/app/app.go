@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"expvar"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
@@ -35,28 +36,38 @@ func Run(ctx context.Context, configFile string) error {
 	}
 
 	// 注册到节点服务器
-	rsp, err := discoveryClient.RegisterServer(context.TODO(), &api.RegisterServerReq{
+	registerReq := &api.RegisterServerReq{
 		ServerType: api.GS,
-	})
+	}
+	rsp, err := discoveryClient.RegisterServer(context.TODO(), registerReq)
 	if err != nil {
 		return err
 	}
 	APPID = rsp.GetAppId()
+	GSID = rsp.GetGsId()
 	go func() {
 		ticker := time.NewTicker(time.Second * 15)
 		for {
 			<-ticker.C
 			_, err := discoveryClient.KeepaliveServer(context.TODO(), &api.KeepaliveServerReq{
-				ServerType: api.GS,
-				AppId:      APPID,
-				LoadCount:  uint32(atomic.LoadInt32(&game.ONLINE_PLAYER_NUM)),
+				ServerType:   api.GS,
+				AppId:        APPID,
+				LoadCount:    uint32(atomic.LoadInt32(&game.ONLINE_PLAYER_NUM)),
+				Capacity:     uint32(config.GetConfig().Hk4e.Capacity),
+				MainLoopUtil: uint32(atomic.LoadInt32(&game.MAIN_LOOP_UTIL)),
 			})
 			if err != nil {
 				logger.Error("keepalive error: %v", err)
+				// 节点服务器重启或主备切换后可能丢失了注册信息 沿用原来的appid和gsid重新注册
+				registerReq.AppId = APPID
+				registerReq.GsId = GSID
+				_, err = discoveryClient.RegisterServer(context.TODO(), registerReq)
+				if err != nil {
+					logger.Error("re-register error: %v", err)
+				}
 			}
 		}
 	}()
-	GSID = rsp.GetGsId()
 	defer func() {
 		_, _ = discoveryClient.CancelServer(context.TODO(), &api.CancelServerReq{
 			ServerType: api.GS,
@@ -84,6 +95,10 @@ func Run(ctx context.Context, configFile string) error {
 
 	messageQueue := mq.NewMessageQueue(api.GS, APPID, discoveryClient)
 	defer messageQueue.Close()
+	// 消息队列各优先级通道的深度 见/debug/vars
+	expvar.Publish("mq_lane", expvar.Func(func() any {
+		return messageQueue.GetLaneStat()
+	}))
 
 	gameCore := game.NewGameCore(db, messageQueue, GSID, APPID, mainGsAppid.AppId, discoveryClient)
 	defer gameCore.Close()
@@ -3,6 +3,7 @@ package game
 import (
 	"runtime"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"hk4e/common/mq"
@@ -41,8 +42,10 @@ var GCG_MANAGER *GCGManager = nil
 var MESSAGE_QUEUE *mq.MessageQueue
 
 var ONLINE_PLAYER_NUM int32 = 0 // 当前在线玩家数
+var MAIN_LOOP_UTIL int32 = 0    // 主循环cpu利用率 百分比
 
 var SELF *model.Player
+var TRACE *mq.TraceInfo // 当前正在处理的客户端消息的链路追踪信息
 
 type Game struct {
 	discovery   *rpc.DiscoveryClient // node节点服务器的natsrpc客户端
@@ -52,6 +55,7 @@ type Game struct {
 	gsAppid     string
 	mainGsAppid string
 	ai          *model.Player // 本服的Ai玩家对象
+	draining    bool          // 排空中 在线玩家会被逐批迁移到其他GS
 }
 
 func NewGameCore(dao *dao.Dao, messageQueue *mq.MessageQueue, gsId uint32, gsAppid string, mainGsAppid string, discovery *rpc.DiscoveryClient) (r *Game) {
@@ -72,21 +76,7 @@ func NewGameCore(dao *dao.Dao, messageQueue *mq.MessageQueue, gsId uint32, gsApp
 	COMMAND_MANAGER = NewCommandManager()
 	GCG_MANAGER = NewGCGManager()
 	RegLuaScriptLibFunc()
-	// 创建本服的Ai世界
-	uid := AiBaseUid + gsId
-	name := AiName
-	sign := AiSign + " GS:" + strconv.Itoa(int(gsId))
-	if r.IsMainGs() {
-		// 约定MainGameServer的Ai的AiWorld叫BigWorld
-		// 此世界会出现在全服的在线玩家列表中 所有的玩家都可以进入到此世界里来
-		uid = BigWorldAiUid
-		name = BigWorldAiName
-		sign = BigWorldAiSign
-	}
-	r.ai = r.CreateRobot(uid, name, sign)
-	WORLD_MANAGER.InitAiWorld(r.ai)
-	COMMAND_MANAGER.SetSystem(r.ai)
-	COMMAND_MANAGER.gmCmd.GMUnlockAllPoint(r.ai.PlayerID, 3)
+	r.initAi()
 	USER_MANAGER.SetRemoteUserOnlineState(BigWorldAiUid, true, mainGsAppid)
 	r.run()
 	return r
@@ -105,10 +95,50 @@ func (g *Game) GetMainGsAppid() string {
 }
 
 func (g *Game) IsMainGs() bool {
-	// 目前的实现逻辑是当前GsId最小的Gs做MainGs
+	// 目前的实现逻辑是当前GsId最小的Gs做MainGs 主GS宕机后由节点服务器重新选举
 	return g.gsAppid == g.mainGsAppid
 }
 
+// ServerMainGsChangeNotify 主GS变更通知 原主GS宕机后由本服接管大世界 本服不再是主GS时交出大世界
+func (g *Game) ServerMainGsChangeNotify(mainGsAppid string) {
+	logger.Warn("main gs change, old appid: %v, new appid: %v", g.mainGsAppid, mainGsAppid)
+	if g.mainGsAppid == mainGsAppid {
+		return
+	}
+	oldIsMainGs := g.IsMainGs()
+	g.mainGsAppid = mainGsAppid
+	USER_MANAGER.SetRemoteUserOnlineState(BigWorldAiUid, true, mainGsAppid)
+	if oldIsMainGs == g.IsMainGs() {
+		return
+	}
+	if g.IsMainGs() {
+		logger.Warn("this gs become main gs, replace ai world with big world, appid: %v", g.gsAppid)
+	} else {
+		logger.Warn("this gs is no longer main gs, release big world, appid: %v", g.gsAppid)
+	}
+	// 销毁原来的Ai世界 再按当前身份重新创建 避免同时存在两个Ai世界或两个GS都运行BigWorld
+	g.DestroyRobot(g.ai.PlayerID)
+	g.initAi()
+}
+
+// initAi 创建本服的Ai世界
+func (g *Game) initAi() {
+	uid := AiBaseUid + g.gsId
+	name := AiName
+	sign := AiSign + " GS:" + strconv.Itoa(int(g.gsId))
+	if g.IsMainGs() {
+		// 约定MainGameServer的Ai的AiWorld叫BigWorld
+		// 此世界会出现在全服的在线玩家列表中 所有的玩家都可以进入到此世界里来
+		uid = BigWorldAiUid
+		name = BigWorldAiName
+		sign = BigWorldAiSign
+	}
+	g.ai = g.CreateRobot(uid, name, sign)
+	WORLD_MANAGER.InitAiWorld(g.ai)
+	COMMAND_MANAGER.SetSystem(g.ai)
+	COMMAND_MANAGER.gmCmd.GMUnlockAllPoint(g.ai.PlayerID, 3)
+}
+
 // GetAi 获取本服的Ai玩家对象
 func (g *Game) GetAi() *model.Player {
 	return g.ai
@@ -136,6 +166,45 @@ func (g *Game) CreateRobot(uid uint32, name string, sign string) *model.Player {
 	return robot
 }
 
+// DestroyRobot 销毁机器人及其世界 世界内的其他玩家重新登录回到自己的世界
+func (g *Game) DestroyRobot(uid uint32) {
+	robot := USER_MANAGER.GetOnlineUser(uid)
+	if robot == nil {
+		return
+	}
+	world := WORLD_MANAGER.GetWorldByID(robot.WorldId)
+	if world != nil {
+		robotUidList := make([]uint32, 0)
+		for _, worldPlayer := range world.GetAllPlayer() {
+			if worldPlayer.PlayerID == uid {
+				continue
+			}
+			if worldPlayer.PlayerID < PlayerBaseUid {
+				// GM指令创建在此世界里的机器人随世界一起销毁
+				robotUidList = append(robotUidList, worldPlayer.PlayerID)
+				continue
+			}
+			g.ReLoginPlayer(worldPlayer.PlayerID, true)
+		}
+		WORLD_MANAGER.DestroyWorld(world.GetId())
+		for _, robotUid := range robotUidList {
+			g.DestroyRobot(robotUid)
+		}
+	}
+	TICK_MANAGER.DestroyUserGlobalTick(uid)
+	// 创建时广播过上线 销毁时同样广播下线 避免其它服务器保留已销毁机器人的在线状态
+	MESSAGE_QUEUE.SendToAll(&mq.NetMsg{
+		MsgType: mq.MsgTypeServer,
+		EventId: mq.ServerUserOnlineStateChangeNotify,
+		ServerMsg: &mq.ServerMsg{
+			UserId:   uid,
+			IsOnline: false,
+		},
+	})
+	USER_MANAGER.DeleteUser(uid)
+	atomic.AddInt32(&ONLINE_PLAYER_NUM, -1)
+}
+
 func (g *Game) run() {
 	go g.gameMainLoopD()
 }
@@ -194,6 +263,7 @@ func (g *Game) gameMainLoop() {
 				totalCost)
 			logger.Info("[GAME MAIN LOOP] total cpu time cost percent, totalCost: %v%%",
 				float32(totalCost)/float32(intervalTime/1e6)*100.0)
+			atomic.StoreInt32(&MAIN_LOOP_UTIL, int32(totalCost*100/(intervalTime/1e6)))
 			avgRouteCost := float32(0)
 			if routeCount != 0 {
 				avgRouteCost = float32(routeCost) / float32(routeCount)
@@ -295,6 +365,9 @@ func (g *Game) SendMsgToGate(cmdId uint16, userId uint32, clientSeq uint32, gate
 		ClientSeq:          clientSeq,
 		PayloadMessageData: payloadMessageData,
 	}
+	if TRACE != nil && TRACE.UserId == userId {
+		gameMsg.Trace = MESSAGE_QUEUE.ReplyTrace(TRACE)
+	}
 	MESSAGE_QUEUE.SendToGate(gateAppId, &mq.NetMsg{
 		MsgType: mq.MsgTypeGame,
 		EventId: mq.NormalMsg,
@@ -333,6 +406,27 @@ func (g *Game) SendMsg(cmdId uint16, userId uint32, clientSeq uint32, payloadMsg
 		return
 	}
 	gameMsg.PayloadMessageData = payloadMessageData
+	if TRACE != nil && TRACE.UserId == userId {
+		gameMsg.Trace = MESSAGE_QUEUE.ReplyTrace(TRACE)
+	}
+	if player.Paused {
+		// 暂停期间缓存下行消息 连接恢复后按顺序补发 超出上限时放弃缓存 恢复后让客户端重新登录
+		if player.PausedMsgOverflow {
+			return
+		}
+		if len(player.PausedMsgList) >= PausedMsgMaxNum {
+			logger.Warn("paused msg list overflow, uid: %v", userId)
+			player.PausedMsgList = nil
+			player.PausedMsgOverflow = true
+			return
+		}
+		player.PausedMsgList = append(player.PausedMsgList, &model.PausedMsg{
+			CmdId:              gameMsg.CmdId,
+			ClientSeq:          gameMsg.ClientSeq,
+			PayloadMessageData: gameMsg.PayloadMessageData,
+		})
+		return
+	}
 	MESSAGE_QUEUE.SendToGate(player.GateAppId, &mq.NetMsg{
 		MsgType: mq.MsgTypeGame,
 		EventId: mq.NormalMsg,
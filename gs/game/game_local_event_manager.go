@@ -22,6 +22,7 @@ const (
 	UserOfflineSaveToDbFinish         // 玩家离线保存完成
 	ReloadGameDataConfig              // 执行热更表
 	ReloadGameDataConfigFinish        // 热更表完成
+	DrainMigrateUser                  // 排空时迁移一批在线玩家到其他GS
 )
 
 const (
@@ -171,7 +172,10 @@ func (l *LocalEventManager) LocalEventHandle(localEvent *LocalEvent) {
 			},
 		})
 		if playerOfflineInfo.ChangeGsInfo.IsChangeGs {
-			gsAppId := USER_MANAGER.GetRemoteUserGsAppId(playerOfflineInfo.ChangeGsInfo.JoinHostUserId)
+			gsAppId := playerOfflineInfo.ChangeGsInfo.TargetGsAppId
+			if gsAppId == "" {
+				gsAppId = USER_MANAGER.GetRemoteUserGsAppId(playerOfflineInfo.ChangeGsInfo.JoinHostUserId)
+			}
 			MESSAGE_QUEUE.SendToGate(playerOfflineInfo.Player.GateAppId, &mq.NetMsg{
 				MsgType: mq.MsgTypeServer,
 				EventId: mq.ServerUserGsChangeNotify,
@@ -196,6 +200,9 @@ func (l *LocalEventManager) LocalEventHandle(localEvent *LocalEvent) {
 				EventId: ReloadGameDataConfigFinish,
 			}
 		}()
+	case DrainMigrateUser:
+		targetGsAppId := localEvent.Msg.(string)
+		GAME.DrainMigrateUser(targetGsAppId)
 	case ReloadGameDataConfigFinish:
 		gdconf.ReplaceGameDataConfig()
 		startTime := time.Now().UnixNano()
@@ -164,11 +164,14 @@ func (r *RouteManager) RouteHandle(netMsg *mq.NetMsg) {
 		gameMsg := netMsg.GameMsg
 		switch netMsg.EventId {
 		case mq.NormalMsg:
+			MESSAGE_QUEUE.AddTraceHop(gameMsg.Trace, mq.TraceStageServerRecv)
+			TRACE = gameMsg.Trace
 			if gameMsg.CmdId == cmd.PlayerLoginReq {
 				GAME.PlayerLoginReq(gameMsg.UserId, gameMsg.ClientSeq, netMsg.OriginServerAppId, gameMsg.PayloadMessage)
-				return
+			} else {
+				r.doRoute(gameMsg.CmdId, gameMsg.UserId, gameMsg.ClientSeq, gameMsg.PayloadMessage)
 			}
-			r.doRoute(gameMsg.CmdId, gameMsg.UserId, gameMsg.ClientSeq, gameMsg.PayloadMessage)
+			TRACE = nil
 		}
 	case mq.MsgTypeConnCtrl:
 		if netMsg.OriginServerType != api.GATE {
@@ -184,9 +187,27 @@ func (r *RouteManager) RouteHandle(netMsg *mq.NetMsg) {
 			GAME.OnUserOffline(connCtrlMsg.UserId, &ChangeGsInfo{
 				IsChangeGs: false,
 			})
+		case mq.UserPauseNotify:
+			GAME.OnUserPause(connCtrlMsg.UserId)
+		case mq.UserResumeNotify:
+			GAME.OnUserResume(connCtrlMsg.UserId, netMsg.OriginServerAppId, connCtrlMsg.MsgLost)
 		}
 	case mq.MsgTypeServer:
 		serverMsg := netMsg.ServerMsg
+		if netMsg.IsTimeout {
+			// 本服发出的可靠消息超时未确认
+			switch netMsg.EventId {
+			case mq.ServerUserMpReq:
+				GAME.ServerUserMpReqTimeout(serverMsg.UserMpInfo)
+			case mq.ServerUserMpRsp:
+				GAME.ServerUserMpRspTimeout(serverMsg.UserMpInfo)
+			case mq.ServerAddFriendNotify:
+				GAME.ServerAddFriendNotifyTimeout(serverMsg.AddFriendInfo)
+			default:
+				logger.Error("server msg timeout, event id: %v, topic: %v", netMsg.EventId, netMsg.Topic)
+			}
+			return
+		}
 		switch netMsg.EventId {
 		case mq.ServerUserOnlineStateChangeNotify:
 			logger.Debug("remote user online state change, uid: %v, online: %v", serverMsg.UserId, serverMsg.IsOnline)
@@ -201,6 +222,16 @@ func (r *RouteManager) RouteHandle(netMsg *mq.NetMsg) {
 			GAME.ServerChatMsgNotify(serverMsg.ChatMsgInfo)
 		case mq.ServerAddFriendNotify:
 			GAME.ServerAddFriendNotify(serverMsg.AddFriendInfo)
+		case mq.ServerDrainStateChangeNotify:
+			if netMsg.OriginServerType != api.NODE {
+				return
+			}
+			GAME.ServerDrainStateChangeNotify(serverMsg.IsDraining)
+		case mq.ServerMainGsChangeNotify:
+			if netMsg.OriginServerType != api.NODE {
+				return
+			}
+			GAME.ServerMainGsChangeNotify(serverMsg.GameServerAppId)
 		}
 	}
 }
@@ -140,6 +140,7 @@ func (u *UserManager) OnlineUser(userId uint32, clientSeq uint32, gateAppId stri
 type ChangeGsInfo struct {
 	IsChangeGs     bool
 	JoinHostUserId uint32
+	TargetGsAppId  string // 指定迁移的目标GS 为空则迁移到JoinHostUserId所在的GS
 }
 
 type PlayerOfflineInfo struct {
@@ -1,13 +1,16 @@
 package game
 
 import (
+	"context"
 	"sync/atomic"
 	"time"
 
 	"hk4e/common/constant"
 	"hk4e/common/mq"
+	"hk4e/gate/kcp"
 	"hk4e/gdconf"
 	"hk4e/gs/model"
+	"hk4e/node/api"
 	"hk4e/pkg/logger"
 	"hk4e/protocol/cmd"
 	"hk4e/protocol/proto"
@@ -229,6 +232,141 @@ func (g *Game) OnUserOffline(userId uint32, changeGsInfo *ChangeGsInfo) {
 	atomic.AddInt32(&ONLINE_PLAYER_NUM, -1)
 }
 
+const (
+	PausedMsgMaxNum = 1000 // 玩家暂停期间缓存的下行消息数量上限
+)
+
+// OnUserPause 玩家连接异常断开 保留在线数据等待连接恢复 暂停期间的下行消息先缓存起来
+func (g *Game) OnUserPause(userId uint32) {
+	logger.Info("user pause, uid: %v", userId)
+	player := USER_MANAGER.GetOnlineUser(userId)
+	if player == nil {
+		logger.Error("player is nil, uid: %v", userId)
+		return
+	}
+	player.Paused = true
+	player.PausedMsgList = nil
+	player.PausedMsgOverflow = false
+}
+
+// OnUserResume 玩家连接恢复 沿用在线数据 无需重新登录 补发暂停期间缓存的下行消息
+// 断开前已有下行消息丢失或缓存超出上限时 客户端状态无法保证一致 通知客户端重新登录
+func (g *Game) OnUserResume(userId uint32, gateAppId string, msgLost bool) {
+	logger.Info("user resume, uid: %v, gateAppId: %v", userId, gateAppId)
+	player := USER_MANAGER.GetOnlineUser(userId)
+	if player == nil {
+		logger.Error("player is nil, uid: %v", userId)
+		// 暂停期间玩家已被移除 断开连接让客户端重新登录
+		MESSAGE_QUEUE.SendToGate(gateAppId, &mq.NetMsg{
+			MsgType: mq.MsgTypeConnCtrl,
+			EventId: mq.KickPlayerNotify,
+			ConnCtrlMsg: &mq.ConnCtrlMsg{
+				KickUserId: userId,
+				KickReason: kcp.EnetNotFoundSession,
+			},
+		})
+		return
+	}
+	pausedMsgList := player.PausedMsgList
+	pausedMsgOverflow := player.PausedMsgOverflow
+	player.Paused = false
+	player.PausedMsgList = nil
+	player.PausedMsgOverflow = false
+	player.GateAppId = gateAppId
+	if msgLost || pausedMsgOverflow {
+		logger.Warn("user resume msg lost, relogin, uid: %v, msgLost: %v, overflow: %v", userId, msgLost, pausedMsgOverflow)
+		g.ReLoginPlayer(userId, false)
+		return
+	}
+	for _, pausedMsg := range pausedMsgList {
+		MESSAGE_QUEUE.SendToGate(player.GateAppId, &mq.NetMsg{
+			MsgType: mq.MsgTypeGame,
+			EventId: mq.NormalMsg,
+			GameMsg: &mq.GameMsg{
+				UserId:             userId,
+				CmdId:              pausedMsg.CmdId,
+				ClientSeq:          pausedMsg.ClientSeq,
+				PayloadMessageData: pausedMsg.PayloadMessageData,
+			},
+		})
+	}
+	if g.draining {
+		// 排空中恢复的玩家立即迁移 不必等待下一批
+		g.requestDrainMigrate(0)
+	}
+}
+
+const (
+	DrainMigrateBatchNum      = 50 // 排空时每批迁移的玩家数量
+	DrainMigrateBatchInterval = 1  // 排空时每批迁移的间隔时间 秒
+)
+
+// ServerDrainStateChangeNotify 服务器排空状态变更通知
+func (g *Game) ServerDrainStateChangeNotify(isDraining bool) {
+	logger.Warn("gs drain state change, draining: %v, appid: %v", isDraining, g.gsAppid)
+	if g.draining == isDraining {
+		return
+	}
+	g.draining = isDraining
+	if isDraining {
+		g.requestDrainMigrate(0)
+	}
+}
+
+// 异步获取迁移的目标GS 完成后回到主协程迁移一批玩家
+func (g *Game) requestDrainMigrate(delay int) {
+	go func() {
+		time.Sleep(time.Second * time.Duration(delay))
+		rsp, err := g.discovery.GetServerAppId(context.TODO(), &api.GetServerAppIdReq{
+			ServerType: api.GS,
+		})
+		targetGsAppId := ""
+		if err != nil {
+			logger.Error("get drain target gs appid error: %v", err)
+		} else {
+			targetGsAppId = rsp.AppId
+		}
+		LOCAL_EVENT_MANAGER.GetLocalEventChan() <- &LocalEvent{
+			EventId: DrainMigrateUser,
+			Msg:     targetGsAppId,
+		}
+	}()
+}
+
+// DrainMigrateUser 走玩家在线跨服迁移流程 将一批在线玩家迁移到目标GS
+func (g *Game) DrainMigrateUser(targetGsAppId string) {
+	if !g.draining {
+		return
+	}
+	if targetGsAppId == "" || targetGsAppId == g.gsAppid {
+		logger.Error("no gs can migrate user to, retry later")
+		g.requestDrainMigrate(DrainMigrateBatchInterval)
+		return
+	}
+	migrateCount := 0
+	remainCount := 0
+	for userId, player := range USER_MANAGER.GetAllOnlineUserList() {
+		if userId < PlayerBaseUid || player.NetFreeze {
+			continue
+		}
+		// 连接暂停中的玩家等恢复后再迁移 计入剩余数量保持重试
+		if player.Paused || migrateCount >= DrainMigrateBatchNum {
+			remainCount++
+			continue
+		}
+		g.SendMsg(cmd.LeaveWorldNotify, userId, 0, new(proto.LeaveWorldNotify))
+		g.OnUserOffline(userId, &ChangeGsInfo{
+			IsChangeGs:    true,
+			TargetGsAppId: targetGsAppId,
+		})
+		migrateCount++
+	}
+	logger.Warn("drain migrate user, count: %v, remain: %v, target gs appid: %v", migrateCount, remainCount, targetGsAppId)
+	if remainCount > 0 {
+		g.requestDrainMigrate(DrainMigrateBatchInterval)
+	}
+}
+
 func (g *Game) LoginNotify(userId uint32, clientSeq uint32, player *model.Player) {
 	g.SendMsg(cmd.PlayerDataNotify, userId, clientSeq, g.PacketPlayerDataNotify(player))
 	g.SendMsg(cmd.StoreWeightLimitNotify, userId, clientSeq, g.PacketStoreWeightLimitNotify())
@@ -196,7 +196,7 @@ func (g *Game) UserApplyEnterWorld(player *model.Player, targetUid uint32) {
 			return
 		}
 		gsAppId := USER_MANAGER.GetRemoteUserGsAppId(targetUid)
-		MESSAGE_QUEUE.SendToGs(gsAppId, &mq.NetMsg{
+		MESSAGE_QUEUE.SendToGsReliable(gsAppId, &mq.NetMsg{
 			MsgType: mq.MsgTypeServer,
 			EventId: mq.ServerUserMpReq,
 			ServerMsg: &mq.ServerMsg{
@@ -273,6 +273,7 @@ func (g *Game) UserDealEnterWorld(hostPlayer *model.Player, otherUid uint32, agr
 			return
 		}
 		gsAppId := USER_MANAGER.GetRemoteUserGsAppId(otherUid)
+		// 房主已经进入多人世界 发送失败时没有需要回滚的状态 不使用可靠消息
 		MESSAGE_QUEUE.SendToGs(gsAppId, &mq.NetMsg{
 			MsgType: mq.MsgTypeServer,
 			EventId: mq.ServerUserMpReq,
@@ -525,6 +526,7 @@ func (g *Game) ServerUserMpReq(userMpInfo *mq.UserMpInfo, gsAppId string) {
 	switch userMpInfo.OriginInfo.CmdName {
 	case "PlayerApplyEnterMpReq":
 		applyFailNotify := func(reason proto.PlayerApplyEnterMpResultNotify_Reason) {
+			// 本服没有需要回滚的状态 不使用可靠消息
 			MESSAGE_QUEUE.SendToGs(gsAppId, &mq.NetMsg{
 				MsgType: mq.MsgTypeServer,
 				EventId: mq.ServerUserMpRsp,
@@ -584,7 +586,8 @@ func (g *Game) ServerUserMpReq(userMpInfo *mq.UserMpInfo, gsAppId string) {
 		}
 		g.SendMsg(cmd.PlayerApplyEnterMpNotify, hostPlayer.PlayerID, hostPlayer.ClientSeq, playerApplyEnterMpNotify)
 
-		MESSAGE_QUEUE.SendToGs(gsAppId, &mq.NetMsg{
+		// 发送失败时撤销房主的申请记录
+		MESSAGE_QUEUE.SendToGsReliable(gsAppId, &mq.NetMsg{
 			MsgType: mq.MsgTypeServer,
 			EventId: mq.ServerUserMpRsp,
 			ServerMsg: &mq.ServerMsg{
@@ -642,3 +645,46 @@ func (g *Game) ServerUserMpRsp(userMpInfo *mq.UserMpInfo) {
 		}
 	}
 }
+
+// ServerUserMpReqTimeout 跨服多人世界请求超时 对方GS未确认收到
+func (g *Game) ServerUserMpReqTimeout(userMpInfo *mq.UserMpInfo) {
+	switch userMpInfo.OriginInfo.CmdName {
+	case "PlayerApplyEnterMpReq":
+		player := USER_MANAGER.GetOnlineUser(userMpInfo.OriginInfo.UserId)
+		if player == nil {
+			logger.Error("player is nil, uid: %v", userMpInfo.OriginInfo.UserId)
+			return
+		}
+		// 房主没有响应
+		playerApplyEnterMpResultNotify := &proto.PlayerApplyEnterMpResultNotify{
+			TargetUid:      userMpInfo.HostUserId,
+			TargetNickname: "",
+			IsAgreed:       false,
+			Reason:         proto.PlayerApplyEnterMpResultNotify_PLAYER_CANNOT_ENTER_MP,
+		}
+		g.SendMsg(cmd.PlayerApplyEnterMpResultNotify, player.PlayerID, player.ClientSeq, playerApplyEnterMpResultNotify)
+	default:
+		logger.Error("server user mp req timeout, cmd name: %v, host uid: %v, apply uid: %v",
+			userMpInfo.OriginInfo.CmdName, userMpInfo.HostUserId, userMpInfo.ApplyUserId)
+	}
+}
+
+// ServerUserMpRspTimeout 跨服多人世界响应超时 申请者所在GS未确认收到
+func (g *Game) ServerUserMpRspTimeout(userMpInfo *mq.UserMpInfo) {
+	switch userMpInfo.OriginInfo.CmdName {
+	case "PlayerApplyEnterMpReq":
+		if !userMpInfo.ApplyOk {
+			return
+		}
+		hostPlayer := USER_MANAGER.GetOnlineUser(userMpInfo.HostUserId)
+		if hostPlayer == nil {
+			logger.Error("player is nil, uid: %v", userMpInfo.HostUserId)
+			return
+		}
+		// 申请者无法收到后续结果 撤销房主的申请记录
+		delete(hostPlayer.CoopApplyMap, userMpInfo.OriginInfo.UserId)
+	default:
+		logger.Error("server user mp rsp timeout, cmd name: %v, host uid: %v",
+			userMpInfo.OriginInfo.CmdName, userMpInfo.HostUserId)
+	}
+}
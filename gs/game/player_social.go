@@ -234,6 +234,7 @@ func (g *Game) AskAddFriendReq(player *model.Player, payloadMsg pb.Message) {
 		if USER_MANAGER.GetRemoteUserOnlineState(targetUid) {
 			// 远程在线玩家
 			gsAppId := USER_MANAGER.GetRemoteUserGsAppId(targetUid)
+			// 本服没有需要回滚的状态 不使用可靠消息
 			MESSAGE_QUEUE.SendToGs(gsAppId, &mq.NetMsg{
 				MsgType: mq.MsgTypeServer,
 				EventId: mq.ServerAddFriendNotify,
@@ -326,42 +327,57 @@ func (g *Game) DealAddFriendReq(player *model.Player, payloadMsg pb.Message) {
 	g.SendMsg(cmd.DealAddFriendRsp, player.PlayerID, player.ClientSeq, dealAddFriendRsp)
 
 	if agree {
-		targetPlayer := USER_MANAGER.GetOnlineUser(targetUid)
-		if targetPlayer == nil {
-			// 非本地玩家
-			if USER_MANAGER.GetRemoteUserOnlineState(targetUid) {
-				// 远程在线玩家
-				gsAppId := USER_MANAGER.GetRemoteUserGsAppId(targetUid)
-				MESSAGE_QUEUE.SendToGs(gsAppId, &mq.NetMsg{
-					MsgType: mq.MsgTypeServer,
-					EventId: mq.ServerAddFriendNotify,
-					ServerMsg: &mq.ServerMsg{
-						AddFriendInfo: &mq.AddFriendInfo{
-							OriginInfo: &mq.OriginInfo{
-								CmdName: "DealAddFriendReq",
-								UserId:  player.PlayerID,
-							},
-							TargetUserId: targetUid,
-							ApplyPlayerOnlineInfo: &mq.UserBaseInfo{
-								UserId: player.PlayerID,
-							},
-						},
-					},
-				})
-			} else {
-				// 全服离线玩家
-				targetPlayer := USER_MANAGER.LoadTempOfflineUser(targetUid, true)
-				if targetPlayer == nil {
-					logger.Error("apply add friend target player is nil, uid: %v", targetUid)
-					return
-				}
-				targetPlayer.FriendList[player.PlayerID] = true
-				USER_MANAGER.SaveTempOfflineUser(targetPlayer)
-			}
+		g.addDealFriendToTarget(&mq.AddFriendInfo{
+			OriginInfo: &mq.OriginInfo{
+				CmdName: "DealAddFriendReq",
+				UserId:  player.PlayerID,
+			},
+			TargetUserId: targetUid,
+			ApplyPlayerOnlineInfo: &mq.UserBaseInfo{
+				UserId: player.PlayerID,
+			},
+		})
+	}
+}
+
+const (
+	DealAddFriendNotifyMaxSend = 5 // 同意好友申请的跨服通知最大发送次数
+)
+
+// 同意好友申请后为申请方添加好友 申请方可能在本服 其它服或离线 重复添加没有副作用
+func (g *Game) addDealFriendToTarget(addFriendInfo *mq.AddFriendInfo) {
+	targetUid := addFriendInfo.TargetUserId
+	friendUid := addFriendInfo.ApplyPlayerOnlineInfo.UserId
+	targetPlayer := USER_MANAGER.GetOnlineUser(targetUid)
+	if targetPlayer != nil {
+		targetPlayer.FriendList[friendUid] = true
+		return
+	}
+	if USER_MANAGER.GetRemoteUserOnlineState(targetUid) {
+		// 远程在线玩家 对方GS超时未确认时重发 对方只是确认丢失时重复添加也不会出错
+		if addFriendInfo.SendCount >= DealAddFriendNotifyMaxSend {
+			logger.Error("deal add friend notify send count limit, uid: %v, target uid: %v", friendUid, targetUid)
 			return
 		}
-		targetPlayer.FriendList[player.PlayerID] = true
+		addFriendInfo.SendCount++
+		gsAppId := USER_MANAGER.GetRemoteUserGsAppId(targetUid)
+		MESSAGE_QUEUE.SendToGsReliable(gsAppId, &mq.NetMsg{
+			MsgType: mq.MsgTypeServer,
+			EventId: mq.ServerAddFriendNotify,
+			ServerMsg: &mq.ServerMsg{
+				AddFriendInfo: addFriendInfo,
+			},
+		})
+		return
 	}
+	// 全服离线玩家
+	targetPlayer = USER_MANAGER.LoadTempOfflineUser(targetUid, true)
+	if targetPlayer == nil {
+		logger.Error("apply add friend target player is nil, uid: %v", targetUid)
+		return
+	}
+	targetPlayer.FriendList[friendUid] = true
+	USER_MANAGER.SaveTempOfflineUser(targetPlayer)
 }
 
 func (g *Game) GetOnlinePlayerListReq(player *model.Player, payloadMsg pb.Message) {
@@ -496,11 +512,21 @@ func (g *Game) ServerAddFriendNotify(addFriendInfo *mq.AddFriendInfo) {
 		}
 		g.SendMsg(cmd.AskAddFriendNotify, targetPlayer.PlayerID, targetPlayer.ClientSeq, askAddFriendNotify)
 	case "DealAddFriendReq":
-		targetPlayer := USER_MANAGER.GetOnlineUser(addFriendInfo.TargetUserId)
-		if targetPlayer == nil {
-			logger.Error("player is nil, uid: %v", addFriendInfo.TargetUserId)
-			return
-		}
-		targetPlayer.FriendList[addFriendInfo.ApplyPlayerOnlineInfo.UserId] = true
+		// 通知到达前申请方可能已经离线或转移到其它服
+		g.addDealFriendToTarget(addFriendInfo)
+	}
+}
+
+// ServerAddFriendNotifyTimeout 跨服添加好友通知超时 对方GS未确认收到
+// 对方可能已经添加成功只是确认丢失 不撤销本方的好友 重新查找申请方所在位置后重发
+func (g *Game) ServerAddFriendNotifyTimeout(addFriendInfo *mq.AddFriendInfo) {
+	switch addFriendInfo.OriginInfo.CmdName {
+	case "DealAddFriendReq":
+		logger.Warn("deal add friend notify timeout, resend, uid: %v, target uid: %v, send count: %v",
+			addFriendInfo.OriginInfo.UserId, addFriendInfo.TargetUserId, addFriendInfo.SendCount)
+		g.addDealFriendToTarget(addFriendInfo)
+	default:
+		logger.Error("server add friend notify timeout, cmd name: %v, target uid: %v",
+			addFriendInfo.OriginInfo.CmdName, addFriendInfo.TargetUserId)
 	}
 }
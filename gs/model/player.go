@@ -80,11 +80,21 @@ type Player struct {
 	GCGInfo                   *GCGInfo                                 `bson:"-" msgpack:"-"` // 七圣召唤信息
 	XLuaDebug                 bool                                     `bson:"-" msgpack:"-"` // 是否开启客户端XLUA调试
 	NetFreeze                 bool                                     `bson:"-" msgpack:"-"` // 客户端网络上下行冻结状态
+	Paused                    bool                                     `bson:"-" msgpack:"-"` // 客户端连接异常断开等待恢复的暂停状态
+	PausedMsgList             []*PausedMsg                             `bson:"-" msgpack:"-"` // 暂停期间缓存的下行消息
+	PausedMsgOverflow         bool                                     `bson:"-" msgpack:"-"` // 暂停期间缓存的下行消息超出上限
 	LastSceneBlockAoiMoveTime uint64                                   `bson:"-" msgpack:"-"` // 上一次移动处理场景区块aoi的时间
 	// 特殊数据
 	ChatMsgMap map[uint32][]*ChatMsg `bson:"-" msgpack:"-"` // 聊天信息 数据量偏大 只从db读写 不保存到redis
 }
 
+// PausedMsg 暂停期间缓存的下行消息 协议已序列化
+type PausedMsg struct {
+	CmdId              uint16
+	ClientSeq          uint32
+	PayloadMessageData []byte
+}
+
 func (p *Player) GetNextGameObjectGuid() uint64 {
 	p.GameObjectGuidCounter++
 	return uint64(p.PlayerID)<<32 + p.GameObjectGuidCounter
@@ -2,20 +2,32 @@ package app
 
 import (
 	"context"
+	"errors"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"hk4e/common/config"
 	"hk4e/common/mq"
+	"hk4e/common/rpc"
 	"hk4e/node/api"
+	"hk4e/node/controller"
+	"hk4e/node/dao"
 	"hk4e/node/service"
 	"hk4e/pkg/logger"
+	"hk4e/pkg/random"
 
 	"github.com/nats-io/nats.go"
 )
 
+const (
+	LeaderTtl           = time.Second * 15 // 主节点锁的存活时间
+	LeaderRenewInterval = time.Second * 5  // 主节点续期和备用节点抢锁的间隔时间
+)
+
 func Run(ctx context.Context, configFile string) error {
 	config.InitConfig(configFile)
 
@@ -33,15 +45,59 @@ func Run(ctx context.Context, configFile string) error {
 	}
 	defer conn.Close()
 
-	// 只用来监听全服广播
-	messageQueue := mq.NewMessageQueue(api.NODE, "node", nil)
-	defer messageQueue.Close()
+	db, err := dao.NewDao()
+	if err != nil {
+		return err
+	}
+	defer db.CloseDao()
 
-	s, err := service.NewService(conn, messageQueue)
+	// 运维管理接口 通过rpc访问主节点 备用节点也可以提供
+	discoveryClient, err := rpc.NewDiscoveryClient()
 	if err != nil {
 		return err
 	}
-	defer s.Close()
+	_ = controller.NewController(discoveryClient)
+
+	// 主备模式 抢到锁的节点作为主节点对外提供服务 其余节点作为备用节点等待接管
+	nodeId := strings.ToLower(random.GetRandomStr(8))
+	var messageQueue *mq.MessageQueue = nil
+	var svc *service.Service = nil
+	defer func() {
+		if svc != nil {
+			svc.Close()
+			db.ReleaseLeader(nodeId)
+		}
+		if messageQueue != nil {
+			messageQueue.Close()
+		}
+	}()
+	// 最近一次成功续期主节点锁的时间
+	var leaderRenewTime time.Time
+	tryBecomeLeader := func() error {
+		ok, err := db.AcquireLeader(nodeId, LeaderTtl)
+		if err != nil || !ok {
+			return nil
+		}
+		logger.Warn("node become leader, node id: %v", nodeId)
+		leaderRenewTime = time.Now()
+		// 只用来监听全服广播
+		messageQueue = mq.NewMessageQueue(api.NODE, "node", nil)
+		svc, err = service.NewService(conn, messageQueue, db)
+		if err != nil {
+			db.ReleaseLeader(nodeId)
+			return err
+		}
+		return nil
+	}
+	err = tryBecomeLeader()
+	if err != nil {
+		return err
+	}
+	if svc == nil {
+		logger.Warn("node standby, node id: %v", nodeId)
+	}
+	leaderTicker := time.NewTicker(LeaderRenewInterval)
+	defer leaderTicker.Stop()
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
@@ -49,6 +105,34 @@ func Run(ctx context.Context, configFile string) error {
 		select {
 		case <-ctx.Done():
 			return nil
+		case <-leaderTicker.C:
+			if svc == nil {
+				err = tryBecomeLeader()
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			ok, err := db.RenewLeader(nodeId, LeaderTtl)
+			if err != nil {
+				logger.Error("node leader renew error: %v, node id: %v", err, nodeId)
+				if time.Since(leaderRenewTime) < LeaderTtl {
+					continue
+				}
+				// 续期失败超过锁的存活时间 锁可能已被其他节点抢占 退出进程避免双主
+				logger.Error("node leader renew timeout, node id: %v", nodeId)
+				svc.Close()
+				svc = nil
+				return errors.New("node leader renew timeout")
+			}
+			if !ok {
+				// 锁已被其他节点抢占 退出进程避免双主
+				logger.Error("node leader lost, node id: %v", nodeId)
+				svc.Close()
+				svc = nil
+				return errors.New("node leader lost")
+			}
+			leaderRenewTime = time.Now()
 		case s := <-c:
 			logger.Warn("get a signal %s", s.String())
 			switch s {
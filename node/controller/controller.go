@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"strconv"
+
+	"hk4e/common/config"
+	"hk4e/common/httpauth"
+	"hk4e/common/rpc"
+	"hk4e/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 节点服务器运维管理接口 主备节点均可访问 请求通过rpc转发到主节点
+
+type Controller struct {
+	discovery *rpc.DiscoveryClient
+}
+
+func NewController(discovery *rpc.DiscoveryClient) (r *Controller) {
+	r = new(Controller)
+	r.discovery = discovery
+	go r.registerRouter()
+	return r
+}
+
+func (c *Controller) registerRouter() {
+	if config.GetConfig().Logger.Level == "DEBUG" {
+		gin.SetMode(gin.DebugMode)
+	} else {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	engine := gin.Default()
+	httpauth.WarnIfNoTrustedProxy()
+	engine.Use(httpauth.Authorize())
+	engine.GET("/node/server/list", c.serverList)
+	engine.GET("/node/gs/online", c.gsOnlineList)
+	engine.POST("/node/server/remove", c.serverRemove)
+	port := config.GetConfig().HttpPort
+	addr := ":" + strconv.Itoa(int(port))
+	err := engine.Run(addr)
+	if err != nil {
+		logger.Error("gin run error: %v", err)
+	}
+}
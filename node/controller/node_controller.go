@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"net/http"
+
+	"hk4e/node/api"
+	"hk4e/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 获取全部服务器实例列表
+func (c *Controller) serverList(context *gin.Context) {
+	rsp, err := c.discovery.GetAllServerInstanceList(context.Request.Context(), &api.NullMsg{})
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	context.JSON(http.StatusOK, rsp)
+}
+
+// 获取全服玩家GS在线列表
+func (c *Controller) gsOnlineList(context *gin.Context) {
+	rsp, err := c.discovery.GetGlobalGsOnlineMap(context.Request.Context(), &api.NullMsg{})
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	context.JSON(http.StatusOK, rsp)
+}
+
+type ServerRemoveReq struct {
+	ServerType string `json:"server_type"`
+	AppId      string `json:"app_id"`
+}
+
+// 强制移除服务器实例
+func (c *Controller) serverRemove(context *gin.Context) {
+	serverRemoveReq := new(ServerRemoveReq)
+	err := context.ShouldBindJSON(serverRemoveReq)
+	if err != nil {
+		logger.Error("parse json error: %v", err)
+		context.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	logger.Warn("ServerRemoveReq: %v", serverRemoveReq)
+	rsp, err := c.discovery.RemoveServer(context.Request.Context(), &api.RemoveServerReq{
+		ServerType: serverRemoveReq.ServerType,
+		AppId:      serverRemoveReq.AppId,
+	})
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	context.JSON(http.StatusOK, rsp)
+}
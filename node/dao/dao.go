@@ -0,0 +1,64 @@
+package dao
+
+import (
+	"context"
+	"strings"
+
+	"hk4e/common/config"
+	"hk4e/pkg/logger"
+
+	"github.com/go-redis/redis/v8"
+)
+
+type Dao struct {
+	redis        *redis.Client
+	redisCluster *redis.ClusterClient
+}
+
+func NewDao() (r *Dao, err error) {
+	r = new(Dao)
+
+	r.redis = nil
+	r.redisCluster = nil
+	redisAddr := strings.ReplaceAll(config.GetConfig().Redis.Addr, "redis://", "")
+	if strings.Contains(redisAddr, ",") {
+		redisAddrList := strings.Split(redisAddr, ",")
+		r.redisCluster = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        redisAddrList,
+			Password:     config.GetConfig().Redis.Password,
+			PoolSize:     10,
+			MinIdleConns: 1,
+		})
+	} else {
+		r.redis = redis.NewClient(&redis.Options{
+			Addr:         redisAddr,
+			Password:     config.GetConfig().Redis.Password,
+			DB:           0,
+			PoolSize:     10,
+			MinIdleConns: 1,
+		})
+	}
+	if r.redisCluster != nil {
+		err = r.redisCluster.Ping(context.TODO()).Err()
+	} else {
+		err = r.redis.Ping(context.TODO()).Err()
+	}
+	if err != nil {
+		logger.Error("redis ping error: %v", err)
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (d *Dao) CloseDao() {
+	var err error = nil
+	if d.redisCluster != nil {
+		err = d.redisCluster.Close()
+	} else {
+		err = d.redis.Close()
+	}
+	if err != nil {
+		logger.Error("redis close error: %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+package dao
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"hk4e/node/model"
+	"hk4e/pkg/logger"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// RedisNodeKeyPrefix key前缀
+const RedisNodeKeyPrefix = "HK4E:NODE"
+
+const (
+	ServerInstanceRedisKey = "SERVER_INSTANCE" // 服务器实例 hash key:appid value:服务器实例
+	ServerAppIdRedisKey    = "SERVER_APPID"    // 已分配过的服务器appid set
+	GsOnlineRedisKey       = "GS_ONLINE"       // 全服玩家GS在线列表 hash key:uid value:gs appid
+	MainGsRedisKey         = "MAIN_GS"         // 主GS的appid
+	RegionEc2bRedisKey     = "REGION_EC2B"     // 区服密钥轮换状态
+	LeaderRedisKey         = "LEADER"          // 主节点选举锁 value:节点id
+)
+
+func (d *Dao) getRedisNodeKey(key string) string {
+	return RedisNodeKeyPrefix + ":" + key
+}
+
+// SetServerInstance 写入服务器实例
+func (d *Dao) SetServerInstance(inst *model.ServerInstance) error {
+	data, err := msgpack.Marshal(inst)
+	if err != nil {
+		logger.Error("marshal server instance error: %v", err)
+		return err
+	}
+	key := d.getRedisNodeKey(ServerInstanceRedisKey)
+	if d.redisCluster != nil {
+		err = d.redisCluster.HSet(context.TODO(), key, inst.AppId, data).Err()
+	} else {
+		err = d.redis.HSet(context.TODO(), key, inst.AppId, data).Err()
+	}
+	if err != nil {
+		logger.Error("set server instance to redis error: %v", err)
+		return err
+	}
+	return nil
+}
+
+// DelServerInstance 删除服务器实例
+func (d *Dao) DelServerInstance(appId string) error {
+	var err error = nil
+	key := d.getRedisNodeKey(ServerInstanceRedisKey)
+	if d.redisCluster != nil {
+		err = d.redisCluster.HDel(context.TODO(), key, appId).Err()
+	} else {
+		err = d.redis.HDel(context.TODO(), key, appId).Err()
+	}
+	if err != nil {
+		logger.Error("del server instance from redis error: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetAllServerInstance 获取全部服务器实例
+func (d *Dao) GetAllServerInstance() ([]*model.ServerInstance, error) {
+	var result map[string]string = nil
+	var err error = nil
+	key := d.getRedisNodeKey(ServerInstanceRedisKey)
+	if d.redisCluster != nil {
+		result, err = d.redisCluster.HGetAll(context.TODO(), key).Result()
+	} else {
+		result, err = d.redis.HGetAll(context.TODO(), key).Result()
+	}
+	if err != nil {
+		logger.Error("get all server instance from redis error: %v", err)
+		return nil, err
+	}
+	instList := make([]*model.ServerInstance, 0, len(result))
+	for appId, data := range result {
+		inst := new(model.ServerInstance)
+		err = msgpack.Unmarshal([]byte(data), inst)
+		if err != nil {
+			logger.Error("unmarshal server instance error: %v, appid: %v", err, appId)
+			continue
+		}
+		instList = append(instList, inst)
+	}
+	return instList, nil
+}
+
+// AddServerAppId 记录已分配的服务器appid
+func (d *Dao) AddServerAppId(appId string) error {
+	var err error = nil
+	key := d.getRedisNodeKey(ServerAppIdRedisKey)
+	if d.redisCluster != nil {
+		err = d.redisCluster.SAdd(context.TODO(), key, appId).Err()
+	} else {
+		err = d.redis.SAdd(context.TODO(), key, appId).Err()
+	}
+	if err != nil {
+		logger.Error("add server appid to redis error: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetAllServerAppId 获取全部已分配的服务器appid
+func (d *Dao) GetAllServerAppId() ([]string, error) {
+	var result []string = nil
+	var err error = nil
+	key := d.getRedisNodeKey(ServerAppIdRedisKey)
+	if d.redisCluster != nil {
+		result, err = d.redisCluster.SMembers(context.TODO(), key).Result()
+	} else {
+		result, err = d.redis.SMembers(context.TODO(), key).Result()
+	}
+	if err != nil {
+		logger.Error("get all server appid from redis error: %v", err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// SetGsOnline 写入玩家所在GS
+func (d *Dao) SetGsOnline(userId uint32, appId string) error {
+	var err error = nil
+	key := d.getRedisNodeKey(GsOnlineRedisKey)
+	if d.redisCluster != nil {
+		err = d.redisCluster.HSet(context.TODO(), key, strconv.Itoa(int(userId)), appId).Err()
+	} else {
+		err = d.redis.HSet(context.TODO(), key, strconv.Itoa(int(userId)), appId).Err()
+	}
+	if err != nil {
+		logger.Error("set gs online to redis error: %v", err)
+		return err
+	}
+	return nil
+}
+
+// DelGsOnline 删除玩家所在GS
+func (d *Dao) DelGsOnline(userId uint32) error {
+	var err error = nil
+	key := d.getRedisNodeKey(GsOnlineRedisKey)
+	if d.redisCluster != nil {
+		err = d.redisCluster.HDel(context.TODO(), key, strconv.Itoa(int(userId))).Err()
+	} else {
+		err = d.redis.HDel(context.TODO(), key, strconv.Itoa(int(userId))).Err()
+	}
+	if err != nil {
+		logger.Error("del gs online from redis error: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetAllGsOnline 获取全服玩家GS在线列表
+func (d *Dao) GetAllGsOnline() (map[uint32]string, error) {
+	var result map[string]string = nil
+	var err error = nil
+	key := d.getRedisNodeKey(GsOnlineRedisKey)
+	if d.redisCluster != nil {
+		result, err = d.redisCluster.HGetAll(context.TODO(), key).Result()
+	} else {
+		result, err = d.redis.HGetAll(context.TODO(), key).Result()
+	}
+	if err != nil {
+		logger.Error("get all gs online from redis error: %v", err)
+		return nil, err
+	}
+	gsOnlineMap := make(map[uint32]string, len(result))
+	for k, v := range result {
+		userId, err := strconv.Atoi(k)
+		if err != nil {
+			logger.Error("parse gs online uid error: %v, uid: %v", err, k)
+			continue
+		}
+		gsOnlineMap[uint32(userId)] = v
+	}
+	return gsOnlineMap, nil
+}
+
+// SetMainGs 写入主GS的appid
+func (d *Dao) SetMainGs(appId string) error {
+	var err error = nil
+	key := d.getRedisNodeKey(MainGsRedisKey)
+	if d.redisCluster != nil {
+		err = d.redisCluster.Set(context.TODO(), key, appId, 0).Err()
+	} else {
+		err = d.redis.Set(context.TODO(), key, appId, 0).Err()
+	}
+	if err != nil {
+		logger.Error("set main gs to redis error: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetMainGs 获取主GS的appid
+func (d *Dao) GetMainGs() (string, error) {
+	var result = ""
+	var err error = nil
+	key := d.getRedisNodeKey(MainGsRedisKey)
+	if d.redisCluster != nil {
+		result, err = d.redisCluster.Get(context.TODO(), key).Result()
+	} else {
+		result, err = d.redis.Get(context.TODO(), key).Result()
+	}
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		logger.Error("get main gs from redis error: %v", err)
+		return "", err
+	}
+	return result, nil
+}
+
+// SetRegionEc2b 写入区服密钥轮换状态
+func (d *Dao) SetRegionEc2b(regionEc2b *model.RegionEc2b) error {
+	data, err := msgpack.Marshal(regionEc2b)
+	if err != nil {
+		logger.Error("marshal region ec2b error: %v", err)
+		return err
+	}
+	key := d.getRedisNodeKey(RegionEc2bRedisKey)
+	if d.redisCluster != nil {
+		err = d.redisCluster.Set(context.TODO(), key, data, 0).Err()
+	} else {
+		err = d.redis.Set(context.TODO(), key, data, 0).Err()
+	}
+	if err != nil {
+		logger.Error("set region ec2b to redis error: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetRegionEc2b 获取区服密钥轮换状态 不存在时返回nil
+func (d *Dao) GetRegionEc2b() (*model.RegionEc2b, error) {
+	var result []byte = nil
+	var err error = nil
+	key := d.getRedisNodeKey(RegionEc2bRedisKey)
+	if d.redisCluster != nil {
+		result, err = d.redisCluster.Get(context.TODO(), key).Bytes()
+	} else {
+		result, err = d.redis.Get(context.TODO(), key).Bytes()
+	}
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		logger.Error("get region ec2b from redis error: %v", err)
+		return nil, err
+	}
+	regionEc2b := new(model.RegionEc2b)
+	err = msgpack.Unmarshal(result, regionEc2b)
+	if err != nil {
+		logger.Error("unmarshal region ec2b error: %v", err)
+		return nil, err
+	}
+	return regionEc2b, nil
+}
+
+// 基于redis的节点服务器主备选举实现
+
+// 仅当锁仍属于自己时续期
+var renewLeaderScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// 仅当锁仍属于自己时释放
+var releaseLeaderScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// AcquireLeader 尝试成为主节点
+func (d *Dao) AcquireLeader(nodeId string, ttl time.Duration) (bool, error) {
+	var result = false
+	var err error = nil
+	key := d.getRedisNodeKey(LeaderRedisKey)
+	if d.redisCluster != nil {
+		result, err = d.redisCluster.SetNX(context.TODO(), key, nodeId, ttl).Result()
+	} else {
+		result, err = d.redis.SetNX(context.TODO(), key, nodeId, ttl).Result()
+	}
+	if err != nil {
+		logger.Error("redis leader setnx error: %v", err)
+		return false, err
+	}
+	return result, nil
+}
+
+// RenewLeader 主节点续期 返回false代表已失去主节点身份
+func (d *Dao) RenewLeader(nodeId string, ttl time.Duration) (bool, error) {
+	var result int64 = 0
+	var err error = nil
+	keys := []string{d.getRedisNodeKey(LeaderRedisKey)}
+	if d.redisCluster != nil {
+		result, err = renewLeaderScript.Run(context.TODO(), d.redisCluster, keys, nodeId, ttl.Milliseconds()).Int64()
+	} else {
+		result, err = renewLeaderScript.Run(context.TODO(), d.redis, keys, nodeId, ttl.Milliseconds()).Int64()
+	}
+	if err != nil {
+		logger.Error("redis leader renew error: %v", err)
+		return false, err
+	}
+	return result == 1, nil
+}
+
+// ReleaseLeader 主节点主动放弃
+func (d *Dao) ReleaseLeader(nodeId string) {
+	var err error = nil
+	keys := []string{d.getRedisNodeKey(LeaderRedisKey)}
+	if d.redisCluster != nil {
+		err = releaseLeaderScript.Run(context.TODO(), d.redisCluster, keys, nodeId).Err()
+	} else {
+		err = releaseLeaderScript.Run(context.TODO(), d.redis, keys, nodeId).Err()
+	}
+	if err != nil {
+		logger.Error("redis leader release error: %v", err)
+	}
+}
@@ -0,0 +1,9 @@
+package model
+
+// RegionEc2b 持久化的区服密钥轮换状态
+type RegionEc2b struct {
+	Data           []byte // 当前密钥
+	CreateTime     int64  // 当前密钥的创建时间
+	PrevData       []byte // 上一个密钥 重叠期内仍然有效
+	PrevExpireTime int64  // 上一个密钥的过期时间
+}
@@ -0,0 +1,18 @@
+package model
+
+// ServerInstance 持久化的服务器实例信息
+type ServerInstance struct {
+	ServerType        string
+	AppId             string
+	GateServerKcpAddr string
+	GateServerKcpPort uint32
+	GateServerMqAddr  string
+	GateServerMqPort  uint32
+	Version           []string
+	LastAliveTime     int64
+	GsId              uint32
+	LoadCount         uint32
+	Capacity          uint32
+	MainLoopUtil      uint32
+	Draining          bool
+}
@@ -2,14 +2,15 @@ package service
 
 import (
 	"context"
-	"math"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"hk4e/common/region"
+	"hk4e/common/mq"
 	"hk4e/node/api"
+	"hk4e/node/dao"
+	"hk4e/node/model"
 	"hk4e/pkg/logger"
 	"hk4e/pkg/random"
 
@@ -47,20 +48,69 @@ type ServerInstance struct {
 	lastAliveTime     int64
 	gsId              uint32
 	loadCount         uint32
+	capacity          uint32 // 最大承载量
+	mainLoopUtil      uint32 // 主循环cpu利用率 百分比
+	draining          bool   // 排空中 不再分配新的玩家和连接
+}
+
+func (i *ServerInstance) toModel() *model.ServerInstance {
+	return &model.ServerInstance{
+		ServerType:        i.serverType,
+		AppId:             i.appId,
+		GateServerKcpAddr: i.gateServerKcpAddr,
+		GateServerKcpPort: i.gateServerKcpPort,
+		GateServerMqAddr:  i.gateServerMqAddr,
+		GateServerMqPort:  i.gateServerMqPort,
+		Version:           i.version,
+		LastAliveTime:     i.lastAliveTime,
+		GsId:              i.gsId,
+		LoadCount:         i.loadCount,
+		Capacity:          i.capacity,
+		MainLoopUtil:      i.mainLoopUtil,
+		Draining:          i.draining,
+	}
+}
+
+func newServerInstanceFromModel(m *model.ServerInstance) *ServerInstance {
+	return &ServerInstance{
+		serverType:        m.ServerType,
+		appId:             m.AppId,
+		gateServerKcpAddr: m.GateServerKcpAddr,
+		gateServerKcpPort: m.GateServerKcpPort,
+		gateServerMqAddr:  m.GateServerMqAddr,
+		gateServerMqPort:  m.GateServerMqPort,
+		version:           m.Version,
+		lastAliveTime:     m.LastAliveTime,
+		gsId:              m.GsId,
+		loadCount:         m.LoadCount,
+		capacity:          m.Capacity,
+		mainLoopUtil:      m.MainLoopUtil,
+		draining:          m.Draining,
+	}
 }
 
 type DiscoveryService struct {
-	regionEc2b            *random.Ec2b         // 全局区服密钥信息
-	serverInstanceMap     map[string]*sync.Map // 全部服务器实例集合 key:服务器类型 value:服务器实例集合 -> key:appid value:服务器实例
-	serverAppIdMap        *sync.Map            // 服务器appid集合 key:appid value:是否存在
-	globalGsOnlineMap     map[uint32]string
-	globalGsOnlineMapLock sync.RWMutex
+	dao                      *dao.Dao         // 状态持久化 用于节点服务器重启和主备切换后恢复
+	messageQueue             *mq.MessageQueue // 用于通知服务器状态变更
+	regionEc2b               *random.Ec2b     // 全局区服密钥信息
+	regionEc2bCreateTime     int64            // 当前密钥的创建时间
+	regionEc2bPrev           *random.Ec2b     // 上一个密钥 轮换后的重叠期内仍然有效
+	regionEc2bPrevExpireTime int64            // 上一个密钥的过期时间
+	regionEc2bLock           sync.RWMutex
+	serverInstanceMap        map[string]*sync.Map // 全部服务器实例集合 key:服务器类型 value:服务器实例集合 -> key:appid value:服务器实例
+	serverAppIdMap           *sync.Map            // 服务器appid集合 key:appid value:是否存在
+	globalGsOnlineMap        map[uint32]string
+	globalGsOnlineMapLock    sync.RWMutex
+	mainGsAppId              string            // 主GS的appid 主GS负责承载大世界
+	mainGsAppIdLock          sync.Mutex        // 主GS选举锁
+	loadBalancePolicyMap     map[string]string // 各服务器类型的负载均衡策略 key:服务器类型 value:策略
 }
 
-func NewDiscoveryService() *DiscoveryService {
+func NewDiscoveryService(db *dao.Dao, messageQueue *mq.MessageQueue) *DiscoveryService {
 	r := new(DiscoveryService)
-	r.regionEc2b = region.NewRegionEc2b()
-	logger.Info("region ec2b create ok, seed: %v", r.regionEc2b.Seed())
+	r.dao = db
+	r.messageQueue = messageQueue
+	r.loadRegionEc2b()
 	r.serverInstanceMap = make(map[string]*sync.Map)
 	r.serverInstanceMap[api.GATE] = new(sync.Map)
 	r.serverInstanceMap[api.GS] = new(sync.Map)
@@ -68,26 +118,100 @@ func NewDiscoveryService() *DiscoveryService {
 	r.serverInstanceMap[api.PATHFINDING] = new(sync.Map)
 	r.serverAppIdMap = new(sync.Map)
 	r.globalGsOnlineMap = make(map[uint32]string)
+	r.initLoadBalancePolicy()
+	r.loadState()
 	go r.removeDeadServer()
+	go r.rotateRegionEc2b()
 	return r
 }
 
+// 从持久化存储中恢复服务器实例和玩家在线状态
+func (s *DiscoveryService) loadState() {
+	appIdList, err := s.dao.GetAllServerAppId()
+	if err == nil {
+		for _, appId := range appIdList {
+			s.serverAppIdMap.Store(appId, true)
+		}
+	}
+	instList, err := s.dao.GetAllServerInstance()
+	if err == nil {
+		nowTime := time.Now().Unix()
+		for _, m := range instList {
+			instMap, exist := s.serverInstanceMap[m.ServerType]
+			if !exist {
+				logger.Error("load unknown server type instance: %v", m)
+				continue
+			}
+			inst := newServerInstanceFromModel(m)
+			// 给服务器留出重新心跳的时间 避免切换后被立即判定为掉线
+			inst.lastAliveTime = nowTime
+			instMap.Store(inst.appId, inst)
+			s.serverAppIdMap.Store(inst.appId, true)
+			logger.Info("load server instance, server type: %v, appid: %v, gsid: %v", inst.serverType, inst.appId, inst.gsId)
+		}
+	}
+	gsOnlineMap, err := s.dao.GetAllGsOnline()
+	if err == nil {
+		s.globalGsOnlineMapLock.Lock()
+		s.globalGsOnlineMap = gsOnlineMap
+		s.globalGsOnlineMapLock.Unlock()
+	}
+	mainGsAppId, err := s.dao.GetMainGs()
+	if err == nil {
+		s.mainGsAppId = mainGsAppId
+	}
+	logger.Info("load discovery state finish, appid count: %v, instance count: %v, online user count: %v, main gs appid: %v",
+		len(appIdList), len(instList), len(gsOnlineMap), mainGsAppId)
+}
+
+// SetUserGsOnlineState 更新全服玩家GS在线列表
+func (s *DiscoveryService) SetUserGsOnlineState(userId uint32, isOnline bool, gsAppId string) {
+	s.globalGsOnlineMapLock.Lock()
+	if isOnline {
+		s.globalGsOnlineMap[userId] = gsAppId
+	} else {
+		delete(s.globalGsOnlineMap, userId)
+	}
+	s.globalGsOnlineMapLock.Unlock()
+	if isOnline {
+		_ = s.dao.SetGsOnline(userId, gsAppId)
+	} else {
+		_ = s.dao.DelGsOnline(userId)
+	}
+}
+
 // RegisterServer 服务器启动注册获取appid
 func (s *DiscoveryService) RegisterServer(ctx context.Context, req *api.RegisterServerReq) (*api.RegisterServerRsp, error) {
-	logger.Info("register new server, server type: %v", req.ServerType)
+	logger.Info("register new server, server type: %v, appid: %v, gsid: %v", req.ServerType, req.AppId, req.GsId)
 	instMap, exist := s.serverInstanceMap[req.ServerType]
 	if !exist {
 		return nil, errors.New("server type not exist")
 	}
 	var appId string
-	for {
-		appId = strings.ToLower(random.GetRandomStr(8))
-		_, exist := s.serverAppIdMap.Load(appId)
-		if !exist {
-			s.serverAppIdMap.Store(appId, true)
-			break
+	if req.AppId != "" {
+		// 服务器重新注册 沿用原来的appid
+		for serverType, otherInstMap := range s.serverInstanceMap {
+			if serverType == req.ServerType {
+				continue
+			}
+			_, exist := otherInstMap.Load(req.AppId)
+			if exist {
+				return nil, errors.New("appid already used by other server type")
+			}
+		}
+		appId = req.AppId
+		s.serverAppIdMap.Store(appId, true)
+	} else {
+		for {
+			appId = strings.ToLower(random.GetRandomStr(8))
+			_, exist := s.serverAppIdMap.Load(appId)
+			if !exist {
+				s.serverAppIdMap.Store(appId, true)
+				break
+			}
 		}
 	}
+	_ = s.dao.AddServerAppId(appId)
 	inst := &ServerInstance{
 		serverType:    req.ServerType,
 		appId:         appId,
@@ -102,8 +226,6 @@ func (s *DiscoveryService) RegisterServer(ctx context.Context, req *api.Register
 		inst.gateServerMqPort = req.GateServerAddr.MqPort
 		inst.version = req.Version
 	}
-	instMap.Store(appId, inst)
-	logger.Info("new server appid is: %v", appId)
 	rsp := &api.RegisterServerRsp{
 		AppId: appId,
 	}
@@ -112,6 +234,9 @@ func (s *DiscoveryService) RegisterServer(ctx context.Context, req *api.Register
 		gsIdUseList[0] = true
 		instMap.Range(func(key, value any) bool {
 			serverInstance := value.(*ServerInstance)
+			if serverInstance.appId == appId {
+				return true
+			}
 			if serverInstance.gsId > MaxGsId {
 				logger.Error("invalid gs id inst: %v", serverInstance)
 				return true
@@ -120,10 +245,18 @@ func (s *DiscoveryService) RegisterServer(ctx context.Context, req *api.Register
 			return true
 		})
 		newGsId := uint32(0)
-		for gsId, use := range gsIdUseList {
-			if !use {
-				newGsId = uint32(gsId)
-				break
+		if req.GsId != 0 {
+			// 服务器重新注册 沿用原来的gsid
+			if req.GsId > MaxGsId || gsIdUseList[req.GsId] {
+				return nil, errors.New("gs id already in use")
+			}
+			newGsId = req.GsId
+		} else {
+			for gsId, use := range gsIdUseList {
+				if !use {
+					newGsId = uint32(gsId)
+					break
+				}
 			}
 		}
 		if newGsId == 0 {
@@ -132,28 +265,45 @@ func (s *DiscoveryService) RegisterServer(ctx context.Context, req *api.Register
 		inst.gsId = newGsId
 		rsp.GsId = newGsId
 	}
+	instMap.Store(appId, inst)
+	_ = s.dao.SetServerInstance(inst.toModel())
+	logger.Info("new server appid is: %v", appId)
 	return rsp, nil
 }
 
 // CancelServer 服务器关闭取消注册
 func (s *DiscoveryService) CancelServer(ctx context.Context, req *api.CancelServerReq) (*api.NullMsg, error) {
 	logger.Info("server cancel, server type: %v, appid: %v", req.ServerType, req.AppId)
-	instMap, exist := s.serverInstanceMap[req.ServerType]
+	err := s.removeServerInstance(req.ServerType, req.AppId)
+	if err != nil {
+		return nil, err
+	}
+	return &api.NullMsg{}, nil
+}
+
+// 移除服务器实例
+func (s *DiscoveryService) removeServerInstance(serverType string, appId string) error {
+	instMap, exist := s.serverInstanceMap[serverType]
 	if !exist {
-		return nil, errors.New("server type not exist")
+		return errors.New("server type not exist")
 	}
-	_, exist = instMap.Load(req.AppId)
+	_, exist = instMap.Load(appId)
 	if !exist {
-		logger.Error("recv not exist server cancel, server type: %v, appid: %v", req.ServerType, req.AppId)
-		return nil, errors.New("server not exist")
+		logger.Error("remove not exist server, server type: %v, appid: %v", serverType, appId)
+		return errors.New("server not exist")
 	}
-	instMap.Delete(req.AppId)
-	return &api.NullMsg{}, nil
+	instMap.Delete(appId)
+	_ = s.dao.DelServerInstance(appId)
+	if serverType == api.GS {
+		s.onGsRemove(appId)
+	}
+	return nil
 }
 
 // KeepaliveServer 服务器在线心跳保持
 func (s *DiscoveryService) KeepaliveServer(ctx context.Context, req *api.KeepaliveServerReq) (*api.NullMsg, error) {
-	logger.Debug("server keepalive, server type: %v, appid: %v, load: %v", req.ServerType, req.AppId, req.LoadCount)
+	logger.Debug("server keepalive, server type: %v, appid: %v, load: %v, capacity: %v, main loop util: %v",
+		req.ServerType, req.AppId, req.LoadCount, req.Capacity, req.MainLoopUtil)
 	instMap, exist := s.serverInstanceMap[req.ServerType]
 	if !exist {
 		return nil, errors.New("server type not exist")
@@ -166,25 +316,23 @@ func (s *DiscoveryService) KeepaliveServer(ctx context.Context, req *api.Keepali
 	serverInstance := inst.(*ServerInstance)
 	serverInstance.lastAliveTime = time.Now().Unix()
 	serverInstance.loadCount = req.LoadCount
+	serverInstance.capacity = req.Capacity
+	serverInstance.mainLoopUtil = req.MainLoopUtil
+	_ = s.dao.SetServerInstance(serverInstance.toModel())
 	return &api.NullMsg{}, nil
 }
 
-// GetServerAppId 获取负载最小的服务器的appid
+// GetServerAppId 按负载均衡策略获取服务器的appid
 func (s *DiscoveryService) GetServerAppId(ctx context.Context, req *api.GetServerAppIdReq) (*api.GetServerAppIdRsp, error) {
-	logger.Debug("get server instance, server type: %v", req.ServerType)
+	logger.Debug("get server instance, server type: %v, uid: %v", req.ServerType, req.Uid)
 	instMap, exist := s.serverInstanceMap[req.ServerType]
 	if !exist {
 		return nil, errors.New("server type not exist")
 	}
-	if s.getServerInstanceMapLen(instMap) == 0 {
+	inst := s.selectServerInstance(req.ServerType, instMap, req.Uid)
+	if inst == nil {
 		return nil, errors.New("no server found")
 	}
-	var inst *ServerInstance = nil
-	if req.ServerType == api.GATE || req.ServerType == api.GS {
-		inst = s.getMinLoadServerInstance(instMap)
-	} else {
-		inst = s.getRandomServerInstance(instMap)
-	}
 	logger.Debug("get server appid is: %v", inst.appId)
 	return &api.GetServerAppIdRsp{
 		AppId: inst.appId,
@@ -194,12 +342,19 @@ func (s *DiscoveryService) GetServerAppId(ctx context.Context, req *api.GetServe
 // GetRegionEc2B 获取区服密钥信息
 func (s *DiscoveryService) GetRegionEc2B(ctx context.Context, req *api.NullMsg) (*api.RegionEc2B, error) {
 	logger.Info("get region ec2b ok")
-	return &api.RegionEc2B{
+	s.regionEc2bLock.RLock()
+	defer s.regionEc2bLock.RUnlock()
+	rsp := &api.RegionEc2B{
 		Data: s.regionEc2b.Bytes(),
-	}, nil
+	}
+	if s.regionEc2bPrev != nil && time.Now().Unix() <= s.regionEc2bPrevExpireTime {
+		rsp.PrevData = s.regionEc2bPrev.Bytes()
+		rsp.PrevExpireTime = s.regionEc2bPrevExpireTime
+	}
+	return rsp, nil
 }
 
-// GetGateServerAddr 获取负载最小的网关服务器的地址和端口
+// GetGateServerAddr 按负载均衡策略获取网关服务器的地址和端口
 func (s *DiscoveryService) GetGateServerAddr(ctx context.Context, req *api.GetGateServerAddrReq) (*api.GateServerAddr, error) {
 	logger.Debug("get gate server addr")
 	instMap, exist := s.serverInstanceMap[api.GATE]
@@ -220,10 +375,10 @@ func (s *DiscoveryService) GetGateServerAddr(ctx context.Context, req *api.GetGa
 		}
 		return true
 	})
-	if s.getServerInstanceMapLen(&versionInstMap) == 0 {
+	inst := s.selectServerInstance(api.GATE, &versionInstMap, 0)
+	if inst == nil {
 		return nil, errors.New("no gate server found")
 	}
-	inst := s.getMinLoadServerInstance(&versionInstMap)
 	logger.Debug("get gate server addr is, ip: %v, port: %v", inst.gateServerKcpAddr, inst.gateServerKcpPort)
 	return &api.GateServerAddr{
 		KcpAddr: inst.gateServerKcpAddr,
@@ -266,16 +421,7 @@ func (s *DiscoveryService) GetMainGameServerAppId(ctx context.Context, req *api.
 	if s.getServerInstanceMapLen(instMap) == 0 {
 		return nil, errors.New("no game server found")
 	}
-	appid := ""
-	mainGsId := uint32(1)
-	instMap.Range(func(key, value any) bool {
-		serverInstance := value.(*ServerInstance)
-		if serverInstance.gsId == mainGsId {
-			appid = serverInstance.appId
-			return false
-		}
-		return true
-	})
+	appid := s.getMainGsAppId()
 	if appid == "" {
 		return nil, errors.New("main game server not found")
 	}
@@ -284,6 +430,83 @@ func (s *DiscoveryService) GetMainGameServerAppId(ctx context.Context, req *api.
 	}, nil
 }
 
+// 获取主GS的appid 主GS不存在时重新选举
+func (s *DiscoveryService) getMainGsAppId() string {
+	s.mainGsAppIdLock.Lock()
+	defer s.mainGsAppIdLock.Unlock()
+	if s.mainGsAppId != "" {
+		_, exist := s.serverInstanceMap[api.GS].Load(s.mainGsAppId)
+		if exist {
+			return s.mainGsAppId
+		}
+	}
+	s.electMainGs()
+	return s.mainGsAppId
+}
+
+// 选举新的主GS 优先选择未排空的gsid最小的GS 需要在持有mainGsAppIdLock时调用
+func (s *DiscoveryService) electMainGs() {
+	var mainInst *ServerInstance = nil
+	s.serverInstanceMap[api.GS].Range(func(key, value any) bool {
+		serverInstance := value.(*ServerInstance)
+		if mainInst == nil {
+			mainInst = serverInstance
+			return true
+		}
+		if mainInst.draining != serverInstance.draining {
+			if mainInst.draining {
+				mainInst = serverInstance
+			}
+			return true
+		}
+		if serverInstance.gsId < mainInst.gsId {
+			mainInst = serverInstance
+		}
+		return true
+	})
+	newMainGsAppId := ""
+	if mainInst != nil {
+		newMainGsAppId = mainInst.appId
+	}
+	if newMainGsAppId == s.mainGsAppId {
+		return
+	}
+	logger.Warn("main gs change, old appid: %v, new appid: %v", s.mainGsAppId, newMainGsAppId)
+	s.mainGsAppId = newMainGsAppId
+	_ = s.dao.SetMainGs(newMainGsAppId)
+	if newMainGsAppId == "" {
+		return
+	}
+	// 通知全部服务器主GS变更 新的主GS接管大世界
+	s.messageQueue.SendToAll(&mq.NetMsg{
+		MsgType: mq.MsgTypeServer,
+		EventId: mq.ServerMainGsChangeNotify,
+		ServerMsg: &mq.ServerMsg{
+			GameServerAppId: newMainGsAppId,
+		},
+	})
+}
+
+// GS移除后的处理 清理该GS上的玩家在线状态 主GS移除时重新选举
+func (s *DiscoveryService) onGsRemove(appId string) {
+	s.globalGsOnlineMapLock.Lock()
+	offlineUserIdList := make([]uint32, 0)
+	for userId, gsAppId := range s.globalGsOnlineMap {
+		if gsAppId == appId {
+			offlineUserIdList = append(offlineUserIdList, userId)
+		}
+	}
+	s.globalGsOnlineMapLock.Unlock()
+	for _, userId := range offlineUserIdList {
+		s.SetUserGsOnlineState(userId, false, "")
+	}
+	s.mainGsAppIdLock.Lock()
+	if s.mainGsAppId == appId {
+		s.electMainGs()
+	}
+	s.mainGsAppIdLock.Unlock()
+}
+
 // GetGlobalGsOnlineMap 获取全服玩家GS在线列表
 func (s *DiscoveryService) GetGlobalGsOnlineMap(ctx context.Context, req *api.NullMsg) (*api.GetGlobalGsOnlineMapRsp, error) {
 	copyMap := make(map[uint32]string)
@@ -297,35 +520,118 @@ func (s *DiscoveryService) GetGlobalGsOnlineMap(ctx context.Context, req *api.Nu
 	}, nil
 }
 
-func (s *DiscoveryService) getRandomServerInstance(instMap *sync.Map) *ServerInstance {
-	instList := make(ServerInstanceSortList, 0)
-	instMap.Range(func(key, value any) bool {
-		instList = append(instList, value.(*ServerInstance))
-		return true
-	})
-	sort.Stable(instList)
-	index := random.GetRandomInt32(0, int32(len(instList)-1))
-	inst := instList[index]
-	return inst
+// DrainServer 服务器开始排空 不再分配新的玩家和连接
+func (s *DiscoveryService) DrainServer(ctx context.Context, req *api.DrainServerReq) (*api.NullMsg, error) {
+	logger.Warn("server drain, server type: %v, appid: %v", req.ServerType, req.AppId)
+	err := s.setServerDrainState(req.ServerType, req.AppId, true)
+	if err != nil {
+		return nil, err
+	}
+	return &api.NullMsg{}, nil
 }
 
-func (s *DiscoveryService) getMinLoadServerInstance(instMap *sync.Map) *ServerInstance {
+// UndrainServer 服务器取消排空
+func (s *DiscoveryService) UndrainServer(ctx context.Context, req *api.UndrainServerReq) (*api.NullMsg, error) {
+	logger.Warn("server undrain, server type: %v, appid: %v", req.ServerType, req.AppId)
+	err := s.setServerDrainState(req.ServerType, req.AppId, false)
+	if err != nil {
+		return nil, err
+	}
+	return &api.NullMsg{}, nil
+}
+
+// GetAllServerInstanceList 获取全部服务器实例信息列表
+func (s *DiscoveryService) GetAllServerInstanceList(ctx context.Context, req *api.NullMsg) (*api.ServerInstanceList, error) {
+	logger.Debug("get all server instance list")
+	s.mainGsAppIdLock.Lock()
+	mainGsAppId := s.mainGsAppId
+	s.mainGsAppIdLock.Unlock()
+	serverInstanceList := make([]*api.ServerInstanceInfo, 0)
+	for _, serverType := range []string{api.GATE, api.GS, api.ANTICHEAT, api.PATHFINDING} {
+		instList := make(ServerInstanceSortList, 0)
+		s.serverInstanceMap[serverType].Range(func(key, value any) bool {
+			instList = append(instList, value.(*ServerInstance))
+			return true
+		})
+		sort.Stable(instList)
+		for _, inst := range instList {
+			serverInstanceList = append(serverInstanceList, &api.ServerInstanceInfo{
+				ServerType: inst.serverType,
+				AppId:      inst.appId,
+				GsId:       inst.gsId,
+				GateServerAddr: &api.GateServerAddr{
+					KcpAddr: inst.gateServerKcpAddr,
+					KcpPort: inst.gateServerKcpPort,
+					MqAddr:  inst.gateServerMqAddr,
+					MqPort:  inst.gateServerMqPort,
+				},
+				Version:       inst.version,
+				LoadCount:     inst.loadCount,
+				Capacity:      inst.capacity,
+				MainLoopUtil:  inst.mainLoopUtil,
+				LastAliveTime: inst.lastAliveTime,
+				IsDraining:    inst.draining,
+				IsMainGs:      inst.serverType == api.GS && inst.appId == mainGsAppId,
+			})
+		}
+	}
+	return &api.ServerInstanceList{
+		ServerInstanceList: serverInstanceList,
+	}, nil
+}
+
+// RemoveServer 强制移除服务器实例 用于清理已宕机但尚未超时的服务器
+func (s *DiscoveryService) RemoveServer(ctx context.Context, req *api.RemoveServerReq) (*api.NullMsg, error) {
+	logger.Warn("server force remove, server type: %v, appid: %v", req.ServerType, req.AppId)
+	err := s.removeServerInstance(req.ServerType, req.AppId)
+	if err != nil {
+		return nil, err
+	}
+	return &api.NullMsg{}, nil
+}
+
+func (s *DiscoveryService) setServerDrainState(serverType string, appId string, draining bool) error {
+	instMap, exist := s.serverInstanceMap[serverType]
+	if !exist {
+		return errors.New("server type not exist")
+	}
+	inst, exist := instMap.Load(appId)
+	if !exist {
+		return errors.New("server not exist")
+	}
+	serverInstance := inst.(*ServerInstance)
+	serverInstance.draining = draining
+	_ = s.dao.SetServerInstance(serverInstance.toModel())
+	// 通知服务器排空状态变更 GS迁移在线玩家 GATE停止接受新连接
+	netMsg := &mq.NetMsg{
+		MsgType: mq.MsgTypeServer,
+		EventId: mq.ServerDrainStateChangeNotify,
+		ServerMsg: &mq.ServerMsg{
+			IsDraining: draining,
+		},
+	}
+	switch serverType {
+	case api.GATE:
+		s.messageQueue.SendToGate(appId, netMsg)
+	case api.GS:
+		s.messageQueue.SendToGs(appId, netMsg)
+	}
+	return nil
+}
+
+// 获取可分配的服务器实例列表 排空中的服务器不参与分配
+func (s *DiscoveryService) getAvailableServerInstanceList(instMap *sync.Map) ServerInstanceSortList {
 	instList := make(ServerInstanceSortList, 0)
 	instMap.Range(func(key, value any) bool {
-		instList = append(instList, value.(*ServerInstance))
+		serverInstance := value.(*ServerInstance)
+		if serverInstance.draining {
+			return true
+		}
+		instList = append(instList, serverInstance)
 		return true
 	})
 	sort.Stable(instList)
-	minLoadInstIndex := 0
-	minLoadInstCount := math.MaxUint32
-	for index, inst := range instList {
-		if inst.loadCount < uint32(minLoadInstCount) {
-			minLoadInstCount = int(inst.loadCount)
-			minLoadInstIndex = index
-		}
-	}
-	inst := instList[minLoadInstIndex]
-	return inst
+	return instList
 }
 
 func (s *DiscoveryService) getServerInstanceMapLen(instMap *sync.Map) int {
@@ -350,6 +656,10 @@ func (s *DiscoveryService) removeDeadServer() {
 					logger.Warn("remove dead server, server type: %v, appid: %v, last alive time: %v",
 						serverInstance.serverType, serverInstance.appId, serverInstance.lastAliveTime)
 					instMap.Delete(key)
+					_ = s.dao.DelServerInstance(serverInstance.appId)
+					if serverInstance.serverType == api.GS {
+						s.onGsRemove(serverInstance.appId)
+					}
 				}
 				return true
 			})
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+	"sync"
+
+	"hk4e/common/config"
+	"hk4e/node/api"
+	"hk4e/pkg/logger"
+	"hk4e/pkg/random"
+)
+
+// 负载均衡策略
+const (
+	LoadBalanceLeastLoad = "least_load" // 负载率最低
+	LoadBalanceWeighted  = "weighted"   // 按剩余承载能力加权随机
+	LoadBalanceSticky    = "sticky"     // 按玩家uid粘滞
+	LoadBalanceRandom    = "random"     // 均匀随机
+)
+
+const (
+	DefaultServerCapacity = 1000 // 服务器未上报承载量时使用的默认值
+	MaxMainLoopUtil       = 100  // 主循环cpu利用率上限 百分比
+)
+
+// 会上报负载的服务器类型 只有这些类型可以使用依赖负载的策略
+var loadReportServerTypeMap = map[string]bool{
+	api.GATE: true,
+	api.GS:   true,
+}
+
+// 初始化各服务器类型的负载均衡策略
+func (s *DiscoveryService) initLoadBalancePolicy() {
+	s.loadBalancePolicyMap = map[string]string{
+		api.GATE:        LoadBalanceWeighted,
+		api.GS:          LoadBalanceWeighted,
+		api.ANTICHEAT:   LoadBalanceSticky,
+		api.PATHFINDING: LoadBalanceSticky,
+	}
+	for serverType, policy := range config.GetConfig().Node.LoadBalance {
+		_, exist := s.loadBalancePolicyMap[serverType]
+		if !exist {
+			logger.Error("load balance policy unknown server type: %v", serverType)
+			continue
+		}
+		switch policy {
+		case LoadBalanceLeastLoad, LoadBalanceWeighted:
+			if !loadReportServerTypeMap[serverType] {
+				logger.Error("server type not report load, can not use load balance policy: %v, server type: %v", policy, serverType)
+				continue
+			}
+		case LoadBalanceSticky, LoadBalanceRandom:
+		default:
+			logger.Error("unknown load balance policy: %v, server type: %v", policy, serverType)
+			continue
+		}
+		s.loadBalancePolicyMap[serverType] = policy
+	}
+	logger.Info("load balance policy: %v", s.loadBalancePolicyMap)
+}
+
+// 按服务器类型配置的负载均衡策略选择服务器实例
+func (s *DiscoveryService) selectServerInstance(serverType string, instMap *sync.Map, uid uint32) *ServerInstance {
+	switch s.loadBalancePolicyMap[serverType] {
+	case LoadBalanceLeastLoad:
+		return s.getMinLoadServerInstance(instMap)
+	case LoadBalanceSticky:
+		return s.getStickyServerInstance(instMap, uid)
+	case LoadBalanceRandom:
+		return s.getRandomServerInstance(instMap)
+	default:
+		return s.getWeightedServerInstance(instMap)
+	}
+}
+
+// 获取服务器实例的承载量
+func (i *ServerInstance) getCapacity() uint32 {
+	if i.capacity == 0 {
+		return DefaultServerCapacity
+	}
+	return i.capacity
+}
+
+// 获取服务器实例的负载率
+func (i *ServerInstance) getLoadRate() float64 {
+	return float64(i.loadCount) / float64(i.getCapacity())
+}
+
+// 获取服务器实例的剩余承载能力 综合剩余承载量和主循环cpu空闲率
+func (i *ServerInstance) getHeadroom() float64 {
+	capacity := i.getCapacity()
+	if i.loadCount >= capacity || i.mainLoopUtil >= MaxMainLoopUtil {
+		return 0.0
+	}
+	remain := float64(capacity - i.loadCount)
+	idle := float64(MaxMainLoopUtil-i.mainLoopUtil) / MaxMainLoopUtil
+	return remain * idle
+}
+
+func (s *DiscoveryService) getWeightedServerInstance(instMap *sync.Map) *ServerInstance {
+	instList := s.getAvailableServerInstanceList(instMap)
+	if len(instList) == 0 {
+		return nil
+	}
+	totalHeadroom := 0.0
+	for _, inst := range instList {
+		totalHeadroom += inst.getHeadroom()
+	}
+	if totalHeadroom <= 0.0 {
+		// 全部服务器都已满载 退化为选择负载率最低的服务器
+		return s.getMinLoadServerInstance(instMap)
+	}
+	r := random.GetRandomFloat64(0.0, totalHeadroom)
+	for _, inst := range instList {
+		headroom := inst.getHeadroom()
+		if r < headroom {
+			return inst
+		}
+		r -= headroom
+	}
+	return instList[len(instList)-1]
+}
+
+// 最高随机权重哈希 服务器增减时只有少量玩家会被重新分配
+func (s *DiscoveryService) getStickyServerInstance(instMap *sync.Map, uid uint32) *ServerInstance {
+	if uid == 0 {
+		return s.getWeightedServerInstance(instMap)
+	}
+	instList := s.getAvailableServerInstanceList(instMap)
+	var stickyInst *ServerInstance = nil
+	maxScore := uint64(0)
+	for _, inst := range instList {
+		if inst.getHeadroom() <= 0.0 {
+			continue
+		}
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(strconv.Itoa(int(uid)) + "_" + inst.appId))
+		score := h.Sum64()
+		if stickyInst == nil || score > maxScore {
+			stickyInst = inst
+			maxScore = score
+		}
+	}
+	if stickyInst == nil {
+		return s.getMinLoadServerInstance(instMap)
+	}
+	return stickyInst
+}
+
+func (s *DiscoveryService) getRandomServerInstance(instMap *sync.Map) *ServerInstance {
+	instList := s.getAvailableServerInstanceList(instMap)
+	if len(instList) == 0 {
+		return nil
+	}
+	index := random.GetRandomInt32(0, int32(len(instList)-1))
+	inst := instList[index]
+	return inst
+}
+
+func (s *DiscoveryService) getMinLoadServerInstance(instMap *sync.Map) *ServerInstance {
+	instList := s.getAvailableServerInstanceList(instMap)
+	if len(instList) == 0 {
+		return nil
+	}
+	minLoadInstIndex := 0
+	minLoadRate := math.MaxFloat64
+	for index, inst := range instList {
+		loadRate := inst.getLoadRate()
+		if loadRate < minLoadRate {
+			minLoadRate = loadRate
+			minLoadInstIndex = index
+		}
+	}
+	inst := instList[minLoadInstIndex]
+	return inst
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"time"
+
+	"hk4e/common/config"
+	"hk4e/common/region"
+	"hk4e/node/model"
+	"hk4e/pkg/logger"
+	"hk4e/pkg/random"
+)
+
+const (
+	DefaultEc2bOverlapTime = 3600 // 默认的旧密钥有效时间 秒 需要大于网关和dispatch的密钥同步间隔加上dispatch延迟下发新密钥的时间
+)
+
+// 从持久化存储中恢复区服密钥 不存在时创建新的密钥
+func (s *DiscoveryService) loadRegionEc2b() {
+	regionEc2b, err := s.dao.GetRegionEc2b()
+	if err == nil && regionEc2b != nil {
+		ec2b, err := random.LoadEc2bKey(regionEc2b.Data)
+		if err == nil {
+			s.regionEc2b = ec2b
+			s.regionEc2bCreateTime = regionEc2b.CreateTime
+			if regionEc2b.PrevData != nil && regionEc2b.PrevExpireTime > time.Now().Unix() {
+				prevEc2b, err := random.LoadEc2bKey(regionEc2b.PrevData)
+				if err == nil {
+					s.regionEc2bPrev = prevEc2b
+					s.regionEc2bPrevExpireTime = regionEc2b.PrevExpireTime
+				}
+			}
+			logger.Info("region ec2b load ok, seed: %v", s.regionEc2b.Seed())
+			return
+		}
+		logger.Error("parse region ec2b error: %v", err)
+	}
+	if err != nil {
+		// redis读取失败时不覆盖已持久化的密钥
+		s.regionEc2b = region.NewRegionEc2b()
+		s.regionEc2bCreateTime = time.Now().Unix()
+		logger.Error("region ec2b load fail, use temp key, seed: %v", s.regionEc2b.Seed())
+		return
+	}
+	s.regionEc2b = region.NewRegionEc2b()
+	s.regionEc2bCreateTime = time.Now().Unix()
+	s.saveRegionEc2b()
+	logger.Info("region ec2b create ok, seed: %v", s.regionEc2b.Seed())
+}
+
+func (s *DiscoveryService) saveRegionEc2b() {
+	regionEc2b := &model.RegionEc2b{
+		Data:       s.regionEc2b.Bytes(),
+		CreateTime: s.regionEc2bCreateTime,
+	}
+	if s.regionEc2bPrev != nil {
+		regionEc2b.PrevData = s.regionEc2bPrev.Bytes()
+		regionEc2b.PrevExpireTime = s.regionEc2bPrevExpireTime
+	}
+	_ = s.dao.SetRegionEc2b(regionEc2b)
+}
+
+// 定时轮换区服密钥 轮换后旧密钥在重叠期内仍然有效 避免已获取旧密钥的客户端无法连接
+func (s *DiscoveryService) rotateRegionEc2b() {
+	ticker := time.NewTicker(time.Second * 60)
+	for {
+		<-ticker.C
+		rotateInterval := int64(config.GetConfig().Node.Ec2bRotateInterval)
+		if rotateInterval <= 0 {
+			continue
+		}
+		overlapTime := int64(config.GetConfig().Node.Ec2bOverlapTime)
+		if overlapTime <= 0 {
+			overlapTime = DefaultEc2bOverlapTime
+		}
+		nowTime := time.Now().Unix()
+		s.regionEc2bLock.Lock()
+		if s.regionEc2bPrev != nil && nowTime > s.regionEc2bPrevExpireTime {
+			logger.Info("region ec2b prev key expire, seed: %v", s.regionEc2bPrev.Seed())
+			s.regionEc2bPrev = nil
+			s.regionEc2bPrevExpireTime = 0
+			s.saveRegionEc2b()
+		}
+		if nowTime-s.regionEc2bCreateTime >= rotateInterval {
+			s.regionEc2bPrev = s.regionEc2b
+			s.regionEc2bPrevExpireTime = nowTime + overlapTime
+			s.regionEc2b = region.NewRegionEc2b()
+			s.regionEc2bCreateTime = nowTime
+			s.saveRegionEc2b()
+			logger.Warn("region ec2b rotate ok, seed: %v, prev seed: %v, prev expire time: %v",
+				s.regionEc2b.Seed(), s.regionEc2bPrev.Seed(), s.regionEc2bPrevExpireTime)
+		}
+		s.regionEc2bLock.Unlock()
+	}
+}
@@ -1,8 +1,11 @@
 package service
 
 import (
+	"context"
+
 	"hk4e/common/mq"
 	"hk4e/node/api"
+	"hk4e/node/dao"
 
 	"github.com/byebyebruce/natsrpc"
 	"github.com/nats-io/nats.go"
@@ -10,11 +13,12 @@ import (
 )
 
 type Service struct {
+	natsrpcServer    *natsrpc.Server
 	messageQueue     *mq.MessageQueue
 	discoveryService *DiscoveryService
 }
 
-func NewService(conn *nats.Conn, messageQueue *mq.MessageQueue) (*Service, error) {
+func NewService(conn *nats.Conn, messageQueue *mq.MessageQueue, db *dao.Dao) (*Service, error) {
 	enc, err := nats.NewEncodedConn(conn, protobuf.PROTOBUF_ENCODER)
 	if err != nil {
 		return nil, err
@@ -23,12 +27,13 @@ func NewService(conn *nats.Conn, messageQueue *mq.MessageQueue) (*Service, error
 	if err != nil {
 		return nil, err
 	}
-	discoveryService := NewDiscoveryService()
+	discoveryService := NewDiscoveryService(db, messageQueue)
 	_, err = api.RegisterDiscoveryNATSRPCServer(svr, discoveryService)
 	if err != nil {
 		return nil, err
 	}
 	s := &Service{
+		natsrpcServer:    svr,
 		messageQueue:     messageQueue,
 		discoveryService: discoveryService,
 	}
@@ -37,6 +42,7 @@ func NewService(conn *nats.Conn, messageQueue *mq.MessageQueue) (*Service, error
 }
 
 func (s *Service) Close() {
+	_ = s.natsrpcServer.Close(context.TODO())
 }
 
 func (s *Service) BroadcastReceiver() {
@@ -52,12 +58,6 @@ func (s *Service) BroadcastReceiver() {
 			continue
 		}
 		serverMsg := netMsg.ServerMsg
-		s.discoveryService.globalGsOnlineMapLock.Lock()
-		if serverMsg.IsOnline {
-			s.discoveryService.globalGsOnlineMap[serverMsg.UserId] = netMsg.OriginServerAppId
-		} else {
-			delete(s.discoveryService.globalGsOnlineMap, serverMsg.UserId)
-		}
-		s.discoveryService.globalGsOnlineMapLock.Unlock()
+		s.discoveryService.SetUserGsOnlineState(serverMsg.UserId, serverMsg.IsOnline, netMsg.OriginServerAppId)
 	}
 }
@@ -13,6 +13,7 @@ import (
 type Handle struct {
 	worldStatic  *world.WorldStatic
 	messageQueue *mq.MessageQueue
+	trace        *mq.TraceInfo // 当前正在处理的客户端消息的链路追踪信息
 }
 
 func NewHandle(messageQueue *mq.MessageQueue) (r *Handle) {
@@ -38,12 +39,15 @@ func (h *Handle) run() {
 				continue
 			}
 			gameMsg := netMsg.GameMsg
+			h.messageQueue.AddTraceHop(gameMsg.Trace, mq.TraceStageServerRecv)
+			h.trace = gameMsg.Trace
 			switch gameMsg.CmdId {
 			case cmd.QueryPathReq:
 				h.QueryPath(gameMsg.UserId, netMsg.OriginServerAppId, gameMsg.PayloadMessage)
 			case cmd.ObstacleModifyNotify:
 				h.ObstacleModifyNotify(gameMsg.UserId, netMsg.OriginServerAppId, gameMsg.PayloadMessage)
 			}
+			h.trace = nil
 		}
 	}()
 }
@@ -64,6 +68,9 @@ func (h *Handle) SendMsg(cmdId uint16, userId uint32, gateAppId string, payloadM
 		return
 	}
 	gameMsg.PayloadMessageData = payloadMessageData
+	if h.trace != nil && h.trace.UserId == userId {
+		gameMsg.Trace = h.messageQueue.ReplyTrace(h.trace)
+	}
 	h.messageQueue.SendToGate(gateAppId, &mq.NetMsg{
 		MsgType: mq.MsgTypeGame,
 		EventId: mq.NormalMsg,
@@ -34,3 +34,27 @@ func TestHk4eAbilityHashCode(t *testing.T) {
 	hashCode = Hk4eAbilityHashCode("Avatar_Ayato_ExtraAttack_CreateBullet")
 	fmt.Printf("Avatar_Ayato_ExtraAttack_CreateBullet hashCode: %v\n", hashCode)
 }
+
+func TestPassword(t *testing.T) {
+	algo, hash, err := PasswordHash("password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Printf("algo: %v, hash: %v\n", algo, hash)
+	if !PasswordVerify("password123", algo, hash) {
+		t.Error("verify password fail")
+	}
+	if PasswordVerify("password124", algo, hash) {
+		t.Error("verify wrong password success")
+	}
+	if PasswordNeedRehash(algo, hash) {
+		t.Error("default hash need rehash")
+	}
+	md5Hash := Md5Str("password123")
+	if !PasswordVerify("password123", "", md5Hash) {
+		t.Error("verify md5 password fail")
+	}
+	if !PasswordNeedRehash("", md5Hash) {
+		t.Error("md5 hash not need rehash")
+	}
+}
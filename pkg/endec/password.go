@@ -0,0 +1,109 @@
+package endec
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// 密码哈希
+// 账号密码统一通过这里的方法计算和校验 其他服务不要自行计算密码哈希
+// 新密码使用加盐的argon2id 哈希格式为$argon2id$v=19$m=内存KB,t=迭代次数,p=并行度$盐$哈希 盐和哈希为无填充base64
+// 旧账号的md5密码仍然可以校验 校验通过后由调用方使用PasswordHash重新计算并保存
+
+const (
+	PasswordAlgoMd5      = "md5"      // 旧账号的无盐md5
+	PasswordAlgoArgon2id = "argon2id" // 加盐的argon2id
+)
+
+const (
+	PasswordAlgoDefault = PasswordAlgoArgon2id
+)
+
+// argon2id参数
+const (
+	argon2Memory  = 19 * 1024 // KB
+	argon2Time    = 2
+	argon2Threads = 1
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// PasswordHash 使用默认算法计算密码哈希 返回算法名和哈希
+func PasswordHash(password string) (algo string, hash string, err error) {
+	salt := make([]byte, argon2SaltLen)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return "", "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	hash = fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	return PasswordAlgoDefault, hash, nil
+}
+
+// PasswordVerify 校验密码 algo为空时视为旧账号的md5
+func PasswordVerify(password string, algo string, hash string) bool {
+	switch algo {
+	case "", PasswordAlgoMd5:
+		return subtle.ConstantTimeCompare([]byte(Md5Str(password)), []byte(hash)) == 1
+	case PasswordAlgoArgon2id:
+		param, salt, key, ok := parseArgon2Hash(hash)
+		if !ok {
+			return false
+		}
+		inputKey := argon2.IDKey([]byte(password), salt, param.time, param.memory, param.threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(inputKey, key) == 1
+	default:
+		return false
+	}
+}
+
+// PasswordNeedRehash 密码哈希是否需要使用默认算法和参数重新计算
+func PasswordNeedRehash(algo string, hash string) bool {
+	if algo != PasswordAlgoDefault {
+		return true
+	}
+	param, salt, key, ok := parseArgon2Hash(hash)
+	if !ok {
+		return true
+	}
+	return param.memory != argon2Memory || param.time != argon2Time || param.threads != argon2Threads ||
+		len(salt) != argon2SaltLen || len(key) != argon2KeyLen
+}
+
+type argon2Param struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+func parseArgon2Hash(hash string) (param *argon2Param, salt []byte, key []byte, ok bool) {
+	split := strings.Split(hash, "$")
+	if len(split) != 6 || split[1] != PasswordAlgoArgon2id {
+		return nil, nil, nil, false
+	}
+	version := 0
+	_, err := fmt.Sscanf(split[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, nil, nil, false
+	}
+	param = new(argon2Param)
+	_, err = fmt.Sscanf(split[3], "m=%d,t=%d,p=%d", &param.memory, &param.time, &param.threads)
+	if err != nil || param.memory == 0 || param.time == 0 || param.threads == 0 {
+		return nil, nil, nil, false
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(split[4])
+	if err != nil {
+		return nil, nil, nil, false
+	}
+	key, err = base64.RawStdEncoding.DecodeString(split[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, false
+	}
+	return param, salt, key, true
+}
@@ -469,6 +469,14 @@ func (c *CmdProtoMap) GetCmdNameByCmdId(cmdId uint16) string {
 	return cmdName
 }
 
+func (c *CmdProtoMap) GetCmdIdList() []uint16 {
+	cmdIdList := make([]uint16, 0, len(c.cmdIdProtoObjMap))
+	for cmdId := range c.cmdIdProtoObjMap {
+		cmdIdList = append(cmdIdList, cmdId)
+	}
+	return cmdIdList
+}
+
 func (c *CmdProtoMap) GetCmdIdByCmdName(cmdName string) uint16 {
 	cmdId, exist := c.cmdNameCmdIdMap[cmdName]
 	if !exist {
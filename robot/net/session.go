@@ -1,6 +1,7 @@
 package net
 
 import (
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -17,7 +18,7 @@ import (
 )
 
 type Session struct {
-	Conn                   *kcp.UDPSession
+	Conn                   hk4egatenet.Conn
 	XorKey                 []byte
 	SendChan               chan *hk4egatenet.ProtoMsg
 	RecvChan               chan *hk4egatenet.ProtoMsg
@@ -33,14 +34,10 @@ func NewSession(gateAddr string, dispatchKey []byte, localPort int) (*Session, e
 	// // DPDK模式需开启
 	// conn, err := kcp.DialWithOptions(gateAddr, "0.0.0.0:"+strconv.Itoa(localPort))
 
-	conn, err := kcp.DialWithOptions(gateAddr)
+	conn, err := dialGate(gateAddr)
 	if err != nil {
-		logger.Error("kcp client conn to server error: %v", err)
 		return nil, err
 	}
-	conn.SetACKNoDelay(true)
-	conn.SetWriteDelay(false)
-	conn.SetWindowSize(255, 255)
 	r := &Session{
 		Conn:                   conn,
 		XorKey:                 dispatchKey,
@@ -54,13 +51,45 @@ func NewSession(gateAddr string, dispatchKey []byte, localPort int) (*Session, e
 		SecurityCmdBuffer:      nil,
 	}
 	if config.GetConfig().Hk4e.ClientProtoProxyEnable {
-		r.ClientCmdProtoMap = client_proto.NewClientCmdProtoMap()
+		// 机器人使用配置中的第一个客户端版本
+		r.ClientCmdProtoMap = client_proto.NewClientCmdProtoMap(strings.Split(config.GetConfig().Hk4e.Version, ",")[0])
 	}
 	go r.recvHandle()
 	go r.sendHandle()
 	return r, nil
 }
 
+// 按配置的传输协议连接网关
+func dialGate(gateAddr string) (hk4egatenet.Conn, error) {
+	robotConfig := config.GetConfig().Hk4eRobot
+	switch robotConfig.GateTransport {
+	case hk4egatenet.TransportTcp:
+		conn, err := hk4egatenet.DialTcp(robotConfig.GateStreamAddr)
+		if err != nil {
+			logger.Error("tcp client conn to server error: %v", err)
+			return nil, err
+		}
+		return conn, nil
+	case hk4egatenet.TransportWebSocket:
+		conn, err := hk4egatenet.DialWebSocket(robotConfig.GateStreamAddr)
+		if err != nil {
+			logger.Error("websocket client conn to server error: %v", err)
+			return nil, err
+		}
+		return conn, nil
+	default:
+		conn, err := kcp.DialWithOptions(gateAddr)
+		if err != nil {
+			logger.Error("kcp client conn to server error: %v", err)
+			return nil, err
+		}
+		conn.SetACKNoDelay(true)
+		conn.SetWriteDelay(false)
+		conn.SetWindowSize(255, 255)
+		return conn, nil
+	}
+}
+
 func (s *Session) SendMsg(cmdId uint16, msg pb.Message) {
 	atomic.AddUint32(&s.ClientSeq, 1)
 	s.SendChan <- &hk4egatenet.ProtoMsg{